@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/audit"
+	"github.com/salliko/reducer/internal/backup"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/salliko/reducer/internal/migration"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// commands — подкоманды shortener. Без подкоманды запускается сервер.
+var commands = map[string]func(args []string) error{
+	"backup":          runBackup,
+	"restore":         runRestore,
+	"migrate-storage": runMigrateStorage,
+}
+
+// runBackup выгружает хранилище из конфигурации в архив:
+//
+//	shortener backup -o urls.backup [-d dsn | -f path]
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "", "archive path")
+
+	var cfg config.Config
+	if err := cfg.ParseFlags(fs, args); err != nil {
+		return err
+	}
+	if *output == "" {
+		return errors.New("backup: -o is required")
+	}
+
+	db, err := databases.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Архив пишется во временный файл, чтобы прерванная выгрузка
+	// не затёрла предыдущий архив.
+	file, err := os.CreateTemp(filepath.Dir(*output), filepath.Base(*output)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	stats, err := backup.Write(file, db)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), *output); err != nil {
+		return err
+	}
+
+	log.Printf("backup: %d links, %d workspaces written to %s", stats.Links, stats.Workspaces, *output)
+	return nil
+}
+
+// runRestore загружает архив в хранилище из конфигурации:
+//
+//	shortener restore -i urls.backup -audit-log audit.log [-on-conflict skip|overwrite|fail] [-d dsn | -f path]
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	input := fs.String("i", "", "archive path")
+	onConflict := fs.String("on-conflict", string(backup.PolicyFail), "what to do with existing records: skip, overwrite or fail")
+
+	var cfg config.Config
+	if err := cfg.ParseFlags(fs, args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errors.New("restore: -i is required")
+	}
+	policy, err := backup.ParsePolicy(*onConflict)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	auditLog, err := openAuditLog(cfg.AuditLogPath)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	db, err := databases.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := backup.Restore(file, audit.Database(db, auditLog), policy)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("restore: %d links, %d workspaces loaded, %d skipped, %d overwritten",
+		stats.Links, stats.Workspaces, stats.Skipped, stats.Overwritten)
+	return nil
+}
+
+// runMigrateStorage копирует данные между хранилищами:
+//
+//	shortener migrate-storage --from file:urls.json --to postgres:dsn --audit-log audit.log
+//
+// Чтобы переехать без простоя, на время копирования запустите сервер
+// с -mirror-storage, указав в нём целевое хранилище, а команду —
+// с --mirrored: новые записи будут попадать в оба, а команда
+// докопирует старые, не затирая записанного зеркалом.
+func runMigrateStorage(args []string) error {
+	fs := flag.NewFlagSet("migrate-storage", flag.ContinueOnError)
+	from := fs.String("from", "", "source storage: file:path, sqlite:path, bolt:path, redis://…, postgres:dsn or memory:")
+	to := fs.String("to", "", "target storage: file:path, sqlite:path, bolt:path, redis://…, postgres:dsn or memory:")
+	batchSize := fs.Int("batch", migration.DefaultBatchSize, "links per batch")
+	checkpoint := fs.String("checkpoint", "migrate-storage.checkpoint", "file to resume an interrupted migration from")
+	auditPath := fs.String("audit-log", os.Getenv("AUDIT_LOG_PATH"), "audit log file the copied links are recorded in")
+	mirrored := fs.Bool("mirrored", false, "the server already mirrors writes to --to; keep what it has written")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return errors.New("migrate-storage: --from and --to are required")
+	}
+
+	auditLog, err := openAuditLog(*auditPath)
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	src, err := databases.OpenSpec(*from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := databases.OpenSpec(*to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	copied, err := migration.Copy(src, audit.Database(dst, auditLog), migration.Options{
+		From:       *from,
+		To:         *to,
+		BatchSize:  *batchSize,
+		Checkpoint: *checkpoint,
+		Mirrored:   *mirrored,
+		Progress: func(copied int) {
+			log.Printf("migrate-storage: %d links copied", copied)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("migrate-storage: %w (run again to resume)", err)
+	}
+
+	report, err := migration.Verify(src, dst, *batchSize)
+	if err != nil {
+		return err
+	}
+	log.Printf("migrate-storage: %d links copied; source %d, target %d, missing %d, extra %d",
+		copied, report.Source, report.Target, report.Missing, report.Extra)
+	if report.Missing > 0 {
+		return fmt.Errorf("migrate-storage: %d links are missing in target", report.Missing)
+	}
+
+	if *checkpoint == "" {
+		return nil
+	}
+	if err := os.Remove(*checkpoint); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// openAuditLog открывает журнал изменений команды, предупреждая, если
+// он ведётся в памяти и не переживёт её завершения.
+func openAuditLog(path string) (audit.Log, error) {
+	if path == "" {
+		log.Print("audit log path is not set, changes are not recorded on disk")
+	}
+	return audit.Open(path)
+}
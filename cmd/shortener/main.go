@@ -1,62 +1,325 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
 	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/audit"
 	"github.com/salliko/reducer/internal/databases"
 	"github.com/salliko/reducer/internal/datahashes"
+	"github.com/salliko/reducer/internal/grpcapi"
 	"github.com/salliko/reducer/internal/handlers"
+	"github.com/salliko/reducer/internal/health"
+	"github.com/salliko/reducer/internal/logging"
+	"github.com/salliko/reducer/internal/metrics"
 	"github.com/salliko/reducer/internal/middlewares"
+	"github.com/salliko/reducer/internal/openapi"
+	"github.com/salliko/reducer/internal/tlsconfig"
+	"github.com/salliko/reducer/internal/tracing"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-func NewRouter(cfg config.Config, db databases.Database) chi.Router {
+// NewRouter собирает маршруты сервиса. Изменения ссылок и рабочих
+// пространств пишутся в auditLog. Каждый маршрут должен быть описан
+// в openapi.json: по описанию проверяются запросы.
+func NewRouter(cfg config.Config, db databases.Database, auditLog audit.Log) chi.Router {
 	r := chi.NewRouter()
 	hashURL := &datahashes.Md5HashData{}
+	spec := openapi.Default()
 
-	r.Use(middleware.Logger)
+	ready := health.New(cfg.ReadyTimeout)
+	ready.Add("storage", health.Storage(db))
+	ready.Add("migrations", health.Migrations(db))
+	ready.Add("delete_queue", health.DeleteQueue(handlers.PendingDeletes, cfg.ReadyMaxPendingDeletes))
+	if cfg.FileStoragePath != "" {
+		ready.Add("file_storage", health.Writable(cfg.FileStoragePath))
+	}
+
+	db = audit.Database(db, auditLog)
+
+	if cfg.Tracing != "" {
+		r.Use(tracing.Middleware)
+	}
+	r.Use(logging.Middleware(zap.L()))
+	var m *metrics.Metrics
+	if cfg.Metrics {
+		m = metrics.New(db, handlers.PendingDeletes)
+		db = m.Database(db)
+		r.Use(m.Middleware)
+	}
+	db = logging.Database(db)
+	r.Use(audit.Middleware)
 	r.Use(middlewares.CookieMiddleware)
 	r.Use(middlewares.GzipRequestMiddleware)
 	r.Use(middlewares.GzipResponseMiddleware)
+	r.Use(spec.Validate)
+	if cfg.Tracing != "" {
+		db = tracing.Database(db)
+		r.Use(tracing.Stage("handler"))
+	}
+
+	if m != nil {
+		r.Method(http.MethodGet, "/metrics", m.Handler())
+	}
 
+	r.Get("/healthz", health.Live)
+	r.Get("/readyz", ready.Ready)
+	r.Method(http.MethodGet, "/api/openapi.json", spec.Handler(cfg.BaseURL))
 	r.Post("/", handlers.GenerateShortURL(hashURL, db, cfg))
 	r.Get("/{ID}", handlers.RedirectFromShortToFull(db))
 	r.Post("/api/shorten", handlers.GenerateShortenJSONURL(hashURL, db, cfg))
 	r.Get("/api/user/urls", handlers.GetAllShortenURLS(db, cfg))
+	r.Get("/api/user/urls/export", handlers.ExportURLs(db, cfg))
+	r.Patch("/api/user/urls/{ID}", handlers.UpdateShortenURL(db, cfg))
+	r.Get("/api/user/urls/{ID}/revisions", handlers.GetURLRevisions(db))
+	r.Post("/api/user/urls/{ID}/rollback", handlers.RollbackShortenURL(db, cfg))
 	r.Get("/ping", handlers.Ping(db))
 	r.Post("/api/shorten/batch", handlers.GenerateManyShortenJSONURL(hashURL, db, cfg))
 	r.Delete("/api/user/urls", handlers.Delete(db))
+	r.Post("/api/user/urls/{ID}/restore", handlers.RestoreShortenURL(db, cfg))
+	r.Delete("/api/user/trash", handlers.EmptyTrash(db))
+	r.Post("/api/user/import", handlers.ImportURLs(hashURL, db, cfg, r))
+	r.Post("/api/workspaces", handlers.CreateWorkspace(db))
+	r.Get("/api/workspaces", handlers.GetWorkspaces(db))
+	r.Get("/api/workspaces/{WS}/members", handlers.GetWorkspaceMembers(db))
+	r.Put("/api/workspaces/{WS}/members", handlers.SetWorkspaceMember(db))
+	r.Delete("/api/workspaces/{WS}/members", handlers.RemoveWorkspaceMember(db))
+	r.Post("/api/workspaces/{WS}/transfer", handlers.TransferToWorkspace(db))
+	if cfg.AdminToken != "" {
+		r.With(middlewares.AdminMiddleware(cfg.AdminToken)).Get("/api/admin/audit", handlers.GetAuditLog(auditLog))
+	}
 
 	return r
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	os.Exit(run())
+}
+
+// run запускает сервер до SIGINT или SIGTERM и возвращает код выхода:
+// 0, если сервер остановился штатно, и 1 при ошибке запуска, работы
+// или остановки. Повторный сигнал во время остановки завершает процесс
+// сразу.
+func run() int {
 	var cfg config.Config
 	if err := cfg.Parse(); err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return 1
+	}
+
+	logger, err := logging.New(cfg.LogLevel, os.Stderr)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+
+	if err := cfg.Validate(); err != nil {
+		logger.Error("invalid config", zap.Error(err))
+		return 1
+	}
+	if !cfg.TLS() && strings.HasPrefix(cfg.BaseURL, "https://") {
+		logger.Warn("base url is https but tls is disabled, expecting a tls-terminating proxy", zap.String("base_url", cfg.BaseURL))
+	}
+
+	db, err := databases.Open(cfg)
+	if err != nil {
+		logger.Error("open storage", zap.Error(err))
+		return 1
+	}
+	defer db.Close()
+
+	if cfg.AuditLogPath == "" {
+		logger.Warn("audit log path is not set, the audit log is kept in memory and lost on restart")
+	}
+	auditLog, err := audit.Open(cfg.AuditLogPath)
+	if err != nil {
+		logger.Error("open audit log", zap.Error(err))
+		return 1
+	}
+	defer auditLog.Close()
+	// Очистка и сброс буферов при остановке идут мимо NewRouter,
+	// поэтому их изменения журналируются здесь.
+	audited := audit.Database(db, auditLog)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Tracing != "" {
+		shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
+		if err != nil {
+			logger.Error("set up tracing", zap.Error(err))
+			return 1
+		}
+		defer shutdownTracing(context.Background())
 	}
 
-	var db databases.Database
-	var err error
-	if cfg.DatabaseDSN != "" {
-		db, err = databases.NewPostgresqlDatabase(cfg)
+	server := &http.Server{Addr: cfg.ServerAddress, Handler: NewRouter(cfg, db, auditLog)}
+	if cfg.TLS() {
+		if server.TLSConfig, err = serverTLS(ctx, cfg); err != nil {
+			logger.Error("set up tls", zap.Error(err))
+			return 1
+		}
+	}
+
+	purgerCtx, stopPurger := context.WithCancel(context.Background())
+	purgerDone := make(chan struct{})
+	go func() {
+		defer close(purgerDone)
+		databases.RunPurger(purgerCtx, audited, cfg.DeletedRetention, cfg.PurgeInterval)
+	}()
+
+	serveErr := make(chan error, 2)
+	var rpc *grpc.Server
+	if cfg.GRPCAddress != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			logger.Error("listen grpc", zap.Error(err))
+			stopPurger()
+			<-purgerDone
+			return 1
+		}
+		var opts []grpc.ServerOption
+		if server.TLSConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(server.TLSConfig)))
+		}
+		rpc = grpcapi.NewServer(cfg, db, auditLog, opts...)
+		go func() {
+			logger.Info("listening grpc", zap.String("address", cfg.GRPCAddress), zap.Bool("tls", cfg.TLS()))
+			serveErr <- rpc.Serve(lis)
+		}()
+	}
+	go func() {
+		logger.Info("listening", zap.String("address", cfg.ServerAddress), zap.Bool("tls", cfg.TLS()))
+		if server.TLSConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+
+	code := 0
+	select {
+	case err := <-serveErr:
+		logger.Error("serve", zap.Error(err))
+		code = 1
+	case <-ctx.Done():
+		logger.Info("shutting down", zap.Duration("timeout", cfg.ShutdownTimeout))
+	}
+	stop()
+
+	if err := shutdown(server, rpc, audited, cfg.ShutdownTimeout); err != nil {
+		logger.Error("shut down", zap.Error(err))
+		code = 1
+	}
+	stopPurger()
+	<-purgerDone
+	logger.Info("stopped")
+	return code
+}
+
+// serverTLS готовит настройки TLS: самоподписанный сертификат на хост
+// BaseURL либо сертификат из файлов, который до отмены ctx
+// перечитывается при их замене и по SIGHUP.
+func serverTLS(ctx context.Context, cfg config.Config) (*tls.Config, error) {
+	if cfg.TLSSelfSigned {
+		u, err := url.Parse(cfg.BaseURL)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		defer db.Close()
-	} else if cfg.FileStoragePath != "" {
-		db, err = databases.NewFileDatabase(cfg.FileStoragePath)
+		cert, err := tlsconfig.SelfSigned(u.Hostname(), "localhost", "127.0.0.1", "::1")
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-		defer db.Close()
-	} else {
-		db = databases.NewMapDatabase()
-		defer db.Close()
+		zap.L().Warn("serving a self-signed tls certificate, for development only")
+		return tlsconfig.New(tlsconfig.Static(cert)), nil
+	}
+
+	reloader, err := tlsconfig.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLSReloadInterval > 0 {
+		go reloader.Watch(ctx, cfg.TLSReloadInterval)
 	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := reloader.Reload(); err != nil {
+					zap.L().Warn("reload tls certificate", zap.Error(err))
+					continue
+				}
+				zap.L().Info("tls certificate reloaded on SIGHUP")
+			}
+		}
+	}()
+	return tlsconfig.New(reloader.GetCertificate), nil
+}
+
+// shutdown перестаёт принимать соединения, ждёт не дольше timeout
+// завершения начатых запросов и удалений, затем сохраняет отложенные
+// записи хранилища. Сервер gRPC rpc может быть nil. Хранилище
+// закрывает вызывающий.
+func shutdown(server *http.Server, rpc *grpc.Server, db databases.Database, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	r := NewRouter(cfg, db)
-	log.Fatal(http.ListenAndServe(cfg.ServerAddress, r))
+	var failed []string
+	rpcDone := make(chan struct{})
+	if rpc != nil {
+		go func() {
+			rpc.GracefulStop()
+			close(rpcDone)
+		}()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		failed = append(failed, fmt.Sprintf("drain requests: %v", err))
+	}
+	if rpc != nil {
+		select {
+		case <-rpcDone:
+		case <-ctx.Done():
+			rpc.Stop()
+			failed = append(failed, fmt.Sprintf("drain grpc calls: %v", ctx.Err()))
+		}
+	}
+	if err := handlers.WaitDeletes(ctx); err != nil {
+		failed = append(failed, fmt.Sprintf("%d deletes pending: %v", handlers.PendingDeletes(), err))
+	}
+	if err := db.Flush(); err != nil {
+		failed = append(failed, fmt.Sprintf("flush storage: %v", err))
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
 }
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"github.com/go-chi/chi"
 	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/audit"
 	"github.com/salliko/reducer/internal/databases"
 	"github.com/salliko/reducer/internal/datahashes"
+	"github.com/salliko/reducer/internal/grpcapi"
+	"github.com/salliko/reducer/internal/openapi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) *http.Response {
@@ -155,26 +170,72 @@ func TestRouter(t *testing.T) {
 				status: http.StatusOK,
 			},
 		},
-		//{
-		//	name:   "#10 DELETE",
-		//	method: http.MethodDelete,
-		//	path:   "/api/user/urls",
-		//	url:    `["3617bf", "419929", "6c5b1c"]`,
-		//	want: want{
-		//		status: http.StatusAccepted,
-		//	},
-		//},
-		//{
-		//	name:   "#11 Gone",
-		//	method: http.MethodGet,
-		//	path:   fmt.Sprintf("/%s", "3617bf"),
-		//	want: want{
-		//		status: http.StatusGone,
-		//	},
-		//},
-	}
-
-	r := NewRouter(cfg, db)
+		{
+			name:   "#10 POST API MAX CLICKS",
+			url:    `{"url": "http://onboarding.example/welcome", "max_clicks": 1}`,
+			method: http.MethodPost,
+			path:   "/api/shorten",
+			want: want{
+				status: http.StatusCreated,
+			},
+		},
+		{
+			name:   "#11 GET MAX CLICKS",
+			method: http.MethodGet,
+			path:   fmt.Sprintf("/%s", hashURL.Hash([]byte("http://onboarding.example/welcome"))),
+			want: want{
+				status:   http.StatusTemporaryRedirect,
+				location: "http://onboarding.example/welcome",
+			},
+		},
+		{
+			name:   "#12 GET MAX CLICKS EXHAUSTED",
+			method: http.MethodGet,
+			path:   fmt.Sprintf("/%s", hashURL.Hash([]byte("http://onboarding.example/welcome"))),
+			want: want{
+				status: http.StatusGone,
+			},
+		},
+		{
+			name:   "#13 POST NEGATIVE MAX CLICKS",
+			url:    "http://onboarding.example/other",
+			method: http.MethodPost,
+			path:   "/?max_clicks=-1",
+			want: want{
+				status: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "#14 DELETE",
+			method: http.MethodDelete,
+			path:   "/api/user/urls",
+			url:    `["3617bf", "419929", "6c5b1c"]`,
+			want: want{
+				status: http.StatusAccepted,
+			},
+		},
+		{
+			name:   "#15 Gone",
+			method: http.MethodGet,
+			path:   fmt.Sprintf("/%s", "3617bf"),
+			want: want{
+				status: http.StatusGone,
+			},
+		},
+		{
+			name:   "#16 POST API MANY WITH EXISTING",
+			url:    `[{"correlation_id": "1", "original_url": "http://ya.ru"},{"correlation_id": "2", "original_url": "https://go.dev/"},{"correlation_id": "3", "original_url": "https://go.dev/"}]`,
+			method: http.MethodPost,
+			path:   "/api/shorten/batch",
+			want: want{
+				status: http.StatusCreated,
+				body: fmt.Sprintf(`[{"correlation_id":"1","short_url":"http://localhost:8080/%s"},{"correlation_id":"2","short_url":"http://localhost:8080/%[2]s"},{"correlation_id":"3","short_url":"http://localhost:8080/%[2]s"}]`,
+					hashURL.Hash([]byte("http://ya.ru")), hashURL.Hash([]byte("https://go.dev/"))),
+			},
+		},
+	}
+
+	r := NewRouter(cfg, db, audit.NewMemoryLog())
 	ts := httptest.NewServer(r)
 
 	defer ts.Close()
@@ -198,3 +259,820 @@ func TestRouter(t *testing.T) {
 		})
 	}
 }
+
+func TestScheduledLinks(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	hashURL := &datahashes.Md5HashData{}
+	activeFrom := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	resp := testRequest(t, ts, http.MethodPost, "/api/shorten", strings.NewReader(
+		fmt.Sprintf(`{"url": "http://launch.example/", "active_from": %q, "fallback_url": "http://launch.example/soon"}`, activeFrom)))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/?active_from="+url.QueryEscape(activeFrom), strings.NewReader("http://launch.example/secret"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/"+hashURL.Hash([]byte("http://launch.example/")), nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "http://launch.example/soon", resp.Header.Get("Location"))
+
+	resp = testRequest(t, ts, http.MethodGet, "/"+hashURL.Hash([]byte("http://launch.example/secret")), nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var rows []struct {
+		Status     string     `json:"status"`
+		ActiveFrom *time.Time `json:"active_from"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rows))
+	require.Len(t, rows, 2)
+	for _, row := range rows {
+		assert.Equal(t, databases.StatusScheduled, row.Status)
+		assert.NotNil(t, row.ActiveFrom)
+	}
+}
+
+// TestReissueKeys проверяет, что ссылка, которую нельзя отдать
+// повторно, не мешает сократить тот же адрес заново.
+func TestReissueKeys(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	shorten := func(body string) (int, string) {
+		resp := testRequest(t, ts, http.MethodPost, "/api/shorten", strings.NewReader(body))
+		defer resp.Body.Close()
+		var res struct {
+			Result string `json:"result"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return resp.StatusCode, res.Result
+	}
+
+	status, first := shorten(`{"url": "http://onboarding.example/", "max_clicks": 1}`)
+	require.Equal(t, http.StatusCreated, status)
+	status, same := shorten(`{"url": "http://onboarding.example/", "max_clicks": 1}`)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, first, same)
+
+	// Другие параметры — другая ссылка.
+	status, titled := shorten(`{"url": "http://onboarding.example/", "max_clicks": 1, "title": "Bob"}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotEqual(t, first, titled)
+
+	// Использованная одноразовая ссылка не возвращается.
+	resp := testRequest(t, ts, http.MethodGet, strings.TrimPrefix(first, cfg.BaseURL), nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	status, second := shorten(`{"url": "http://onboarding.example/", "max_clicks": 1}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.NotEqual(t, first, second)
+
+	// То же для удалённой ссылки и для пакета.
+	resp = testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://deleted.example/"))
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	deleted := string(data)
+	require.NoError(t, db.Delete(strings.TrimPrefix(deleted, cfg.BaseURL+"/"), "aZT57qJnkvCrMQ=="))
+	resp = testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://deleted.example/"))
+	data, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEqual(t, deleted, string(data))
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/shorten/batch", strings.NewReader(
+		`[{"correlation_id": "1", "original_url": "http://onboarding.example/", "max_clicks": 1}]`))
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var batch []databases.OutputURL
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&batch))
+	require.Len(t, batch, 1)
+	assert.NotEqual(t, first, batch[0].ShortURL)
+}
+
+func TestEditLinks(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	hashURL := &datahashes.Md5HashData{}
+	key := hashURL.Hash([]byte("http://typo.example/"))
+
+	resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://typo.example/"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPatch, "/api/user/urls/"+key, strings.NewReader(
+		`{"url": "http://fixed.example/", "password": "secret", "title": "Fixed"}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPatch, "/api/user/urls/"+key, strings.NewReader(`{"hash": "other"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/"+key, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+key, nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("", "secret")
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "http://fixed.example/", resp.Header.Get("Location"))
+
+	// Ключ перенаправленной ссылки не выдаётся за сокращение исходного адреса.
+	resp = testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://typo.example/"))
+	shortURL, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEqual(t, cfg.BaseURL+"/"+key, string(shortURL))
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/user/urls/"+key+"/rollback", strings.NewReader(`{"version": 1}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/"+key, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "http://typo.example/", resp.Header.Get("Location"))
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls/"+key+"/revisions", nil)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var revisions []struct {
+		Version     int    `json:"version"`
+		OriginalURL string `json:"original_url"`
+		HasPassword bool   `json:"has_password"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&revisions))
+	require.Len(t, revisions, 2)
+	assert.Equal(t, "http://typo.example/", revisions[0].OriginalURL)
+	assert.Equal(t, "http://fixed.example/", revisions[1].OriginalURL)
+	assert.True(t, revisions[1].HasPassword)
+
+	resp = testRequest(t, ts, http.MethodPatch, "/api/user/urls/unknown", strings.NewReader(`{"title": "x"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestTrash(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080", DeletedRetention: time.Hour}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	hashURL := &datahashes.Md5HashData{}
+	key := hashURL.Hash([]byte("http://trash.example/"))
+
+	resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://trash.example/"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodDelete, "/api/user/urls", strings.NewReader(fmt.Sprintf(`[%q]`, key)))
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/"+key, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/user/urls/"+key+"/restore", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/"+key, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodDelete, "/api/user/urls", strings.NewReader(fmt.Sprintf(`[%q]`, key)))
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodDelete, "/api/user/trash", nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"purged": 1}`, string(body))
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/user/urls/"+key+"/restore", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUserURLsPagination(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	for i := 0; i < 5; i++ {
+		resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader(fmt.Sprintf("http://page.example/%d", i)))
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	var seen []string
+	path := "/api/user/urls?limit=2&domain=page.example"
+	for path != "" {
+		resp := testRequest(t, ts, http.MethodGet, path, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rows []struct {
+			OriginalURL string `json:"original_url"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rows))
+		resp.Body.Close()
+		require.LessOrEqual(t, len(rows), 2)
+		for _, row := range rows {
+			seen = append(seen, row.OriginalURL)
+		}
+
+		path = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	assert.Len(t, seen, 5)
+
+	resp := testRequest(t, ts, http.MethodGet, "/api/user/urls?sort=title", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestTagsAndFolders(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	hashURL := &datahashes.Md5HashData{}
+
+	resp := testRequest(t, ts, http.MethodPost, "/?tags=launch,%20promo&folder=Spring", strings.NewReader("http://tags.example/1"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/shorten", strings.NewReader(
+		`{"url": "http://tags.example/2", "tags": ["promo"], "folder": "Spring"}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/shorten/batch", strings.NewReader(
+		`[{"correlation_id": "1", "original_url": "http://tags.example/3", "tags": ["launch"]}]`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	list := func(query string) []string {
+		resp := testRequest(t, ts, http.MethodGet, "/api/user/urls?"+query, nil)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rows []struct {
+			OriginalURL string `json:"original_url"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rows))
+		var originals []string
+		for _, row := range rows {
+			originals = append(originals, row.OriginalURL)
+		}
+		return originals
+	}
+
+	assert.Equal(t, []string{"http://tags.example/1", "http://tags.example/3"}, list("tag=launch"))
+	assert.Equal(t, []string{"http://tags.example/1"}, list("tag=launch&tag=promo"))
+	assert.Equal(t, []string{"http://tags.example/1", "http://tags.example/2"}, list("folder=Spring"))
+
+	key := hashURL.Hash([]byte("http://tags.example/2"))
+	resp = testRequest(t, ts, http.MethodPatch, "/api/user/urls/"+key, strings.NewReader(`{"tags": ["launch"], "folder": ""}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, []string{"http://tags.example/1"}, list("folder=Spring"))
+	assert.Len(t, list("tag=launch"), 3)
+	assert.Empty(t, list("tag=promo&folder=Autumn"))
+}
+
+func TestWorkspaces(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	auditLog := audit.NewMemoryLog()
+	ts := httptest.NewServer(NewRouter(cfg, db, auditLog))
+	defer ts.Close()
+
+	resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://team.example"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/workspaces", strings.NewReader(`{"name": "Team"}`))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var ws databases.Workspace
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ws))
+	resp.Body.Close()
+	assert.Equal(t, databases.RoleOwner, ws.Role)
+
+	resp = testRequest(t, ts, http.MethodPut, "/api/workspaces/"+ws.ID+"/members", strings.NewReader(`{"user_id": "other", "role": "admin"}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodDelete, "/api/workspaces/"+ws.ID+"/members", strings.NewReader(`{"user_id": "aZT57qJnkvCrMQ=="}`))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/workspaces/"+ws.ID+"/transfer", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var res struct {
+		Transferred int `json:"transferred"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	resp.Body.Close()
+	assert.Equal(t, 1, res.Transferred)
+
+	// Владелец забирает ссылки участника, ушедшего из команды.
+	require.NoError(t, db.Create(databases.URL{Hash: "departed", Original: "http://departed.example", UserID: "colleague"}))
+	resp = testRequest(t, ts, http.MethodPut, "/api/workspaces/"+ws.ID+"/members", strings.NewReader(`{"user_id": "colleague", "role": "editor"}`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = testRequest(t, ts, http.MethodPost, "/api/workspaces/"+ws.ID+"/transfer", strings.NewReader(`{"user_id": "colleague"}`))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	resp.Body.Close()
+	assert.Equal(t, 1, res.Transferred)
+	entries, err := auditLog.Query(audit.Filter{Action: audit.ActionTransfer})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "aZT57qJnkvCrMQ==", entries[1].Actor)
+	assert.Equal(t, "colleague", entries[1].From)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls?workspace="+ws.ID, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls?workspace=missing", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestImport(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://import.example/taken"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	type report struct {
+		Rows []struct {
+			Row    int    `json:"row"`
+			Status string `json:"status"`
+		} `json:"rows"`
+		Created  int `json:"created"`
+		Conflict int `json:"conflict"`
+		Invalid  int `json:"invalid"`
+	}
+	upload := func(format, body string) report {
+		resp := testRequest(t, ts, http.MethodPost, "/api/user/import?format="+format, strings.NewReader(body))
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var rep report
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rep))
+		return rep
+	}
+
+	rep := upload("csv", "url,alias,tags,expires_at\n"+
+		"http://import.example/1,,\"a, b\",\n"+
+		"http://import.example/2,promo,,2100-01-01T00:00:00Z\n"+
+		"http://import.example/taken,,,\n"+
+		"not a url,,,\n"+
+		"http://import.example/3,promo,,\n"+
+		"http://import.example/4,,,yesterday\n")
+	assert.Equal(t, 2, rep.Created)
+	assert.Equal(t, 2, rep.Conflict)
+	assert.Equal(t, 2, rep.Invalid)
+	require.Len(t, rep.Rows, 6)
+	assert.Equal(t, 5, rep.Rows[4].Row)
+	assert.Equal(t, "conflict", rep.Rows[4].Status)
+
+	u, err := db.Select("promo")
+	require.NoError(t, err)
+	assert.Equal(t, "http://import.example/2", u.Original)
+	require.NotNil(t, u.ExpiresAt)
+
+	var body strings.Builder
+	for i := 0; i < 250; i++ {
+		fmt.Fprintf(&body, "{\"url\": \"http://import.example/bulk/%d\", \"tags\": [\"bulk\"]}\n\n", i)
+	}
+	body.WriteString("{broken\n")
+	rep = upload("ndjson", body.String())
+	assert.Equal(t, 250, rep.Created)
+	assert.Equal(t, 1, rep.Invalid)
+	assert.Equal(t, 251, rep.Rows[250].Row)
+
+	// Пакеты одновременных загрузок не смешиваются, а повтор ключа из
+	// прошлого пакета находится в хранилище.
+	var wg sync.WaitGroup
+	reports := make([]report, 2)
+	for i := range reports {
+		var body strings.Builder
+		body.WriteString("url\n")
+		for j := 0; j < 150; j++ {
+			fmt.Fprintf(&body, "http://import.example/parallel/%d/%d\n", i, j)
+		}
+		fmt.Fprintf(&body, "http://import.example/parallel/%d/0\nhttp://import.example/taken\n", i)
+		wg.Add(1)
+		go func(i int, body string) {
+			defer wg.Done()
+			reports[i] = upload("csv", body)
+		}(i, body.String())
+	}
+	wg.Wait()
+	for _, rep := range reports {
+		assert.Equal(t, 150, rep.Created)
+		assert.Equal(t, 2, rep.Conflict)
+	}
+
+	resp = testRequest(t, ts, http.MethodPost, "/api/user/import", strings.NewReader("url\n"))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func TestReservedAliases(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080", Metrics: true, AdminToken: "secret"}
+	r := NewRouter(cfg, databases.NewMapDatabase(), audit.NewMemoryLog())
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// Каждый статический маршрут верхнего уровня должен быть закрыт
+	// для алиасов, иначе такая ссылка никогда не откроется.
+	var body strings.Builder
+	body.WriteString("url,alias\n")
+	aliases := make(map[string]bool)
+	require.NoError(t, chi.Walk(r, func(_, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		segment := strings.SplitN(strings.TrimPrefix(route, "/"), "/", 2)[0]
+		if segment != "" && !strings.HasPrefix(segment, "{") && !aliases[segment] {
+			aliases[segment] = true
+			fmt.Fprintf(&body, "http://import.example/%s,%s\n", segment, strings.ToUpper(segment))
+		}
+		return nil
+	}))
+	require.NotEmpty(t, aliases)
+
+	resp := testRequest(t, ts, http.MethodPost, "/api/user/import?format=csv", strings.NewReader(body.String()))
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rep struct {
+		Rows []struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"rows"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rep))
+	require.Len(t, rep.Rows, len(aliases))
+	for _, row := range rep.Rows {
+		assert.Equal(t, "invalid", row.Status, row.Error)
+	}
+}
+
+func TestExport(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	hashURL := &datahashes.Md5HashData{}
+	for _, original := range []string{"http://export.example/1", "http://export.example/2"} {
+		resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader(original))
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	require.NoError(t, db.Delete(hashURL.Hash([]byte("http://export.example/2")), "aZT57qJnkvCrMQ=="))
+
+	resp := testRequest(t, ts, http.MethodGet, "/api/user/urls/export?format=csv", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=UTF-8", resp.Header.Get("Content-Type"))
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	assert.Equal(t, []string{"short_url", "original_url", "created_at", "deleted_at", "clicks"}, records[0])
+	assert.Equal(t, "http://export.example/1", records[1][1])
+	assert.Empty(t, records[1][3])
+	assert.NotEmpty(t, records[2][3])
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/user/urls/export?deleted=false", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "user_id", Value: "aZT57qJnkvCrMQ=="})
+	req.Header.Set("Accept", "application/x-ndjson")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err = http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `"original_url":"http://export.example/1"`)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls/export", nil)
+	var rows []struct {
+		Clicks int `json:"clicks"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rows))
+	resp.Body.Close()
+	assert.Len(t, rows, 2)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/user/urls/export?format=xml", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+}
+
+func TestAuditLog(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080", AdminToken: "admin-secret"}
+	ts := httptest.NewServer(NewRouter(cfg, databases.NewMapDatabase(), audit.NewMemoryLog()))
+	defer ts.Close()
+
+	key := (&datahashes.Md5HashData{}).Hash([]byte("http://audit.example/"))
+	resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://audit.example/"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = testRequest(t, ts, http.MethodPost, "/api/shorten/batch", strings.NewReader(`[{"correlation_id": "1", "original_url": "http://audit-batch.example/"}]`))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = testRequest(t, ts, http.MethodDelete, "/api/user/urls", strings.NewReader(fmt.Sprintf(`[%q]`, key)))
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/api/admin/audit", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/admin/audit?limit=2", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var entries []audit.Entry
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, entries, 2)
+	assert.Equal(t, audit.ActionCreate, entries[0].Action)
+	assert.Equal(t, "aZT57qJnkvCrMQ==", entries[0].Actor)
+	assert.Equal(t, "127.0.0.1", entries[0].SourceIP)
+	assert.NotEmpty(t, entries[0].RequestID)
+	assert.Contains(t, resp.Header.Get("Link"), "cursor=2")
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/admin/audit?action=delete", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	resp.Body.Close()
+	require.Len(t, entries, 1)
+	assert.Equal(t, key, entries[0].Key)
+	assert.NotEmpty(t, entries[0].Before)
+	assert.NotEmpty(t, entries[0].After)
+}
+
+func TestHealth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	db, err := databases.NewFileDatabase(path)
+	require.NoError(t, err)
+	cfg := config.Config{BaseURL: "http://localhost:8080", FileStoragePath: path, ReadyTimeout: time.Second, ReadyMaxPendingDeletes: 10}
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	resp := testRequest(t, ts, http.MethodGet, "/healthz", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodGet, "/readyz", nil)
+	var report struct {
+		Status string
+		Checks map[string]struct{ Status string }
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ok", report.Status)
+	for _, name := range []string{"storage", "migrations", "delete_queue", "file_storage"} {
+		assert.Equal(t, "ok", report.Checks[name].Status, name)
+	}
+}
+
+// TestOpenAPI падает, если маршрут NewRouter не описан в openapi.json
+// или описание ссылается на маршрут, которого нет.
+func TestOpenAPI(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080", Metrics: true, AdminToken: "secret"}
+	r := NewRouter(cfg, databases.NewMapDatabase(), audit.NewMemoryLog())
+
+	var routes []openapi.Route
+	require.NoError(t, chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routes = append(routes, openapi.Route{Method: method, Path: route})
+		return nil
+	}))
+	assert.ElementsMatch(t, openapi.Default().Routes(), routes)
+
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	resp := testRequest(t, ts, http.MethodGet, "/api/openapi.json", nil)
+	var doc struct {
+		OpenAPI string
+		Servers []struct{ URL string }
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+	resp.Body.Close()
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	require.Len(t, doc.Servers, 1)
+	assert.Equal(t, cfg.BaseURL, doc.Servers[0].URL)
+
+	// Запрос к /api/…, не подходящий под схему, отклоняет проверка
+	// с телом Error.
+	resp = testRequest(t, ts, http.MethodPost, "/api/shorten/batch", strings.NewReader(`[{"correlation_id": "1"}]`))
+	var apiErr openapi.Error
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&apiErr))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "application/json; charset=UTF-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, []openapi.FieldError{{In: openapi.InBody, Field: "[0].original_url", Message: "is required"}}, apiErr.Details)
+}
+
+func TestShutdown(t *testing.T) {
+	primary, err := databases.NewSQLiteDatabase(filepath.Join(t.TempDir(), "urls.db"))
+	require.NoError(t, err)
+	db := databases.NewCachedDatabase(primary, 10, time.Minute, time.Minute)
+	defer db.Close()
+	require.NoError(t, db.Create(databases.URL{Hash: "visited", Original: "http://visited.example/", UserID: "user"}))
+	// Переход по ссылке из кеша засчитывается в памяти.
+	_, err = db.Select("visited")
+	require.NoError(t, err)
+	_, err = db.Visit("visited")
+	require.NoError(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+
+	rpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	rpc := grpcapi.NewServer(config.Config{}, db, audit.NewMemoryLog())
+	go rpc.Serve(rpcListener)
+
+	// Начатый запрос успевает закончиться, а отложенный переход сохраняется.
+	done := make(chan error, 1)
+	go func() { done <- shutdown(server, rpc, db, time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(t, http.StatusOK, <-status)
+	u, err := primary.Select("visited")
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.Clicks)
+
+	// Запрос, не закончившийся за отведённое время, делает остановку
+	// неудачной.
+	started, release = make(chan struct{}), make(chan struct{})
+	defer close(release)
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server = &http.Server{Handler: mux}
+	go server.Serve(listener)
+	go http.Get("http://" + listener.Addr().String() + "/slow")
+	<-started
+	err = shutdown(server, nil, db, 50*time.Millisecond)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "drain requests")
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := config.Config{BaseURL: "http://localhost:8080", Metrics: true}
+	db := databases.NewCachedDatabase(databases.NewMapDatabase(), 10, time.Minute, time.Second)
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	key := (&datahashes.Md5HashData{}).Hash([]byte("http://metrics.example/"))
+	resp := testRequest(t, ts, http.MethodPost, "/", strings.NewReader("http://metrics.example/"))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	for i := 0; i < 2; i++ {
+		resp = testRequest(t, ts, http.MethodGet, "/"+key, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	}
+	resp = testRequest(t, ts, http.MethodGet, "/missing", nil)
+	resp.Body.Close()
+
+	resp = testRequest(t, ts, http.MethodGet, "/metrics", nil)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	metrics := string(body)
+	// Переходы по разным ключам попадают в одну серию маршрута.
+	assert.Contains(t, metrics, `reducer_http_requests_total{code="307",method="GET",route="/{ID}"} 2`)
+	assert.Contains(t, metrics, `reducer_http_requests_total{code="400",method="GET",route="/{ID}"} 1`)
+	assert.Contains(t, metrics, `reducer_storage_operation_duration_seconds_count{method="Visit"} 2`)
+	assert.Contains(t, metrics, `reducer_storage_errors_total{error="not_found",method="Select"} 1`)
+	assert.Contains(t, metrics, `reducer_delete_queue_depth 0`)
+	assert.Contains(t, metrics, `reducer_cache_hits_total{cache="memory"} 1`)
+	assert.Contains(t, metrics, `reducer_cache_hit_ratio{cache="memory"}`)
+
+	// Без Metrics путь /metrics разбирается как ключ ссылки.
+	plain := httptest.NewServer(NewRouter(config.Config{BaseURL: "http://localhost:8080"}, databases.NewMapDatabase(), audit.NewMemoryLog()))
+	defer plain.Close()
+	resp = testRequest(t, plain, http.MethodGet, "/metrics", nil)
+	resp.Body.Close()
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	cfg := config.Config{BaseURL: "http://localhost:8080", Tracing: "stdout"}
+	db := databases.NewMapDatabase()
+	ts := httptest.NewServer(NewRouter(cfg, db, audit.NewMemoryLog()))
+	defer ts.Close()
+
+	key := (&datahashes.Md5HashData{}).Hash([]byte("http://traced.example/"))
+	require.NoError(t, db.Create(databases.URL{Hash: key, Original: "http://traced.example/", UserID: "user"}))
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/"+key, nil)
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), span.Name())
+	}
+	server, handler := spans["GET /{ID}"], spans["handler"]
+	require.NotNil(t, server)
+	require.NotNil(t, handler)
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), handler.Parent().SpanID())
+	for _, name := range []string{"databases.Select", "databases.Visit"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, handler.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+	}
+}
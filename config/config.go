@@ -1,8 +1,13 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/caarlos0/env/v6"
+	"net/url"
+	"os"
+	"time"
 )
 
 type Config struct {
@@ -10,19 +15,150 @@ type Config struct {
 	BaseURL         string `env:"BASE_URL" envDefault:"http://localhost:8080"`
 	FileStoragePath string `env:"FILE_STORAGE_PATH"`
 	DatabaseDSN     string `env:"DATABASE_DSN"`
+	// SQLitePath — файл встроенной базы SQLite. Её же можно выбрать,
+	// передав в DatabaseDSN адрес вида sqlite://path.
+	SQLitePath string `env:"SQLITE_PATH"`
+	// BoltPath — файл встроенного хранилища ключ-значение bbolt.
+	BoltPath string `env:"BOLT_PATH"`
+	// RedisURL — адрес Redis (redis://…), в котором хранятся ссылки.
+	RedisURL string `env:"REDIS_URL"`
+	// RedisCacheURL — адрес Redis, в котором кешируются ссылки
+	// основного хранилища, на время RedisCacheTTL.
+	RedisCacheURL string        `env:"REDIS_CACHE_URL"`
+	RedisCacheTTL time.Duration `env:"REDIS_CACHE_TTL" envDefault:"10m"`
+	// CacheSize — сколько ссылок держит в памяти кеш перед хранилищем,
+	// 0 выключает кеш. Найденные ссылки живут в нём CacheTTL,
+	// промахи — CacheNegativeTTL.
+	CacheSize        int           `env:"CACHE_SIZE"`
+	CacheTTL         time.Duration `env:"CACHE_TTL" envDefault:"1m"`
+	CacheNegativeTTL time.Duration `env:"CACHE_NEGATIVE_TTL" envDefault:"10s"`
+	// DeletedRetention — сколько удалённые ссылки можно восстановить,
+	// прежде чем фоновая очистка удалит их окончательно. Очистка
+	// запускается раз в PurgeInterval; 0 её выключает.
+	DeletedRetention time.Duration `env:"DELETED_RETENTION" envDefault:"720h"`
+	PurgeInterval    time.Duration `env:"PURGE_INTERVAL" envDefault:"1h"`
+	// MirrorStorage — второе хранилище (file:path, sqlite:path, bolt:path, redis://… или postgres:dsn),
+	// в которое дублируются все записи на время переезда.
+	MirrorStorage string `env:"MIRROR_STORAGE"`
+	// Metrics включает метрики Prometheus на /metrics.
+	Metrics bool `env:"METRICS"`
+	// Tracing включает трассировку OpenTelemetry и выбирает, куда
+	// отправлять спаны: stdout, file:path или otlp.
+	Tracing string `env:"TRACING"`
+	// LogLevel — наименьший уровень записей лога: debug, info, warn
+	// или error.
+	LogLevel string `env:"LOG_LEVEL" envDefault:"info"`
+	// AuditLogPath — файл журнала изменений. Без него журнал ведётся
+	// в памяти и теряется при перезапуске.
+	AuditLogPath string `env:"AUDIT_LOG_PATH"`
+	// AdminToken открывает администраторам /api/admin/… по заголовку
+	// Authorization: Bearer <token>; без него эти маршруты выключены.
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// ReadyTimeout ограничивает каждую проверку /readyz, а при очереди
+	// на удаление длиннее ReadyMaxPendingDeletes сервис сообщает, что
+	// не готов принимать запросы.
+	ReadyTimeout           time.Duration `env:"READY_TIMEOUT" envDefault:"2s"`
+	ReadyMaxPendingDeletes int64         `env:"READY_MAX_PENDING_DELETES" envDefault:"10000"`
+	// ShutdownTimeout — сколько при остановке ждать завершения начатых
+	// запросов и удалений.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"20s"`
+	// TLSCertFile и TLSKeyFile включают HTTPS с сертификатом и ключом
+	// из файлов в PEM. Их замена замечается раз в TLSReloadInterval
+	// или по SIGHUP. TLSSelfSigned вместо них выпускает самоподписанный
+	// сертификат — только для разработки.
+	TLSCertFile       string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile        string        `env:"TLS_KEY_FILE"`
+	TLSSelfSigned     bool          `env:"TLS_SELF_SIGNED"`
+	TLSReloadInterval time.Duration `env:"TLS_RELOAD_INTERVAL" envDefault:"1m"`
+	// GRPCAddress — адрес gRPC API рядом с HTTP; пустой его выключает.
+	// При включённом TLS gRPC использует тот же сертификат.
+	GRPCAddress string `env:"GRPC_ADDRESS"`
+}
+
+var (
+	ErrTLSKeyPair    = errors.New("tls certificate and key files must be set together")
+	ErrTLSSelfSigned = errors.New("self-signed tls excludes certificate files")
+	ErrBaseURL       = errors.New("invalid base url")
+	ErrPurgeInterval = errors.New("purge interval must not be negative")
+)
+
+// TLS сообщает, что сервер должен отвечать по HTTPS.
+func (c Config) TLS() bool {
+	return c.TLSSelfSigned || c.TLSCertFile != ""
+}
+
+// Validate проверяет, что настройки сервера согласованы: сертификат
+// задан вместе с ключом, а BaseURL — адрес http или https с хостом,
+// и при включённом TLS — обязательно https. BaseURL на https без TLS
+// допустим: TLS может завершать прокси перед сервером. Интервал
+// очистки не может быть отрицательным.
+func (c Config) Validate() error {
+	if c.PurgeInterval < 0 {
+		return fmt.Errorf("%w: %s", ErrPurgeInterval, c.PurgeInterval)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return ErrTLSKeyPair
+	}
+	if c.TLSSelfSigned && c.TLSCertFile != "" {
+		return ErrTLSSelfSigned
+	}
+
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBaseURL, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%w: %q has no host", ErrBaseURL, c.BaseURL)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return fmt.Errorf("%w: scheme of %q must be http or https", ErrBaseURL, c.BaseURL)
+	case c.TLS() && u.Scheme != "https":
+		return fmt.Errorf("%w: %q must use https when tls is enabled", ErrBaseURL, c.BaseURL)
+	}
+	return nil
 }
 
 func (c *Config) Parse() error {
+	return c.ParseFlags(flag.CommandLine, os.Args[1:])
+}
+
+// ParseFlags читает конфигурацию из окружения и флагов args. Флаги
+// конфигурации добавляются в fs, поэтому подкоманды могут объявить
+// в нём и собственные.
+func (c *Config) ParseFlags(fs *flag.FlagSet, args []string) error {
 	if err := env.Parse(c); err != nil {
 		return err
 	}
 
-	flag.StringVar(&c.ServerAddress, "a", c.ServerAddress, "server address")
-	flag.StringVar(&c.BaseURL, "b", c.BaseURL, "base url")
-	flag.StringVar(&c.FileStoragePath, "f", c.FileStoragePath, "file storage path")
-	flag.StringVar(&c.DatabaseDSN, "d", c.DatabaseDSN, "database dsn")
+	fs.StringVar(&c.ServerAddress, "a", c.ServerAddress, "server address")
+	fs.StringVar(&c.BaseURL, "b", c.BaseURL, "base url")
+	fs.StringVar(&c.FileStoragePath, "f", c.FileStoragePath, "file storage path")
+	fs.StringVar(&c.DatabaseDSN, "d", c.DatabaseDSN, "database dsn")
+	fs.StringVar(&c.SQLitePath, "sqlite", c.SQLitePath, "sqlite database path")
+	fs.StringVar(&c.BoltPath, "bolt", c.BoltPath, "bbolt database path")
+	fs.StringVar(&c.RedisURL, "redis", c.RedisURL, "redis url to store urls in")
+	fs.StringVar(&c.RedisCacheURL, "redis-cache", c.RedisCacheURL, "redis url to cache urls of the primary storage in")
+	fs.DurationVar(&c.RedisCacheTTL, "redis-cache-ttl", c.RedisCacheTTL, "how long urls stay in the redis cache")
+	fs.IntVar(&c.CacheSize, "cache-size", c.CacheSize, "how many urls the in-memory cache holds, 0 disables it")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "how long found urls stay in the in-memory cache")
+	fs.DurationVar(&c.CacheNegativeTTL, "cache-negative-ttl", c.CacheNegativeTTL, "how long misses stay in the in-memory cache")
+	fs.DurationVar(&c.DeletedRetention, "deleted-retention", c.DeletedRetention, "how long deleted urls can be restored")
+	fs.DurationVar(&c.PurgeInterval, "purge-interval", c.PurgeInterval, "how often deleted urls are purged, 0 disables purging")
+	fs.StringVar(&c.MirrorStorage, "mirror-storage", c.MirrorStorage, "storage (file:path, sqlite:path, bolt:path, redis://… or postgres:dsn) that receives a copy of every write")
+	fs.BoolVar(&c.Metrics, "metrics", c.Metrics, "serve prometheus metrics on /metrics")
+	fs.StringVar(&c.Tracing, "tracing", c.Tracing, "opentelemetry span exporter: stdout, file:path or otlp")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum log level: debug, info, warn or error")
+	fs.StringVar(&c.AuditLogPath, "audit-log", c.AuditLogPath, "audit log file, in memory if empty")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token for /api/admin routes, disabled if empty")
+	fs.DurationVar(&c.ReadyTimeout, "ready-timeout", c.ReadyTimeout, "timeout of each readiness check")
+	fs.Int64Var(&c.ReadyMaxPendingDeletes, "ready-max-pending-deletes", c.ReadyMaxPendingDeletes, "delete queue length above which the service is not ready")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to drain requests and deletes on shutdown")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "tls certificate file in pem, enables https")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "tls private key file in pem")
+	fs.BoolVar(&c.TLSSelfSigned, "tls-self-signed", c.TLSSelfSigned, "serve https with a generated self-signed certificate, for development")
+	fs.DurationVar(&c.TLSReloadInterval, "tls-reload-interval", c.TLSReloadInterval, "how often to check tls files for changes")
+	fs.StringVar(&c.GRPCAddress, "grpc", c.GRPCAddress, "grpc server address, disabled if empty")
 
-	flag.Parse()
-
-	return nil
+	return fs.Parse(args)
 }
@@ -1 +1,37 @@
 package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		err  error
+	}{
+		{name: "plain http", cfg: Config{BaseURL: "http://localhost:8080"}},
+		{name: "https behind proxy", cfg: Config{BaseURL: "https://short.example"}},
+		{name: "tls files", cfg: Config{BaseURL: "https://short.example", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}},
+		{name: "self-signed", cfg: Config{BaseURL: "https://localhost:8443", TLSSelfSigned: true}},
+		{name: "tls with http base url", cfg: Config{BaseURL: "http://short.example", TLSSelfSigned: true}, err: ErrBaseURL},
+		{name: "cert without key", cfg: Config{BaseURL: "https://short.example", TLSCertFile: "cert.pem"}, err: ErrTLSKeyPair},
+		{name: "self-signed with files", cfg: Config{BaseURL: "https://short.example", TLSSelfSigned: true, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}, err: ErrTLSSelfSigned},
+		{name: "no host", cfg: Config{BaseURL: "localhost:8080"}, err: ErrBaseURL},
+		{name: "unknown scheme", cfg: Config{BaseURL: "ftp://short.example"}, err: ErrBaseURL},
+		{name: "purging disabled", cfg: Config{BaseURL: "http://localhost:8080", PurgeInterval: 0}},
+		{name: "negative purge interval", cfg: Config{BaseURL: "http://localhost:8080", PurgeInterval: -time.Minute}, err: ErrPurgeInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
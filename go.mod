@@ -3,8 +3,22 @@ module github.com/salliko/reducer
 go 1.16
 
 require (
-	github.com/caarlos0/env/v6 v6.9.1 // indirect
-	github.com/go-chi/chi v1.5.4 // indirect
-	github.com/jackc/pgx/v4 v4.15.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/caarlos0/env/v6 v6.9.1
+	github.com/go-chi/chi v1.5.4
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/jackc/pgx/v4 v4.15.0
+	github.com/prometheus/client_golang v1.12.1
+	github.com/stretchr/testify v1.7.0
+	go.etcd.io/bbolt v1.3.6
+	go.opentelemetry.io/otel v1.4.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.4.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.4.1
+	go.opentelemetry.io/otel/sdk v1.4.1
+	go.opentelemetry.io/otel/trace v1.4.1
+	go.uber.org/zap v1.21.0
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	google.golang.org/grpc v1.44.0
+	google.golang.org/protobuf v1.27.1
+	modernc.org/sqlite v1.17.3
 )
@@ -0,0 +1,356 @@
+// Package audit ведёт неизменяемый журнал изменений ссылок и рабочих
+// пространств: кто, когда и откуда что сделал, с состоянием до и после.
+// Записи только дописываются, а каждая хранит хеш предыдущей, поэтому
+// правка или удаление записи задним числом обнаруживается при открытии
+// журнала.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrTampered означает, что цепочка записей журнала нарушена.
+var ErrTampered = errors.New("audit log is tampered")
+
+// Действия, которые пишутся в журнал.
+const (
+	ActionCreate          = "create"
+	ActionUpdate          = "update"
+	ActionDelete          = "delete"
+	ActionRestore         = "restore"
+	ActionPurge           = "purge"
+	ActionLoad            = "load"
+	ActionCreateWorkspace = "create_workspace"
+	ActionSetMember       = "set_member"
+	ActionTransfer        = "transfer"
+	ActionLoadWorkspace   = "load_workspace"
+)
+
+// maxEntrySize ограничивает длину строки файла журнала при чтении.
+const maxEntrySize = 16 << 20
+
+// Entry — запись журнала. ID, PrevHash и Hash заполняет журнал.
+type Entry struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	// Action — одно из действий Action*.
+	Action string `json:"action"`
+	// Actor — пользователь, от имени которого сделано изменение;
+	// пусто у изменений, сделанных самим сервисом.
+	Actor     string `json:"actor,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Workspace string `json:"workspace,omitempty"`
+	// From — пользователь, чьи ссылки Transfer передал пространству.
+	From string `json:"from,omitempty"`
+	// Before и After — состояние ссылки, пространства или участника
+	// до и после изменения; пусто, если его не было или оно неизвестно.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+	// Keys и Count описывают изменения многих ссылок сразу: переданные
+	// ключи и число затронутых ссылок.
+	Keys     []string `json:"keys,omitempty"`
+	Count    int      `json:"count,omitempty"`
+	PrevHash string   `json:"prev_hash"`
+	Hash     string   `json:"hash"`
+}
+
+// Filter отбирает записи журнала. Пустые поля не ограничивают выборку.
+type Filter struct {
+	Key       string
+	Actor     string
+	Action    string
+	Workspace string
+	// Since и Until ограничивают время записи: [since, until).
+	Since *time.Time
+	Until *time.Time
+	// After пропускает записи с ID не больше After.
+	After uint64
+	// Limit — наибольшее число записей, 0 — без ограничения.
+	Limit int
+}
+
+func (f Filter) match(e Entry) bool {
+	switch {
+	case e.ID <= f.After:
+		return false
+	case f.Key != "" && e.Key != f.Key:
+		return false
+	case f.Actor != "" && e.Actor != f.Actor:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Workspace != "" && e.Workspace != f.Workspace:
+		return false
+	case f.Since != nil && e.Time.Before(*f.Since):
+		return false
+	case f.Until != nil && !e.Time.Before(*f.Until):
+		return false
+	}
+	return true
+}
+
+// Log — журнал изменений. Записи в нём можно только дописывать.
+type Log interface {
+	// Append дописывает записи в журнал одним пакетом.
+	Append(entries ...Entry) error
+	// Query возвращает записи, подходящие под f, по возрастанию ID.
+	Query(f Filter) ([]Entry, error)
+	Close() error
+}
+
+// chain — конец цепочки записей: последний ID и хеш.
+type chain struct {
+	lastID   uint64
+	lastHash string
+}
+
+// hash считает хеш записи вместе с хешем предыдущей.
+func hash(e Entry) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// seal нумерует e и сцепляет её с концом цепочки.
+func (c *chain) seal(e *Entry) error {
+	e.ID = c.lastID + 1
+	e.Time = e.Time.UTC()
+	e.PrevHash = c.lastHash
+	h, err := hash(*e)
+	if err != nil {
+		return err
+	}
+	e.Hash = h
+	c.lastID, c.lastHash = e.ID, e.Hash
+	return nil
+}
+
+// verify проверяет, что e — следующее звено цепочки, и продлевает её.
+func (c *chain) verify(e Entry) error {
+	h, err := hash(e)
+	if err != nil {
+		return err
+	}
+	if e.ID != c.lastID+1 || e.PrevHash != c.lastHash || e.Hash != h {
+		return fmt.Errorf("%w: entry %d", ErrTampered, c.lastID+1)
+	}
+	c.lastID, c.lastHash = e.ID, e.Hash
+	return nil
+}
+
+// MemoryLog хранит журнал в памяти и теряет его при перезапуске.
+type MemoryLog struct {
+	mu      sync.RWMutex
+	chain   chain
+	entries []Entry
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{}
+}
+
+func (l *MemoryLog) Append(entries ...Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.chain
+	sealed := make([]Entry, len(entries))
+	for i, e := range entries {
+		if err := next.seal(&e); err != nil {
+			return err
+		}
+		sealed[i] = e
+	}
+	l.chain = next
+	l.entries = append(l.entries, sealed...)
+	return nil
+}
+
+func (l *MemoryLog) Query(f Filter) ([]Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var result []Entry
+	for _, e := range l.entries {
+		if f.Limit > 0 && len(result) == f.Limit {
+			break
+		}
+		if f.match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (l *MemoryLog) Close() error { return nil }
+
+// FileLog хранит журнал в файле, по записи JSON на строку. Файл только
+// дописывается, и каждый пакет записей сбрасывается на диск до того,
+// как Append вернёт управление.
+type FileLog struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	chain chain
+}
+
+// OpenFileLog открывает журнал в файле path, создавая его при
+// необходимости, и проверяет цепочку уже записанных записей. Последняя
+// строка без перевода строки — запись, оборванная сбоем посреди Append,
+// которая не была подтверждена; она отрезается.
+func OpenFileLog(path string) (*FileLog, error) {
+	l := &FileLog{path: path}
+	size, err := l.scan(func(e Entry) error { return l.chain.verify(e) })
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := truncateTail(path, size); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// truncateTail обрезает файл path до size байт, если он длиннее.
+func truncateTail(path string, size int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= size {
+		return nil
+	}
+	return os.Truncate(path, size)
+}
+
+// scan передаёт fn записи файла журнала по порядку и возвращает длину
+// прочитанных целых строк. Строка без перевода строки в конце файла
+// пропускается: её либо ещё дописывает Append, либо оборвал сбой.
+func (l *FileLog) scan(fn func(Entry) error) (int64, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var size int64
+	reader := bufio.NewReaderSize(file, 64<<10)
+	for line := 1; ; line++ {
+		data, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			data, err = readLong(reader, data)
+		}
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return size, fmt.Errorf("%w: line %d: %v", ErrTampered, line, err)
+		}
+		if err := fn(e); err != nil {
+			return size, err
+		}
+		size += int64(len(data))
+	}
+}
+
+// readLong дочитывает строку длиннее буфера reader.
+func readLong(reader *bufio.Reader, head []byte) ([]byte, error) {
+	data := append([]byte(nil), head...)
+	for {
+		more, err := reader.ReadSlice('\n')
+		data = append(data, more...)
+		if len(data) > maxEntrySize {
+			return nil, fmt.Errorf("%w: entry longer than %d bytes", ErrTampered, maxEntrySize)
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return data, err
+		}
+	}
+}
+
+func (l *FileLog) Append(entries ...Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.chain
+	var buf []byte
+	for _, e := range entries {
+		if err := next.seal(&e); err != nil {
+			return err
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if _, err := l.file.Write(buf); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.chain = next
+	return nil
+}
+
+// Query читает файл журнала целиком, не держа его в памяти. Файл
+// читается своим дескриптором без блокировки, поэтому Append не ждёт
+// конца выборки.
+func (l *FileLog) Query(f Filter) ([]Entry, error) {
+	var result []Entry
+	errLimit := errors.New("limit reached")
+	_, err := l.scan(func(e Entry) error {
+		if f.Limit > 0 && len(result) == f.Limit {
+			return errLimit
+		}
+		if f.match(e) {
+			result = append(result, e)
+		}
+		return nil
+	})
+	if err != nil && err != errLimit {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (l *FileLog) Close() error {
+	return l.file.Close()
+}
+
+// Open открывает журнал в файле path, а при пустом path — в памяти.
+// Журнал в памяти теряется при перезапуске, о чём вызывающему стоит
+// предупредить.
+func Open(path string) (Log, error) {
+	if path == "" {
+		return NewMemoryLog(), nil
+	}
+	return OpenFileLog(path)
+}
@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenFileLog(path)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.NoError(t, l.Append(
+		Entry{Time: now, Action: ActionCreate, Actor: "user", Key: "a"},
+		Entry{Time: now, Action: ActionCreate, Actor: "user", Key: "b"},
+	))
+	require.NoError(t, l.Append(Entry{Time: now.Add(time.Minute), Action: ActionDelete, Actor: "other", Key: "a"}))
+	require.NoError(t, l.Close())
+
+	// После повторного открытия нумерация и цепочка продолжаются.
+	l, err = OpenFileLog(path)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Time: now, Action: ActionUpdate, Actor: "user", Key: "b"}))
+
+	all, err := l.Query(Filter{})
+	require.NoError(t, err)
+	require.Len(t, all, 4)
+	for i, e := range all {
+		assert.EqualValues(t, i+1, e.ID)
+		if i > 0 {
+			assert.Equal(t, all[i-1].Hash, e.PrevHash)
+		}
+	}
+
+	found, err := l.Query(Filter{Key: "a"})
+	require.NoError(t, err)
+	assert.Len(t, found, 2)
+	found, err = l.Query(Filter{Actor: "user", After: 1, Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.EqualValues(t, 2, found[0].ID)
+	since := now.Add(time.Second)
+	found, err = l.Query(Filter{Since: &since})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	assert.Equal(t, ActionDelete, found[0].Action)
+	require.NoError(t, l.Close())
+
+	// Правка записи задним числом ломает цепочку.
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, bytes.Replace(data, []byte(`"actor":"other"`), []byte(`"actor":"user"`), 1), 0600))
+	_, err = OpenFileLog(path)
+	assert.ErrorIs(t, err, ErrTampered)
+}
+
+// Запись, оборванная сбоем посреди Append, отрезается при открытии,
+// а не считается подделкой.
+func TestFileLogTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := OpenFileLog(path)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Action: ActionCreate, Key: "a"}))
+	require.NoError(t, l.Close())
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"id":2,"action":"cre`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	l, err = OpenFileLog(path)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(Entry{Action: ActionDelete, Key: "a"}))
+	require.NoError(t, l.Close())
+
+	l, err = OpenFileLog(path)
+	require.NoError(t, err)
+	defer l.Close()
+	all, err := l.Query(Filter{})
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, ActionDelete, all[1].Action)
+}
+
+func TestOpen(t *testing.T) {
+	l, err := Open("")
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryLog{}, l)
+
+	l, err = Open(filepath.Join(t.TempDir(), "audit.log"))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
+
+func TestDatabase(t *testing.T) {
+	log := NewMemoryLog()
+	db := Database(databases.NewMapDatabase(), log)
+	ctx := context.WithValue(context.Background(), sourceIPKey, "192.0.2.1")
+	bound := databases.WithContext(ctx, db)
+
+	u := databases.URL{Hash: "a", Original: "http://a.example/", UserID: "owner", PasswordHash: "secret-hash"}
+	require.NoError(t, bound.Create(u))
+	require.NoError(t, bound.CreateMany([]databases.URL{{Hash: "b", Original: "http://b.example/", UserID: "owner"}}))
+
+	_, err := bound.Update("a", "owner", func(u *databases.URL) error {
+		u.Title = "edited"
+		return nil
+	})
+	require.NoError(t, err)
+	// Чужое удаление хранилище пропускает, и в журнал оно не попадает.
+	require.NoError(t, bound.Delete("a", "stranger"))
+	require.NoError(t, bound.Delete("a", "owner"))
+	require.NoError(t, bound.Delete("a", "owner"))
+
+	entries, err := log.Query(Filter{})
+	require.NoError(t, err)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+		assert.Equal(t, "192.0.2.1", e.SourceIP)
+		assert.Equal(t, "owner", e.Actor)
+		assert.NotContains(t, string(e.Before)+string(e.After), "secret-hash")
+	}
+	assert.Equal(t, []string{ActionCreate, ActionCreate, ActionUpdate, ActionDelete}, actions)
+
+	var before, after databases.URL
+	require.NoError(t, json.Unmarshal(entries[2].Before, &before))
+	require.NoError(t, json.Unmarshal(entries[2].After, &after))
+	assert.Empty(t, before.Title)
+	assert.Equal(t, "edited", after.Title)
+
+	require.NoError(t, json.Unmarshal(entries[3].After, &after))
+	assert.NotNil(t, after.DeletedAt)
+}
+
+// readCounter считает чтения ссылок из хранилища.
+type readCounter struct {
+	databases.Database
+	selects, batches int
+}
+
+func (d *readCounter) Select(key string) (databases.URL, error) {
+	d.selects++
+	return d.Database.Select(key)
+}
+
+func (d *readCounter) SelectMany(keys []string) ([]databases.URL, error) {
+	d.batches++
+	return d.Database.SelectMany(keys)
+}
+
+func TestDatabaseDeleteBatch(t *testing.T) {
+	log := NewMemoryLog()
+	storage := &readCounter{Database: databases.NewMapDatabase()}
+	db := Database(storage, log)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Create(databases.URL{Hash: key, Original: "http://" + key + ".example/", UserID: "owner"}))
+	}
+	require.NoError(t, db.Create(databases.URL{Hash: "d", Original: "http://d.example/", UserID: "other"}))
+
+	keys := []string{"a", "b", "c", "d", "missing"}
+	databases.DeleteBatch(db, "owner", keys, func() {
+		for _, key := range keys {
+			require.NoError(t, db.Delete(key, "owner"))
+		}
+	})
+
+	// Пакет читается один раз до и один раз после удаления.
+	assert.Equal(t, 0, storage.selects)
+	assert.Equal(t, 2, storage.batches)
+	entries, err := log.Query(Filter{Action: ActionDelete})
+	require.NoError(t, err)
+	var deleted []string
+	for _, e := range entries {
+		deleted = append(deleted, e.Key)
+	}
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, deleted)
+}
@@ -0,0 +1,384 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/salliko/reducer/internal/logging"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const sourceIPKey contextKey = iota
+
+// redactedPassword заменяет в журнале хеш пароля ссылки: видно, что
+// пароль есть или сменился, но не сам хеш.
+const redactedPassword = "[REDACTED]"
+
+// WithSourceIP кладёт в ctx адрес клиента addr (host:port или только
+// host), с которого пришло изменение.
+func WithSourceIP(ctx context.Context, addr string) context.Context {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return context.WithValue(ctx, sourceIPKey, addr)
+}
+
+// Middleware кладёт в контекст запроса адрес клиента, с которого
+// пришло изменение.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithSourceIP(r.Context(), r.RemoteAddr)))
+	})
+}
+
+// auditedDatabase пишет в журнал каждое успешное изменение хранилища.
+// Адрес клиента и идентификатор запроса берутся из ctx, к которому
+// хранилище привязано WithContext.
+type auditedDatabase struct {
+	db  databases.Database
+	log Log
+	ctx context.Context
+
+	mu sync.Mutex
+	// batched — сколько идущих пакетов DeleteBatch удаляют ключ.
+	batched map[string]int
+}
+
+// Database оборачивает db так, что изменения в нём попадают в log.
+// Ошибка записи в журнал не отменяет уже сделанное изменение и только
+// пишется в лог.
+func Database(db databases.Database, log Log) databases.Database {
+	return &auditedDatabase{db: db, log: log, ctx: context.Background()}
+}
+
+func (d *auditedDatabase) WithContext(ctx context.Context) databases.Database {
+	return &auditedDatabase{db: databases.WithContext(ctx, d.db), log: d.log, ctx: ctx}
+}
+
+// Unwrap возвращает обёрнутое хранилище.
+func (d *auditedDatabase) Unwrap() databases.Database { return d.db }
+
+// entry заполняет общие поля записи.
+func (d *auditedDatabase) entry(action, actor string) Entry {
+	ip, _ := d.ctx.Value(sourceIPKey).(string)
+	return Entry{
+		Time:      time.Now(),
+		Action:    action,
+		Actor:     actor,
+		SourceIP:  ip,
+		RequestID: logging.RequestID(d.ctx),
+	}
+}
+
+func (d *auditedDatabase) record(entries ...Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	if err := d.log.Append(entries...); err != nil {
+		logging.FromContext(d.ctx).Error("append audit log", zap.String("action", entries[0].Action), zap.Error(err))
+	}
+}
+
+// snapshot сериализует состояние для записи журнала.
+func snapshot(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// urlSnapshot сериализует ссылку, скрывая хеш пароля.
+func urlSnapshot(u databases.URL) json.RawMessage {
+	if u.PasswordHash != "" {
+		u.PasswordHash = redactedPassword
+	}
+	return snapshot(u)
+}
+
+func (d *auditedDatabase) Create(u databases.URL) error {
+	if err := d.db.Create(u); err != nil {
+		return err
+	}
+	e := d.entry(ActionCreate, u.UserID)
+	e.Key, e.Workspace, e.After = u.Hash, u.WorkspaceID, urlSnapshot(u)
+	d.record(e)
+	return nil
+}
+
+func (d *auditedDatabase) CreateMany(urls []databases.URL) error {
+	if err := d.db.CreateMany(urls); err != nil {
+		return err
+	}
+	entries := make([]Entry, len(urls))
+	for i, u := range urls {
+		e := d.entry(ActionCreate, u.UserID)
+		e.Key, e.Workspace, e.After = u.Hash, u.WorkspaceID, urlSnapshot(u)
+		entries[i] = e
+	}
+	d.record(entries...)
+	return nil
+}
+
+func (d *auditedDatabase) Flush() error {
+	return d.db.Flush()
+}
+
+func (d *auditedDatabase) Update(key, userID string, edit func(*databases.URL) error) (databases.URL, error) {
+	var before databases.URL
+	u, err := d.db.Update(key, userID, func(u *databases.URL) error {
+		before = *u
+		before.Tags = append([]string(nil), u.Tags...)
+		return edit(u)
+	})
+	if err != nil {
+		return u, err
+	}
+	e := d.entry(ActionUpdate, userID)
+	e.Key, e.Workspace, e.Before, e.After = key, u.WorkspaceID, urlSnapshot(before), urlSnapshot(u)
+	d.record(e)
+	return u, nil
+}
+
+// Delete удаляет ссылку и пишет это в журнал так же, как DeleteBatch
+// из одной ссылки. Внутри пакета DeleteBatch ссылка просто удаляется.
+func (d *auditedDatabase) Delete(key, userID string) error {
+	d.mu.Lock()
+	batched := d.batched[key] > 0
+	d.mu.Unlock()
+	if batched {
+		return d.db.Delete(key, userID)
+	}
+
+	var err error
+	d.DeleteBatch(userID, []string{key}, func() { err = d.db.Delete(key, userID) })
+	return err
+}
+
+// DeleteBatch читает ссылки keys один раз до и один раз после del
+// и пишет в журнал те, что были действующими, а после del удалены:
+// ссылки, которые пользователь удалить не может, хранилище молча
+// пропускает.
+func (d *auditedDatabase) DeleteBatch(userID string, keys []string, del func()) {
+	d.mu.Lock()
+	if d.batched == nil {
+		d.batched = make(map[string]int)
+	}
+	for _, key := range keys {
+		d.batched[key]++
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		for _, key := range keys {
+			if d.batched[key]--; d.batched[key] == 0 {
+				delete(d.batched, key)
+			}
+		}
+		d.mu.Unlock()
+	}()
+
+	before, err := d.db.SelectMany(keys)
+	del()
+	if err != nil {
+		logging.FromContext(d.ctx).Error("select urls before delete", zap.Error(err))
+		return
+	}
+	after, err := d.db.SelectMany(keys)
+	if err != nil {
+		logging.FromContext(d.ctx).Error("select urls after delete", zap.Error(err))
+		return
+	}
+
+	deleted := make(map[string]databases.URL, len(after))
+	for _, u := range after {
+		if u.Deleted() {
+			deleted[u.Hash] = u
+		}
+	}
+	var entries []Entry
+	for _, u := range before {
+		a, ok := deleted[u.Hash]
+		if !ok || u.Deleted() {
+			continue
+		}
+		delete(deleted, u.Hash)
+		e := d.entry(ActionDelete, userID)
+		e.Key, e.Workspace, e.Before, e.After = u.Hash, u.WorkspaceID, urlSnapshot(u), urlSnapshot(a)
+		entries = append(entries, e)
+	}
+	d.record(entries...)
+}
+
+func (d *auditedDatabase) Restore(key, userID string, since time.Time) (databases.URL, error) {
+	u, err := d.db.Restore(key, userID, since)
+	if err != nil {
+		return u, err
+	}
+	e := d.entry(ActionRestore, userID)
+	e.Key, e.Workspace, e.After = key, u.WorkspaceID, urlSnapshot(u)
+	d.record(e)
+	return u, nil
+}
+
+func (d *auditedDatabase) Purge(userID string, before time.Time) (int, error) {
+	purged, err := d.db.Purge(userID, before)
+	if err != nil || purged == 0 {
+		return purged, err
+	}
+	e := d.entry(ActionPurge, userID)
+	e.Count = purged
+	d.record(e)
+	return purged, nil
+}
+
+func (d *auditedDatabase) Load(recs []databases.Record, overwrite bool) ([]string, error) {
+	conflicts, err := d.db.Load(recs, overwrite)
+	if err != nil {
+		return conflicts, err
+	}
+	// При overwrite заменены и уже существовавшие ссылки.
+	skipped := make(map[string]bool, len(conflicts))
+	if !overwrite {
+		for _, key := range conflicts {
+			skipped[key] = true
+		}
+	}
+	var entries []Entry
+	for _, rec := range recs {
+		if skipped[rec.URL.Hash] {
+			continue
+		}
+		e := d.entry(ActionLoad, "")
+		e.Key, e.Workspace, e.After = rec.URL.Hash, rec.URL.WorkspaceID, urlSnapshot(rec.URL)
+		entries = append(entries, e)
+	}
+	d.record(entries...)
+	return conflicts, nil
+}
+
+func (d *auditedDatabase) CreateWorkspace(w databases.Workspace, ownerID string) error {
+	if err := d.db.CreateWorkspace(w, ownerID); err != nil {
+		return err
+	}
+	e := d.entry(ActionCreateWorkspace, ownerID)
+	e.Workspace, e.After = w.ID, snapshot(w)
+	d.record(e)
+	return nil
+}
+
+// SetMember пишет в журнал прежнюю и новую роль участника. Исключённый
+// участник записывается с пустым состоянием после.
+func (d *auditedDatabase) SetMember(actorID string, m databases.Member) error {
+	var before *databases.Member
+	if members, err := d.db.Members(m.WorkspaceID, actorID); err == nil {
+		for i := range members {
+			if members[i].UserID == m.UserID {
+				before = &members[i]
+			}
+		}
+	}
+	if err := d.db.SetMember(actorID, m); err != nil {
+		return err
+	}
+	e := d.entry(ActionSetMember, actorID)
+	e.Workspace = m.WorkspaceID
+	if before != nil {
+		e.Before = snapshot(before)
+	}
+	if m.Role != "" {
+		e.After = snapshot(m)
+	}
+	d.record(e)
+	return nil
+}
+
+func (d *auditedDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	transferred, err := d.db.Transfer(workspaceID, userID, fromID, keys)
+	if err != nil || transferred == 0 {
+		return transferred, err
+	}
+	if fromID == "" {
+		fromID = userID
+	}
+	e := d.entry(ActionTransfer, userID)
+	e.Workspace, e.From, e.Keys, e.Count = workspaceID, fromID, keys, transferred
+	d.record(e)
+	return transferred, nil
+}
+
+func (d *auditedDatabase) LoadWorkspace(rec databases.WorkspaceRecord, overwrite bool) error {
+	if err := d.db.LoadWorkspace(rec, overwrite); err != nil {
+		return err
+	}
+	e := d.entry(ActionLoadWorkspace, "")
+	e.Workspace, e.After = rec.Workspace.ID, snapshot(rec)
+	d.record(e)
+	return nil
+}
+
+func (d *auditedDatabase) Select(key string) (databases.URL, error) {
+	return d.db.Select(key)
+}
+
+func (d *auditedDatabase) SelectMany(keys []string) ([]databases.URL, error) {
+	return d.db.SelectMany(keys)
+}
+
+func (d *auditedDatabase) Totals() (databases.Totals, error) {
+	return d.db.Totals()
+}
+
+func (d *auditedDatabase) Visit(key string) (databases.URL, error) {
+	return d.db.Visit(key)
+}
+
+func (d *auditedDatabase) AddClicks(clicks map[string]int) error {
+	return d.db.AddClicks(clicks)
+}
+
+func (d *auditedDatabase) SelectAll(userID string) ([]databases.URL, error) {
+	return d.db.SelectAll(userID)
+}
+
+func (d *auditedDatabase) List(q databases.Query) (databases.Page, error) {
+	return d.db.List(q)
+}
+
+func (d *auditedDatabase) Iterate(q databases.Query, fn func(databases.URL) error) error {
+	return d.db.Iterate(q, fn)
+}
+
+func (d *auditedDatabase) Revisions(key, userID string) ([]databases.Revision, error) {
+	return d.db.Revisions(key, userID)
+}
+
+func (d *auditedDatabase) Workspaces(userID string) ([]databases.Workspace, error) {
+	return d.db.Workspaces(userID)
+}
+
+func (d *auditedDatabase) Members(workspaceID, userID string) ([]databases.Member, error) {
+	return d.db.Members(workspaceID, userID)
+}
+
+func (d *auditedDatabase) Dump(after string, fn func(databases.Record) error) error {
+	return d.db.Dump(after, fn)
+}
+
+func (d *auditedDatabase) DumpWorkspaces(fn func(databases.WorkspaceRecord) error) error {
+	return d.db.DumpWorkspaces(fn)
+}
+
+func (d *auditedDatabase) Close() {
+	d.db.Close()
+}
+
+func (d *auditedDatabase) Ping() error {
+	return d.db.Ping()
+}
@@ -0,0 +1,341 @@
+// Package backup пишет и читает переносимые архивы хранилища ссылок.
+//
+// Архив — gzip-сжатый поток JSON-строк. Первая строка — заголовок
+// с форматом и версией, затем идут рабочие пространства и ссылки,
+// последняя строка — итог с числом записей и SHA-256 всех предыдущих
+// строк. Архив читается потоком и не держится в памяти целиком.
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/salliko/reducer/internal/databases"
+	"hash"
+	"io"
+	"time"
+)
+
+const (
+	Format  = "reducer-backup"
+	Version = 1
+
+	// batchSize — сколько ссылок загружается в хранилище одним Load.
+	batchSize = 500
+	// maxLine ограничивает длину строки архива.
+	maxLine = 16 << 20
+)
+
+var ErrCorrupted = errors.New(`backup archive is corrupted`)
+
+const (
+	entryHeader    = "header"
+	entryWorkspace = "workspace"
+	entryLink      = "link"
+	entryFooter    = "footer"
+)
+
+// entry — строка архива.
+type entry struct {
+	Type string `json:"type"`
+
+	Format    string     `json:"format,omitempty"`
+	Version   int        `json:"version,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	Workspace *databases.WorkspaceRecord `json:"workspace,omitempty"`
+	Link      *databases.Record          `json:"link,omitempty"`
+
+	Links      int    `json:"links,omitempty"`
+	Workspaces int    `json:"workspaces,omitempty"`
+	Checksum   string `json:"sha256,omitempty"`
+}
+
+// Stats — итог записи или восстановления архива.
+type Stats struct {
+	Workspaces  int
+	Links       int
+	Skipped     int
+	Overwritten int
+}
+
+// Policy определяет, что делать с записями, которые уже есть в хранилище.
+type Policy string
+
+const (
+	PolicySkip      Policy = "skip"
+	PolicyOverwrite Policy = "overwrite"
+	PolicyFail      Policy = "fail"
+)
+
+// ParsePolicy разбирает политику разрешения конфликтов.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicySkip, PolicyOverwrite, PolicyFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// Write выгружает всё содержимое db в архив w.
+func Write(w io.Writer, db databases.Database) (Stats, error) {
+	var stats Stats
+	gz := gzip.NewWriter(w)
+	sum := sha256.New()
+	enc := json.NewEncoder(io.MultiWriter(gz, sum))
+
+	now := time.Now().UTC()
+	err := enc.Encode(entry{Type: entryHeader, Format: Format, Version: Version, CreatedAt: &now})
+	if err != nil {
+		return stats, err
+	}
+
+	err = db.DumpWorkspaces(func(rec databases.WorkspaceRecord) error {
+		stats.Workspaces++
+		return enc.Encode(entry{Type: entryWorkspace, Workspace: &rec})
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	err = db.Dump("", func(rec databases.Record) error {
+		stats.Links++
+		return enc.Encode(entry{Type: entryLink, Link: &rec})
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	// Итог не входит в контрольную сумму, поэтому пишется мимо sum.
+	err = json.NewEncoder(gz).Encode(entry{
+		Type:       entryFooter,
+		Links:      stats.Links,
+		Workspaces: stats.Workspaces,
+		Checksum:   hex.EncodeToString(sum.Sum(nil)),
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, gz.Close()
+}
+
+// reader читает строки архива, считая контрольную сумму.
+type reader struct {
+	gz     *gzip.Reader
+	s      *bufio.Scanner
+	sum    hash.Hash
+	footer *entry
+	stats  Stats
+}
+
+func newReader(r io.Reader) (*reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	s := bufio.NewScanner(gz)
+	s.Buffer(make([]byte, 0, 64*1024), maxLine)
+	rd := &reader{gz: gz, s: s, sum: sha256.New()}
+
+	e, err := rd.next()
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.Type != entryHeader || e.Format != Format {
+		return nil, fmt.Errorf("%w: missing header", ErrCorrupted)
+	}
+	if e.Version > Version {
+		return nil, fmt.Errorf("backup version %d is newer than supported %d", e.Version, Version)
+	}
+	return rd, nil
+}
+
+// next возвращает очередную запись архива или nil после итога,
+// сверив с ним контрольную сумму и число записей.
+func (rd *reader) next() (*entry, error) {
+	if rd.footer != nil {
+		return nil, nil
+	}
+	if !rd.s.Scan() {
+		if err := rd.s.Err(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+		return nil, fmt.Errorf("%w: unexpected end of archive", ErrCorrupted)
+	}
+
+	line := rd.s.Bytes()
+	var e entry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	switch e.Type {
+	case entryFooter:
+		rd.footer = &e
+		if e.Checksum != hex.EncodeToString(rd.sum.Sum(nil)) {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+		}
+		if e.Links != rd.stats.Links || e.Workspaces != rd.stats.Workspaces {
+			return nil, fmt.Errorf("%w: record count mismatch", ErrCorrupted)
+		}
+		return nil, nil
+	case entryWorkspace:
+		if e.Workspace == nil {
+			return nil, fmt.Errorf("%w: empty workspace entry", ErrCorrupted)
+		}
+		rd.stats.Workspaces++
+	case entryLink:
+		if e.Link == nil {
+			return nil, fmt.Errorf("%w: empty link entry", ErrCorrupted)
+		}
+		rd.stats.Links++
+	case entryHeader:
+	default:
+		return nil, fmt.Errorf("%w: unknown entry %q", ErrCorrupted, e.Type)
+	}
+
+	rd.sum.Write(line)
+	rd.sum.Write([]byte{'\n'})
+	return &e, nil
+}
+
+// Verify проверяет заголовок, контрольную сумму и число записей архива.
+func Verify(r io.Reader) (Stats, error) {
+	rd, err := newReader(r)
+	if err != nil {
+		return Stats{}, err
+	}
+	for {
+		e, err := rd.next()
+		if err != nil {
+			return rd.stats, err
+		}
+		if e == nil {
+			return rd.stats, nil
+		}
+	}
+}
+
+// Restore загружает архив в db. Сначала архив целиком проверяется,
+// а при PolicyFail — ещё и на конфликты с содержимым db, и только
+// потом загружается, так что повреждённый архив или конфликт
+// не оставляют хранилище загруженным наполовину.
+func Restore(r io.ReadSeeker, db databases.Database, policy Policy) (Stats, error) {
+	if err := precheck(r, db, policy); err != nil {
+		return Stats{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Stats{}, err
+	}
+
+	rd, err := newReader(r)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	overwrite := policy == PolicyOverwrite
+	batch := make([]databases.Record, 0, batchSize)
+	load := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		conflicts, err := db.Load(batch, overwrite)
+		if err != nil {
+			return err
+		}
+		if len(conflicts) > 0 && policy == PolicyFail {
+			return fmt.Errorf("link %s: %w", conflicts[0], databases.ErrConflict)
+		}
+		if overwrite {
+			stats.Links += len(batch)
+			stats.Overwritten += len(conflicts)
+		} else {
+			stats.Links += len(batch) - len(conflicts)
+			stats.Skipped += len(conflicts)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		e, err := rd.next()
+		if err != nil {
+			return stats, err
+		}
+		if e == nil {
+			break
+		}
+
+		switch e.Type {
+		case entryWorkspace:
+			err := db.LoadWorkspace(*e.Workspace, overwrite)
+			if errors.Is(err, databases.ErrConflict) && policy == PolicySkip {
+				stats.Skipped++
+				continue
+			}
+			if err != nil {
+				return stats, fmt.Errorf("workspace %s: %w", e.Workspace.Workspace.ID, err)
+			}
+			stats.Workspaces++
+		case entryLink:
+			batch = append(batch, *e.Link)
+			if len(batch) == batchSize {
+				if err := load(); err != nil {
+					return stats, err
+				}
+			}
+		}
+	}
+
+	return stats, load()
+}
+
+// precheck проверяет архив, а при PolicyFail — что ни одного
+// пространства и ни одной ссылки из архива ещё нет в db.
+func precheck(r io.Reader, db databases.Database, policy Policy) error {
+	rd, err := newReader(r)
+	if err != nil {
+		return err
+	}
+	var workspaces map[string]bool
+	if policy == PolicyFail {
+		workspaces = make(map[string]bool)
+		err := db.DumpWorkspaces(func(rec databases.WorkspaceRecord) error {
+			workspaces[rec.Workspace.ID] = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		e, err := rd.next()
+		if err != nil || e == nil {
+			return err
+		}
+		if policy != PolicyFail {
+			continue
+		}
+		if e.Type == entryWorkspace {
+			if id := e.Workspace.Workspace.ID; workspaces[id] {
+				return fmt.Errorf("workspace %s: %w", id, databases.ErrConflict)
+			}
+			continue
+		}
+		if e.Type != entryLink {
+			continue
+		}
+		key := e.Link.URL.Hash
+		if _, err := db.Select(key); !errors.Is(err, databases.ErrNotFound) {
+			if err == nil || errors.Is(err, databases.ErrGone) {
+				return fmt.Errorf("link %s: %w", key, databases.ErrConflict)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteAndRestore(t *testing.T) {
+	src, err := databases.NewFileDatabase(filepath.Join(t.TempDir(), "urls.json"))
+	require.NoError(t, err)
+
+	require.NoError(t, src.CreateWorkspace(databases.Workspace{ID: "team", Name: "Team"}, "alice"))
+	require.NoError(t, src.Create(databases.URL{Hash: "a", Original: "http://a.example", UserID: "alice", Tags: []string{"x"}}))
+	require.NoError(t, src.Create(databases.URL{Hash: "b", Original: "http://b.example", UserID: "bob", MaxClicks: 5}))
+	_, err = src.Visit("b")
+	require.NoError(t, err)
+	_, err = src.Update("a", "alice", func(u *databases.URL) error {
+		u.Original = "http://a2.example"
+		return nil
+	})
+	require.NoError(t, err)
+	_, err = src.Transfer("team", "alice", "", []string{"a"})
+	require.NoError(t, err)
+	require.NoError(t, src.Delete("b", "bob"))
+
+	var archive bytes.Buffer
+	stats, err := Write(&archive, src)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Links: 2, Workspaces: 1}, stats)
+
+	stats, err = Verify(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Links)
+
+	dst := databases.NewMapDatabase()
+	stats, err = Restore(bytes.NewReader(archive.Bytes()), dst, PolicyFail)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Links: 2, Workspaces: 1}, stats)
+
+	a, err := dst.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, "http://a2.example", a.Original)
+	assert.Equal(t, "team", a.WorkspaceID)
+	assert.Equal(t, []string{"x"}, a.Tags)
+	revisions, err := dst.Revisions("a", "alice")
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	assert.Equal(t, "http://a.example", revisions[0].Original)
+
+	_, err = dst.Select("b")
+	assert.ErrorIs(t, err, databases.ErrGone)
+	b, err := dst.Restore("b", "bob", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, b.Clicks)
+
+	_, err = Restore(bytes.NewReader(archive.Bytes()), dst, PolicyFail)
+	assert.ErrorIs(t, err, databases.ErrConflict)
+
+	stats, err = Restore(bytes.NewReader(archive.Bytes()), dst, PolicySkip)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Skipped: 3}, stats)
+
+	stats, err = Restore(bytes.NewReader(archive.Bytes()), dst, PolicyOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Links: 2, Workspaces: 1, Overwritten: 2}, stats)
+	_, err = dst.Select("b")
+	assert.ErrorIs(t, err, databases.ErrGone)
+}
+
+// TestRestoreWorkspaceConflict проверяет, что при PolicyFail конфликт
+// пространства находится до загрузки и хранилище остаётся нетронутым.
+func TestRestoreWorkspaceConflict(t *testing.T) {
+	src := databases.NewMapDatabase()
+	require.NoError(t, src.CreateWorkspace(databases.Workspace{ID: "ops", Name: "Ops"}, "alice"))
+	require.NoError(t, src.CreateWorkspace(databases.Workspace{ID: "team", Name: "Team"}, "alice"))
+	require.NoError(t, src.Create(databases.URL{Hash: "a", Original: "http://a.example", UserID: "alice"}))
+	var archive bytes.Buffer
+	_, err := Write(&archive, src)
+	require.NoError(t, err)
+
+	dst := databases.NewMapDatabase()
+	require.NoError(t, dst.CreateWorkspace(databases.Workspace{ID: "team", Name: "Other"}, "carol"))
+	_, err = Restore(bytes.NewReader(archive.Bytes()), dst, PolicyFail)
+	assert.ErrorIs(t, err, databases.ErrConflict)
+
+	workspaces, err := dst.Workspaces("alice")
+	require.NoError(t, err)
+	assert.Empty(t, workspaces)
+	_, err = dst.Select("a")
+	assert.ErrorIs(t, err, databases.ErrNotFound)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	src := databases.NewMapDatabase()
+	require.NoError(t, src.Create(databases.URL{Hash: "a", Original: "http://a.example", UserID: "alice"}))
+
+	var archive bytes.Buffer
+	_, err := Write(&archive, src)
+	require.NoError(t, err)
+
+	// Подменяем ссылку в распакованном архиве и сжимаем его заново.
+	gr, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	data, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	var tampered bytes.Buffer
+	gw := gzip.NewWriter(&tampered)
+	_, err = gw.Write(bytes.Replace(data, []byte("http://a.example"), []byte("http://evil.example"), 1))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	_, err = Verify(bytes.NewReader(tampered.Bytes()))
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	_, err = Restore(bytes.NewReader(tampered.Bytes()), databases.NewMapDatabase(), PolicySkip)
+	assert.ErrorIs(t, err, ErrCorrupted)
+
+	_, err = Verify(bytes.NewReader(archive.Bytes()[:archive.Len()/2]))
+	assert.ErrorIs(t, err, ErrCorrupted)
+}
@@ -0,0 +1,756 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+var (
+	// bucketURLs — ключ ссылки → ссылка.
+	bucketURLs = []byte("urls")
+	// bucketUserURLs и bucketWorkspaceURLs — индексы владелец\x00ключ → пусто.
+	bucketUserURLs      = []byte("user_urls")
+	bucketWorkspaceURLs = []byte("workspace_urls")
+	// bucketRevisions — ключ ссылки → история её ревизий.
+	bucketRevisions  = []byte("revisions")
+	bucketWorkspaces = []byte("workspaces")
+	// bucketMembers — пространство → роли участников.
+	bucketMembers = []byte("members")
+
+	boltBuckets = [][]byte{bucketURLs, bucketUserURLs, bucketWorkspaceURLs, bucketRevisions, bucketWorkspaces, bucketMembers}
+)
+
+// boltDumpPage — сколько ссылок Dump читает одной транзакцией.
+const boltDumpPage = 500
+
+// BoltDatabase хранит ссылки во встроенном B+-дереве bbolt. Каждая
+// запись — отдельная транзакция со сбросом на диск, поэтому после
+// падения процесса база открывается в состоянии последней завершённой
+// транзакции.
+type BoltDatabase struct {
+	db *bolt.DB
+}
+
+func NewBoltDatabase(path string) (*BoltDatabase, error) {
+	if path == "" {
+		return nil, errors.New(`bolt: database path is required`)
+	}
+	// Файл занят другим процессом — ошибка вместо бесконечного ожидания.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDatabase{db: db}, nil
+}
+
+// indexKey — ключ индекса владельца owner для ссылки key.
+func indexKey(owner, key string) []byte {
+	return []byte(owner + "\x00" + key)
+}
+
+func boltGet(tx *bolt.Tx, key string) (URL, error) {
+	data := tx.Bucket(bucketURLs).Get([]byte(key))
+	if data == nil {
+		return URL{}, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	var u URL
+	err := json.Unmarshal(data, &u)
+	return u, err
+}
+
+// boltPut сохраняет ссылку u, заменившую prev, и переносит её в индексах.
+func boltPut(tx *bolt.Tx, prev *URL, u URL) error {
+	if prev != nil {
+		if err := boltUnindex(tx, *prev); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketURLs).Put([]byte(u.Hash), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketUserURLs).Put(indexKey(u.UserID, u.Hash), nil); err != nil {
+		return err
+	}
+	if u.WorkspaceID != "" {
+		return tx.Bucket(bucketWorkspaceURLs).Put(indexKey(u.WorkspaceID, u.Hash), nil)
+	}
+	return nil
+}
+
+func boltUnindex(tx *bolt.Tx, u URL) error {
+	if err := tx.Bucket(bucketUserURLs).Delete(indexKey(u.UserID, u.Hash)); err != nil {
+		return err
+	}
+	if u.WorkspaceID != "" {
+		return tx.Bucket(bucketWorkspaceURLs).Delete(indexKey(u.WorkspaceID, u.Hash))
+	}
+	return nil
+}
+
+// boltRemove окончательно удаляет ссылку вместе с историей.
+func boltRemove(tx *bolt.Tx, u URL) error {
+	if err := boltUnindex(tx, u); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketRevisions).Delete([]byte(u.Hash)); err != nil {
+		return err
+	}
+	return tx.Bucket(bucketURLs).Delete([]byte(u.Hash))
+}
+
+// boltOwned возвращает ссылки из индекса bucket с владельцем owner.
+func boltOwned(tx *bolt.Tx, bucket []byte, owner string) ([]URL, error) {
+	var data []URL
+	prefix := indexKey(owner, "")
+	c := tx.Bucket(bucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		u, err := boltGet(tx, string(k[len(prefix):]))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	return data, nil
+}
+
+func boltRevisions(tx *bolt.Tx, key string) ([]Revision, error) {
+	data := tx.Bucket(bucketRevisions).Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	var revisions []Revision
+	err := json.Unmarshal(data, &revisions)
+	return revisions, err
+}
+
+func boltPutRevisions(tx *bolt.Tx, key string, revisions []Revision) error {
+	if len(revisions) == 0 {
+		return tx.Bucket(bucketRevisions).Delete([]byte(key))
+	}
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketRevisions).Put([]byte(key), data)
+}
+
+// boltMembers возвращает роли участников пространства.
+func boltMembers(tx *bolt.Tx, workspaceID string) (map[string]string, error) {
+	members := make(map[string]string)
+	data := tx.Bucket(bucketMembers).Get([]byte(workspaceID))
+	if data == nil {
+		return members, nil
+	}
+	err := json.Unmarshal(data, &members)
+	return members, err
+}
+
+func boltPutMembers(tx *bolt.Tx, workspaceID string, members map[string]string) error {
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketMembers).Put([]byte(workspaceID), data)
+}
+
+func boltPutWorkspace(tx *bolt.Tx, w Workspace) error {
+	w.Role = ""
+	data, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketWorkspaces).Put([]byte(w.ID), data)
+}
+
+// boltAccess ищет ссылку, на которую у userID есть права не ниже need.
+func boltAccess(tx *bolt.Tx, key, userID, need string) (URL, error) {
+	u, err := boltGet(tx, key)
+	if err != nil {
+		return URL{}, err
+	}
+	members, err := boltMembers(tx, u.WorkspaceID)
+	if err != nil {
+		return URL{}, err
+	}
+	err = checkAccess(u, userID, members[userID], need)
+	if errors.Is(err, ErrNotFound) {
+		return URL{}, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	return u, err
+}
+
+// boltCreate добавляет новую ссылку.
+func boltCreate(tx *bolt.Tx, u URL) error {
+	if tx.Bucket(bucketURLs).Get([]byte(u.Hash)) != nil {
+		return ErrConflict
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now().UTC()
+	}
+	return boltPut(tx, nil, u)
+}
+
+func (b *BoltDatabase) Close() {
+	b.db.Close()
+}
+
+func (b *BoltDatabase) Ping() error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketURLs) == nil {
+			return errors.New(`bolt: urls bucket is missing`)
+		}
+		return nil
+	})
+}
+
+func (b *BoltDatabase) Create(u URL) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltCreate(tx, u)
+	})
+}
+
+// CreateMany сохраняет пакет одной транзакцией: при конфликте хотя бы
+// одного ключа не сохраняется ни одна ссылка.
+func (b *BoltDatabase) CreateMany(urls []URL) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, u := range urls {
+			if err := boltCreate(tx, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDatabase) Flush() error {
+	return nil
+}
+
+func (b *BoltDatabase) Select(key string) (u URL, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		u, err = boltGet(tx, key)
+		return err
+	})
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Deleted() {
+		return URL{}, ErrGone
+	}
+	return u, nil
+}
+
+func (b *BoltDatabase) SelectMany(keys []string) (data []URL, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			u, err := boltGet(tx, key)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			data = append(data, u)
+		}
+		return nil
+	})
+	return data, err
+}
+
+// Totals обходит ссылки в одной транзакции чтения и разбирает у каждой
+// только владельца и отметку об удалении.
+func (b *BoltDatabase) Totals() (t Totals, err error) {
+	users := make(map[string]bool)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketURLs).ForEach(func(_, data []byte) error {
+			var u struct {
+				UserID    string     `json:"user_id"`
+				DeletedAt *time.Time `json:"deleted_at"`
+			}
+			if err := json.Unmarshal(data, &u); err != nil {
+				return err
+			}
+			if u.DeletedAt == nil {
+				t.URLs++
+				users[u.UserID] = true
+			}
+			return nil
+		})
+	})
+	t.Users = len(users)
+	return t, err
+}
+
+func (b *BoltDatabase) Visit(key string) (u URL, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		prev, err := boltGet(tx, key)
+		if err != nil {
+			return err
+		}
+		u = prev
+		if err := checkVisit(u, time.Now()); err != nil {
+			return err
+		}
+		u.Clicks++
+		return boltPut(tx, &prev, u)
+	})
+	if err != nil && !errors.Is(err, ErrNotActive) {
+		return URL{}, err
+	}
+	return u, err
+}
+
+func (b *BoltDatabase) AddClicks(clicks map[string]int) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for key, n := range clicks {
+			prev, err := boltGet(tx, key)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			u := prev
+			u.Clicks += n
+			if err := boltPut(tx, &prev, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltDatabase) SelectAll(userID string) ([]URL, error) {
+	var data []URL
+	err := b.db.View(func(tx *bolt.Tx) error {
+		rows, err := boltOwned(tx, bucketUserURLs, userID)
+		for _, u := range rows {
+			if u.Personal(userID) {
+				data = append(data, u)
+			}
+		}
+		return err
+	})
+	return data, err
+}
+
+// snapshot читает ссылки, среди которых ищется выборка q: из индекса
+// пространства или личного индекса пользователя.
+func (b *BoltDatabase) snapshot(q Query) (rows []URL, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if q.WorkspaceID == "" {
+			rows, err = boltOwned(tx, bucketUserURLs, q.UserID)
+			return err
+		}
+		members, err := boltMembers(tx, q.WorkspaceID)
+		if err != nil {
+			return err
+		}
+		if err := checkRole(members[q.UserID], RoleViewer); err != nil {
+			return err
+		}
+		rows, err = boltOwned(tx, bucketWorkspaceURLs, q.WorkspaceID)
+		return err
+	})
+	return rows, err
+}
+
+func (b *BoltDatabase) List(q Query) (Page, error) {
+	rows, err := b.snapshot(q)
+	if err != nil {
+		return Page{}, err
+	}
+	return applyQuery(rows, q)
+}
+
+func (b *BoltDatabase) Iterate(q Query, fn func(URL) error) error {
+	rows, err := b.snapshot(q)
+	if err != nil {
+		return err
+	}
+	q.Limit, q.Cursor = 0, ""
+	page, err := applyQuery(rows, q)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range page.URLs {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltDatabase) Update(key, userID string, edit func(*URL) error) (u URL, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		prev, err := boltAccess(tx, key, userID, RoleEditor)
+		if err != nil {
+			return err
+		}
+		if prev.Deleted() {
+			return ErrGone
+		}
+		u = prev
+		if err := edit(&u); err != nil {
+			return err
+		}
+
+		revisions, err := boltRevisions(tx, key)
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, prev.Revision(len(revisions)+1, time.Now()))
+		if err := boltPutRevisions(tx, key, revisions); err != nil {
+			return err
+		}
+		return boltPut(tx, &prev, u)
+	})
+	if err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (b *BoltDatabase) Revisions(key, userID string) (revisions []Revision, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if _, err := boltAccess(tx, key, userID, RoleViewer); err != nil {
+			return err
+		}
+		revisions, err = boltRevisions(tx, key)
+		return err
+	})
+	return revisions, err
+}
+
+func (b *BoltDatabase) Restore(key, userID string, since time.Time) (u URL, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		prev, err := boltAccess(tx, key, userID, RoleEditor)
+		if err != nil {
+			return err
+		}
+		if prev.Purgeable(since) {
+			return ErrGone
+		}
+		u = prev
+		u.DeletedAt = nil
+		return boltPut(tx, &prev, u)
+	})
+	if err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (b *BoltDatabase) Purge(userID string, before time.Time) (purged int, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		var rows []URL
+		err := tx.Bucket(bucketURLs).ForEach(func(_, data []byte) error {
+			var u URL
+			if err := json.Unmarshal(data, &u); err != nil {
+				return err
+			}
+			if u.Purgeable(before) && (userID == "" || u.Personal(userID)) {
+				rows = append(rows, u)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Удалять ключи во время ForEach нельзя, поэтому отдельным проходом.
+		for _, u := range rows {
+			if err := boltRemove(tx, u); err != nil {
+				return err
+			}
+		}
+		purged = len(rows)
+		return nil
+	})
+	return purged, err
+}
+
+// Delete помечает ссылку удалённой. Недоступные и уже удалённые ссылки
+// пропускаются молча, как и в PostgresqlDatabase.
+func (b *BoltDatabase) Delete(key, userID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		prev, err := boltAccess(tx, key, userID, RoleEditor)
+		if err != nil || prev.Deleted() {
+			return nil
+		}
+		u := prev
+		now := time.Now()
+		u.DeletedAt = &now
+		return boltPut(tx, &prev, u)
+	})
+}
+
+func (b *BoltDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketWorkspaces).Get([]byte(w.ID)) != nil {
+			return ErrConflict
+		}
+		if err := boltPutWorkspace(tx, w); err != nil {
+			return err
+		}
+		return boltPutMembers(tx, w.ID, map[string]string{ownerID: RoleOwner})
+	})
+}
+
+func (b *BoltDatabase) Workspaces(userID string) ([]Workspace, error) {
+	var data []Workspace
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMembers).ForEach(func(id, _ []byte) error {
+			members, err := boltMembers(tx, string(id))
+			if err != nil {
+				return err
+			}
+			role, ok := members[userID]
+			if !ok {
+				return nil
+			}
+			var w Workspace
+			if err := json.Unmarshal(tx.Bucket(bucketWorkspaces).Get(id), &w); err != nil {
+				return err
+			}
+			w.Role = role
+			data = append(data, w)
+			return nil
+		})
+	})
+	sort.Slice(data, func(i, j int) bool { return data[i].CreatedAt.Before(data[j].CreatedAt) })
+	return data, err
+}
+
+func (b *BoltDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	var data []Member
+	err := b.db.View(func(tx *bolt.Tx) error {
+		members, err := boltMembers(tx, workspaceID)
+		if err != nil {
+			return err
+		}
+		if err := checkRole(members[userID], RoleViewer); err != nil {
+			return err
+		}
+		for member, role := range members {
+			data = append(data, Member{WorkspaceID: workspaceID, UserID: member, Role: role})
+		}
+		return nil
+	})
+	sort.Slice(data, func(i, j int) bool { return data[i].UserID < data[j].UserID })
+	return data, err
+}
+
+func (b *BoltDatabase) SetMember(actorID string, m Member) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		members, err := boltMembers(tx, m.WorkspaceID)
+		if err != nil {
+			return err
+		}
+		if err := checkMemberChange(members, actorID, m); err != nil {
+			return err
+		}
+
+		if m.Role == "" {
+			delete(members, m.UserID)
+		} else {
+			members[m.UserID] = m.Role
+		}
+		return boltPutMembers(tx, m.WorkspaceID, members)
+	})
+}
+
+func (b *BoltDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (transferred int, err error) {
+	if fromID == "" {
+		fromID = userID
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		members, err := boltMembers(tx, workspaceID)
+		if err != nil {
+			return err
+		}
+		if err := checkTransfer(userID, fromID, members[userID], members[fromID]); err != nil {
+			return err
+		}
+
+		var rows []URL
+		if len(keys) == 0 {
+			owned, err := boltOwned(tx, bucketUserURLs, fromID)
+			if err != nil {
+				return err
+			}
+			for _, u := range owned {
+				if u.Personal(fromID) {
+					rows = append(rows, u)
+				}
+			}
+		}
+		for _, key := range uniqueKeys(keys) {
+			u, err := boltAccess(tx, key, fromID, RoleEditor)
+			if err != nil {
+				return err
+			}
+			if err := checkTransferURL(u, userID, fromID); err != nil {
+				return err
+			}
+			rows = append(rows, u)
+		}
+
+		for _, prev := range rows {
+			u := prev
+			u.WorkspaceID = workspaceID
+			if err := boltPut(tx, &prev, u); err != nil {
+				return err
+			}
+		}
+		transferred = len(rows)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return transferred, nil
+}
+
+// Dump читает ссылки страницами и вызывает fn вне транзакции: долгая
+// читающая транзакция не даёт bbolt расширять файл при записи.
+func (b *BoltDatabase) Dump(after string, fn func(Record) error) error {
+	for {
+		var page []Record
+		err := b.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(bucketURLs).Cursor()
+			k, data := c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, data = c.Next()
+			}
+			for ; k != nil && len(page) < boltDumpPage; k, data = c.Next() {
+				var rec Record
+				if err := json.Unmarshal(data, &rec.URL); err != nil {
+					return err
+				}
+				revisions, err := boltRevisions(tx, rec.URL.Hash)
+				if err != nil {
+					return err
+				}
+				rec.Revisions = revisions
+				page = append(page, rec)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, rec := range page {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if len(page) < boltDumpPage {
+			return nil
+		}
+		after = page[len(page)-1].URL.Hash
+	}
+}
+
+// Load сохраняет пакет одной транзакцией.
+func (b *BoltDatabase) Load(recs []Record, overwrite bool) (conflicts []string, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		conflicts = nil
+		for _, rec := range recs {
+			key := rec.URL.Hash
+			var prev *URL
+			if u, err := boltGet(tx, key); err == nil {
+				conflicts = append(conflicts, key)
+				if !overwrite {
+					continue
+				}
+				prev = &u
+			} else if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+
+			if err := boltPut(tx, prev, rec.URL); err != nil {
+				return err
+			}
+			if err := boltPutRevisions(tx, key, rec.Revisions); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+func (b *BoltDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	var data []WorkspaceRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketWorkspaces).ForEach(func(id, value []byte) error {
+			var rec WorkspaceRecord
+			if err := json.Unmarshal(value, &rec.Workspace); err != nil {
+				return err
+			}
+			members, err := boltMembers(tx, string(id))
+			if err != nil {
+				return err
+			}
+			for userID, role := range members {
+				rec.Members = append(rec.Members, Member{WorkspaceID: rec.Workspace.ID, UserID: userID, Role: role})
+			}
+			sort.Slice(rec.Members, func(i, j int) bool { return rec.Members[i].UserID < rec.Members[j].UserID })
+			data = append(data, rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range data {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		id := rec.Workspace.ID
+		if tx.Bucket(bucketWorkspaces).Get([]byte(id)) != nil && !overwrite {
+			return ErrConflict
+		}
+		if err := boltPutWorkspace(tx, rec.Workspace); err != nil {
+			return err
+		}
+		members := make(map[string]string, len(rec.Members))
+		for _, m := range rec.Members {
+			members[m.UserID] = m.Role
+		}
+		return boltPutMembers(tx, id, members)
+	})
+}
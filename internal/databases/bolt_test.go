@@ -0,0 +1,115 @@
+package databases
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBolt(t *testing.T) (*BoltDatabase, string) {
+	path := filepath.Join(t.TempDir(), "urls.bolt")
+	db, err := NewBoltDatabase(path)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return db, path
+}
+
+func TestBoltDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		db, _ := newTestBolt(t)
+		return db
+	})
+}
+
+// TestBoltDatabaseCrashRecovery снимает копию файла у открытой базы,
+// как если бы процесс упал, не закрыв её, и открывает копию.
+func TestBoltDatabaseCrashRecovery(t *testing.T) {
+	db, path := newTestBolt(t)
+	require.NoError(t, db.Create(URL{Hash: "kept", Original: "http://kept.example", UserID: "user"}))
+	_, err := db.Update("kept", "user", func(u *URL) error {
+		u.Title = "edited"
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.CreateMany([]URL{{Hash: "batched", Original: "http://batched.example", UserID: "user"}}))
+
+	// Второй процесс не может открыть занятый файл.
+	_, err = NewBoltDatabase(path)
+	assert.Error(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	crashed := filepath.Join(t.TempDir(), "crashed.bolt")
+	require.NoError(t, os.WriteFile(crashed, data, 0o600))
+
+	recovered, err := NewBoltDatabase(crashed)
+	require.NoError(t, err)
+	defer recovered.Close()
+
+	u, err := recovered.Select("kept")
+	require.NoError(t, err)
+	assert.Equal(t, "edited", u.Title)
+	revisions, err := recovered.Revisions("kept", "user")
+	require.NoError(t, err)
+	assert.Len(t, revisions, 1)
+	_, err = recovered.Select("batched")
+	assert.NoError(t, err)
+
+	all, err := recovered.SelectAll("user")
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+}
+
+func TestBoltDatabaseWorkspacesAndPurge(t *testing.T) {
+	db, path := newTestBolt(t)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "alice"}))
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "alice"}))
+	require.NoError(t, db.CreateWorkspace(Workspace{ID: "team", Name: "Team"}, "alice"))
+	assert.ErrorIs(t, db.CreateWorkspace(Workspace{ID: "team"}, "bob"), ErrConflict)
+	require.NoError(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "bob", Role: RoleViewer}))
+
+	_, err := db.Transfer("team", "bob", "", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	transferred, err := db.Transfer("team", "alice", "", []string{"a"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, transferred)
+
+	// Индексы переносятся вместе со ссылкой.
+	page, err := db.List(Query{UserID: "bob", WorkspaceID: "team"})
+	require.NoError(t, err)
+	require.Len(t, page.URLs, 1)
+	assert.Equal(t, "a", page.URLs[0].Hash)
+	personal, err := db.SelectAll("alice")
+	require.NoError(t, err)
+	require.Len(t, personal, 1)
+	assert.Equal(t, "b", personal[0].Hash)
+
+	require.NoError(t, db.Delete("a", "bob"))
+	_, err = db.Select("a")
+	require.NoError(t, err)
+	require.NoError(t, db.Delete("b", "alice"))
+	purged, err := db.Purge("alice", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	db.Close()
+	reopened, err := NewBoltDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	_, err = reopened.Select("b")
+	assert.ErrorIs(t, err, ErrNotFound)
+	workspaces, err := reopened.Workspaces("bob")
+	require.NoError(t, err)
+	require.Len(t, workspaces, 1)
+	assert.Equal(t, RoleViewer, workspaces[0].Role)
+
+	var keys []string
+	require.NoError(t, reopened.Dump("", func(rec Record) error {
+		keys = append(keys, rec.URL.Hash)
+		return nil
+	}))
+	assert.Equal(t, []string{"a"}, keys)
+}
@@ -0,0 +1,396 @@
+package databases
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CachedDatabase держит в памяти последние прочитанные через Select
+// ссылки, а также промахи: ключи, которых нет или которые удалены.
+// Размер кеша ограничен, самые давно прочитанные записи вытесняются.
+// Одновременные промахи по одному ключу сводятся к одному чтению из
+// основного хранилища. Изменения идут в основное хранилище, а кеш
+// после них обновляется или сбрасывается.
+//
+// Переходы по действующим ссылкам без лимита, которые есть в кеше,
+// засчитываются в памяти и уходят в основное хранилище пакетом (см.
+// clickBuffer), а также при Flush и перед выборками, где видны
+// счётчики.
+type CachedDatabase struct {
+	Database
+
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	// order — записи от недавно прочитанных к давно прочитанным.
+	order *list.List
+	calls map[string]*cacheCall
+	// writes — идущие записи по ключам, см. beginWrite.
+	writes map[string]*cacheWrite
+	clicks *clickBuffer
+	stats  CacheStats
+}
+
+// CacheStats — число чтений, отданных кешем, и чтений, за которыми
+// пришлось идти в основное хранилище.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type cacheEntry struct {
+	key     string
+	u       URL
+	err     error
+	expires time.Time
+}
+
+// cacheCall — чтение ключа из основного хранилища, которого ждут
+// одновременные промахи. stale означает, что ключ изменился, пока
+// чтение шло, и его результат нельзя класть в кеш.
+type cacheCall struct {
+	done  chan struct{}
+	u     URL
+	err   error
+	stale bool
+}
+
+// cacheWrite — записи ключа, которые идут в основном хранилище.
+// version растёт при каждом сбросе ключа: запись, во время которой
+// ключ сбросили, могла вернуть ссылку до изменения.
+type cacheWrite struct {
+	running int
+	version uint64
+}
+
+// NewCachedDatabase ставит перед primary кеш на size ссылок. Найденные
+// ссылки живут в кеше ttl, промахи — negativeTTL.
+func NewCachedDatabase(primary Database, size int, ttl, negativeTTL time.Duration) *CachedDatabase {
+	return &CachedDatabase{
+		Database:    primary,
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		items:       make(map[string]*list.Element),
+		order:       list.New(),
+		calls:       make(map[string]*cacheCall),
+		writes:      make(map[string]*cacheWrite),
+		clicks:      newClickBuffer(primary),
+	}
+}
+
+// Unwrap возвращает основное хранилище.
+func (c *CachedDatabase) Unwrap() Database { return c.Database }
+
+func (c *CachedDatabase) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// cacheable сообщает, что результат Select можно запомнить.
+func cacheable(err error) bool {
+	return err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrGone)
+}
+
+// lookup возвращает запись кеша, если она ещё не устарела.
+// Вызывается под c.mu.
+func (c *CachedDatabase) lookup(key string) (*cacheEntry, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e, true
+}
+
+// put запоминает результат Select и вытесняет лишние записи.
+// Вызывается под c.mu.
+func (c *CachedDatabase) put(key string, u URL, err error) {
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 || c.size <= 0 {
+		return
+	}
+	if err == nil {
+		// Основное хранилище ещё не знает об отложенных переходах.
+		u.Clicks += c.clicks.pending(key)
+	}
+	e := &cacheEntry{key: key, u: u, err: err, expires: c.now().Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+	} else {
+		c.items[key] = c.order.PushFront(e)
+	}
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate сбрасывает записи keys и не даёт идущим чтениям этих
+// ключей положить в кеш прочитанное до изменения.
+func (c *CachedDatabase) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.order.Remove(el)
+			delete(c.items, key)
+		}
+		if call, ok := c.calls[key]; ok {
+			call.stale = true
+		}
+		if w, ok := c.writes[key]; ok {
+			w.version++
+		}
+	}
+}
+
+// beginWrite отмечает начало записи ключа key и возвращает версию
+// ключа, которую нужно передать в endWrite.
+func (c *CachedDatabase) beginWrite(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w, ok := c.writes[key]
+	if !ok {
+		w = &cacheWrite{}
+		c.writes[key] = w
+	}
+	w.running++
+	return w.version
+}
+
+// endWrite завершает запись ключа key. Ссылку u, которую вернула
+// успешная запись, кладёт в кеш, только если ключ не сбрасывали
+// с beginWrite: иначе удаление, закончившееся раньше записи в кеш,
+// было бы потеряно.
+func (c *CachedDatabase) endWrite(key string, version uint64, u URL, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := c.writes[key]
+	w.running--
+	if w.running == 0 {
+		delete(c.writes, key)
+	}
+	if err != nil || w.version != version {
+		return
+	}
+	if call, ok := c.calls[key]; ok {
+		call.stale = true
+	}
+	c.put(key, u, nil)
+}
+
+// reset сбрасывает весь кеш.
+func (c *CachedDatabase) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	for _, call := range c.calls {
+		call.stale = true
+	}
+	for _, w := range c.writes {
+		w.version++
+	}
+}
+
+func (c *CachedDatabase) Select(key string) (URL, error) {
+	c.mu.Lock()
+	if e, ok := c.lookup(key); ok {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return e.u, e.err
+	}
+	c.stats.Misses++
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return call.u, call.err
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.u, call.err = c.Database.Select(key)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if !call.stale && cacheable(call.err) {
+		c.put(key, call.u, call.err)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.u, call.err
+}
+
+func (c *CachedDatabase) Create(u URL) error {
+	err := c.Database.Create(u)
+	// Ключ мог попасть в кеш промахом.
+	c.invalidate(u.Hash)
+	return err
+}
+
+func (c *CachedDatabase) CreateMany(urls []URL) error {
+	err := c.Database.CreateMany(urls)
+	keys := make([]string, len(urls))
+	for i, u := range urls {
+		keys[i] = u.Hash
+	}
+	// Ключи могли попасть в кеш промахами.
+	c.invalidate(keys...)
+	return err
+}
+
+func (c *CachedDatabase) Close() {
+	c.clicks.flushAndLog()
+	c.Database.Close()
+}
+
+// Flush сохраняет и отложенные записи основного хранилища, и переходы,
+// засчитанные кешем.
+func (c *CachedDatabase) Flush() error {
+	clicksErr := c.clicks.flush()
+	if err := c.Database.Flush(); err != nil {
+		return err
+	}
+	return clicksErr
+}
+
+// Visit засчитывает переход по действующей ссылке без лимита, которая
+// есть в кеше, не обращаясь к основному хранилищу. Переходы по ссылкам
+// с лимитом атомарно засчитывает основное хранилище.
+func (c *CachedDatabase) Visit(key string) (URL, error) {
+	c.mu.Lock()
+	if e, ok := c.lookup(key); ok && e.err == nil && e.u.MaxClicks == 0 && checkVisit(e.u, c.now()) == nil {
+		e.u.Clicks++
+		u := e.u
+		c.clicks.add(key)
+		c.mu.Unlock()
+		return u, nil
+	}
+	c.mu.Unlock()
+
+	version := c.beginWrite(key)
+	u, err := c.Database.Visit(key)
+	if err != nil {
+		c.invalidate(key)
+	}
+	c.endWrite(key, version, u, err)
+	return u, err
+}
+
+func (c *CachedDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	version := c.beginWrite(key)
+	u, err := c.Database.Update(key, userID, edit)
+	c.endWrite(key, version, u, err)
+	return u, err
+}
+
+func (c *CachedDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	version := c.beginWrite(key)
+	u, err := c.Database.Restore(key, userID, since)
+	c.endWrite(key, version, u, err)
+	return u, err
+}
+
+func (c *CachedDatabase) Purge(userID string, before time.Time) (int, error) {
+	purged, err := c.Database.Purge(userID, before)
+	// Какие ключи удалены, неизвестно, а промахи ErrGone по ним
+	// должны смениться на ErrNotFound.
+	if purged > 0 {
+		c.reset()
+	}
+	return purged, err
+}
+
+func (c *CachedDatabase) Delete(key, userID string) error {
+	err := c.Database.Delete(key, userID)
+	c.invalidate(key)
+	return err
+}
+
+func (c *CachedDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	transferred, err := c.Database.Transfer(workspaceID, userID, fromID, keys)
+	if len(keys) == 0 {
+		c.reset()
+	} else {
+		c.invalidate(keys...)
+	}
+	return transferred, err
+}
+
+func (c *CachedDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	conflicts, err := c.Database.Load(recs, overwrite)
+	keys := make([]string, len(recs))
+	for i, rec := range recs {
+		keys[i] = rec.URL.Hash
+	}
+	c.invalidate(keys...)
+	return conflicts, err
+}
+
+func (c *CachedDatabase) AddClicks(clicks map[string]int) error {
+	err := c.Database.AddClicks(clicks)
+	keys := make([]string, 0, len(clicks))
+	for key := range clicks {
+		keys = append(keys, key)
+	}
+	c.invalidate(keys...)
+	return err
+}
+
+// Выборки, где видны счётчики переходов, сначала отправляют отложенные
+// переходы в основное хранилище.
+
+func (c *CachedDatabase) SelectAll(userID string) ([]URL, error) {
+	if err := c.clicks.flush(); err != nil {
+		return nil, err
+	}
+	return c.Database.SelectAll(userID)
+}
+
+func (c *CachedDatabase) List(q Query) (Page, error) {
+	if err := c.clicks.flush(); err != nil {
+		return Page{}, err
+	}
+	return c.Database.List(q)
+}
+
+func (c *CachedDatabase) Iterate(q Query, fn func(URL) error) error {
+	if err := c.clicks.flush(); err != nil {
+		return err
+	}
+	return c.Database.Iterate(q, fn)
+}
+
+func (c *CachedDatabase) Dump(after string, fn func(Record) error) error {
+	if err := c.clicks.flush(); err != nil {
+		return err
+	}
+	return c.Database.Dump(after, fn)
+}
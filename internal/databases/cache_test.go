@@ -0,0 +1,261 @@
+package databases
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDatabase считает чтения Select и переходы Visit и, если
+// задан gate, не отдаёт прочитанное, пока gate не закроют. visited,
+// если задан, вызывается после перехода, до ответа кешу.
+type countingDatabase struct {
+	*MapDatabase
+	selects int32
+	visits  int32
+	gate    chan struct{}
+	visited func()
+}
+
+func (d *countingDatabase) Select(key string) (URL, error) {
+	atomic.AddInt32(&d.selects, 1)
+	u, err := d.MapDatabase.Select(key)
+	if d.gate != nil {
+		<-d.gate
+	}
+	return u, err
+}
+
+func (d *countingDatabase) Visit(key string) (URL, error) {
+	atomic.AddInt32(&d.visits, 1)
+	u, err := d.MapDatabase.Visit(key)
+	if d.visited != nil {
+		d.visited()
+	}
+	return u, err
+}
+
+func newTestCache(t *testing.T, size int) (*CachedDatabase, *countingDatabase, *time.Time) {
+	primary := &countingDatabase{MapDatabase: NewMapDatabase()}
+	db := NewCachedDatabase(primary, size, time.Minute, 10*time.Second)
+	now := time.Now()
+	db.now = func() time.Time { return now }
+	return db, primary, &now
+}
+
+func TestCachedDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		db, _, _ := newTestCache(t, 10)
+		return db
+	})
+}
+
+func TestCachedDatabaseLRUAndTTL(t *testing.T) {
+	db, primary, now := newTestCache(t, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Create(URL{Hash: key, Original: "http://" + key + ".example", UserID: "user"}))
+	}
+
+	for _, key := range []string{"a", "b", "a"} {
+		_, err := db.Select(key)
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, primary.selects)
+
+	// c вытесняет b, который читали давнее a.
+	_, err := db.Select("c")
+	require.NoError(t, err)
+	_, err = db.Select("a")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, primary.selects)
+	_, err = db.Select("b")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, primary.selects)
+
+	*now = now.Add(time.Minute)
+	_, err = db.Select("b")
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, primary.selects)
+}
+
+func TestCachedDatabaseNegative(t *testing.T) {
+	db, primary, now := newTestCache(t, 10)
+
+	for i := 0; i < 3; i++ {
+		_, err := db.Select("missing")
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	assert.EqualValues(t, 1, primary.selects)
+
+	// Промах живёт меньше найденной ссылки.
+	*now = now.Add(10 * time.Second)
+	_, err := db.Select("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.EqualValues(t, 2, primary.selects)
+
+	// Созданная ссылка сразу видна, несмотря на промах в кеше.
+	require.NoError(t, db.Create(URL{Hash: "missing", Original: "http://missing.example", UserID: "user"}))
+	_, err = db.Select("missing")
+	assert.NoError(t, err)
+
+	_, err = db.Select("batched")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, db.CreateMany([]URL{{Hash: "batched", Original: "http://batched.example", UserID: "user"}}))
+	_, err = db.Select("batched")
+	assert.NoError(t, err)
+}
+
+func TestCachedDatabaseInvalidation(t *testing.T) {
+	db, primary, _ := newTestCache(t, 10)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	_, err := db.Select("a")
+	require.NoError(t, err)
+
+	_, err = db.Update("a", "user", func(u *URL) error { u.Title = "edited"; return nil })
+	require.NoError(t, err)
+	u, err := db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, "edited", u.Title)
+
+	_, err = db.Visit("a")
+	require.NoError(t, err)
+	u, err = db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.Clicks)
+	assert.EqualValues(t, 1, primary.selects)
+
+	require.NoError(t, db.Delete("a", "user"))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+
+	_, err = db.Restore("a", "user", time.Time{})
+	require.NoError(t, err)
+	_, err = db.Select("a")
+	assert.NoError(t, err)
+
+	require.NoError(t, db.Delete("a", "user"))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+	purged, err := db.Purge("user", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCachedDatabaseCollapsesMisses(t *testing.T) {
+	db, primary, _ := newTestCache(t, 10)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	primary.gate = make(chan struct{})
+
+	const readers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Select("a")
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&primary.selects) == 1 }, time.Second, time.Millisecond)
+	// Даём остальным читателям встать в очередь за первым.
+	time.Sleep(20 * time.Millisecond)
+	close(primary.gate)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 1, primary.selects)
+}
+
+// TestCachedDatabaseStaleRead проверяет, что чтение, начатое до
+// удаления, не кладёт в кеш ссылку, которой уже нет.
+func TestCachedDatabaseStaleRead(t *testing.T) {
+	db, primary, _ := newTestCache(t, 10)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	primary.gate = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := db.Select("a")
+		assert.NoError(t, err)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&primary.selects) == 1 }, time.Second, time.Millisecond)
+	// Ссылка уже прочитана, но ещё не отдана кешу.
+	require.NoError(t, db.Delete("a", "user"))
+	close(primary.gate)
+	<-done
+
+	_, err := db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+func TestCachedDatabaseStaleVisit(t *testing.T) {
+	db, primary, _ := newTestCache(t, 10)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+
+	// Ссылку удалили сразу после перехода: его результат не должен
+	// вернуть её в кеш.
+	primary.visited = func() {
+		primary.visited = nil
+		require.NoError(t, db.Delete("a", "user"))
+	}
+	_, err := db.Visit("a")
+	require.NoError(t, err)
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+// TestCachedDatabaseVisitFromCache проверяет, что переход по ссылке
+// из кеша не обращается к основному хранилищу.
+func TestCachedDatabaseVisitFromCache(t *testing.T) {
+	db, primary, _ := newTestCache(t, 10)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "once", Original: "http://once.example", UserID: "user", MaxClicks: 1}))
+
+	// Переход, как в ResolveURL: Select, затем Visit.
+	for i := 1; i <= 3; i++ {
+		_, err := db.Select("a")
+		require.NoError(t, err)
+		u, err := db.Visit("a")
+		require.NoError(t, err)
+		assert.Equal(t, i, u.Clicks)
+	}
+	assert.EqualValues(t, 1, primary.selects)
+	assert.EqualValues(t, 0, primary.visits)
+	stored, err := primary.MapDatabase.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 0, stored.Clicks)
+
+	// Выборка со счётчиками сначала отправляет отложенные переходы.
+	page, err := db.List(Query{UserID: "user", Sort: SortClicks, Desc: true})
+	require.NoError(t, err)
+	require.Len(t, page.URLs, 2)
+	assert.Equal(t, "a", page.URLs[0].Hash)
+	assert.Equal(t, 3, page.URLs[0].Clicks)
+
+	_, err = db.Visit("a")
+	require.NoError(t, err)
+	require.NoError(t, db.Flush())
+	stored, err = primary.MapDatabase.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 4, stored.Clicks)
+	assert.EqualValues(t, 0, primary.visits)
+
+	// Переходы по ссылке с лимитом засчитывает основное хранилище.
+	_, err = db.Select("once")
+	require.NoError(t, err)
+	_, err = db.Visit("once")
+	require.NoError(t, err)
+	_, err = db.Visit("once")
+	assert.ErrorIs(t, err, ErrGone)
+	assert.EqualValues(t, 2, primary.visits)
+}
@@ -0,0 +1,98 @@
+package databases
+
+import (
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	// clickFlushDelay — сколько отложенные переходы ждут отправки
+	// в основное хранилище или записи в файл.
+	clickFlushDelay = time.Second
+	// maxPendingClicks — число ссылок с отложенными переходами у кеша
+	// или отложенных переходов у FileDatabase, при котором они
+	// отправляются, не дожидаясь clickFlushDelay.
+	maxPendingClicks = 1024
+)
+
+// clickBuffer копит переходы, которые кеш засчитал сам, и отправляет
+// их в хранилище одним AddClicks через clickFlushDelay, а если ссылок
+// с переходами набралось maxPendingClicks, — сразу, не задерживая
+// переход. Если процесс упадёт, переходы за последние clickFlushDelay
+// потеряются.
+type clickBuffer struct {
+	db     Database
+	mu     sync.Mutex
+	clicks map[string]int
+	timer  *time.Timer
+}
+
+func newClickBuffer(db Database) *clickBuffer {
+	return &clickBuffer{db: db, clicks: make(map[string]int)}
+}
+
+// add засчитывает переход по ссылке key и возвращает число ещё не
+// отправленных переходов по ней.
+func (b *clickBuffer) add(key string) int {
+	b.mu.Lock()
+	b.clicks[key]++
+	n := b.clicks[key]
+	full := b.schedule()
+	b.mu.Unlock()
+
+	if full {
+		go b.flushAndLog()
+	}
+	return n
+}
+
+// pending возвращает число ещё не отправленных переходов по ссылке key.
+func (b *clickBuffer) pending(key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.clicks[key]
+}
+
+// schedule заводит отправку и сообщает, что переходов накопилось
+// столько, что отправить их нужно сразу. Вызывается под b.mu.
+func (b *clickBuffer) schedule() bool {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(clickFlushDelay, b.flushAndLog)
+	}
+	return len(b.clicks) >= maxPendingClicks
+}
+
+// flush отправляет накопленные переходы. Не принятые хранилищем
+// переходы остаются до следующей отправки.
+func (b *clickBuffer) flush() error {
+	b.mu.Lock()
+	clicks := b.clicks
+	b.clicks = make(map[string]int)
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	err := b.db.AddClicks(clicks)
+	if err != nil {
+		b.mu.Lock()
+		for key, n := range clicks {
+			b.clicks[key] += n
+		}
+		b.schedule()
+		b.mu.Unlock()
+	}
+	return err
+}
+
+func (b *clickBuffer) flushAndLog() {
+	if err := b.flush(); err != nil {
+		zap.L().Warn("flush cached clicks failed", zap.Error(err))
+	}
+}
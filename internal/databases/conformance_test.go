@@ -0,0 +1,476 @@
+package databases
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConformance прогоняет проверки, которые обязано проходить любое
+// хранилище. open возвращает новое пустое хранилище на каждую проверку.
+func testConformance(t *testing.T, open func(t *testing.T) Database) {
+	checks := []struct {
+		name string
+		run  func(t *testing.T, db Database)
+	}{
+		{"CreateConflict", testCreateConflict},
+		{"Select", testSelect},
+		{"SelectMany", testSelectMany},
+		{"Totals", testTotals},
+		{"Gone", testGone},
+		{"VisitMaxClicks", testVisitMaxClicks},
+		{"AddClicks", testAddClicks},
+		{"CreateMany", testCreateMany},
+		{"CreateManyIsAtomic", testCreateManyIsAtomic},
+		{"ConcurrentCreateMany", testConcurrentCreateMany},
+		{"UserListing", testUserListing},
+		{"List", testList},
+		{"TransferFromMember", testTransferFromMember},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentDelete", testConcurrentDelete},
+	}
+	for _, check := range checks {
+		check := check
+		t.Run(check.name, func(t *testing.T) {
+			check.run(t, open(t))
+		})
+	}
+}
+
+func hashesOf(urls []URL) []string {
+	keys := make([]string, 0, len(urls))
+	for _, u := range urls {
+		keys = append(keys, u.Hash)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testCreateConflict(t *testing.T, db Database) {
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	assert.ErrorIs(t, db.Create(URL{Hash: "a", Original: "http://other.example", UserID: "other"}), ErrConflict)
+
+	// Конфликт не портит ссылку, которая уже есть.
+	u, err := db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, "http://a.example", u.Original)
+	assert.Equal(t, "user", u.UserID)
+
+	// Удалённая ссылка тоже занимает ключ.
+	require.NoError(t, db.Delete("a", "user"))
+	assert.ErrorIs(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}), ErrConflict)
+}
+
+func testSelect(t *testing.T, db Database) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	require.NoError(t, db.Create(URL{
+		Hash:        "full",
+		Original:    "http://full.example/path?q=1",
+		UserID:      "user",
+		MaxClicks:   5,
+		FallbackURL: "http://fallback.example",
+		ExpiresAt:   &expires,
+		Title:       "Title",
+		Folder:      "folder",
+		Tags:        []string{"a", "b"},
+	}))
+
+	u, err := db.Select("full")
+	require.NoError(t, err)
+	assert.Equal(t, "full", u.Hash)
+	assert.Equal(t, "http://full.example/path?q=1", u.Original)
+	assert.Equal(t, "user", u.UserID)
+	assert.Equal(t, 5, u.MaxClicks)
+	assert.Equal(t, "http://fallback.example", u.FallbackURL)
+	require.NotNil(t, u.ExpiresAt)
+	assert.True(t, expires.Equal(*u.ExpiresAt))
+	assert.Equal(t, "Title", u.Title)
+	assert.Equal(t, "folder", u.Folder)
+	assert.Equal(t, []string{"a", "b"}, u.Tags)
+	assert.False(t, u.Deleted())
+	assert.False(t, u.CreatedAt.IsZero())
+
+	_, err = db.Select("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testSelectMany(t *testing.T, db Database) {
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user", Tags: []string{"t"}}))
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "c", Original: "http://c.example", UserID: "user"}))
+	require.NoError(t, db.Delete("b", "user"))
+
+	urls, err := db.SelectMany([]string{"a", "b", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, hashesOf(urls))
+	for _, u := range urls {
+		assert.Equal(t, u.Hash == "b", u.Deleted())
+		if u.Hash == "a" {
+			assert.Equal(t, []string{"t"}, u.Tags)
+		}
+	}
+
+	urls, err = db.SelectMany(nil)
+	require.NoError(t, err)
+	assert.Empty(t, urls)
+}
+
+func testTotals(t *testing.T, db Database) {
+	totals, err := db.Totals()
+	require.NoError(t, err)
+	assert.Equal(t, Totals{}, totals)
+
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "c", Original: "http://c.example", UserID: "other"}))
+	require.NoError(t, db.Delete("c", "other"))
+
+	// Удалённые ссылки и пользователи, у которых остались только они,
+	// не считаются.
+	totals, err = db.Totals()
+	require.NoError(t, err)
+	assert.Equal(t, Totals{URLs: 2, Users: 1}, totals)
+}
+
+func testAddClicks(t *testing.T, db Database) {
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example/?q=1&r=/x", UserID: "user", Tags: []string{"t"}, ExpiresAt: &expires}))
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "user"}))
+	_, err := db.Visit("a")
+	require.NoError(t, err)
+
+	require.NoError(t, db.AddClicks(map[string]int{"a": 2, "b": 5, "missing": 1}))
+	require.NoError(t, db.AddClicks(nil))
+
+	a, err := db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, a.Clicks)
+	assert.Equal(t, "http://a.example/?q=1&r=/x", a.Original)
+	assert.Equal(t, []string{"t"}, a.Tags)
+	require.NotNil(t, a.ExpiresAt)
+	assert.WithinDuration(t, expires, *a.ExpiresAt, time.Millisecond)
+	b, err := db.Select("b")
+	require.NoError(t, err)
+	assert.Equal(t, 5, b.Clicks)
+	_, err = db.Select("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testGone(t *testing.T, db Database) {
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+
+	// Чужие и несуществующие ссылки Delete молча пропускает.
+	require.NoError(t, db.Delete("a", "stranger"))
+	require.NoError(t, db.Delete("missing", "user"))
+	_, err := db.Select("a")
+	require.NoError(t, err)
+
+	require.NoError(t, db.Delete("a", "user"))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+	_, err = db.Visit("a")
+	assert.ErrorIs(t, err, ErrGone)
+
+	// Повторное удаление ничего не меняет.
+	require.NoError(t, db.Delete("a", "user"))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+func testCreateMany(t *testing.T, db Database) {
+	var urls []URL
+	for i := 0; i < 3; i++ {
+		urls = append(urls, URL{Hash: fmt.Sprintf("b%d", i), Original: fmt.Sprintf("http://b%d.example", i), UserID: "user"})
+	}
+	require.NoError(t, db.CreateMany(urls))
+
+	all, err := db.SelectAll("user")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b0", "b1", "b2"}, hashesOf(all))
+
+	// Пустой пакет и Flush без отложенных записей проходят без ошибок.
+	require.NoError(t, db.CreateMany(nil))
+	require.NoError(t, db.Flush())
+}
+
+func testUserListing(t *testing.T, db Database) {
+	for _, u := range []URL{
+		{Hash: "a1", Original: "http://a1.example", UserID: "alice"},
+		{Hash: "a2", Original: "http://a2.example", UserID: "alice"},
+		{Hash: "a3", Original: "http://a3.example", UserID: "alice"},
+		{Hash: "b1", Original: "http://b1.example", UserID: "bob"},
+	} {
+		require.NoError(t, db.Create(u))
+	}
+
+	all, err := db.SelectAll("alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1", "a2", "a3"}, hashesOf(all))
+	for _, u := range all {
+		assert.Equal(t, "alice", u.UserID)
+	}
+
+	all, err = db.SelectAll("bob")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1"}, hashesOf(all))
+
+	all, err = db.SelectAll("nobody")
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func testConcurrentCreate(t *testing.T, db Database) {
+	const writers = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, conflicts := 0, 0
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			err := db.Create(URL{Hash: fmt.Sprintf("own%d", i), Original: "http://own.example", UserID: "user"})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			err := db.Create(URL{Hash: "shared", Original: fmt.Sprintf("http://shared%d.example", i), UserID: "user"})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, ErrConflict):
+				conflicts++
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, created)
+	assert.Equal(t, writers-1, conflicts)
+	all, err := db.SelectAll("user")
+	require.NoError(t, err)
+	assert.Len(t, all, writers+1)
+}
+
+func testConcurrentDelete(t *testing.T, db Database) {
+	const links = 20
+	for i := 0; i < links; i++ {
+		require.NoError(t, db.Create(URL{Hash: fmt.Sprintf("d%d", i), Original: "http://d.example", UserID: "user"}))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < links; i++ {
+		wg.Add(2)
+		go func(key string) {
+			defer wg.Done()
+			if err := db.Delete(key, "user"); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("d%d", i))
+		go func(key string) {
+			defer wg.Done()
+			_, err := db.Visit(key)
+			if err != nil && !errors.Is(err, ErrGone) {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("d%d", i))
+	}
+	wg.Wait()
+
+	for i := 0; i < links; i++ {
+		_, err := db.Select(fmt.Sprintf("d%d", i))
+		assert.ErrorIs(t, err, ErrGone)
+	}
+}
+
+func testVisitMaxClicks(t *testing.T, db Database) {
+	require.NoError(t, db.Create(URL{Hash: "once", Original: "http://ya.ru", UserID: "user", MaxClicks: 1}))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	visited, gone := 0, 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.Visit("once")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				visited++
+			case errors.Is(err, ErrGone):
+				gone++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, visited)
+	assert.Equal(t, 19, gone)
+
+	_, err := db.Visit("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func testList(t *testing.T, db Database) {
+	base := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, original := range []string{
+		"https://Example.com/a", "https://example.com/b", "https://other.org/c",
+		"https://sub.example.com/d", "https://example.com/e",
+	} {
+		require.NoError(t, db.Create(URL{
+			Hash:      fmt.Sprintf("k%d", i),
+			Original:  original,
+			UserID:    "user",
+			Clicks:    i % 3,
+			CreatedAt: base.Add(time.Duration(i) * time.Hour),
+		}))
+	}
+	require.NoError(t, db.Create(URL{Hash: "foreign", Original: "https://example.com/x", UserID: "other"}))
+	require.NoError(t, db.Delete("k4", "user"))
+
+	hashes := func(page Page) []string {
+		var keys []string
+		for _, u := range page.URLs {
+			keys = append(keys, u.Hash)
+		}
+		return keys
+	}
+
+	page, err := db.List(Query{UserID: "user", Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k0", "k1"}, hashes(page))
+	require.NotEmpty(t, page.NextCursor)
+
+	page, err = db.List(Query{UserID: "user", Limit: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k2", "k3"}, hashes(page))
+
+	page, err = db.List(Query{UserID: "user", Limit: 2, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k4"}, hashes(page))
+	assert.Empty(t, page.NextCursor)
+
+	page, err = db.List(Query{UserID: "user", Sort: SortClicks, Desc: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k2", "k4", "k1", "k3", "k0"}, hashes(page))
+
+	page, err = db.List(Query{UserID: "user", Domain: "EXAMPLE.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k0", "k1", "k4"}, hashes(page))
+
+	notDeleted := false
+	from, to := base.Add(time.Hour), base.Add(4*time.Hour)
+	page, err = db.List(Query{UserID: "user", Search: "example", Deleted: &notDeleted, CreatedFrom: &from, CreatedTo: &to})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k1", "k3"}, hashes(page))
+
+	page, err = db.List(Query{UserID: "user", Limit: 1})
+	require.NoError(t, err)
+	_, err = db.List(Query{UserID: "user", Limit: 1, Sort: SortClicks, Cursor: page.NextCursor})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func testCreateManyIsAtomic(t *testing.T, db Database) {
+	require.NoError(t, db.Create(URL{Hash: "taken", Original: "http://taken.example", UserID: "user"}))
+
+	fresh := URL{Hash: "fresh", Original: "http://fresh.example", UserID: "user", Tags: []string{"a"}}
+	assert.ErrorIs(t, db.CreateMany([]URL{fresh, {Hash: "taken", Original: "http://taken.example", UserID: "user"}}), ErrConflict)
+	assert.ErrorIs(t, db.CreateMany([]URL{fresh, fresh}), ErrConflict)
+
+	_, err := db.Select("fresh")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, db.CreateMany([]URL{fresh}))
+	u, err := db.Select("fresh")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, u.Tags)
+}
+
+// Пакеты одновременных запросов не смешиваются: отвергнутый пакет
+// одного не уносит ссылок другого.
+func testConcurrentCreateMany(t *testing.T, db Database) {
+	require.NoError(t, db.Create(URL{Hash: "taken", Original: "http://taken.example", UserID: "user"}))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			urls := []URL{
+				{Hash: fmt.Sprintf("c%d-a", i), Original: "http://c.example", UserID: "user"},
+				{Hash: fmt.Sprintf("c%d-b", i), Original: "http://c.example", UserID: "user"},
+			}
+			if i%2 == 1 {
+				urls = append(urls, URL{Hash: "taken", Original: "http://taken.example", UserID: "user"})
+			}
+			errs[i] = db.CreateMany(urls)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		_, selectErr := db.Select(fmt.Sprintf("c%d-a", i))
+		if i%2 == 1 {
+			assert.ErrorIs(t, err, ErrConflict)
+			assert.ErrorIs(t, selectErr, ErrNotFound)
+		} else {
+			assert.NoError(t, err)
+			assert.NoError(t, selectErr)
+		}
+	}
+}
+
+// Владелец пространства забирает в него ссылки другого участника.
+func testTransferFromMember(t *testing.T, db Database) {
+	require.NoError(t, db.CreateWorkspace(Workspace{ID: "team", Name: "Team"}, "alice"))
+	for _, m := range []Member{{UserID: "bob", Role: RoleViewer}, {UserID: "carol", Role: RoleEditor}} {
+		m.WorkspaceID = "team"
+		require.NoError(t, db.SetMember("alice", m))
+	}
+	for _, u := range []URL{
+		{Hash: "a1", Original: "http://a1.example", UserID: "alice"},
+		{Hash: "b1", Original: "http://b1.example", UserID: "bob"},
+		{Hash: "b2", Original: "http://b2.example", UserID: "bob"},
+		{Hash: "b3", Original: "http://b3.example", UserID: "bob"},
+		{Hash: "d1", Original: "http://d1.example", UserID: "dave"},
+	} {
+		require.NoError(t, db.Create(u))
+	}
+
+	// Чужие ссылки передаёт только владелец и только участника.
+	_, err := db.Transfer("team", "carol", "bob", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = db.Transfer("team", "alice", "dave", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = db.Transfer("team", "alice", "bob", []string{"a1"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	transferred, err := db.Transfer("team", "alice", "bob", []string{"b1", "b1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, transferred)
+	transferred, err = db.Transfer("team", "alice", "bob", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, transferred)
+
+	page, err := db.List(Query{UserID: "alice", WorkspaceID: "team"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2", "b3"}, hashesOf(page.URLs))
+	u, err := db.Select("d1")
+	require.NoError(t, err)
+	assert.Empty(t, u.WorkspaceID)
+}
@@ -2,349 +2,334 @@ package databases
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/jackc/pgx/v4"
-	"github.com/jackc/pgx/v4/pgxpool"
-	"github.com/salliko/reducer/config"
-	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 var ErrConflict = errors.New(`conflict`)
 var ErrGone = errors.New(`Gone`)
+var ErrNotFound = errors.New(`not found`)
+var ErrNotActive = errors.New(`not active yet`)
 
 type Database interface {
-	Create(key, value, userID string) error
-	Select(key string) (string, error)
+	Create(URL) error
+	// Select возвращает ссылку по ключу, не засчитывая переход.
+	Select(key string) (URL, error)
+	// SelectMany возвращает найденные ссылки keys, включая удалённые,
+	// одним обращением к хранилищу. Порядок ссылок не определён.
+	SelectMany(keys []string) ([]URL, error)
+	// Visit атомарно засчитывает переход по ссылке. Возвращает ErrGone,
+	// если ссылка удалена, просрочена или лимит переходов исчерпан,
+	// и ErrNotActive вместе с самой ссылкой, если время её активации
+	// ещё не наступило.
+	Visit(key string) (URL, error)
+	// AddClicks прибавляет к счётчикам ссылок переходы clicks, которые
+	// кеш засчитал, не обращаясь к хранилищу. Лимит переходов не
+	// проверяется: так считаются только ссылки без лимита. Ключи, которых
+	// нет, пропускаются.
+	AddClicks(clicks map[string]int) error
 	SelectAll(string) ([]URL, error)
+	// Totals считает неудалённые ссылки и их владельцев запросом
+	// к хранилищу, не выгружая самих ссылок.
+	Totals() (Totals, error)
+	// List возвращает страницу ссылок пользователя q.UserID.
+	List(q Query) (Page, error)
+	// Iterate передаёт fn ссылки выборки q по одной, не собирая их
+	// в срез. Лимит и курсор q не учитываются. Ошибка fn прерывает обход.
+	Iterate(q Query, fn func(URL) error) error
+	// Update атомарно применяет edit к ссылке, которую может править
+	// userID, сохраняя предыдущее состояние в истории ревизий.
+	Update(key, userID string, edit func(*URL) error) (URL, error)
+	// Revisions возвращает историю изменений ссылки, от старых к новым.
+	Revisions(key, userID string) ([]Revision, error)
+	// Restore отменяет удаление ссылки, если она удалена не раньше since.
+	// Для удалённых раньше ссылок возвращается ErrGone.
+	Restore(key, userID string, since time.Time) (URL, error)
+	// Purge окончательно удаляет ссылки, удалённые раньше before.
+	// Непустой userID ограничивает очистку личными ссылками пользователя.
+	Purge(userID string, before time.Time) (int, error)
+	// CreateWorkspace заводит рабочее пространство с владельцем ownerID.
+	CreateWorkspace(w Workspace, ownerID string) error
+	// Workspaces возвращает пространства, в которых состоит userID,
+	// с его ролью в каждом.
+	Workspaces(userID string) ([]Workspace, error)
+	Members(workspaceID, userID string) ([]Member, error)
+	// SetMember добавляет участника, меняет его роль или, при пустой
+	// роли, исключает его. Доступно только владельцам пространства.
+	SetMember(actorID string, m Member) error
+	// Transfer от имени userID передаёт пространству ссылки keys
+	// пользователя fromID, а при пустом keys — все его личные ссылки.
+	// Пустой fromID означает самого userID. Ссылки другого участника
+	// пространства может передать только владелец пространства.
+	// Возвращает число переданных ссылок.
+	Transfer(workspaceID, userID, fromID string, keys []string) (int, error)
+	// Dump передаёт fn все ссылки всех пользователей, включая удалённые,
+	// по возрастанию ключа, начиная с первого ключа после after.
+	Dump(after string, fn func(Record) error) error
+	// Load сохраняет пакет записей как есть: со счётчиком переходов,
+	// датами и историей. Уже существующие ссылки заменяются только при
+	// overwrite, иначе остаются нетронутыми. Возвращает ключи уже
+	// существовавших ссылок в обоих случаях.
+	Load(recs []Record, overwrite bool) (conflicts []string, err error)
+	// DumpWorkspaces передаёт fn все рабочие пространства с участниками.
+	DumpWorkspaces(fn func(WorkspaceRecord) error) error
+	// LoadWorkspace сохраняет пространство с участниками. Существующее
+	// пространство заменяется только при overwrite, иначе возвращается
+	// ErrConflict.
+	LoadWorkspace(rec WorkspaceRecord, overwrite bool) error
 	Close()
 	Ping() error
-	CreateMany(URL) error
+	// CreateMany сохраняет ссылки одним пакетом: все или ни одной.
+	// Если хотя бы один ключ занят, возвращает ErrConflict.
+	CreateMany([]URL) error
+	// Flush сохраняет отложенные записи, например переходы, которые
+	// кеш засчитал сам.
 	Flush() error
 	Delete(string, string) error
 }
 
-type URL struct {
-	Hash     string `json:"hash"`
-	Original string `json:"original"`
-	UserID   string `json:"user_id"`
-}
-
-type InputURL struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
-}
-
-type OutputURL struct {
-	CorrelationID string `json:"correlation_id"`
-	ShortURL      string `json:"short_url"`
+// WithContext возвращает db, вызовы которого относятся к ctx запроса,
+// если db это умеет (например, чтобы записать их в трассировку или лог
+// запроса), иначе сам db. Обёртки, умеющие WithContext, привязывают
+// к ctx и оборачиваемое хранилище.
+func WithContext(ctx context.Context, db Database) Database {
+	if binder, ok := db.(interface {
+		WithContext(context.Context) Database
+	}); ok {
+		return binder.WithContext(ctx)
+	}
+	return db
 }
 
-func hasKey(key string, db []URL) bool {
-	for _, row := range db {
-		if row.Hash == key {
-			return true
+// Layers возвращает db и хранилища под ним: обёртки вроде кешей и
+// зеркала отдают оборачиваемое основное хранилище методом Unwrap.
+func Layers(db Database) []Database {
+	layers := []Database{db}
+	for {
+		wrapper, ok := db.(interface{ Unwrap() Database })
+		if !ok {
+			return layers
 		}
+		db = wrapper.Unwrap()
+		layers = append(layers, db)
 	}
-	return false
 }
 
-func getOriginal(key string, db []URL) (string, error) {
-	for _, row := range db {
-		if row.Hash == key {
-			return row.Original, nil
+// DeleteBatch вызывает del, который удаляет ссылки keys пользователя
+// userID через db — по одной и, возможно, параллельно. Слои db, которым
+// нужно состояние всего пакета до и после удаления, как журналу аудита,
+// умеют DeleteBatch и оборачивают del своим.
+func DeleteBatch(db Database, userID string, keys []string, del func()) {
+	for _, layer := range Layers(db) {
+		if batcher, ok := layer.(interface {
+			DeleteBatch(userID string, keys []string, del func())
+		}); ok {
+			next := del
+			del = func() { batcher.DeleteBatch(userID, keys, next) }
 		}
 	}
-
-	return "", fmt.Errorf("key %s not found", key)
-}
-
-type MapDatabase struct {
-	db []URL
+	del()
 }
 
-func NewMapDatabase() *MapDatabase {
-	return &MapDatabase{}
-}
-
-func (m *MapDatabase) Close() {
-	// Заглушка
-}
-
-func (m *MapDatabase) Ping() error {
-	return nil
-}
-
-func (m *MapDatabase) CreateMany(v URL) error {
-	return nil
-}
-
-func (m *MapDatabase) Flush() error {
-	return nil
-}
-
-func (m *MapDatabase) Create(key, value, userID string) error {
-	if hasKey(key, m.db) {
-		return ErrConflict
-	}
-	m.db = append(m.db, URL{Hash: key, Original: value, UserID: userID})
-	return nil
+// Totals — число неудалённых ссылок и пользователей, у которых они есть.
+type Totals struct {
+	URLs  int
+	Users int
 }
 
-func (m *MapDatabase) Select(key string) (string, error) {
-	original, err := getOriginal(key, m.db)
-	if err != nil {
-		return original, err
-	}
-	return original, nil
+// MigrationState — сколько миграций схемы применено в базе и сколько
+// их знает эта версия сервиса.
+type MigrationState struct {
+	Applied int `json:"applied"`
+	Known   int `json:"known"`
 }
 
-func (m *MapDatabase) SelectAll(userID string) ([]URL, error) {
-	var data []URL
-	for _, val := range m.db {
-		if val.UserID == userID {
-			data = append(data, val)
-		}
+type URL struct {
+	Hash      string `json:"hash"`
+	Original  string `json:"original"`
+	UserID    string `json:"user_id"`
+	MaxClicks int    `json:"max_clicks,omitempty"`
+	Clicks    int    `json:"clicks"`
+	// ActiveFrom — момент, до которого ссылка не раскрывается.
+	ActiveFrom *time.Time `json:"active_from,omitempty"`
+	// FallbackURL — адрес заглушки «скоро», на который ведёт
+	// ещё не активная ссылка.
+	FallbackURL string `json:"fallback_url,omitempty"`
+	// ExpiresAt — момент, после которого ссылка перестаёт работать.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// PasswordHash — bcrypt-хеш пароля, который спрашивается перед переходом.
+	PasswordHash string `json:"password_hash,omitempty"`
+	Title        string `json:"title,omitempty"`
+	// DeletedAt — момент мягкого удаления; nil у действующих ссылок.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Tags      []string   `json:"tags,omitempty"`
+	Folder    string     `json:"folder,omitempty"`
+	// WorkspaceID — рабочее пространство, которому принадлежит ссылка.
+	// У личных ссылок пусто, ими распоряжается только UserID.
+	WorkspaceID string `json:"workspace_id,omitempty"`
+}
+
+// Revision — сохранённое состояние редактируемых полей ссылки.
+type Revision struct {
+	Version      int        `json:"version"`
+	Original     string     `json:"original"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+	Title        string     `json:"title,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Revision снимает текущее состояние редактируемых полей ссылки.
+func (u URL) Revision(version int, now time.Time) Revision {
+	return Revision{
+		Version:      version,
+		Original:     u.Original,
+		ExpiresAt:    u.ExpiresAt,
+		PasswordHash: u.PasswordHash,
+		Title:        u.Title,
+		CreatedAt:    now,
 	}
-	return data, nil
-}
-
-func (m *MapDatabase) Delete(key, userID string) error {
-	return nil
 }
 
-type FileDatabase struct {
-	path string
-	db   []URL
+// ApplyRevision возвращает редактируемым полям ссылки состояние из ревизии r.
+func (u *URL) ApplyRevision(r Revision) {
+	u.Original = r.Original
+	u.ExpiresAt = r.ExpiresAt
+	u.PasswordHash = r.PasswordHash
+	u.Title = r.Title
 }
 
-func NewFileDatabase(fileName string) (*FileDatabase, error) {
-	fileDatabase := &FileDatabase{path: fileName}
-	err := fileDatabase.sync()
-	if err != nil {
-		return nil, err
-	}
-	return fileDatabase, nil
+// Deleted сообщает, что ссылка удалена владельцем.
+func (u URL) Deleted() bool {
+	return u.DeletedAt != nil
 }
 
-func (f *FileDatabase) Close() {
-	// Заглушка
+// Purgeable сообщает, что ссылка удалена раньше before и подлежит
+// окончательному удалению.
+func (u URL) Purgeable(before time.Time) bool {
+	return u.Deleted() && u.DeletedAt.Before(before)
 }
 
-func (f *FileDatabase) Ping() error {
-	return nil
+// Exhausted сообщает, что лимит переходов по ссылке исчерпан.
+// Нулевой MaxClicks означает ссылку без ограничений.
+func (u URL) Exhausted() bool {
+	return u.MaxClicks > 0 && u.Clicks >= u.MaxClicks
 }
 
-func (f *FileDatabase) CreateMany(v URL) error {
-	return nil
+// Scheduled сообщает, что на момент now ссылка ещё не активна.
+func (u URL) Scheduled(now time.Time) bool {
+	return u.ActiveFrom != nil && now.Before(*u.ActiveFrom)
 }
 
-func (f *FileDatabase) Flush() error {
-	return nil
+// Expired сообщает, что на момент now срок действия ссылки истёк.
+func (u URL) Expired(now time.Time) bool {
+	return u.ExpiresAt != nil && !now.Before(*u.ExpiresAt)
 }
 
-func (f *FileDatabase) sync() error {
-	file, err := os.OpenFile(f.path, os.O_RDONLY|os.O_CREATE, 0777)
-	if err != nil {
-		return err
-	}
-
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return err
-	}
+const (
+	StatusActive    = "active"
+	StatusScheduled = "scheduled"
+	StatusExhausted = "exhausted"
+	StatusExpired   = "expired"
+	StatusDeleted   = "deleted"
+)
 
-	if fileInfo.Size() != 0 {
-		err = json.NewDecoder(file).Decode(&f.db)
-		if err != nil {
-			return err
-		}
+// Status возвращает состояние ссылки на момент now для показа владельцу.
+func (u URL) Status(now time.Time) string {
+	switch {
+	case u.Deleted():
+		return StatusDeleted
+	case u.Expired(now):
+		return StatusExpired
+	case u.Exhausted():
+		return StatusExhausted
+	case u.Scheduled(now):
+		return StatusScheduled
+	default:
+		return StatusActive
 	}
-
-	return nil
 }
 
-func (f *FileDatabase) Create(key, value, userID string) error {
-	if hasKey(key, f.db) {
-		return ErrConflict
-	}
-
-	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE, 0777)
-	if err != nil {
-		return err
+// checkVisit проверяет, можно ли на момент now перейти по ссылке.
+func checkVisit(u URL, now time.Time) error {
+	if u.Deleted() || u.Expired(now) || u.Exhausted() {
+		return ErrGone
 	}
-
-	defer file.Close()
-
-	f.db = append(f.db, URL{Hash: key, Original: value, UserID: userID})
-
-	err = json.NewEncoder(file).Encode(f.db)
-	if err != nil {
-		return err
+	if u.Scheduled(now) {
+		return ErrNotActive
 	}
-
 	return nil
 }
 
-func (f *FileDatabase) Select(key string) (string, error) {
-	err := f.sync()
-	if err != nil {
-		return "", err
-	}
-
-	original, err := getOriginal(key, f.db)
-	if err != nil {
-		return original, err
-	}
-	return original, nil
-
-}
+const (
+	maxTagLength    = 64
+	maxFolderLength = 255
+)
 
-func (f *FileDatabase) SelectAll(userID string) ([]URL, error) {
-	var data []URL
-	for _, val := range f.db {
-		if val.UserID == userID {
-			data = append(data, val)
+// NormalizeTags обрезает пробелы, убирает повторы и сортирует теги.
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	var data []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
 		}
-	}
-	return data, nil
-}
-
-func (f *FileDatabase) Delete(key, userID string) error {
-	return nil
-}
-
-type PostgresqlDatabase struct {
-	conn   *pgxpool.Pool
-	buffer []URL
-}
-
-func NewPostgresqlDatabase(cfg config.Config) (*PostgresqlDatabase, error) {
-	conn, err := pgxpool.Connect(context.Background(), cfg.DatabaseDSN)
-	if err != nil {
-		return nil, err
-	}
-
-	rows, err := conn.Query(context.Background(), createTable)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	return &PostgresqlDatabase{conn: conn, buffer: make([]URL, 0, 500)}, nil
-}
-
-func (p *PostgresqlDatabase) Close() {
-	p.conn.Close()
-}
-
-func (p *PostgresqlDatabase) Ping() error {
-	return p.conn.Ping(context.Background())
-}
-
-func (p *PostgresqlDatabase) Create(key, value, userID string) error {
-	original, err := p.Select(key)
-	if err != nil {
-		if !errors.Is(err, pgx.ErrNoRows) {
-			return err
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d bytes", tag, maxTagLength)
 		}
-	}
-
-	if original != "" {
-		return ErrConflict
-	}
-
-	rows, err := p.conn.Query(context.Background(), insert, key, value, userID)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	return nil
-}
-
-func (p *PostgresqlDatabase) CreateMany(value URL) error {
-	p.buffer = append(p.buffer, value)
-
-	if cap(p.buffer) == len(p.buffer) {
-		err := p.Flush()
-		if err != nil {
-			return err
+		if !seen[tag] {
+			seen[tag] = true
+			data = append(data, tag)
 		}
 	}
-	return nil
+	sort.Strings(data)
+	return data, nil
 }
 
-func (p *PostgresqlDatabase) Flush() error {
-	tx, err := p.conn.Begin(context.Background())
-	if err != nil {
-		return err
+// NormalizeFolder обрезает пробелы в имени папки и проверяет его длину.
+func NormalizeFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(folder)
+	if len(folder) > maxFolderLength {
+		return "", fmt.Errorf("folder is longer than %d bytes", maxFolderLength)
 	}
-	defer tx.Rollback(context.Background())
+	return folder, nil
+}
 
-	// Запрос prepare
-	stmt, err := tx.Prepare(context.Background(), "insert", insert)
-	if err != nil {
-		return err
-	}
-	// Закрываем запрос
-	for _, v := range p.buffer {
-		if _, err := tx.Exec(context.Background(), stmt.SQL, v.Hash, v.Original, v.UserID); err != nil {
-			if err = tx.Rollback(context.Background()); err != nil {
-				return err
+// HasTags сообщает, что у ссылки есть все теги из tags.
+func (u URL) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, own := range u.Tags {
+			if own == tag {
+				found = true
+				break
 			}
-			return err
+		}
+		if !found {
+			return false
 		}
 	}
-
-	err = tx.Commit(context.Background())
-	if err != nil {
-		return err
-	}
-
-	p.buffer = p.buffer[:0]
-
-	return nil
-}
-
-func (p *PostgresqlDatabase) Select(key string) (string, error) {
-	var original string
-	var isDeleted bool
-	err := p.conn.QueryRow(context.Background(), selectOriginal, key).Scan(&original, &isDeleted)
-	if err != nil {
-		return "", err
-	}
-	if isDeleted {
-		return "", ErrGone
-	}
-	return original, nil
+	return true
 }
 
-func (p *PostgresqlDatabase) SelectAll(userID string) ([]URL, error) {
-	var data []URL
-	rows, err := p.conn.Query(context.Background(), selectAllUserRows, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var u URL
-		err := rows.Scan(&u.Hash, &u.Original, &u.UserID)
-		if err != nil {
-			return nil, err
-		}
-		data = append(data, u)
-	}
-	return data, nil
+type InputURL struct {
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	MaxClicks     int        `json:"max_clicks,omitempty"`
+	ActiveFrom    *time.Time `json:"active_from,omitempty"`
+	FallbackURL   string     `json:"fallback_url,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	Title         string     `json:"title,omitempty"`
+	Tags          []string   `json:"tags,omitempty"`
+	Folder        string     `json:"folder,omitempty"`
 }
 
-func (p *PostgresqlDatabase) Delete(key, userID string) error {
-	rows, err := p.conn.Query(context.Background(), delete, key, userID)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	return nil
+type OutputURL struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url"`
 }
@@ -1 +1,268 @@
 package databases
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMapDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database { return NewMapDatabase() })
+}
+
+func TestFileDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		db, err := NewFileDatabase(filepath.Join(t.TempDir(), "db.json"))
+		require.NoError(t, err)
+		return db
+	})
+}
+
+func TestFileDatabaseVisitMaxClicks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	testVisitMaxClicks(t, db)
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	_, err = reopened.Visit("once")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+func TestFileDatabaseVisitFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.Create(URL{Hash: "abc", Original: "http://ya.ru", UserID: "user"}))
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	_, err = db.Visit("abc")
+	require.NoError(t, err)
+	// Переход по ссылке без лимита не перезаписывает файл.
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	require.NoError(t, db.Flush())
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	u, err := reopened.Select("abc")
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.Clicks)
+}
+
+// TestFileDatabaseVisitSavedLater проверяет, что отложенные переходы
+// записываются в файл и без Flush.
+func TestFileDatabaseVisitSavedLater(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.Create(URL{Hash: "abc", Original: "http://ya.ru", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "busy", Original: "http://busy.example", UserID: "user"}))
+
+	clicks := func(key string) int {
+		reopened, err := NewFileDatabase(path)
+		require.NoError(t, err)
+		u, err := reopened.Select(key)
+		require.NoError(t, err)
+		return u.Clicks
+	}
+
+	// Набралось maxPendingClicks переходов — файл записывается сразу.
+	for i := 0; i < maxPendingClicks; i++ {
+		_, err = db.Visit("busy")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, maxPendingClicks, clicks("busy"))
+
+	_, err = db.Visit("abc")
+	require.NoError(t, err)
+	assert.Equal(t, 0, clicks("abc"))
+	assert.Eventually(t, func() bool { return clicks("abc") == 1 }, 3*clickFlushDelay, 10*time.Millisecond)
+}
+
+func TestMapDatabaseVisitScheduled(t *testing.T) {
+	db := NewMapDatabase()
+	activeFrom := time.Now().Add(time.Hour)
+	require.NoError(t, db.Create(URL{Hash: "soon", Original: "http://ya.ru", ActiveFrom: &activeFrom, FallbackURL: "http://ya.ru/soon"}))
+
+	u, err := db.Visit("soon")
+	assert.ErrorIs(t, err, ErrNotActive)
+	assert.Equal(t, "http://ya.ru/soon", u.FallbackURL)
+
+	all, err := db.SelectAll("")
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, 0, all[0].Clicks)
+	assert.Equal(t, StatusScheduled, all[0].Status(time.Now()))
+}
+
+func TestFileDatabaseUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.Create(URL{Hash: "abc", Original: "http://typo.example", UserID: "user"}))
+
+	_, err = db.Update("abc", "stranger", func(u *URL) error { return nil })
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	u, err := db.Update("abc", "user", func(u *URL) error {
+		u.Original = "http://fixed.example"
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://fixed.example", u.Original)
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	u, err = reopened.Select("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "http://fixed.example", u.Original)
+
+	revisions, err := reopened.Revisions("abc", "user")
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	assert.Equal(t, 1, revisions[0].Version)
+	assert.Equal(t, "http://typo.example", revisions[0].Original)
+}
+
+func TestFileDatabaseLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"hash":"abc","original":"http://ya.ru","user_id":"user"}]`), 0644))
+
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	u, err := db.Select("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "http://ya.ru", u.Original)
+}
+
+func TestFileDatabaseRestoreAndPurge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	require.NoError(t, db.Create(URL{Hash: "old", Original: "http://old.example", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "new", Original: "http://new.example", UserID: "user"}))
+	require.NoError(t, db.Create(URL{Hash: "other", Original: "http://other.example", UserID: "other"}))
+	require.NoError(t, db.Delete("old", "user"))
+	require.NoError(t, db.Delete("new", "user"))
+	require.NoError(t, db.Delete("other", "user"))
+
+	_, err = db.Select("other")
+	assert.NoError(t, err)
+	_, err = db.Visit("old")
+	assert.ErrorIs(t, err, ErrGone)
+
+	// Ссылки, удалённые раньше начала окна, восстановить уже нельзя.
+	_, err = db.Restore("old", "user", time.Now().Add(time.Minute))
+	assert.ErrorIs(t, err, ErrGone)
+	_, err = db.Restore("new", "other", time.Now().Add(-time.Minute))
+	assert.ErrorIs(t, err, ErrNotFound)
+	u, err := db.Restore("new", "user", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, u.Deleted())
+
+	purged, err := db.Purge("", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	reopened, err := NewFileDatabase(path)
+	require.NoError(t, err)
+	_, err = reopened.Select("old")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = reopened.Select("new")
+	assert.NoError(t, err)
+}
+
+func TestFileDatabaseWorkspaces(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	db, err := NewFileDatabase(path)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "alice"}))
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "alice"}))
+	require.NoError(t, db.CreateWorkspace(Workspace{ID: "team", Name: "Team"}, "alice"))
+	assert.ErrorIs(t, db.CreateWorkspace(Workspace{ID: "team"}, "bob"), ErrConflict)
+
+	assert.ErrorIs(t, db.SetMember("bob", Member{WorkspaceID: "team", UserID: "bob", Role: RoleOwner}), ErrNotFound)
+	require.NoError(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "bob", Role: RoleViewer}))
+	require.NoError(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "carol", Role: RoleEditor}))
+	assert.ErrorIs(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "alice", Role: RoleEditor}), ErrLastOwner)
+
+	_, err = db.Transfer("team", "bob", "", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	transferred, err := db.Transfer("team", "alice", "", []string{"a"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, transferred)
+
+	// После перезапуска пространство и права сохраняются.
+	db, err = NewFileDatabase(path)
+	require.NoError(t, err)
+
+	page, err := db.List(Query{UserID: "bob", WorkspaceID: "team"})
+	require.NoError(t, err)
+	require.Len(t, page.URLs, 1)
+	assert.Equal(t, "a", page.URLs[0].Hash)
+	_, err = db.List(Query{UserID: "dave", WorkspaceID: "team"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	personal, err := db.SelectAll("alice")
+	require.NoError(t, err)
+	require.Len(t, personal, 1)
+	assert.Equal(t, "b", personal[0].Hash)
+
+	edit := func(u *URL) error { u.Title = "shared"; return nil }
+	_, err = db.Update("a", "bob", edit)
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = db.Update("a", "carol", edit)
+	require.NoError(t, err)
+	_, err = db.Revisions("a", "bob")
+	require.NoError(t, err)
+
+	require.NoError(t, db.Delete("a", "bob"))
+	_, err = db.Select("a")
+	require.NoError(t, err)
+	require.NoError(t, db.Delete("a", "carol"))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+
+	workspaces, err := db.Workspaces("bob")
+	require.NoError(t, err)
+	require.Len(t, workspaces, 1)
+	assert.Equal(t, RoleViewer, workspaces[0].Role)
+}
+
+func TestMirrorDatabase(t *testing.T) {
+	primary, mirror := NewMapDatabase(), NewMapDatabase()
+	db := NewMirrorDatabase(primary, mirror)
+
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+	_, err := db.Update("a", "user", func(u *URL) error {
+		u.Title = "edited"
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Delete("a", "user"))
+
+	// Ссылка, которой ещё нет во втором хранилище, не мешает основному.
+	require.NoError(t, primary.Create(URL{Hash: "b", Original: "http://b.example", UserID: "user"}))
+	_, err = db.Visit("b")
+	require.NoError(t, err)
+
+	_, err = mirror.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+	revisions, err := mirror.Revisions("a", "user")
+	require.NoError(t, err)
+	assert.Len(t, revisions, 1)
+	_, err = mirror.Select("b")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMirrorDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database { return NewMirrorDatabase(NewMapDatabase(), NewMapDatabase()) })
+}
@@ -0,0 +1,14 @@
+package databases
+
+// Record — ссылка вместе с историей правок: единица переноса данных
+// между хранилищами.
+type Record struct {
+	URL       URL        `json:"url"`
+	Revisions []Revision `json:"revisions,omitempty"`
+}
+
+// WorkspaceRecord — рабочее пространство вместе с участниками.
+type WorkspaceRecord struct {
+	Workspace Workspace `json:"workspace"`
+	Members   []Member  `json:"members"`
+}
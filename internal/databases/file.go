@@ -0,0 +1,409 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/json"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileFormatVersion — версия формата файла хранилища. Файлы первой версии
+// содержали только JSON-массив ссылок и по-прежнему читаются.
+const fileFormatVersion = 2
+
+type fileSnapshot struct {
+	Version int `json:"version"`
+	memoryStore
+}
+
+// FileDatabase хранит ссылки в памяти и переписывает файл целиком
+// при каждом изменении. Переходы по ссылкам без лимита записываются
+// не сразу, а через clickFlushDelay или когда их накопится
+// maxPendingClicks: если процесс упадёт, теряются только они.
+type FileDatabase struct {
+	mu    sync.Mutex
+	path  string
+	store memoryStore
+	// dirty — число переходов по ссылкам без лимита, ещё не записанных
+	// в файл; timer запишет их, если файл не перепишут раньше.
+	dirty int
+	timer *time.Timer
+}
+
+func NewFileDatabase(fileName string) (*FileDatabase, error) {
+	fileDatabase := &FileDatabase{path: fileName}
+	err := fileDatabase.sync()
+	if err != nil {
+		return nil, err
+	}
+	return fileDatabase, nil
+}
+
+func (f *FileDatabase) Close() {
+	f.flushAndLog()
+}
+
+func (f *FileDatabase) Ping() error {
+	return nil
+}
+
+// CreateMany сохраняет пакет одной перезаписью файла.
+func (f *FileDatabase) CreateMany(urls []URL) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.store.createMany(urls); err != nil {
+		return err
+	}
+
+	return f.save()
+}
+
+// Flush записывает в файл отложенные счётчики переходов.
+func (f *FileDatabase) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dirty == 0 {
+		return nil
+	}
+
+	return f.save()
+}
+
+func (f *FileDatabase) flushAndLog() {
+	if err := f.Flush(); err != nil {
+		zap.L().Warn("save file storage failed", zap.Error(err))
+	}
+}
+
+// markDirty отмечает n незаписанных переходов и сообщает, что их
+// накопилось столько, что файл нужно записать сразу. Вызывается под f.mu.
+func (f *FileDatabase) markDirty(n int) bool {
+	f.dirty += n
+	if f.timer == nil {
+		f.timer = time.AfterFunc(clickFlushDelay, f.flushAndLog)
+	}
+	return f.dirty >= maxPendingClicks
+}
+
+func (f *FileDatabase) sync() error {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		f.store = memoryStore{}
+		f.store.reindex()
+		return f.save()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.store = memoryStore{}
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+	case data[0] == '[':
+		err = json.Unmarshal(data, &f.store.URLs)
+	default:
+		var snapshot fileSnapshot
+		err = json.Unmarshal(data, &snapshot)
+		f.store = snapshot.memoryStore
+	}
+	if err != nil {
+		return err
+	}
+
+	f.store.reindex()
+	return nil
+}
+
+// save записывает хранилище во временный файл и атомарно подменяет им
+// основной, чтобы сбой посреди записи не оставил файл обрезанным.
+func (f *FileDatabase) save() error {
+	file, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = json.NewEncoder(file).Encode(fileSnapshot{Version: fileFormatVersion, memoryStore: f.store})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), f.path); err != nil {
+		return err
+	}
+	f.dirty = 0
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	return nil
+}
+
+func (f *FileDatabase) Create(u URL) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.store.create(u); err != nil {
+		return err
+	}
+
+	return f.save()
+}
+
+func (f *FileDatabase) Select(key string) (URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.get(key)
+}
+
+func (f *FileDatabase) SelectMany(keys []string) ([]URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.selectMany(keys), nil
+}
+
+func (f *FileDatabase) Totals() (Totals, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.totals(), nil
+}
+
+func (f *FileDatabase) Visit(key string) (URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u, err := f.store.visit(key, time.Now())
+	if err != nil {
+		return u, err
+	}
+
+	// Счётчик ссылки с лимитом сохраняем сразу, иначе после перезапуска
+	// одноразовая ссылка снова станет доступной. Остальные счётчики
+	// записываются с задержкой, см. markDirty.
+	if u.MaxClicks == 0 && !f.markDirty(1) {
+		return u, nil
+	}
+	if err := f.save(); err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+// AddClicks, как и переход по ссылке без лимита, записывается
+// с задержкой.
+func (f *FileDatabase) AddClicks(clicks map[string]int) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.store.addClicks(clicks)
+	n := 0
+	for _, clicks := range clicks {
+		n += clicks
+	}
+	if !f.markDirty(n) {
+		return nil
+	}
+	return f.save()
+}
+
+func (f *FileDatabase) SelectAll(userID string) ([]URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.selectAll(userID), nil
+}
+
+func (f *FileDatabase) List(q Query) (Page, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.list(q)
+}
+
+func (f *FileDatabase) Iterate(q Query, fn func(URL) error) error {
+	f.mu.Lock()
+	data, err := f.store.snapshot(q)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range data {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u, err := f.store.update(key, userID, edit, time.Now())
+	if err != nil {
+		return URL{}, err
+	}
+
+	if err := f.save(); err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (f *FileDatabase) Revisions(key, userID string) ([]Revision, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.revisions(key, userID)
+}
+
+func (f *FileDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	u, err := f.store.restore(key, userID, since)
+	if err != nil {
+		return URL{}, err
+	}
+
+	if err := f.save(); err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (f *FileDatabase) Purge(userID string, before time.Time) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	purged := f.store.purge(userID, before)
+	if purged == 0 {
+		return 0, nil
+	}
+
+	if err := f.save(); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (f *FileDatabase) Delete(key, userID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.store.delete(key, userID, time.Now()) {
+		return nil
+	}
+
+	return f.save()
+}
+
+func (f *FileDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.store.createWorkspace(w, ownerID); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileDatabase) Workspaces(userID string) ([]Workspace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.workspaces(userID), nil
+}
+
+func (f *FileDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.store.members(workspaceID, userID)
+}
+
+func (f *FileDatabase) SetMember(actorID string, member Member) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.store.setMember(actorID, member); err != nil {
+		return err
+	}
+	return f.save()
+}
+
+func (f *FileDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	transferred, err := f.store.transfer(workspaceID, userID, fromID, keys)
+	if err != nil || transferred == 0 {
+		return transferred, err
+	}
+	return transferred, f.save()
+}
+
+func (f *FileDatabase) Dump(after string, fn func(Record) error) error {
+	f.mu.Lock()
+	data := f.store.dump(after)
+	f.mu.Unlock()
+
+	for _, rec := range data {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load сохраняет пакет одной перезаписью файла.
+func (f *FileDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conflicts := f.store.load(recs, overwrite)
+	if !overwrite && len(conflicts) == len(recs) {
+		return conflicts, nil
+	}
+	return conflicts, f.save()
+}
+
+func (f *FileDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	f.mu.Lock()
+	data := f.store.dumpWorkspaces()
+	f.mu.Unlock()
+
+	for _, rec := range data {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FileDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.store.loadWorkspace(rec, overwrite); err != nil {
+		return err
+	}
+	return f.save()
+}
@@ -0,0 +1,114 @@
+package databases
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqlDialect — различия SQL-хранилищ, которые нужны построителю
+// запроса списка ссылок.
+type sqlDialect struct {
+	// placeholder — формат нумерованного параметра запроса.
+	placeholder string
+	// userURLs и workspaceURLs — начало запроса с условием на владельца
+	// в первом параметре; buildListQuery дописывает остальные условия.
+	userURLs      string
+	workspaceURLs string
+	// contains — условие «строка column содержит подстроку param».
+	contains string
+	// domain — выражение хоста оригинального адреса.
+	domain string
+	// hasTags — условие «у ссылки есть все теги из params».
+	hasTags    func(params []string) string
+	deleted    string
+	notDeleted string
+}
+
+var postgresDialect = sqlDialect{
+	placeholder:   "$%d",
+	userURLs:      listURLs,
+	workspaceURLs: listWorkspaceURLs,
+	contains:      "strpos(lower(%s), %s) > 0",
+	domain:        domainExpr,
+	hasTags: func(params []string) string {
+		return fmt.Sprintf("array[%s]::text[] <@ %s", strings.Join(params, ", "), tagsExpr)
+	},
+	deleted:    "is_deleted is true",
+	notDeleted: "is_deleted is not true",
+}
+
+// buildListQuery строит запрос keyset-пагинации для q. Значения фильтров
+// передаются параметрами, в текст запроса попадают только имена колонок.
+func buildListQuery(q Query, d sqlDialect) (string, []interface{}, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return "", nil, err
+	}
+	c, _ := decodeCursor(q)
+
+	var sb strings.Builder
+	args := []interface{}{q.UserID}
+	if q.WorkspaceID != "" {
+		sb.WriteString(d.workspaceURLs)
+		args = []interface{}{q.WorkspaceID}
+	} else {
+		sb.WriteString(d.userURLs)
+	}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf(d.placeholder, len(args))
+	}
+
+	if q.Search != "" {
+		n := arg(strings.ToLower(q.Search))
+		fmt.Fprintf(&sb, " and (%s or %s)", fmt.Sprintf(d.contains, "original", n), fmt.Sprintf(d.contains, "title", n))
+	}
+	if q.Domain != "" {
+		fmt.Fprintf(&sb, " and %s = %s", d.domain, arg(strings.ToLower(q.Domain)))
+	}
+	if q.CreatedFrom != nil {
+		fmt.Fprintf(&sb, " and created_at >= %s", arg(q.CreatedFrom.UTC()))
+	}
+	if q.CreatedTo != nil {
+		fmt.Fprintf(&sb, " and created_at < %s", arg(q.CreatedTo.UTC()))
+	}
+	if len(q.Tags) > 0 {
+		params := make([]string, 0, len(q.Tags))
+		for _, tag := range q.Tags {
+			params = append(params, arg(tag))
+		}
+		fmt.Fprintf(&sb, " and %s", d.hasTags(params))
+	}
+	if q.Folder != "" {
+		fmt.Fprintf(&sb, " and folder = %s", arg(q.Folder))
+	}
+	if q.Deleted != nil {
+		if *q.Deleted {
+			sb.WriteString(" and " + d.deleted)
+		} else {
+			sb.WriteString(" and " + d.notDeleted)
+		}
+	}
+
+	column, op, order := "created_at", ">", "asc"
+	if q.Sort == SortClicks {
+		column = "clicks"
+	}
+	if q.Desc {
+		op, order = "<", "desc"
+	}
+	if c != nil {
+		var value interface{} = c.Created.UTC()
+		if q.Sort == SortClicks {
+			value = c.Clicks
+		}
+		fmt.Fprintf(&sb, " and (%s, hash) %s (%s, %s)", column, op, arg(value), arg(c.Hash))
+	}
+	fmt.Fprintf(&sb, " order by %[1]s %[2]s, hash %[2]s", column, order)
+	if q.Limit > 0 {
+		// Лишняя строка показывает, что за страницей есть продолжение.
+		fmt.Fprintf(&sb, " limit %s", arg(q.Limit+1))
+	}
+
+	return sb.String(), args, nil
+}
@@ -0,0 +1,619 @@
+package databases
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore — общее состояние MapDatabase и FileDatabase.
+// Методы не синхронизированы: блокировку держит вызывающий.
+type memoryStore struct {
+	URLs       []URL                 `json:"urls"`
+	History    map[string][]Revision `json:"revisions,omitempty"`
+	Workspaces map[string]Workspace  `json:"workspaces,omitempty"`
+	// Members — роли участников: пространство → пользователь → роль.
+	Members   map[string]map[string]string `json:"members,omitempty"`
+	positions map[string]int
+}
+
+func (s *memoryStore) reindex() {
+	s.positions = make(map[string]int, len(s.URLs))
+	for i, row := range s.URLs {
+		s.positions[row.Hash] = i
+	}
+}
+
+func (s *memoryStore) find(key string) (int, error) {
+	i, ok := s.positions[key]
+	if !ok {
+		return 0, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	return i, nil
+}
+
+// access ищет ссылку, на которую у userID есть права не ниже need.
+func (s *memoryStore) access(key, userID, need string) (int, error) {
+	i, err := s.find(key)
+	if err != nil {
+		return 0, err
+	}
+	u := s.URLs[i]
+	err = checkAccess(u, userID, s.Members[u.WorkspaceID][userID], need)
+	if errors.Is(err, ErrNotFound) {
+		return 0, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return i, nil
+}
+
+func (s *memoryStore) create(u URL) error {
+	if s.positions == nil {
+		s.reindex()
+	}
+	if _, ok := s.positions[u.Hash]; ok {
+		return ErrConflict
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now().UTC()
+	}
+	s.positions[u.Hash] = len(s.URLs)
+	s.URLs = append(s.URLs, u)
+	return nil
+}
+
+// createMany добавляет пакет ссылок целиком или, при конфликте
+// хотя бы одного ключа, не добавляет ни одной.
+func (s *memoryStore) createMany(rows []URL) error {
+	if s.positions == nil {
+		s.reindex()
+	}
+	keys := make(map[string]bool, len(rows))
+	for _, u := range rows {
+		if _, ok := s.positions[u.Hash]; ok || keys[u.Hash] {
+			return ErrConflict
+		}
+		keys[u.Hash] = true
+	}
+	for _, u := range rows {
+		if err := s.create(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) get(key string) (URL, error) {
+	i, err := s.find(key)
+	if err != nil {
+		return URL{}, err
+	}
+	if s.URLs[i].Deleted() {
+		return URL{}, ErrGone
+	}
+	return s.URLs[i], nil
+}
+
+func (s *memoryStore) selectMany(keys []string) []URL {
+	var data []URL
+	for _, key := range keys {
+		if i, err := s.find(key); err == nil {
+			data = append(data, s.URLs[i])
+		}
+	}
+	return data
+}
+
+func (s *memoryStore) totals() Totals {
+	var t Totals
+	users := make(map[string]bool)
+	for _, u := range s.URLs {
+		if u.Deleted() {
+			continue
+		}
+		t.URLs++
+		users[u.UserID] = true
+	}
+	t.Users = len(users)
+	return t
+}
+
+func (s *memoryStore) visit(key string, now time.Time) (URL, error) {
+	i, err := s.find(key)
+	if err != nil {
+		return URL{}, err
+	}
+
+	row := s.URLs[i]
+	if err := checkVisit(row, now); err != nil {
+		if err == ErrNotActive {
+			return row, err
+		}
+		return URL{}, err
+	}
+
+	s.URLs[i].Clicks++
+	return s.URLs[i], nil
+}
+
+func (s *memoryStore) addClicks(clicks map[string]int) {
+	for key, n := range clicks {
+		if i, err := s.find(key); err == nil {
+			s.URLs[i].Clicks += n
+		}
+	}
+}
+
+func (s *memoryStore) selectAll(userID string) []URL {
+	var data []URL
+	for _, val := range s.URLs {
+		if val.Personal(userID) {
+			data = append(data, val)
+		}
+	}
+	return data
+}
+
+func (s *memoryStore) update(key, userID string, edit func(*URL) error, now time.Time) (URL, error) {
+	i, err := s.access(key, userID, RoleEditor)
+	if err != nil {
+		return URL{}, err
+	}
+
+	u := s.URLs[i]
+	if u.Deleted() {
+		return URL{}, ErrGone
+	}
+	if err := edit(&u); err != nil {
+		return URL{}, err
+	}
+
+	if s.History == nil {
+		s.History = make(map[string][]Revision)
+	}
+	prev := s.URLs[i].Revision(len(s.History[key])+1, now)
+	s.History[key] = append(s.History[key], prev)
+	s.URLs[i] = u
+
+	return u, nil
+}
+
+func (s *memoryStore) revisions(key, userID string) ([]Revision, error) {
+	if _, err := s.access(key, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+	return append([]Revision(nil), s.History[key]...), nil
+}
+
+// delete помечает ссылку удалённой. Недоступные и уже удалённые ссылки
+// пропускаются молча, как и в PostgresqlDatabase.
+func (s *memoryStore) delete(key, userID string, now time.Time) bool {
+	i, err := s.access(key, userID, RoleEditor)
+	if err != nil || s.URLs[i].Deleted() {
+		return false
+	}
+	s.URLs[i].DeletedAt = &now
+	return true
+}
+
+func (s *memoryStore) restore(key, userID string, since time.Time) (URL, error) {
+	i, err := s.access(key, userID, RoleEditor)
+	if err != nil {
+		return URL{}, err
+	}
+	if s.URLs[i].Purgeable(since) {
+		return URL{}, ErrGone
+	}
+	s.URLs[i].DeletedAt = nil
+	return s.URLs[i], nil
+}
+
+func (s *memoryStore) purge(userID string, before time.Time) int {
+	kept := s.URLs[:0]
+	purged := 0
+	for _, row := range s.URLs {
+		if row.Purgeable(before) && (userID == "" || row.Personal(userID)) {
+			delete(s.History, row.Hash)
+			purged++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	s.URLs = kept
+	s.reindex()
+	return purged
+}
+
+func (s *memoryStore) list(q Query) (Page, error) {
+	if q.WorkspaceID != "" {
+		if err := checkRole(s.Members[q.WorkspaceID][q.UserID], RoleViewer); err != nil {
+			return Page{}, err
+		}
+	}
+	return applyQuery(s.URLs, q)
+}
+
+// snapshot возвращает копию всей выборки q, чтобы обходить её без блокировки.
+func (s *memoryStore) snapshot(q Query) ([]URL, error) {
+	q.Limit, q.Cursor = 0, ""
+	page, err := s.list(q)
+	return page.URLs, err
+}
+
+func (s *memoryStore) createWorkspace(w Workspace, ownerID string) error {
+	if _, ok := s.Workspaces[w.ID]; ok {
+		return ErrConflict
+	}
+	if s.Workspaces == nil {
+		s.Workspaces = make(map[string]Workspace)
+		s.Members = make(map[string]map[string]string)
+	}
+	s.Workspaces[w.ID] = w
+	s.Members[w.ID] = map[string]string{ownerID: RoleOwner}
+	return nil
+}
+
+func (s *memoryStore) workspaces(userID string) []Workspace {
+	var data []Workspace
+	for id, members := range s.Members {
+		if role, ok := members[userID]; ok {
+			w := s.Workspaces[id]
+			w.Role = role
+			data = append(data, w)
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].CreatedAt.Before(data[j].CreatedAt) })
+	return data
+}
+
+func (s *memoryStore) members(workspaceID, userID string) ([]Member, error) {
+	if err := checkRole(s.Members[workspaceID][userID], RoleViewer); err != nil {
+		return nil, err
+	}
+	var data []Member
+	for member, role := range s.Members[workspaceID] {
+		data = append(data, Member{WorkspaceID: workspaceID, UserID: member, Role: role})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].UserID < data[j].UserID })
+	return data, nil
+}
+
+func (s *memoryStore) setMember(actorID string, m Member) error {
+	members := s.Members[m.WorkspaceID]
+	if err := checkMemberChange(members, actorID, m); err != nil {
+		return err
+	}
+
+	if m.Role == "" {
+		delete(members, m.UserID)
+	} else {
+		members[m.UserID] = m.Role
+	}
+	return nil
+}
+
+func (s *memoryStore) transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	if fromID == "" {
+		fromID = userID
+	}
+	members := s.Members[workspaceID]
+	if err := checkTransfer(userID, fromID, members[userID], members[fromID]); err != nil {
+		return 0, err
+	}
+
+	var positions []int
+	if len(keys) == 0 {
+		for i, row := range s.URLs {
+			if row.Personal(fromID) {
+				positions = append(positions, i)
+			}
+		}
+	}
+	for _, key := range uniqueKeys(keys) {
+		i, err := s.access(key, fromID, RoleEditor)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkTransferURL(s.URLs[i], userID, fromID); err != nil {
+			return 0, err
+		}
+		positions = append(positions, i)
+	}
+
+	for _, i := range positions {
+		s.URLs[i].WorkspaceID = workspaceID
+	}
+	return len(positions), nil
+}
+
+// dump возвращает копии записей с ключами после after по возрастанию ключа.
+func (s *memoryStore) dump(after string) []Record {
+	var data []Record
+	for _, u := range s.URLs {
+		if u.Hash > after {
+			revisions := append([]Revision(nil), s.History[u.Hash]...)
+			data = append(data, Record{URL: u, Revisions: revisions})
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].URL.Hash < data[j].URL.Hash })
+	return data
+}
+
+func (s *memoryStore) load(recs []Record, overwrite bool) []string {
+	if s.positions == nil {
+		s.reindex()
+	}
+
+	var conflicts []string
+	for _, rec := range recs {
+		key := rec.URL.Hash
+		if i, ok := s.positions[key]; ok {
+			conflicts = append(conflicts, key)
+			if !overwrite {
+				continue
+			}
+			s.URLs[i] = rec.URL
+		} else {
+			s.positions[key] = len(s.URLs)
+			s.URLs = append(s.URLs, rec.URL)
+		}
+
+		delete(s.History, key)
+		if len(rec.Revisions) > 0 {
+			if s.History == nil {
+				s.History = make(map[string][]Revision)
+			}
+			s.History[key] = append([]Revision(nil), rec.Revisions...)
+		}
+	}
+	return conflicts
+}
+
+func (s *memoryStore) dumpWorkspaces() []WorkspaceRecord {
+	var data []WorkspaceRecord
+	for id, w := range s.Workspaces {
+		rec := WorkspaceRecord{Workspace: w}
+		for userID, role := range s.Members[id] {
+			rec.Members = append(rec.Members, Member{WorkspaceID: id, UserID: userID, Role: role})
+		}
+		sort.Slice(rec.Members, func(i, j int) bool { return rec.Members[i].UserID < rec.Members[j].UserID })
+		data = append(data, rec)
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].Workspace.ID < data[j].Workspace.ID })
+	return data
+}
+
+func (s *memoryStore) loadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	id := rec.Workspace.ID
+	if _, ok := s.Workspaces[id]; ok && !overwrite {
+		return ErrConflict
+	}
+	if s.Workspaces == nil {
+		s.Workspaces = make(map[string]Workspace)
+		s.Members = make(map[string]map[string]string)
+	}
+	rec.Workspace.Role = ""
+	s.Workspaces[id] = rec.Workspace
+	members := make(map[string]string, len(rec.Members))
+	for _, m := range rec.Members {
+		members[m.UserID] = m.Role
+	}
+	s.Members[id] = members
+	return nil
+}
+
+type MapDatabase struct {
+	mu    sync.Mutex
+	store memoryStore
+}
+
+func NewMapDatabase() *MapDatabase {
+	return &MapDatabase{}
+}
+
+func (m *MapDatabase) Close() {
+	// Заглушка
+}
+
+func (m *MapDatabase) Ping() error {
+	return nil
+}
+
+func (m *MapDatabase) CreateMany(urls []URL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.createMany(urls)
+}
+
+func (m *MapDatabase) Flush() error {
+	return nil
+}
+
+func (m *MapDatabase) Create(u URL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.create(u)
+}
+
+func (m *MapDatabase) Select(key string) (URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.get(key)
+}
+
+func (m *MapDatabase) SelectMany(keys []string) ([]URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.selectMany(keys), nil
+}
+
+func (m *MapDatabase) Visit(key string) (URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.visit(key, time.Now())
+}
+
+func (m *MapDatabase) AddClicks(clicks map[string]int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store.addClicks(clicks)
+	return nil
+}
+
+func (m *MapDatabase) SelectAll(userID string) ([]URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.selectAll(userID), nil
+}
+
+func (m *MapDatabase) Totals() (Totals, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.totals(), nil
+}
+
+func (m *MapDatabase) List(q Query) (Page, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.list(q)
+}
+
+func (m *MapDatabase) Iterate(q Query, fn func(URL) error) error {
+	m.mu.Lock()
+	data, err := m.store.snapshot(q)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, u := range data {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MapDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.update(key, userID, edit, time.Now())
+}
+
+func (m *MapDatabase) Revisions(key, userID string) ([]Revision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.revisions(key, userID)
+}
+
+func (m *MapDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.restore(key, userID, since)
+}
+
+func (m *MapDatabase) Purge(userID string, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.purge(userID, before), nil
+}
+
+func (m *MapDatabase) Delete(key, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store.delete(key, userID, time.Now())
+	return nil
+}
+
+func (m *MapDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.createWorkspace(w, ownerID)
+}
+
+func (m *MapDatabase) Workspaces(userID string) ([]Workspace, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.workspaces(userID), nil
+}
+
+func (m *MapDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.members(workspaceID, userID)
+}
+
+func (m *MapDatabase) SetMember(actorID string, member Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.setMember(actorID, member)
+}
+
+func (m *MapDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.transfer(workspaceID, userID, fromID, keys)
+}
+
+func (m *MapDatabase) Dump(after string, fn func(Record) error) error {
+	m.mu.Lock()
+	data := m.store.dump(after)
+	m.mu.Unlock()
+
+	for _, rec := range data {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MapDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.load(recs, overwrite), nil
+}
+
+func (m *MapDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	m.mu.Lock()
+	data := m.store.dumpWorkspaces()
+	m.mu.Unlock()
+
+	for _, rec := range data {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MapDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.store.loadWorkspace(rec, overwrite)
+}
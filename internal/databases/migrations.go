@@ -0,0 +1,128 @@
+package databases
+
+import "strings"
+
+// Схема общая для Postgres и SQLite. Миграции записаны один раз,
+// а то, что в диалектах пишется по-разному, стоит в фигурных скобках
+// и подставляется postgresSchema и sqliteSchema:
+//
+//	{id}            — автоинкрементный первичный ключ;
+//	{timestamp}     — тип колонки времени;
+//	{now}           — текущее время в значениях по умолчанию;
+//	{if not exists} — условие alter table … add column.
+var (
+	createTable = `
+		create table if not exists urls (
+			id {id},
+			hash varchar(25),
+			original text,
+			user_id varchar(250),
+			is_deleted boolean default false
+		)
+	`
+
+	createRevisionsTable = `
+		create table if not exists url_revisions (
+			id {id},
+			hash varchar(25) not null,
+			version integer not null,
+			original text not null,
+			expires_at {timestamp},
+			password_hash text not null default '',
+			title text not null default '',
+			created_at {timestamp} not null default {now},
+			unique (hash, version)
+		)
+	`
+
+	createTagsTable = `
+		create table if not exists tags (
+			id {id},
+			user_id varchar(250) not null,
+			name varchar(64) not null,
+			unique (user_id, name)
+		)
+	`
+
+	createURLTagsTable = `
+		create table if not exists url_tags (
+			hash varchar(25) not null,
+			tag_id integer not null references tags (id) on delete cascade,
+			primary key (hash, tag_id)
+		)
+	`
+
+	createWorkspacesTable = `
+		create table if not exists workspaces (
+			id varchar(64) primary key not null,
+			name text not null,
+			created_at {timestamp} not null default {now}
+		)
+	`
+
+	createWorkspaceMembersTable = `
+		create table if not exists workspace_members (
+			workspace_id varchar(64) not null references workspaces (id) on delete cascade,
+			user_id varchar(250) not null,
+			role varchar(16) not null,
+			primary key (workspace_id, user_id)
+		)
+	`
+
+	// Миграции применяются по порядку и не редактируются после выпуска:
+	// изменения схемы добавляются новыми элементами в конец.
+	schemaMigrations = []string{
+		createTable,
+		`alter table urls add column {if not exists} max_clicks integer not null default 0`,
+		`alter table urls add column {if not exists} clicks integer not null default 0`,
+		`alter table urls add column {if not exists} active_from {timestamp}`,
+		`alter table urls add column {if not exists} fallback_url text not null default ''`,
+		`alter table urls add column {if not exists} expires_at {timestamp}`,
+		`alter table urls add column {if not exists} password_hash text not null default ''`,
+		`alter table urls add column {if not exists} title text not null default ''`,
+		createRevisionsTable,
+		`alter table urls add column {if not exists} deleted_at {timestamp}`,
+		`update urls set deleted_at = {now} where is_deleted and deleted_at is null`,
+		`alter table urls add column {if not exists} created_at {timestamp} not null default {now}`,
+		`create index if not exists urls_user_created_idx on urls (user_id, created_at, hash)`,
+		`create index if not exists urls_user_clicks_idx on urls (user_id, clicks, hash)`,
+		`alter table urls add column {if not exists} folder text not null default ''`,
+		createTagsTable,
+		createURLTagsTable,
+		`alter table urls add column {if not exists} workspace_id varchar(64) not null default ''`,
+		`create index if not exists urls_workspace_created_idx on urls (workspace_id, created_at, hash)`,
+		createWorkspacesTable,
+		createWorkspaceMembersTable,
+		`create index if not exists urls_hash_idx on urls (hash)`,
+	}
+
+	postgresSchema = strings.NewReplacer(
+		"{id}", "serial primary key not null",
+		"{timestamp}", "timestamptz",
+		"{now}", "now()",
+		"{if not exists}", "if not exists",
+	)
+
+	// В SQLite время пишет приложение текстом в UTC, а колонку not null
+	// alter table добавляет только с постоянным значением по умолчанию.
+	// Поэтому {now} здесь — начало эпохи в формате драйвера: вставки
+	// всегда задают время сами.
+	sqliteSchema = strings.NewReplacer(
+		"{id}", "integer primary key autoincrement",
+		"{timestamp}", "timestamp",
+		"{now}", "'1970-01-01 00:00:00 +0000 UTC'",
+		"{if not exists}", "",
+	)
+
+	migrations       = schemaFor(postgresSchema)
+	sqliteMigrations = schemaFor(sqliteSchema)
+)
+
+// schemaFor переводит общие миграции на диалект dialect.
+func schemaFor(dialect *strings.Replacer) []string {
+	data := make([]string, len(schemaMigrations))
+	for i, m := range schemaMigrations {
+		data[i] = dialect.Replace(m)
+	}
+	return data
+}
@@ -0,0 +1,211 @@
+package databases
+
+import (
+	"go.uber.org/zap"
+	"time"
+)
+
+// MirrorDatabase читает из основного хранилища и повторяет каждую
+// успешную запись во втором. Нужен на время переезда между хранилищами:
+// пока migrate-storage копирует старые данные, новые попадают в оба.
+// Ошибки второго хранилища только логируются — отвечает основное.
+type MirrorDatabase struct {
+	primary Database
+	mirror  Database
+}
+
+func NewMirrorDatabase(primary, mirror Database) *MirrorDatabase {
+	return &MirrorDatabase{primary: primary, mirror: mirror}
+}
+
+// Unwrap возвращает основное хранилище.
+func (m *MirrorDatabase) Unwrap() Database { return m.primary }
+
+func (m *MirrorDatabase) logMirror(op string, err error) {
+	if err != nil {
+		zap.L().Warn("mirror write failed", zap.String("op", op), zap.Error(err))
+	}
+}
+
+func (m *MirrorDatabase) Close() {
+	m.primary.Close()
+	m.mirror.Close()
+}
+
+func (m *MirrorDatabase) Ping() error {
+	m.logMirror("ping", m.mirror.Ping())
+	return m.primary.Ping()
+}
+
+func (m *MirrorDatabase) Create(u URL) error {
+	if err := m.primary.Create(u); err != nil {
+		return err
+	}
+	m.logMirror("create", m.mirror.Create(u))
+	return nil
+}
+
+func (m *MirrorDatabase) CreateMany(urls []URL) error {
+	if err := m.primary.CreateMany(urls); err != nil {
+		return err
+	}
+	m.logMirror("create many", m.mirror.CreateMany(urls))
+	return nil
+}
+
+func (m *MirrorDatabase) Flush() error {
+	if err := m.primary.Flush(); err != nil {
+		return err
+	}
+	m.logMirror("flush", m.mirror.Flush())
+	return nil
+}
+
+func (m *MirrorDatabase) Select(key string) (URL, error) {
+	return m.primary.Select(key)
+}
+
+func (m *MirrorDatabase) SelectMany(keys []string) ([]URL, error) {
+	return m.primary.SelectMany(keys)
+}
+
+func (m *MirrorDatabase) Totals() (Totals, error) {
+	return m.primary.Totals()
+}
+
+func (m *MirrorDatabase) Visit(key string) (URL, error) {
+	u, err := m.primary.Visit(key)
+	if err != nil {
+		return u, err
+	}
+	_, mirrorErr := m.mirror.Visit(key)
+	m.logMirror("visit", mirrorErr)
+	return u, nil
+}
+
+func (m *MirrorDatabase) AddClicks(clicks map[string]int) error {
+	if err := m.primary.AddClicks(clicks); err != nil {
+		return err
+	}
+	m.logMirror("add clicks", m.mirror.AddClicks(clicks))
+	return nil
+}
+
+func (m *MirrorDatabase) SelectAll(userID string) ([]URL, error) {
+	return m.primary.SelectAll(userID)
+}
+
+func (m *MirrorDatabase) List(q Query) (Page, error) {
+	return m.primary.List(q)
+}
+
+func (m *MirrorDatabase) Iterate(q Query, fn func(URL) error) error {
+	return m.primary.Iterate(q, fn)
+}
+
+// Update повторяет во втором хранилище не саму правку, а её итог,
+// чтобы оба хранилища получили одинаковое состояние ссылки.
+func (m *MirrorDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	u, err := m.primary.Update(key, userID, edit)
+	if err != nil {
+		return u, err
+	}
+	_, mirrorErr := m.mirror.Update(key, userID, func(dst *URL) error {
+		*dst = u
+		return nil
+	})
+	m.logMirror("update", mirrorErr)
+	return u, nil
+}
+
+func (m *MirrorDatabase) Revisions(key, userID string) ([]Revision, error) {
+	return m.primary.Revisions(key, userID)
+}
+
+func (m *MirrorDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	u, err := m.primary.Restore(key, userID, since)
+	if err != nil {
+		return u, err
+	}
+	_, mirrorErr := m.mirror.Restore(key, userID, since)
+	m.logMirror("restore", mirrorErr)
+	return u, nil
+}
+
+func (m *MirrorDatabase) Purge(userID string, before time.Time) (int, error) {
+	purged, err := m.primary.Purge(userID, before)
+	if err != nil {
+		return purged, err
+	}
+	_, mirrorErr := m.mirror.Purge(userID, before)
+	m.logMirror("purge", mirrorErr)
+	return purged, nil
+}
+
+func (m *MirrorDatabase) Delete(key, userID string) error {
+	if err := m.primary.Delete(key, userID); err != nil {
+		return err
+	}
+	m.logMirror("delete", m.mirror.Delete(key, userID))
+	return nil
+}
+
+func (m *MirrorDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	if err := m.primary.CreateWorkspace(w, ownerID); err != nil {
+		return err
+	}
+	m.logMirror("create workspace", m.mirror.CreateWorkspace(w, ownerID))
+	return nil
+}
+
+func (m *MirrorDatabase) Workspaces(userID string) ([]Workspace, error) {
+	return m.primary.Workspaces(userID)
+}
+
+func (m *MirrorDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	return m.primary.Members(workspaceID, userID)
+}
+
+func (m *MirrorDatabase) SetMember(actorID string, member Member) error {
+	if err := m.primary.SetMember(actorID, member); err != nil {
+		return err
+	}
+	m.logMirror("set member", m.mirror.SetMember(actorID, member))
+	return nil
+}
+
+func (m *MirrorDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	transferred, err := m.primary.Transfer(workspaceID, userID, fromID, keys)
+	if err != nil {
+		return transferred, err
+	}
+	_, mirrorErr := m.mirror.Transfer(workspaceID, userID, fromID, keys)
+	m.logMirror("transfer", mirrorErr)
+	return transferred, nil
+}
+
+func (m *MirrorDatabase) Dump(after string, fn func(Record) error) error {
+	return m.primary.Dump(after, fn)
+}
+
+func (m *MirrorDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	conflicts, err := m.primary.Load(recs, overwrite)
+	if err != nil {
+		return conflicts, err
+	}
+	_, mirrorErr := m.mirror.Load(recs, overwrite)
+	m.logMirror("load", mirrorErr)
+	return conflicts, nil
+}
+
+func (m *MirrorDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	return m.primary.DumpWorkspaces(fn)
+}
+
+func (m *MirrorDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	if err := m.primary.LoadWorkspace(rec, overwrite); err != nil {
+		return err
+	}
+	m.logMirror("load workspace", m.mirror.LoadWorkspace(rec, overwrite))
+	return nil
+}
@@ -0,0 +1,119 @@
+package databases
+
+import (
+	"fmt"
+	"github.com/salliko/reducer/config"
+	"strings"
+	"time"
+)
+
+// Open открывает хранилище, выбранное конфигурацией: Postgres при
+// заданном DatabaseDSN (или SQLite при DSN вида sqlite://path),
+// SQLite при SQLitePath, bbolt при BoltPath, Redis при RedisURL,
+// файл при FileStoragePath, иначе память. При заданном RedisCacheURL
+// перед хранилищем ставится кеш в Redis, при ненулевом CacheSize —
+// кеш в памяти, а при заданном MirrorStorage записи дублируются во
+// второе хранилище.
+func Open(cfg config.Config) (Database, error) {
+	db, err := openPrimary(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.RedisCacheURL != "" {
+		cached, err := NewRedisCacheDatabase(db, cfg.RedisCacheURL, cfg.RedisCacheTTL)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("redis cache: %w", err)
+		}
+		db = cached
+	}
+	if cfg.CacheSize > 0 {
+		db = NewCachedDatabase(db, cfg.CacheSize, cfg.CacheTTL, cfg.CacheNegativeTTL)
+	}
+	if cfg.MirrorStorage == "" {
+		return db, nil
+	}
+
+	mirror, err := OpenSpec(cfg.MirrorStorage)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("mirror storage: %w", err)
+	}
+	return NewMirrorDatabase(db, mirror), nil
+}
+
+func openPrimary(cfg config.Config) (Database, error) {
+	if strings.HasPrefix(cfg.DatabaseDSN, sqliteScheme) {
+		return NewSQLiteDatabase(strings.TrimPrefix(cfg.DatabaseDSN, sqliteScheme))
+	}
+	if cfg.DatabaseDSN != "" {
+		return NewPostgresqlDatabase(cfg)
+	}
+	if cfg.SQLitePath != "" {
+		return NewSQLiteDatabase(cfg.SQLitePath)
+	}
+	if cfg.BoltPath != "" {
+		return NewBoltDatabase(cfg.BoltPath)
+	}
+	if cfg.RedisURL != "" {
+		return NewRedisDatabase(cfg.RedisURL, cfg.DeletedRetention)
+	}
+	if cfg.FileStoragePath != "" {
+		return NewFileDatabase(cfg.FileStoragePath)
+	}
+	return NewMapDatabase(), nil
+}
+
+const (
+	sqliteScheme = "sqlite://"
+	// specRedisRetention — сколько Redis, открытый по строке, хранит
+	// просроченные ссылки; совпадает со значением DeletedRetention
+	// по умолчанию.
+	specRedisRetention = 720 * time.Hour
+)
+
+// OpenSpec открывает хранилище по строке вида file:path, sqlite:path,
+// bolt:path, postgres:dsn или memory:. Адреса вида postgres://…,
+// sqlite://… и redis://… можно передавать и без префикса.
+func OpenSpec(spec string) (Database, error) {
+	if strings.HasPrefix(spec, sqliteScheme) {
+		return NewSQLiteDatabase(strings.TrimPrefix(spec, sqliteScheme))
+	}
+	if strings.HasPrefix(spec, "redis://") || strings.HasPrefix(spec, "rediss://") {
+		return NewRedisDatabase(spec, specRedisRetention)
+	}
+	if strings.HasPrefix(spec, "postgres://") || strings.HasPrefix(spec, "postgresql://") {
+		return NewPostgresqlDatabase(config.Config{DatabaseDSN: spec})
+	}
+
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("storage %q: file path is required", spec)
+		}
+		return NewFileDatabase(arg)
+	case "sqlite":
+		if arg == "" {
+			return nil, fmt.Errorf("storage %q: sqlite path is required", spec)
+		}
+		return NewSQLiteDatabase(arg)
+	case "bolt":
+		if arg == "" {
+			return nil, fmt.Errorf("storage %q: bolt path is required", spec)
+		}
+		return NewBoltDatabase(arg)
+	case "postgres":
+		if arg == "" {
+			return nil, fmt.Errorf("storage %q: dsn is required", spec)
+		}
+		return NewPostgresqlDatabase(config.Config{DatabaseDSN: arg})
+	case "memory":
+		return NewMapDatabase(), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q: want file:path, sqlite:path, bolt:path, redis://…, postgres:dsn or memory:", spec)
+}
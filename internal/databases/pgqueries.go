@@ -1,35 +1,302 @@
 package databases
 
 var (
-	createTable = `
-		create table if not exists urls (
-			id serial primary key not null,
-			hash varchar(25),
-			original text,
-			user_id varchar(250),
-			is_deleted boolean default false
+	createMigrationsTable = `
+		create table if not exists schema_migrations (
+			version integer primary key not null,
+			applied_at timestamptz default now()
 		)
 	`
 
+	lockMigrations = `
+		lock table schema_migrations in exclusive mode
+	`
+
+	selectMigrationVersion = `
+		select coalesce(max(version), 0) from schema_migrations
+	`
+
+	insertMigrationVersion = `
+		insert into schema_migrations (version) values ($1)
+	`
+
+	// tagsExpr собирает отсортированные теги ссылки в массив.
+	tagsExpr = `array(
+		select t.name from url_tags ut join tags t on t.id = ut.tag_id
+		where ut.hash = urls.hash order by t.name
+	)`
+
+	// urlColumns — колонки ссылки в порядке, который ожидает scanURL.
+	urlColumns = `hash, original, user_id, max_clicks, clicks, active_from, fallback_url, expires_at, password_hash, title, deleted_at, created_at, folder, ` + tagsExpr + `, workspace_id`
+
 	insert = `
-		insert into urls (hash, original, user_id) 
-		values ($1, $2, $3)
+		insert into urls (hash, original, user_id, max_clicks, active_from, fallback_url, expires_at, password_hash, title, folder, workspace_id, clicks, created_at) 
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, coalesce($13, now()))
+	`
+
+	selectURL = `
+		select ` + urlColumns + `, is_deleted
+		from urls
+		where hash = $1
 	`
 
-	selectOriginal = `
-		select original, is_deleted from urls where hash = $1
+	selectURLs = `
+		select ` + urlColumns + `
+		from urls
+		where hash = any($1)
+	`
+
+	countURLs = `
+		select count(*), count(distinct user_id)
+		from urls
+		where is_deleted is not true
 	`
 
 	selectAllUserRows = `
-		select 
-			hash, original, user_id
+		select ` + urlColumns + `
+		from urls
+		where user_id = $1 and workspace_id = ''
+	`
+
+	// listURLs и listWorkspaceURLs дополняются условиями, порядком
+	// и лимитом в PostgresqlDatabase.List.
+	listURLs = `
+		select ` + urlColumns + `
+		from urls
+		where user_id = $1 and workspace_id = ''
+	`
+
+	listWorkspaceURLs = `
+		select ` + urlColumns + `
+		from urls
+		where workspace_id = $1
+	`
+
+	// domainExpr выделяет хост из оригинального адреса.
+	domainExpr = `lower(substring(original from '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^/:?#]+)'))`
+
+	selectURLForUpdate = `
+		select ` + urlColumns + `, is_deleted
 		from urls
-		where user_id = $1
+		where hash = $1
+		for update
 	`
 
-	delete = `
+	selectMemberRole = `
+		select role from workspace_members
+		where workspace_id = $1 and user_id = $2
+	`
+
+	updateURL = `
 		update urls set
-			is_deleted = true
-		where hash = $1 and user_id = $2
+			original = $2,
+			expires_at = $3,
+			password_hash = $4,
+			title = $5,
+			folder = $6
+		where hash = $1
+	`
+
+	insertTags = `
+		insert into tags (user_id, name)
+		select $1, unnest($2::text[])
+		on conflict (user_id, name) do nothing
+	`
+
+	insertURLTags = `
+		insert into url_tags (hash, tag_id)
+		select $1, id from tags where user_id = $2 and name = any($3::text[])
+	`
+
+	deleteURLTags = `
+		delete from url_tags where hash = $1
+	`
+
+	insertRevision = `
+		insert into url_revisions (hash, version, original, expires_at, password_hash, title)
+		select $1, coalesce(max(version), 0) + 1, $2, $3, $4, $5
+		from url_revisions
+		where hash = $1
+	`
+
+	selectRevisions = `
+		select version, original, expires_at, password_hash, title, created_at
+		from url_revisions
+		where hash = $1
+		order by version
+	`
+
+	addClicks = `
+		update urls set
+			clicks = urls.clicks + added.clicks
+		from unnest($1::text[], $2::integer[]) as added (hash, clicks)
+		where urls.hash = added.hash
+	`
+
+	incrementClicks = `
+		update urls set
+			clicks = clicks + 1
+		where hash = $1
+			and is_deleted is not true
+			and (max_clicks = 0 or clicks < max_clicks)
+			and (active_from is null or active_from <= now())
+			and (expires_at is null or expires_at > now())
+		returning ` + urlColumns + `
+	`
+
+	// deleteURL удаляет личную ссылку автора $2 или ссылку пространства,
+	// в котором $2 состоит с одной из ролей $3.
+	deleteURL = `
+		update urls set
+			is_deleted = true,
+			deleted_at = now()
+		where hash = $1 and is_deleted is not true
+			and (workspace_id = '' and user_id = $2 or exists (
+				select 1 from workspace_members m
+				where m.workspace_id = urls.workspace_id and m.user_id = $2 and m.role = any($3::text[])
+			))
+	`
+
+	restoreURL = `
+		update urls set
+			is_deleted = false,
+			deleted_at = null
+		where hash = $1
+		returning ` + urlColumns + `
+	`
+
+	purgeCondition = `
+		is_deleted and deleted_at < $1 and ($2 = '' or user_id = $2 and workspace_id = '')
+	`
+
+	insertWorkspace = `
+		insert into workspaces (id, name, created_at) values ($1, $2, $3)
+		on conflict (id) do nothing
+	`
+
+	selectUserWorkspaces = `
+		select w.id, w.name, w.created_at, m.role
+		from workspaces w join workspace_members m on m.workspace_id = w.id
+		where m.user_id = $1
+		order by w.created_at, w.id
+	`
+
+	// selectMembersForUpdate блокирует состав пространства на время
+	// изменения, чтобы два владельца не исключили друг друга одновременно.
+	selectMembersForUpdate = `
+		select user_id, role from workspace_members
+		where workspace_id = $1
+		order by user_id
+		for update
+	`
+
+	upsertMember = `
+		insert into workspace_members (workspace_id, user_id, role) values ($1, $2, $3)
+		on conflict (workspace_id, user_id) do update set role = excluded.role
+	`
+
+	deleteMember = `
+		delete from workspace_members where workspace_id = $1 and user_id = $2
+	`
+
+	transferUserURLs = `
+		update urls set workspace_id = $1
+		where user_id = $2 and workspace_id = ''
+	`
+
+	transferURLs = `
+		update urls set workspace_id = $1 where hash = any($2)
+	`
+
+	purgeRevisions = `
+		delete from url_revisions
+		where hash in (select hash from urls where ` + purgeCondition + `)
+	`
+
+	purgeURLTags = `
+		delete from url_tags
+		where hash in (select hash from urls where ` + purgeCondition + `)
+	`
+
+	purgeURLs = `
+		delete from urls where ` + purgeCondition + `
+	`
+
+	// revisionsJSON собирает историю ссылки в JSON-массив ревизий.
+	revisionsJSON = `coalesce((
+		select json_agg(json_build_object(
+			'version', r.version, 'original', r.original, 'expires_at', r.expires_at,
+			'password_hash', r.password_hash, 'title', r.title, 'created_at', r.created_at
+		) order by r.version)
+		from url_revisions r where r.hash = urls.hash
+	), '[]')`
+
+	dumpURLs = `
+		select ` + urlColumns + `, ` + revisionsJSON + `
+		from urls
+		where hash > $1
+		order by hash
+	`
+
+	// lockKey до конца транзакции занимает ключ ссылки: уникального
+	// индекса по hash нет, и только эта блокировка не даёт двум
+	// транзакциям добавить один ключ.
+	lockKey = `
+		select pg_advisory_xact_lock(hashtext($1))
+	`
+
+	selectURLExists = `
+		select exists (select 1 from urls where hash = $1)
+	`
+
+	lockURLs = `
+		select hash from urls where hash = any($1::text[]) for update
+	`
+
+	purgeLoadedRevisions = `
+		delete from url_revisions where hash = any($1::text[])
+	`
+
+	purgeLoadedURLTags = `
+		delete from url_tags where hash = any($1::text[])
+	`
+
+	purgeLoadedURLs = `
+		delete from urls where hash = any($1::text[])
+	`
+
+	loadURL = `
+		insert into urls (hash, original, user_id, max_clicks, clicks, active_from, fallback_url,
+			expires_at, password_hash, title, is_deleted, deleted_at, created_at, folder, workspace_id)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 is not null, $11, $12, $13, $14)
+	`
+
+	loadRevision = `
+		insert into url_revisions (hash, version, original, expires_at, password_hash, title, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	dumpWorkspaces = `
+		select w.id, w.name, w.created_at, coalesce((
+			select json_agg(json_build_object(
+				'workspace_id', m.workspace_id, 'user_id', m.user_id, 'role', m.role
+			) order by m.user_id)
+			from workspace_members m where m.workspace_id = w.id
+		), '[]')
+		from workspaces w
+		order by w.id
+	`
+
+	selectWorkspaceForUpdate = `
+		select id from workspaces where id = $1 for update
+	`
+
+	upsertWorkspace = `
+		insert into workspaces (id, name, created_at) values ($1, $2, $3)
+		on conflict (id) do update set name = excluded.name, created_at = excluded.created_at
+	`
+
+	deleteMembers = `
+		delete from workspace_members where workspace_id = $1
 	`
 )
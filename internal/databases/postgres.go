@@ -0,0 +1,800 @@
+package databases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/salliko/reducer/config"
+	"sort"
+	"time"
+)
+
+type PostgresqlDatabase struct {
+	conn *pgxpool.Pool
+}
+
+func NewPostgresqlDatabase(cfg config.Config) (*PostgresqlDatabase, error) {
+	conn, err := pgxpool.Connect(context.Background(), cfg.DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrate(context.Background(), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgresqlDatabase{conn: conn}, nil
+}
+
+// migrate последовательно применяет ещё не применённые миграции.
+// Номер миграции — её индекс в migrations плюс один.
+func migrate(ctx context.Context, conn *pgxpool.Pool) error {
+	if _, err := conn.Exec(ctx, createMigrationsTable); err != nil {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockMigrations); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRow(ctx, selectMigrationVersion).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if _, err := tx.Exec(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(ctx, insertMigrationVersion, i+1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Close() {
+	p.conn.Close()
+}
+
+// PoolStat возвращает состояние пула соединений.
+func (p *PostgresqlDatabase) PoolStat() *pgxpool.Stat {
+	return p.conn.Stat()
+}
+
+// MigrationState сообщает, сколько миграций применено в базе.
+func (p *PostgresqlDatabase) MigrationState() (MigrationState, error) {
+	state := MigrationState{Known: len(migrations)}
+	err := p.conn.QueryRow(context.Background(), selectMigrationVersion).Scan(&state.Applied)
+	return state, err
+}
+
+func (p *PostgresqlDatabase) Ping() error {
+	return p.conn.Ping(context.Background())
+}
+
+func (p *PostgresqlDatabase) Create(u URL) error {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertURL(ctx, tx, u); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// lockKeys занимает ключи keys до конца транзакции tx. Ключи берутся
+// по порядку, чтобы транзакции с общими ключами не ждали друг друга.
+func lockKeys(ctx context.Context, tx pgx.Tx, keys []string) error {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		if _, err := tx.Exec(ctx, lockKey, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertURL добавляет ссылку вместе с её тегами в транзакции tx.
+// Занятый ключ даёт ErrConflict.
+func insertURL(ctx context.Context, tx pgx.Tx, u URL) error {
+	if err := lockKeys(ctx, tx, []string{u.Hash}); err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, selectURLExists, u.Hash).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrConflict
+	}
+
+	var createdAt *time.Time
+	if !u.CreatedAt.IsZero() {
+		createdAt = &u.CreatedAt
+	}
+	_, err := tx.Exec(ctx, insert, u.Hash, u.Original, u.UserID, u.MaxClicks,
+		u.ActiveFrom, u.FallbackURL, u.ExpiresAt, u.PasswordHash, u.Title, u.Folder, u.WorkspaceID, u.Clicks, createdAt)
+	if err != nil {
+		return err
+	}
+	return setTags(ctx, tx, u)
+}
+
+// setTags заменяет теги ссылки на u.Tags, заводя недостающие теги владельца.
+func setTags(ctx context.Context, tx pgx.Tx, u URL) error {
+	if _, err := tx.Exec(ctx, deleteURLTags, u.Hash); err != nil {
+		return err
+	}
+	if len(u.Tags) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, insertTags, u.UserID, u.Tags); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, insertURLTags, u.Hash, u.UserID, u.Tags)
+	return err
+}
+
+// CreateMany сохраняет пакет одной транзакцией.
+func (p *PostgresqlDatabase) CreateMany(urls []URL) error {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	keys := make([]string, len(urls))
+	for i, v := range urls {
+		keys[i] = v.Hash
+	}
+	if err := lockKeys(ctx, tx, keys); err != nil {
+		return err
+	}
+	for _, v := range urls {
+		if err := insertURL(ctx, tx, v); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Flush() error {
+	return nil
+}
+
+// scanURL читает в u колонки urlColumns, а в dest — следующие за ними.
+func scanURL(row pgx.Row, u *URL, dest ...interface{}) error {
+	return row.Scan(append([]interface{}{
+		&u.Hash, &u.Original, &u.UserID, &u.MaxClicks, &u.Clicks,
+		&u.ActiveFrom, &u.FallbackURL, &u.ExpiresAt, &u.PasswordHash, &u.Title, &u.DeletedAt, &u.CreatedAt,
+		&u.Folder, &u.Tags, &u.WorkspaceID,
+	}, dest...)...)
+}
+
+// querier — общее у пула соединений и транзакции.
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// memberRole возвращает роль userID в пространстве workspaceID или
+// пустую строку, если пользователь в нём не состоит.
+func memberRole(ctx context.Context, q querier, workspaceID, userID string) (string, error) {
+	if workspaceID == "" {
+		return "", nil
+	}
+	var role string
+	err := q.QueryRow(ctx, selectMemberRole, workspaceID, userID).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// access проверяет права userID на ссылку u не ниже need.
+func access(ctx context.Context, q querier, u URL, userID, need string) error {
+	role, err := memberRole(ctx, q, u.WorkspaceID, userID)
+	if err != nil {
+		return err
+	}
+	err = checkAccess(u, userID, role, need)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("key %s: %w", u.Hash, ErrNotFound)
+	}
+	return err
+}
+
+// selectForUpdate блокирует ссылку в транзакции tx и проверяет,
+// что у userID есть на неё права не ниже need.
+func selectForUpdate(ctx context.Context, tx pgx.Tx, key, userID, need string) (URL, error) {
+	var u URL
+	var isDeleted bool
+	err := scanURL(tx.QueryRow(ctx, selectURLForUpdate, key), &u, &isDeleted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return URL{}, fmt.Errorf("key %s: %w", key, ErrNotFound)
+		}
+		return URL{}, err
+	}
+	if err := access(ctx, tx, u, userID, need); err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (p *PostgresqlDatabase) Select(key string) (URL, error) {
+	var u URL
+	var isDeleted bool
+	err := scanURL(p.conn.QueryRow(context.Background(), selectURL, key), &u, &isDeleted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return URL{}, fmt.Errorf("key %s: %w", key, ErrNotFound)
+		}
+		return URL{}, err
+	}
+	if isDeleted {
+		return URL{}, ErrGone
+	}
+	return u, nil
+}
+
+func (p *PostgresqlDatabase) SelectMany(keys []string) ([]URL, error) {
+	var data []URL
+	rows, err := p.conn.Query(context.Background(), selectURLs, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u URL
+		if err := scanURL(rows, &u); err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	return data, rows.Err()
+}
+
+func (p *PostgresqlDatabase) Totals() (t Totals, err error) {
+	err = p.conn.QueryRow(context.Background(), countURLs).Scan(&t.URLs, &t.Users)
+	return t, err
+}
+
+func (p *PostgresqlDatabase) Visit(key string) (URL, error) {
+	var u URL
+	// Условный update не даст двум одновременным запросам израсходовать
+	// последний переход: второй просто не найдёт подходящей строки.
+	err := scanURL(p.conn.QueryRow(context.Background(), incrementClicks, key), &u)
+	if err == nil {
+		return u, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return URL{}, err
+	}
+
+	u, err = p.Select(key)
+	if err != nil {
+		return URL{}, err
+	}
+	if err := checkVisit(u, time.Now()); errors.Is(err, ErrNotActive) {
+		return u, err
+	}
+	return URL{}, ErrGone
+}
+
+func (p *PostgresqlDatabase) AddClicks(clicks map[string]int) error {
+	keys := make([]string, 0, len(clicks))
+	counts := make([]int32, 0, len(clicks))
+	for key, n := range clicks {
+		keys = append(keys, key)
+		counts = append(counts, int32(n))
+	}
+	_, err := p.conn.Exec(context.Background(), addClicks, keys, counts)
+	return err
+}
+
+func (p *PostgresqlDatabase) SelectAll(userID string) ([]URL, error) {
+	var data []URL
+	rows, err := p.conn.Query(context.Background(), selectAllUserRows, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u URL
+		err := scanURL(rows, &u)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	return data, rows.Err()
+}
+
+func (p *PostgresqlDatabase) List(q Query) (Page, error) {
+	var data []URL
+	err := p.query(q, func(u URL) error {
+		data = append(data, u)
+		return nil
+	})
+	if err != nil {
+		return Page{}, err
+	}
+
+	q, _ = q.Normalize()
+	return paginate(data, q), nil
+}
+
+func (p *PostgresqlDatabase) Iterate(q Query, fn func(URL) error) error {
+	q.Limit, q.Cursor = 0, ""
+	return p.query(q, fn)
+}
+
+// query выполняет выборку q и передаёт fn строки по мере их чтения.
+func (p *PostgresqlDatabase) query(q Query, fn func(URL) error) error {
+	if q.WorkspaceID != "" {
+		role, err := memberRole(context.Background(), p.conn, q.WorkspaceID, q.UserID)
+		if err != nil {
+			return err
+		}
+		if err := checkRole(role, RoleViewer); err != nil {
+			return err
+		}
+	}
+
+	query, args, err := buildListQuery(q, postgresDialect)
+	if err != nil {
+		return err
+	}
+
+	rows, err := p.conn.Query(context.Background(), query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u URL
+		if err := scanURL(rows, &u); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *PostgresqlDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return URL{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	u, err := selectForUpdate(ctx, tx, key, userID, RoleEditor)
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Deleted() {
+		return URL{}, ErrGone
+	}
+	prev := u.Revision(0, time.Now())
+
+	if err := edit(&u); err != nil {
+		return URL{}, err
+	}
+
+	_, err = tx.Exec(ctx, insertRevision, key, prev.Original, prev.ExpiresAt, prev.PasswordHash, prev.Title)
+	if err != nil {
+		return URL{}, err
+	}
+	_, err = tx.Exec(ctx, updateURL, key, u.Original, u.ExpiresAt, u.PasswordHash, u.Title, u.Folder)
+	if err != nil {
+		return URL{}, err
+	}
+	if err := setTags(ctx, tx, u); err != nil {
+		return URL{}, err
+	}
+
+	return u, tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Revisions(key, userID string) ([]Revision, error) {
+	u, err := p.Select(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := access(context.Background(), p.conn, u, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.conn.Query(context.Background(), selectRevisions, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var data []Revision
+	for rows.Next() {
+		var r Revision
+		err := rows.Scan(&r.Version, &r.Original, &r.ExpiresAt, &r.PasswordHash, &r.Title, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, r)
+	}
+	return data, rows.Err()
+}
+
+func (p *PostgresqlDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return URL{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	u, err := selectForUpdate(ctx, tx, key, userID, RoleEditor)
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Purgeable(since) {
+		return URL{}, ErrGone
+	}
+
+	if err := scanURL(tx.QueryRow(ctx, restoreURL, key), &u); err != nil {
+		return URL{}, err
+	}
+	return u, tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Purge(userID string, before time.Time) (int, error) {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, purgeRevisions, before, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, purgeURLTags, before, userID); err != nil {
+		return 0, err
+	}
+	tag, err := tx.Exec(ctx, purgeURLs, before, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Delete(key, userID string) error {
+	_, err := p.conn.Exec(context.Background(), deleteURL, key, userID, rolesAtLeast(RoleEditor))
+	return err
+}
+
+func (p *PostgresqlDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, insertWorkspace, w.ID, w.Name, w.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrConflict
+	}
+	if _, err := tx.Exec(ctx, upsertMember, w.ID, ownerID, RoleOwner); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Workspaces(userID string) ([]Workspace, error) {
+	rows, err := p.conn.Query(context.Background(), selectUserWorkspaces, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var data []Workspace
+	for rows.Next() {
+		var w Workspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.CreatedAt, &w.Role); err != nil {
+			return nil, err
+		}
+		data = append(data, w)
+	}
+	return data, rows.Err()
+}
+
+// selectMembers читает роли участников пространства, блокируя их
+// до конца транзакции tx.
+func selectMembers(ctx context.Context, tx pgx.Tx, workspaceID string) (map[string]string, error) {
+	rows, err := tx.Query(ctx, selectMembersForUpdate, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string]string)
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return nil, err
+		}
+		members[userID] = role
+	}
+	return members, rows.Err()
+}
+
+func (p *PostgresqlDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	members, err := selectMembers(ctx, tx, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRole(members[userID], RoleViewer); err != nil {
+		return nil, err
+	}
+
+	var data []Member
+	for member, role := range members {
+		data = append(data, Member{WorkspaceID: workspaceID, UserID: member, Role: role})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].UserID < data[j].UserID })
+	return data, tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) SetMember(actorID string, m Member) error {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	members, err := selectMembers(ctx, tx, m.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	if err := checkMemberChange(members, actorID, m); err != nil {
+		return err
+	}
+
+	if m.Role == "" {
+		_, err = tx.Exec(ctx, deleteMember, m.WorkspaceID, m.UserID)
+	} else {
+		_, err = tx.Exec(ctx, upsertMember, m.WorkspaceID, m.UserID, m.Role)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	if fromID == "" {
+		fromID = userID
+	}
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	role, err := memberRole(ctx, tx, workspaceID, userID)
+	if err != nil {
+		return 0, err
+	}
+	fromRole, err := memberRole(ctx, tx, workspaceID, fromID)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkTransfer(userID, fromID, role, fromRole); err != nil {
+		return 0, err
+	}
+
+	if len(keys) == 0 {
+		tag, err := tx.Exec(ctx, transferUserURLs, workspaceID, fromID)
+		if err != nil {
+			return 0, err
+		}
+		return int(tag.RowsAffected()), tx.Commit(ctx)
+	}
+
+	for _, key := range keys {
+		u, err := selectForUpdate(ctx, tx, key, fromID, RoleEditor)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkTransferURL(u, userID, fromID); err != nil {
+			return 0, err
+		}
+	}
+	tag, err := tx.Exec(ctx, transferURLs, workspaceID, keys)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) Dump(after string, fn func(Record) error) error {
+	rows, err := p.conn.Query(context.Background(), dumpURLs, after)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec Record
+		var revisions []byte
+		if err := scanURL(rows, &rec.URL, &revisions); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(revisions, &rec.Revisions); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Load сохраняет пакет в одной транзакции.
+func (p *PostgresqlDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	keys := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		keys = append(keys, rec.URL.Hash)
+	}
+	if err := lockKeys(ctx, tx, keys); err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	rows, err := tx.Query(ctx, lockURLs, keys)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+	for _, rec := range recs {
+		u := rec.URL
+		if existing[u.Hash] {
+			conflicts = append(conflicts, u.Hash)
+			if !overwrite {
+				continue
+			}
+			for _, query := range []string{purgeLoadedRevisions, purgeLoadedURLTags, purgeLoadedURLs} {
+				if _, err := tx.Exec(ctx, query, []string{u.Hash}); err != nil {
+					return nil, err
+				}
+			}
+		}
+		existing[u.Hash] = true
+
+		_, err := tx.Exec(ctx, loadURL, u.Hash, u.Original, u.UserID, u.MaxClicks, u.Clicks, u.ActiveFrom,
+			u.FallbackURL, u.ExpiresAt, u.PasswordHash, u.Title, u.DeletedAt, u.CreatedAt, u.Folder, u.WorkspaceID)
+		if err != nil {
+			return nil, err
+		}
+		if err := setTags(ctx, tx, u); err != nil {
+			return nil, err
+		}
+		for _, r := range rec.Revisions {
+			_, err := tx.Exec(ctx, loadRevision, u.Hash, r.Version, r.Original, r.ExpiresAt, r.PasswordHash, r.Title, r.CreatedAt)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return conflicts, tx.Commit(ctx)
+}
+
+func (p *PostgresqlDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	rows, err := p.conn.Query(context.Background(), dumpWorkspaces)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec WorkspaceRecord
+		var members []byte
+		if err := rows.Scan(&rec.Workspace.ID, &rec.Workspace.Name, &rec.Workspace.CreatedAt, &members); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(members, &rec.Members); err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *PostgresqlDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	ctx := context.Background()
+	tx, err := p.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	w := rec.Workspace
+	var id string
+	err = tx.QueryRow(ctx, selectWorkspaceForUpdate, w.ID).Scan(&id)
+	if err == nil && !overwrite {
+		return ErrConflict
+	}
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, upsertWorkspace, w.ID, w.Name, w.CreatedAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, deleteMembers, w.ID); err != nil {
+		return err
+	}
+	for _, m := range rec.Members {
+		if _, err := tx.Exec(ctx, upsertMember, w.ID, m.UserID, m.Role); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
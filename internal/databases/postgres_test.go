@@ -0,0 +1,121 @@
+package databases
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/salliko/reducer/config"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// testPostgresDSN — адрес Postgres, в котором тесты заводят временные
+// базы. Без него тесты поднимают свой сервер, если найдут initdb.
+const testPostgresDSN = "TEST_DATABASE_DSN"
+
+var testPostgresDatabases int32
+
+// postgresBinary ищет программу Postgres в PATH и в каталогах, куда её
+// ставят пакеты дистрибутивов.
+func postgresBinary(name string) (string, bool) {
+	if path, err := exec.LookPath(name); err == nil {
+		return path, true
+	}
+	for _, pattern := range []string{"/usr/lib/postgresql/*/bin/", "/usr/local/pgsql/bin/", "/opt/homebrew/bin/"} {
+		matches, _ := filepath.Glob(pattern + name)
+		if len(matches) > 0 {
+			return matches[len(matches)-1], true
+		}
+	}
+	return "", false
+}
+
+// startTestPostgres поднимает одноразовый сервер Postgres во временном
+// каталоге и возвращает адрес его служебной базы. Сервер
+// останавливается вместе с тестом.
+func startTestPostgres(t *testing.T) string {
+	initdb, ok := postgresBinary("initdb")
+	if !ok {
+		t.Skipf("postgres: set %s or install initdb", testPostgresDSN)
+	}
+	pgCtl, ok := postgresBinary("pg_ctl")
+	if !ok {
+		t.Skipf("postgres: set %s or install pg_ctl", testPostgresDSN)
+	}
+	if os.Geteuid() == 0 {
+		t.Skipf("postgres: refuses to run as root, set %s", testPostgresDSN)
+	}
+
+	// Путь к сокету ограничен ~100 байтами, поэтому каталог берётся
+	// короткий, а не из t.TempDir.
+	dir, err := os.MkdirTemp("", "pg")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	data := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "--auth=trust", "--no-sync").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -c fsync=off", port, dir)
+	out, err = exec.Command(pgCtl, "-D", data, "-o", options, "-l", filepath.Join(dir, "log"), "-w", "start").CombinedOutput()
+	require.NoError(t, err, string(out))
+	t.Cleanup(func() {
+		exec.Command(pgCtl, "-D", data, "-m", "immediate", "-w", "stop").Run()
+	})
+
+	return fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+}
+
+// postgresOpener возвращает open для testConformance: каждый вызов
+// заводит в сервере чистую базу и удаляет её после теста.
+func postgresOpener(t *testing.T) func(t *testing.T) Database {
+	admin := os.Getenv(testPostgresDSN)
+	if admin == "" {
+		admin = startTestPostgres(t)
+	}
+	adminURL, err := url.Parse(admin)
+	require.NoError(t, err)
+
+	return func(t *testing.T) Database {
+		ctx := context.Background()
+		name := fmt.Sprintf("reducer_test_%d_%d", os.Getpid(), atomic.AddInt32(&testPostgresDatabases, 1))
+		conn, err := pgx.Connect(ctx, admin)
+		require.NoError(t, err)
+		defer conn.Close(ctx)
+		_, err = conn.Exec(ctx, "create database "+name)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			conn, err := pgx.Connect(ctx, admin)
+			if err != nil {
+				t.Log(err)
+				return
+			}
+			defer conn.Close(ctx)
+			if _, err := conn.Exec(ctx, "drop database if exists "+name); err != nil {
+				t.Log(err)
+			}
+		})
+
+		dsn := *adminURL
+		dsn.Path = "/" + name
+		db, err := NewPostgresqlDatabase(config.Config{DatabaseDSN: dsn.String()})
+		require.NoError(t, err)
+		t.Cleanup(db.Close)
+		return db
+	}
+}
+
+func TestPostgresqlDatabaseConformance(t *testing.T) {
+	testConformance(t, postgresOpener(t))
+}
@@ -0,0 +1,34 @@
+package databases
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"time"
+)
+
+// RunPurger раз в interval окончательно удаляет ссылки, пролежавшие
+// удалёнными дольше retention. Работает до отмены ctx; при interval <= 0
+// очистка выключена и RunPurger сразу возвращается.
+func RunPurger(ctx context.Context, db Database, retention, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := db.Purge("", time.Now().Add(-retention))
+			if err != nil {
+				zap.L().Error("purge deleted urls", zap.Error(err))
+				continue
+			}
+			if purged > 0 {
+				zap.L().Info("purged deleted urls", zap.Int("purged", purged))
+			}
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package databases
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New(`invalid cursor`)
+
+const (
+	SortCreated = "created"
+	SortClicks  = "clicks"
+)
+
+// Query описывает выборку ссылок пользователя для постраничного вывода.
+type Query struct {
+	UserID string
+	// WorkspaceID выбирает ссылки рабочего пространства, в котором
+	// состоит UserID, вместо личных ссылок пользователя.
+	WorkspaceID string
+	// Search — подстрока адреса или заголовка, без учёта регистра.
+	Search string
+	// Domain — хост оригинального адреса, без учёта регистра.
+	Domain string
+	// CreatedFrom и CreatedTo ограничивают время создания: [from, to).
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// Tags отбирает ссылки, у которых есть все перечисленные теги.
+	Tags   []string
+	Folder string
+	// Deleted отбирает только удалённые (true) или только действующие
+	// (false) ссылки; nil — все.
+	Deleted *bool
+	Sort    string
+	Desc    bool
+	Limit   int
+	// Cursor — значение Page.NextCursor предыдущей страницы.
+	Cursor string
+}
+
+// Page — страница выборки. Пустой NextCursor означает последнюю страницу.
+type Page struct {
+	URLs       []URL
+	NextCursor string
+}
+
+// cursor — позиция последней выданной ссылки в порядке сортировки.
+// Ключ ссылки разрешает равенство значений сортировки.
+type cursor struct {
+	Sort    string    `json:"s"`
+	Desc    bool      `json:"d,omitempty"`
+	Created time.Time `json:"c,omitempty"`
+	Clicks  int       `json:"n,omitempty"`
+	Hash    string    `json:"h"`
+}
+
+func newCursor(q Query, u URL) string {
+	c := cursor{Sort: q.Sort, Desc: q.Desc, Hash: u.Hash}
+	if q.Sort == SortClicks {
+		c.Clicks = u.Clicks
+	} else {
+		c.Created = u.CreatedAt
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor разбирает курсор и проверяет, что он выдан для того же
+// порядка сортировки, что и q.
+func decodeCursor(q Query) (*cursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != q.Sort || c.Desc != q.Desc {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// Normalize подставляет значения по умолчанию и проверяет запрос.
+func (q Query) Normalize() (Query, error) {
+	if q.Sort == "" {
+		q.Sort = SortCreated
+	}
+	if q.Sort != SortCreated && q.Sort != SortClicks {
+		return q, errors.New(`unknown sort ` + q.Sort)
+	}
+	if _, err := decodeCursor(q); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// Domain возвращает хост оригинального адреса ссылки в нижнем регистре.
+func (u URL) Domain() string {
+	parsed, err := url.Parse(u.Original)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// Match сообщает, подходит ли ссылка под фильтры запроса.
+// Курсор и сортировка не учитываются.
+func (q Query) Match(u URL) bool {
+	if q.WorkspaceID != "" {
+		if u.WorkspaceID != q.WorkspaceID {
+			return false
+		}
+	} else if !u.Personal(q.UserID) {
+		return false
+	}
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(u.Original), search) &&
+			!strings.Contains(strings.ToLower(u.Title), search) {
+			return false
+		}
+	}
+	if q.Domain != "" && u.Domain() != strings.ToLower(q.Domain) {
+		return false
+	}
+	if q.CreatedFrom != nil && u.CreatedAt.Before(*q.CreatedFrom) {
+		return false
+	}
+	if q.CreatedTo != nil && !u.CreatedAt.Before(*q.CreatedTo) {
+		return false
+	}
+	if !u.HasTags(q.Tags) {
+		return false
+	}
+	if q.Folder != "" && u.Folder != q.Folder {
+		return false
+	}
+	if q.Deleted != nil && u.Deleted() != *q.Deleted {
+		return false
+	}
+	return true
+}
+
+// less сравнивает ссылки в порядке сортировки запроса без учёта Desc.
+func (q Query) less(a, b URL) bool {
+	if q.Sort == SortClicks {
+		if a.Clicks != b.Clicks {
+			return a.Clicks < b.Clicks
+		}
+	} else if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.Hash < b.Hash
+}
+
+// after сообщает, что ссылка u идёт в выборке после курсора c.
+func (q Query) after(u URL, c *cursor) bool {
+	pos := URL{Hash: c.Hash, CreatedAt: c.Created, Clicks: c.Clicks}
+	if q.Desc {
+		return q.less(u, pos)
+	}
+	return q.less(pos, u)
+}
+
+// applyQuery отбирает, сортирует и режет на страницы ссылки хранилищ,
+// которые держат данные в памяти. rows не изменяется.
+func applyQuery(rows []URL, q Query) (Page, error) {
+	q, err := q.Normalize()
+	if err != nil {
+		return Page{}, err
+	}
+	c, _ := decodeCursor(q)
+
+	var data []URL
+	for _, u := range rows {
+		if q.Match(u) && (c == nil || q.after(u, c)) {
+			data = append(data, u)
+		}
+	}
+
+	sort.Slice(data, func(i, j int) bool {
+		if q.Desc {
+			return q.less(data[j], data[i])
+		}
+		return q.less(data[i], data[j])
+	})
+
+	return paginate(data, q), nil
+}
+
+// paginate обрезает отсортированную выборку до q.Limit и выставляет
+// курсор следующей страницы, если в data есть ещё ссылки.
+func paginate(data []URL, q Query) Page {
+	if q.Limit <= 0 || len(data) <= q.Limit {
+		return Page{URLs: data}
+	}
+	data = data[:q.Limit]
+	return Page{URLs: data, NextCursor: newCursor(q, data[len(data)-1])}
+}
@@ -0,0 +1,962 @@
+package databases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"sort"
+	"time"
+)
+
+const (
+	redisPrefix = "reducer:"
+	// redisRetries — сколько раз повторяется транзакция, ключи которой
+	// изменил кто-то другой.
+	redisRetries = 100
+	// redisDumpPage — сколько ссылок Dump и Purge читают за раз.
+	redisDumpPage = 500
+)
+
+var errRedisContention = errors.New(`redis: too many concurrent updates`)
+
+// RedisDatabase хранит ссылки в Redis или совместимом с ним хранилище.
+//
+// Ссылка лежит JSON-строкой под ключом url:<key>, её история — под
+// revisions:<key>. Множества user:<id> и workspace-urls:<id> индексируют
+// ключи ссылок по владельцу, упорядоченное множество urls — все ключи
+// для выгрузки по порядку. Изменения делаются транзакциями WATCH/MULTI,
+// а счётчик переходов — скриптами Lua, не трогающими индексов.
+//
+// Ссылка со сроком действия хранится ещё retention после его истечения,
+// чтобы владелец видел её в списке, а потом Redis удаляет её сам.
+// Индексы от таких ссылок чистятся при чтении.
+type RedisDatabase struct {
+	client    *redis.Client
+	retention time.Duration
+}
+
+func NewRedisDatabase(rawURL string, retention time.Duration) (*RedisDatabase, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisDatabase{client: client, retention: retention}, nil
+}
+
+func newRedisClient(rawURL string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func redisLinkKey(hash string) string        { return redisPrefix + "url:" + hash }
+func redisRevisionsKey(hash string) string   { return redisPrefix + "revisions:" + hash }
+func redisUserKey(userID string) string      { return redisPrefix + "user:" + userID }
+func redisWorkspaceURLsKey(id string) string { return redisPrefix + "workspace-urls:" + id }
+func redisWorkspaceKey(id string) string     { return redisPrefix + "workspace:" + id }
+func redisMembersKey(id string) string       { return redisPrefix + "members:" + id }
+
+var (
+	redisAllKey        = redisPrefix + "urls"
+	redisWorkspacesKey = redisPrefix + "workspaces"
+)
+
+// redisTotals считает неудалённые ссылки и их владельцев на стороне
+// Redis: KEYS[1] — индекс всех ссылок, ARGV[1] — префикс ключа ссылки.
+// Ссылки, которые Redis уже удалил по сроку, пропускаются.
+var redisTotals = redis.NewScript(`
+local urls, users, seen = 0, 0, {}
+for _, hash in ipairs(redis.call("ZRANGE", KEYS[1], 0, -1)) do
+	local data = redis.call("GET", ARGV[1] .. hash)
+	if data then
+		local u = cjson.decode(data)
+		if u.deleted_at == nil or u.deleted_at == cjson.null then
+			urls = urls + 1
+			if not seen[u.user_id] then
+				seen[u.user_id] = true
+				users = users + 1
+			end
+		end
+	end
+end
+return {urls, users}
+`)
+
+// redisAddClicks прибавляет к счётчикам ссылок KEYS переходы ARGV,
+// не трогая индексов и срока жизни ключа.
+var redisAddClicks = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	local data = redis.call("GET", key)
+	if data then
+		local u = cjson.decode(data)
+		u.clicks = (tonumber(u.clicks) or 0) + tonumber(ARGV[i])
+		local ttl = redis.call("PTTL", key)
+		redis.call("SET", key, cjson.encode(u))
+		if ttl > 0 then
+			redis.call("PEXPIRE", key, ttl)
+		end
+	end
+end
+return 0
+`)
+
+// redisVisit засчитывает переход по ссылке KEYS[1], если она не удалена
+// и её лимит переходов не исчерпан, и возвращает ссылку с новым
+// счётчиком. Индексы и срок жизни ключа не меняются.
+var redisVisit = redis.NewScript(`
+local data = redis.call("GET", KEYS[1])
+if not data then
+	return false
+end
+local u = cjson.decode(data)
+local clicks = tonumber(u.clicks) or 0
+local max = tonumber(u.max_clicks) or 0
+if (u.deleted_at ~= nil and u.deleted_at ~= cjson.null) or (max > 0 and clicks >= max) then
+	return false
+end
+u.clicks = clicks + 1
+data = cjson.encode(u)
+local ttl = redis.call("PTTL", KEYS[1])
+redis.call("SET", KEYS[1], data)
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return data
+`)
+
+// atomic выполняет fn в транзакции, следящей за keys, и повторяет её,
+// если ключи изменились до EXEC.
+func (r *RedisDatabase) atomic(fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < redisRetries; i++ {
+		err := r.client.Watch(context.Background(), fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return errRedisContention
+}
+
+func redisGet(c redis.Cmdable, key string) (URL, error) {
+	data, err := c.Get(context.Background(), redisLinkKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return URL{}, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return URL{}, err
+	}
+	var u URL
+	err = json.Unmarshal(data, &u)
+	return u, err
+}
+
+// expireAt возвращает момент, когда Redis может удалить ссылку u,
+// или nil для бессрочной ссылки.
+func (r *RedisDatabase) expireAt(u URL) *time.Time {
+	if u.ExpiresAt == nil {
+		return nil
+	}
+	t := u.ExpiresAt.Add(r.retention)
+	return &t
+}
+
+// put сохраняет ссылку u, заменившую prev, и переносит её в индексах.
+func (r *RedisDatabase) put(pipe redis.Pipeliner, prev *URL, u URL) error {
+	ctx := context.Background()
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		pipe.SRem(ctx, redisUserKey(prev.UserID), prev.Hash)
+		if prev.WorkspaceID != "" {
+			pipe.SRem(ctx, redisWorkspaceURLsKey(prev.WorkspaceID), prev.Hash)
+		}
+	}
+	// SET сбрасывает прежний срок жизни ключа.
+	pipe.Set(ctx, redisLinkKey(u.Hash), data, 0)
+	if t := r.expireAt(u); t != nil {
+		pipe.PExpireAt(ctx, redisLinkKey(u.Hash), *t)
+		pipe.PExpireAt(ctx, redisRevisionsKey(u.Hash), *t)
+	} else {
+		pipe.Persist(ctx, redisRevisionsKey(u.Hash))
+	}
+	pipe.SAdd(ctx, redisUserKey(u.UserID), u.Hash)
+	if u.WorkspaceID != "" {
+		pipe.SAdd(ctx, redisWorkspaceURLsKey(u.WorkspaceID), u.Hash)
+	}
+	pipe.ZAdd(ctx, redisAllKey, &redis.Z{Member: u.Hash})
+	return nil
+}
+
+// putRevisions заменяет историю ссылки u.
+func (r *RedisDatabase) putRevisions(pipe redis.Pipeliner, u URL, revisions []Revision) error {
+	ctx := context.Background()
+	key := redisRevisionsKey(u.Hash)
+	if len(revisions) == 0 {
+		pipe.Del(ctx, key)
+		return nil
+	}
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, key, data, 0)
+	if t := r.expireAt(u); t != nil {
+		pipe.PExpireAt(ctx, key, *t)
+	}
+	return nil
+}
+
+// remove окончательно удаляет ссылку вместе с историей и индексами.
+func (r *RedisDatabase) remove(pipe redis.Pipeliner, u URL) {
+	ctx := context.Background()
+	pipe.Del(ctx, redisLinkKey(u.Hash), redisRevisionsKey(u.Hash))
+	pipe.SRem(ctx, redisUserKey(u.UserID), u.Hash)
+	if u.WorkspaceID != "" {
+		pipe.SRem(ctx, redisWorkspaceURLsKey(u.WorkspaceID), u.Hash)
+	}
+	pipe.ZRem(ctx, redisAllKey, u.Hash)
+}
+
+func redisRevisions(c redis.Cmdable, key string) ([]Revision, error) {
+	data, err := c.Get(context.Background(), redisRevisionsKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision
+	err = json.Unmarshal(data, &revisions)
+	return revisions, err
+}
+
+// links читает ссылки hashes одним MGET. Ключи, которых уже нет —
+// Redis удалил просроченную ссылку, — убираются из индекса index.
+func (r *RedisDatabase) links(index string, hashes []string) ([]URL, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	ctx := context.Background()
+	keys := make([]string, len(hashes))
+	for i, hash := range hashes {
+		keys[i] = redisLinkKey(hash)
+	}
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []URL
+	var stale []interface{}
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			stale = append(stale, hashes[i])
+			continue
+		}
+		var u URL
+		if err := json.Unmarshal([]byte(s), &u); err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	if len(stale) > 0 && index != "" {
+		if err := r.client.SRem(ctx, index, stale...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// owned возвращает ссылки из индекса index.
+func (r *RedisDatabase) owned(index string) ([]URL, error) {
+	hashes, err := r.client.SMembers(context.Background(), index).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hashes)
+	return r.links(index, hashes)
+}
+
+func redisMemberRole(c redis.Cmdable, workspaceID, userID string) (string, error) {
+	if workspaceID == "" {
+		return "", nil
+	}
+	role, err := c.HGet(context.Background(), redisMembersKey(workspaceID), userID).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return role, err
+}
+
+// redisAccess ищет ссылку, на которую у userID есть права не ниже need.
+func redisAccess(c redis.Cmdable, key, userID, need string) (URL, error) {
+	u, err := redisGet(c, key)
+	if err != nil {
+		return URL{}, err
+	}
+	role, err := redisMemberRole(c, u.WorkspaceID, userID)
+	if err != nil {
+		return URL{}, err
+	}
+	err = checkAccess(u, userID, role, need)
+	if errors.Is(err, ErrNotFound) {
+		return URL{}, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	return u, err
+}
+
+func (r *RedisDatabase) Close() {
+	r.client.Close()
+}
+
+func (r *RedisDatabase) Ping() error {
+	return r.client.Ping(context.Background()).Err()
+}
+
+func (r *RedisDatabase) Create(u URL) error {
+	return r.atomic(func(tx *redis.Tx) error {
+		n, err := tx.Exists(context.Background(), redisLinkKey(u.Hash)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrConflict
+		}
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = time.Now().UTC()
+		}
+		_, err = tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			return r.put(pipe, nil, u)
+		})
+		return err
+	}, redisLinkKey(u.Hash))
+}
+
+// CreateMany проверяет, что ни одного ключа пакета ещё нет, и записывает
+// пакет одним конвейером MULTI/EXEC: целиком или никак.
+func (r *RedisDatabase) CreateMany(urls []URL) error {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(urls))
+	seen := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		if seen[u.Hash] {
+			return ErrConflict
+		}
+		seen[u.Hash] = true
+		keys = append(keys, redisLinkKey(u.Hash))
+	}
+
+	return r.atomic(func(tx *redis.Tx) error {
+		n, err := tx.Exists(context.Background(), keys...).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrConflict
+		}
+		now := time.Now().UTC()
+		_, err = tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			for _, u := range urls {
+				if u.CreatedAt.IsZero() {
+					u.CreatedAt = now
+				}
+				if err := r.put(pipe, nil, u); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+}
+
+func (r *RedisDatabase) Flush() error {
+	return nil
+}
+
+func (r *RedisDatabase) Select(key string) (URL, error) {
+	u, err := redisGet(r.client, key)
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Deleted() {
+		return URL{}, ErrGone
+	}
+	return u, nil
+}
+
+func (r *RedisDatabase) SelectMany(keys []string) ([]URL, error) {
+	return r.links("", keys)
+}
+
+func (r *RedisDatabase) Totals() (Totals, error) {
+	counts, err := redisTotals.Run(context.Background(), r.client, []string{redisAllKey}, redisLinkKey("")).Int64Slice()
+	if err != nil {
+		return Totals{}, err
+	}
+	return Totals{URLs: int(counts[0]), Users: int(counts[1])}, nil
+}
+
+// Visit проверяет сроки ссылки по прочитанной копии, а счётчик
+// увеличивает скриптом redisVisit: переходы не конкурируют друг
+// с другом за ключ, а лимит переходов проверяется атомарно.
+func (r *RedisDatabase) Visit(key string) (URL, error) {
+	u, err := redisGet(r.client, key)
+	if err != nil {
+		return URL{}, err
+	}
+	if err := checkVisit(u, time.Now()); err != nil {
+		if errors.Is(err, ErrNotActive) {
+			return u, err
+		}
+		return URL{}, err
+	}
+
+	data, err := redisVisit.Run(context.Background(), r.client, []string{redisLinkKey(key)}).Text()
+	if errors.Is(err, redis.Nil) {
+		// Ссылку удалили или исчерпали, пока шёл переход.
+		return URL{}, ErrGone
+	}
+	if err != nil {
+		return URL{}, err
+	}
+	u = URL{}
+	err = json.Unmarshal([]byte(data), &u)
+	return u, err
+}
+
+func (r *RedisDatabase) AddClicks(clicks map[string]int) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(clicks))
+	counts := make([]interface{}, 0, len(clicks))
+	for key, n := range clicks {
+		keys = append(keys, redisLinkKey(key))
+		counts = append(counts, n)
+	}
+	return redisAddClicks.Run(context.Background(), r.client, keys, counts...).Err()
+}
+
+func (r *RedisDatabase) SelectAll(userID string) ([]URL, error) {
+	rows, err := r.owned(redisUserKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	var data []URL
+	for _, u := range rows {
+		if u.Personal(userID) {
+			data = append(data, u)
+		}
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].CreatedAt.Before(data[j].CreatedAt) })
+	return data, nil
+}
+
+// snapshot читает ссылки, среди которых ищется выборка q.
+func (r *RedisDatabase) snapshot(q Query) ([]URL, error) {
+	if q.WorkspaceID == "" {
+		return r.owned(redisUserKey(q.UserID))
+	}
+	role, err := redisMemberRole(r.client, q.WorkspaceID, q.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRole(role, RoleViewer); err != nil {
+		return nil, err
+	}
+	return r.owned(redisWorkspaceURLsKey(q.WorkspaceID))
+}
+
+func (r *RedisDatabase) List(q Query) (Page, error) {
+	rows, err := r.snapshot(q)
+	if err != nil {
+		return Page{}, err
+	}
+	return applyQuery(rows, q)
+}
+
+func (r *RedisDatabase) Iterate(q Query, fn func(URL) error) error {
+	rows, err := r.snapshot(q)
+	if err != nil {
+		return err
+	}
+	q.Limit, q.Cursor = 0, ""
+	page, err := applyQuery(rows, q)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range page.URLs {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RedisDatabase) Update(key, userID string, edit func(*URL) error) (u URL, err error) {
+	err = r.atomic(func(tx *redis.Tx) error {
+		prev, err := redisAccess(tx, key, userID, RoleEditor)
+		if err != nil {
+			return err
+		}
+		if prev.Deleted() {
+			return ErrGone
+		}
+		u = prev
+		if err := edit(&u); err != nil {
+			return err
+		}
+
+		revisions, err := redisRevisions(tx, key)
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, prev.Revision(len(revisions)+1, time.Now()))
+		_, err = tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			if err := r.put(pipe, &prev, u); err != nil {
+				return err
+			}
+			return r.putRevisions(pipe, u, revisions)
+		})
+		return err
+	}, redisLinkKey(key), redisRevisionsKey(key))
+	if err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (r *RedisDatabase) Revisions(key, userID string) ([]Revision, error) {
+	if _, err := redisAccess(r.client, key, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+	return redisRevisions(r.client, key)
+}
+
+func (r *RedisDatabase) Restore(key, userID string, since time.Time) (u URL, err error) {
+	err = r.atomic(func(tx *redis.Tx) error {
+		prev, err := redisAccess(tx, key, userID, RoleEditor)
+		if err != nil {
+			return err
+		}
+		if prev.Purgeable(since) {
+			return ErrGone
+		}
+		u = prev
+		u.DeletedAt = nil
+		_, err = tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			return r.put(pipe, &prev, u)
+		})
+		return err
+	}, redisLinkKey(key))
+	if err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+// Purge обходит все ссылки страницами и удаляет подходящие, следя
+// за каждой, чтобы не удалить ссылку, которую тем временем восстановили.
+func (r *RedisDatabase) Purge(userID string, before time.Time) (int, error) {
+	purged := 0
+	err := r.Dump("", func(rec Record) error {
+		u := rec.URL
+		if !u.Purgeable(before) || userID != "" && !u.Personal(userID) {
+			return nil
+		}
+		err := r.atomic(func(tx *redis.Tx) error {
+			cur, err := redisGet(tx, u.Hash)
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			if err != nil || !cur.Purgeable(before) {
+				return err
+			}
+			_, err = tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+				r.remove(pipe, cur)
+				return nil
+			})
+			if err == nil {
+				purged++
+			}
+			return err
+		}, redisLinkKey(u.Hash))
+		return err
+	})
+	return purged, err
+}
+
+// Delete помечает ссылку удалённой. Недоступные и уже удалённые ссылки
+// пропускаются молча, как и в PostgresqlDatabase.
+func (r *RedisDatabase) Delete(key, userID string) error {
+	return r.atomic(func(tx *redis.Tx) error {
+		prev, err := redisAccess(tx, key, userID, RoleEditor)
+		if err != nil || prev.Deleted() {
+			return nil
+		}
+		u := prev
+		now := time.Now()
+		u.DeletedAt = &now
+		_, err = tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			return r.put(pipe, &prev, u)
+		})
+		return err
+	}, redisLinkKey(key))
+}
+
+func (r *RedisDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	ctx := context.Background()
+	return r.atomic(func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, redisWorkspaceKey(w.ID)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrConflict
+		}
+		w.Role = ""
+		data, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, redisWorkspaceKey(w.ID), data, 0)
+			pipe.SAdd(ctx, redisWorkspacesKey, w.ID)
+			pipe.Del(ctx, redisMembersKey(w.ID))
+			pipe.HSet(ctx, redisMembersKey(w.ID), ownerID, RoleOwner)
+			return nil
+		})
+		return err
+	}, redisWorkspaceKey(w.ID))
+}
+
+func (r *RedisDatabase) workspace(id string) (Workspace, error) {
+	var w Workspace
+	data, err := r.client.Get(context.Background(), redisWorkspaceKey(id)).Bytes()
+	if err != nil {
+		return w, err
+	}
+	err = json.Unmarshal(data, &w)
+	return w, err
+}
+
+func (r *RedisDatabase) Workspaces(userID string) ([]Workspace, error) {
+	ids, err := r.client.SMembers(context.Background(), redisWorkspacesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []Workspace
+	for _, id := range ids {
+		role, err := redisMemberRole(r.client, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		if role == "" {
+			continue
+		}
+		w, err := r.workspace(id)
+		if err != nil {
+			return nil, err
+		}
+		w.Role = role
+		data = append(data, w)
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].CreatedAt.Before(data[j].CreatedAt) })
+	return data, nil
+}
+
+func (r *RedisDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	members, err := r.client.HGetAll(context.Background(), redisMembersKey(workspaceID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRole(members[userID], RoleViewer); err != nil {
+		return nil, err
+	}
+
+	var data []Member
+	for member, role := range members {
+		data = append(data, Member{WorkspaceID: workspaceID, UserID: member, Role: role})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].UserID < data[j].UserID })
+	return data, nil
+}
+
+func (r *RedisDatabase) SetMember(actorID string, m Member) error {
+	ctx := context.Background()
+	key := redisMembersKey(m.WorkspaceID)
+	return r.atomic(func(tx *redis.Tx) error {
+		members, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if err := checkMemberChange(members, actorID, m); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if m.Role == "" {
+				pipe.HDel(ctx, key, m.UserID)
+			} else {
+				pipe.HSet(ctx, key, m.UserID, m.Role)
+			}
+			return nil
+		})
+		return err
+	}, key)
+}
+
+func (r *RedisDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (transferred int, err error) {
+	if fromID == "" {
+		fromID = userID
+	}
+	ctx := context.Background()
+	err = r.atomic(func(tx *redis.Tx) error {
+		members, err := tx.HGetAll(ctx, redisMembersKey(workspaceID)).Result()
+		if err != nil {
+			return err
+		}
+		if err := checkTransfer(userID, fromID, members[userID], members[fromID]); err != nil {
+			return err
+		}
+
+		hashes := uniqueKeys(keys)
+		if len(hashes) == 0 {
+			if hashes, err = tx.SMembers(ctx, redisUserKey(fromID)).Result(); err != nil {
+				return err
+			}
+		}
+		if len(hashes) == 0 {
+			transferred = 0
+			return nil
+		}
+		watched := make([]string, len(hashes))
+		for i, hash := range hashes {
+			watched[i] = redisLinkKey(hash)
+		}
+		if err := tx.Watch(ctx, watched...).Err(); err != nil {
+			return err
+		}
+
+		var rows []URL
+		for _, hash := range hashes {
+			u, err := redisAccess(tx, hash, fromID, RoleEditor)
+			if len(keys) == 0 {
+				// Личные ссылки берутся из индекса, где могли остаться
+				// ключи просроченных или уже переданных ссылок.
+				if err != nil || !u.Personal(fromID) {
+					continue
+				}
+			} else if err != nil {
+				return err
+			}
+			if err := checkTransferURL(u, userID, fromID); err != nil {
+				return err
+			}
+			rows = append(rows, u)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := range rows {
+				u := rows[i]
+				u.WorkspaceID = workspaceID
+				if err := r.put(pipe, &rows[i], u); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		transferred = len(rows)
+		return err
+	}, redisMembersKey(workspaceID), redisUserKey(fromID))
+	if err != nil {
+		return 0, err
+	}
+	return transferred, nil
+}
+
+// Dump читает ключи из упорядоченного множества страницами и вызывает
+// fn между запросами.
+func (r *RedisDatabase) Dump(after string, fn func(Record) error) error {
+	ctx := context.Background()
+	for {
+		min := "-"
+		if after != "" {
+			min = "(" + after
+		}
+		hashes, err := r.client.ZRangeByLex(ctx, redisAllKey, &redis.ZRangeBy{
+			Min: min, Max: "+", Count: redisDumpPage,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+
+		rows, err := r.links("", hashes)
+		if err != nil {
+			return err
+		}
+		if len(rows) < len(hashes) {
+			// Redis удалил просроченные ссылки — убираем их ключи из порядка.
+			present := make(map[string]bool, len(rows))
+			for _, u := range rows {
+				present[u.Hash] = true
+			}
+			for _, hash := range hashes {
+				if !present[hash] {
+					if err := r.client.ZRem(ctx, redisAllKey, hash).Err(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		for _, u := range rows {
+			revisions, err := redisRevisions(r.client, u.Hash)
+			if err != nil {
+				return err
+			}
+			if err := fn(Record{URL: u, Revisions: revisions}); err != nil {
+				return err
+			}
+		}
+		if len(hashes) < redisDumpPage {
+			return nil
+		}
+		after = hashes[len(hashes)-1]
+	}
+}
+
+// Load записывает пакет одной транзакцией.
+func (r *RedisDatabase) Load(recs []Record, overwrite bool) (conflicts []string, err error) {
+	if len(recs) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		keys = append(keys, redisLinkKey(rec.URL.Hash))
+	}
+
+	err = r.atomic(func(tx *redis.Tx) error {
+		conflicts = nil
+		current := make(map[string]*URL, len(recs))
+		for _, rec := range recs {
+			key := rec.URL.Hash
+			if _, ok := current[key]; ok {
+				continue
+			}
+			u, err := redisGet(tx, key)
+			if errors.Is(err, ErrNotFound) {
+				current[key] = nil
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			current[key] = &u
+		}
+
+		_, err := tx.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+			for _, rec := range recs {
+				key := rec.URL.Hash
+				prev := current[key]
+				if prev != nil {
+					conflicts = append(conflicts, key)
+					if !overwrite {
+						continue
+					}
+				}
+				if err := r.put(pipe, prev, rec.URL); err != nil {
+					return err
+				}
+				if err := r.putRevisions(pipe, rec.URL, rec.Revisions); err != nil {
+					return err
+				}
+				u := rec.URL
+				current[key] = &u
+			}
+			return nil
+		})
+		return err
+	}, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+func (r *RedisDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	ids, err := r.client.SMembers(context.Background(), redisWorkspacesKey).Result()
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		w, err := r.workspace(id)
+		if err != nil {
+			return err
+		}
+		members, err := r.client.HGetAll(context.Background(), redisMembersKey(id)).Result()
+		if err != nil {
+			return err
+		}
+		rec := WorkspaceRecord{Workspace: w}
+		for userID, role := range members {
+			rec.Members = append(rec.Members, Member{WorkspaceID: id, UserID: userID, Role: role})
+		}
+		sort.Slice(rec.Members, func(i, j int) bool { return rec.Members[i].UserID < rec.Members[j].UserID })
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RedisDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	ctx := context.Background()
+	w := rec.Workspace
+	return r.atomic(func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, redisWorkspaceKey(w.ID)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 && !overwrite {
+			return ErrConflict
+		}
+		w.Role = ""
+		data, err := json.Marshal(w)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, redisWorkspaceKey(w.ID), data, 0)
+			pipe.SAdd(ctx, redisWorkspacesKey, w.ID)
+			pipe.Del(ctx, redisMembersKey(w.ID))
+			for _, m := range rec.Members {
+				pipe.HSet(ctx, redisMembersKey(w.ID), m.UserID, m.Role)
+			}
+			return nil
+		})
+		return err
+	}, redisWorkspaceKey(w.ID), redisMembersKey(w.ID))
+}
@@ -0,0 +1,282 @@
+package databases
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRedis(t *testing.T) (*RedisDatabase, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	db, err := NewRedisDatabase("redis://"+server.Addr(), 24*time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return db, server
+}
+
+func TestRedisDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		db, _ := newTestRedis(t)
+		return db
+	})
+}
+
+func TestRedisDatabaseExpiry(t *testing.T) {
+	db, server := newTestRedis(t)
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, db.Create(URL{Hash: "short", Original: "http://short.example", UserID: "user", ExpiresAt: &expires}))
+	require.NoError(t, db.Create(URL{Hash: "forever", Original: "http://forever.example", UserID: "user"}))
+
+	// Ключ живёт до истечения ссылки плюс срок хранения просроченных.
+	ttl := server.TTL(redisLinkKey("short"))
+	assert.InDelta(t, (25 * time.Hour).Seconds(), ttl.Seconds(), 60)
+	assert.Zero(t, server.TTL(redisLinkKey("forever")))
+
+	// Правка, снявшая срок действия, снимает и срок жизни ключа.
+	_, err := db.Update("short", "user", func(u *URL) error {
+		u.ExpiresAt = nil
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Zero(t, server.TTL(redisLinkKey("short")))
+
+	_, err = db.Update("short", "user", func(u *URL) error {
+		u.ExpiresAt = &expires
+		return nil
+	})
+	require.NoError(t, err)
+	server.FastForward(26 * time.Hour)
+
+	_, err = db.Select("short")
+	assert.ErrorIs(t, err, ErrNotFound)
+	all, err := db.SelectAll("user")
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, "forever", all[0].Hash)
+	// Индексы просроченной ссылки вычищаются при чтении.
+	members, err := server.SMembers(redisUserKey("user"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"forever"}, members)
+}
+
+func TestRedisDatabaseVisit(t *testing.T) {
+	db, server := newTestRedis(t)
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user", ExpiresAt: &expires}))
+	require.NoError(t, db.Create(URL{Hash: "limited", Original: "http://limited.example", UserID: "user", MaxClicks: 5}))
+	ttl := server.TTL(redisLinkKey("a"))
+
+	// Одновременные переходы не спорят за ключ и не теряются.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var visited, gone int
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := db.Visit("a")
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := db.Visit("limited")
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				visited++
+			} else {
+				assert.ErrorIs(t, err, ErrGone)
+				gone++
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 5, visited)
+	assert.Equal(t, 15, gone)
+
+	u, err := db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 20, u.Clicks)
+	assert.Equal(t, "http://a.example", u.Original)
+	assert.InDelta(t, ttl.Seconds(), server.TTL(redisLinkKey("a")).Seconds(), 1)
+
+	require.NoError(t, db.Delete("a", "user"))
+	_, err = db.Visit("a")
+	assert.ErrorIs(t, err, ErrGone)
+	_, err = db.Visit("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestRedisDatabaseWorkspacesAndDump(t *testing.T) {
+	db, _ := newTestRedis(t)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "alice"}))
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "alice"}))
+	require.NoError(t, db.CreateWorkspace(Workspace{ID: "team", Name: "Team"}, "alice"))
+	assert.ErrorIs(t, db.CreateWorkspace(Workspace{ID: "team"}, "bob"), ErrConflict)
+	require.NoError(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "bob", Role: RoleViewer}))
+	assert.ErrorIs(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "alice", Role: RoleViewer}), ErrLastOwner)
+
+	_, err := db.Transfer("team", "bob", "", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	transferred, err := db.Transfer("team", "alice", "", []string{"a"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, transferred)
+
+	page, err := db.List(Query{UserID: "bob", WorkspaceID: "team"})
+	require.NoError(t, err)
+	require.Len(t, page.URLs, 1)
+	assert.Equal(t, "a", page.URLs[0].Hash)
+
+	require.NoError(t, db.Delete("b", "alice"))
+	purged, err := db.Purge("alice", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	copied := NewMapDatabase()
+	require.NoError(t, db.DumpWorkspaces(func(rec WorkspaceRecord) error { return copied.LoadWorkspace(rec, false) }))
+	require.NoError(t, db.Dump("", func(rec Record) error {
+		_, err := copied.Load([]Record{rec}, false)
+		return err
+	}))
+	members, err := copied.Members("team", "bob")
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+	_, err = copied.Select("a")
+	assert.NoError(t, err)
+	_, err = copied.Select("b")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	conflicts, err := db.Load([]Record{{URL: URL{Hash: "a", Original: "http://other.example"}}}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, conflicts)
+}
+
+func TestRedisCacheDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		server := miniredis.RunT(t)
+		db, err := NewRedisCacheDatabase(NewMapDatabase(), "redis://"+server.Addr(), time.Hour)
+		require.NoError(t, err)
+		t.Cleanup(db.Close)
+		return db
+	})
+}
+
+func TestRedisCacheDatabase(t *testing.T) {
+	server := miniredis.RunT(t)
+	primary := NewMapDatabase()
+	db, err := NewRedisCacheDatabase(primary, "redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	defer db.Close()
+
+	expires := time.Now().Add(time.Minute)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user", ExpiresAt: &expires}))
+	_, err = db.Select("a")
+	require.NoError(t, err)
+	// Кеш не переживает срок действия ссылки.
+	assert.LessOrEqual(t, server.TTL(redisCacheKey("a")), time.Minute)
+
+	// Изменение в обход кеша не видно, пока запись в кеше жива.
+	_, err = primary.Update("a", "user", func(u *URL) error { u.Title = "direct"; return nil })
+	require.NoError(t, err)
+	u, err := db.Select("a")
+	require.NoError(t, err)
+	assert.Empty(t, u.Title)
+
+	_, err = db.Update("a", "user", func(u *URL) error { u.Title = "cached"; return nil })
+	require.NoError(t, err)
+	u, err = db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, "cached", u.Title)
+
+	_, err = db.Visit("a")
+	require.NoError(t, err)
+	u, err = db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, u.Clicks)
+
+	require.NoError(t, db.Delete("a", "user"))
+	assert.False(t, server.Exists(redisCacheKey("a")))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+func TestRedisCacheDatabaseVisitFromCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	primary := &countingDatabase{MapDatabase: NewMapDatabase()}
+	db, err := NewRedisCacheDatabase(primary, "redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+
+	// Переход, как в ResolveURL: Select, затем Visit.
+	for i := 1; i <= 3; i++ {
+		_, err := db.Select("a")
+		require.NoError(t, err)
+		u, err := db.Visit("a")
+		require.NoError(t, err)
+		assert.Equal(t, i, u.Clicks)
+	}
+	assert.EqualValues(t, 1, primary.selects)
+	assert.EqualValues(t, 0, primary.visits)
+
+	require.NoError(t, db.Flush())
+	stored, err := primary.MapDatabase.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, stored.Clicks)
+	// Копия со старым счётчиком после отправки переходов сброшена.
+	assert.False(t, server.Exists(redisCacheKey("a")))
+	u, err := db.Select("a")
+	require.NoError(t, err)
+	assert.Equal(t, 3, u.Clicks)
+}
+
+// racingPrimary вызывает during после чтения ссылки или перехода,
+// но до того, как кеш получит ссылку.
+type racingPrimary struct {
+	Database
+	during func()
+}
+
+func (p *racingPrimary) Select(key string) (URL, error) {
+	u, err := p.Database.Select(key)
+	during := p.during
+	p.during = func() {}
+	during()
+	return u, err
+}
+
+func (p *racingPrimary) Visit(key string) (URL, error) {
+	u, err := p.Database.Visit(key)
+	during := p.during
+	p.during = func() {}
+	during()
+	return u, err
+}
+
+func TestRedisCacheDatabaseStaleRead(t *testing.T) {
+	server := miniredis.RunT(t)
+	primary := &racingPrimary{Database: NewMapDatabase(), during: func() {}}
+	db, err := NewRedisCacheDatabase(primary, "redis://"+server.Addr(), time.Hour)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "user"}))
+
+	// Ссылку удалили, пока её читали: прочитанное не должно попасть в кеш.
+	primary.during = func() { require.NoError(t, db.Delete("a", "user")) }
+	_, err = db.Select("a")
+	require.NoError(t, err)
+	assert.False(t, server.Exists(redisCacheKey("a")))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+
+	// То же для перехода.
+	require.NoError(t, db.Create(URL{Hash: "b", Original: "http://b.example", UserID: "user"}))
+	primary.during = func() { require.NoError(t, db.Delete("b", "user")) }
+	_, err = db.Visit("b")
+	require.NoError(t, err)
+	_, err = db.Select("b")
+	assert.ErrorIs(t, err, ErrGone)
+}
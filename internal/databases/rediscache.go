@@ -0,0 +1,288 @@
+package databases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// RedisCacheDatabase держит в Redis копии ссылок основного хранилища,
+// чтобы переходы не ходили за ссылкой в него. Кешируются только
+// действующие ссылки, и не дольше их срока действия. Всё, кроме
+// чтения ссылки по ключу, делает основное хранилище, а кеш после
+// изменений обновляется или сбрасывается. Ошибки Redis только
+// логируются: без кеша хранилище продолжает работать.
+//
+// Переход по действующей ссылке без лимита, которая есть в кеше, стоит
+// одного чтения из Redis: переходы копятся в процессе и уходят в
+// основное хранилище пакетом (см. clickBuffer), а также при Flush
+// и перед выборками, где видны счётчики.
+type RedisCacheDatabase struct {
+	// hits и misses идут первыми ради выравнивания для sync/atomic.
+	hits   uint64
+	misses uint64
+	Database
+	client *redis.Client
+	ttl    time.Duration
+	clicks *clickBuffer
+}
+
+func NewRedisCacheDatabase(primary Database, rawURL string, ttl time.Duration) (*RedisCacheDatabase, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &RedisCacheDatabase{Database: primary, client: client, ttl: ttl}
+	// Отправленные переходы идут через AddClicks кеша, чтобы копии
+	// ссылок со старыми счётчиками сбрасывались.
+	c.clicks = newClickBuffer(c)
+	return c, nil
+}
+
+// Unwrap возвращает основное хранилище.
+func (c *RedisCacheDatabase) Unwrap() Database { return c.Database }
+
+func (c *RedisCacheDatabase) CacheStats() CacheStats {
+	return CacheStats{Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses)}
+}
+
+// redisCacheVersionTTL — сколько живёт версия ключа кеша. Она должна
+// пережить любое чтение из основного хранилища.
+const redisCacheVersionTTL = time.Hour
+
+func redisCacheKey(hash string) string { return redisPrefix + "cache:" + hash }
+
+// redisCacheVersionKey — счётчик сбросов ключа hash. По нему store
+// узнаёт, что ссылку изменили, пока к ней шло обращение.
+func redisCacheVersionKey(hash string) string { return redisPrefix + "cache-version:" + hash }
+
+func (c *RedisCacheDatabase) logCache(op string, err error) {
+	if err != nil {
+		zap.L().Warn("redis cache failed", zap.String("op", op), zap.Error(err))
+	}
+}
+
+// version возвращает текущую версию ключа hash; у ключа без сбросов
+// она пустая.
+func (c *RedisCacheDatabase) version(ctx context.Context, client redis.Cmdable, hash string) (string, error) {
+	v, err := client.Get(ctx, redisCacheVersionKey(hash)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return v, err
+}
+
+// store кладёт ссылку в кеш до ближайшего из двух моментов: конца ttl
+// или истечения срока действия ссылки. Если версия ключа сменилась
+// с version, ссылка могла устареть и в кеш не попадает.
+func (c *RedisCacheDatabase) store(u URL, version string) {
+	ttl := c.ttl
+	if u.ExpiresAt != nil {
+		if left := time.Until(*u.ExpiresAt); left < ttl {
+			ttl = left
+		}
+	}
+	if ttl <= 0 || u.Deleted() {
+		return
+	}
+	data, err := json.Marshal(u)
+	if err != nil {
+		c.logCache("store", err)
+		return
+	}
+
+	ctx := context.Background()
+	err = c.client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := c.version(ctx, tx, u.Hash)
+		if err != nil || current != version {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, redisCacheKey(u.Hash), data, ttl)
+			return nil
+		})
+		return err
+	}, redisCacheVersionKey(u.Hash))
+	if errors.Is(err, redis.TxFailedErr) {
+		// Ключ сбросили, пока ссылка ложилась в кеш.
+		return
+	}
+	c.logCache("store", err)
+}
+
+// invalidate сбрасывает ключи keys и меняет их версии, чтобы идущие
+// обращения не положили в кеш ссылку до изменения.
+func (c *RedisCacheDatabase) invalidate(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	ctx := context.Background()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(ctx, redisCacheKey(key))
+			pipe.Incr(ctx, redisCacheVersionKey(key))
+			pipe.Expire(ctx, redisCacheVersionKey(key), redisCacheVersionTTL)
+		}
+		return nil
+	})
+	c.logCache("invalidate", err)
+}
+
+func (c *RedisCacheDatabase) Close() {
+	c.clicks.flushAndLog()
+	c.Database.Close()
+	c.client.Close()
+}
+
+// Flush сохраняет и отложенные записи основного хранилища, и переходы,
+// засчитанные кешем.
+func (c *RedisCacheDatabase) Flush() error {
+	clicksErr := c.clicks.flush()
+	if err := c.Database.Flush(); err != nil {
+		return err
+	}
+	return clicksErr
+}
+
+// cached возвращает копию ссылки key из кеша без отложенных переходов.
+func (c *RedisCacheDatabase) cached(key string) (URL, bool) {
+	data, err := c.client.Get(context.Background(), redisCacheKey(key)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			c.logCache("select", err)
+		}
+		return URL{}, false
+	}
+	var u URL
+	if err := json.Unmarshal(data, &u); err != nil {
+		return URL{}, false
+	}
+	return u, true
+}
+
+func (c *RedisCacheDatabase) Select(key string) (URL, error) {
+	if u, ok := c.cached(key); ok {
+		atomic.AddUint64(&c.hits, 1)
+		u.Clicks += c.clicks.pending(key)
+		return u, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	return c.fetch(key, func() (URL, error) { return c.Database.Select(key) })
+}
+
+// fetch выполняет обращение к основному хранилищу и кладёт вернувшуюся
+// ссылку в кеш, если ключ не сбрасывали, пока оно шло.
+func (c *RedisCacheDatabase) fetch(key string, op func() (URL, error)) (URL, error) {
+	version, verErr := c.version(context.Background(), c.client, key)
+	c.logCache("version", verErr)
+
+	u, err := op()
+	if err == nil && verErr == nil {
+		c.store(u, version)
+	}
+	return u, err
+}
+
+// Visit засчитывает переход по действующей ссылке без лимита из кеша
+// сам. Остальные переходы засчитывает основное хранилище, и ссылка
+// с новым счётчиком кладётся в кеш.
+func (c *RedisCacheDatabase) Visit(key string) (URL, error) {
+	if u, ok := c.cached(key); ok && u.MaxClicks == 0 && checkVisit(u, time.Now()) == nil {
+		u.Clicks += c.clicks.add(key)
+		return u, nil
+	}
+
+	u, err := c.fetch(key, func() (URL, error) { return c.Database.Visit(key) })
+	if errors.Is(err, ErrGone) {
+		c.invalidate(key)
+	}
+	return u, err
+}
+
+func (c *RedisCacheDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	return c.fetch(key, func() (URL, error) { return c.Database.Update(key, userID, edit) })
+}
+
+func (c *RedisCacheDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	return c.fetch(key, func() (URL, error) { return c.Database.Restore(key, userID, since) })
+}
+
+func (c *RedisCacheDatabase) Delete(key, userID string) error {
+	err := c.Database.Delete(key, userID)
+	c.invalidate(key)
+	return err
+}
+
+func (c *RedisCacheDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	if len(keys) == 0 {
+		owner := fromID
+		if owner == "" {
+			owner = userID
+		}
+		owned, err := c.Database.SelectAll(owner)
+		if err != nil {
+			return 0, err
+		}
+		for _, u := range owned {
+			keys = append(keys, u.Hash)
+		}
+		defer c.invalidate(keys...)
+		return c.Database.Transfer(workspaceID, userID, fromID, nil)
+	}
+	defer c.invalidate(keys...)
+	return c.Database.Transfer(workspaceID, userID, fromID, keys)
+}
+
+func (c *RedisCacheDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	keys := make([]string, len(recs))
+	for i, rec := range recs {
+		keys[i] = rec.URL.Hash
+	}
+	defer c.invalidate(keys...)
+	return c.Database.Load(recs, overwrite)
+}
+
+func (c *RedisCacheDatabase) AddClicks(clicks map[string]int) error {
+	keys := make([]string, 0, len(clicks))
+	for key := range clicks {
+		keys = append(keys, key)
+	}
+	defer c.invalidate(keys...)
+	return c.Database.AddClicks(clicks)
+}
+
+// Выборки, где видны счётчики переходов, сначала отправляют отложенные
+// переходы в основное хранилище.
+
+func (c *RedisCacheDatabase) SelectAll(userID string) ([]URL, error) {
+	if err := c.clicks.flush(); err != nil {
+		return nil, err
+	}
+	return c.Database.SelectAll(userID)
+}
+
+func (c *RedisCacheDatabase) List(q Query) (Page, error) {
+	if err := c.clicks.flush(); err != nil {
+		return Page{}, err
+	}
+	return c.Database.List(q)
+}
+
+func (c *RedisCacheDatabase) Iterate(q Query, fn func(URL) error) error {
+	if err := c.clicks.flush(); err != nil {
+		return err
+	}
+	return c.Database.Iterate(q, fn)
+}
+
+func (c *RedisCacheDatabase) Dump(after string, fn func(Record) error) error {
+	if err := c.clicks.flush(); err != nil {
+		return err
+	}
+	return c.Database.Dump(after, fn)
+}
@@ -0,0 +1,900 @@
+package databases
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"modernc.org/sqlite"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sqliteDriver = "sqlite"
+	// tagSeparator разделяет теги в выводе sqliteTagsExpr.
+	tagSeparator = "\x1f"
+	// sqliteDumpPage — сколько ссылок Dump читает одним запросом.
+	sqliteDumpPage = 500
+)
+
+func init() {
+	// Разбор хоста и регистронезависимый поиск делаются функциями Go,
+	// чтобы фильтры списка вели себя так же, как в остальных хранилищах.
+	sqlite.MustRegisterDeterministicScalarFunction("url_domain", 1, sqliteStringFunc(func(original string) string {
+		return URL{Original: original}.Domain()
+	}))
+	sqlite.MustRegisterDeterministicScalarFunction("fold", 1, sqliteStringFunc(strings.ToLower))
+}
+
+// sqliteStringFunc превращает строковую функцию в функцию SQL
+// с одним аргументом; null остаётся null.
+func sqliteStringFunc(f func(string) string) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		switch v := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return f(v), nil
+		case []byte:
+			return f(string(v)), nil
+		default:
+			return f(fmt.Sprint(v)), nil
+		}
+	}
+}
+
+var sqliteDialect = sqlDialect{
+	placeholder:   "?%d",
+	userURLs:      sqliteListURLs,
+	workspaceURLs: sqliteListWorkspaceURLs,
+	contains:      "instr(fold(%s), %s) > 0",
+	domain:        "url_domain(original)",
+	hasTags: func(params []string) string {
+		conds := make([]string, 0, len(params))
+		for _, p := range params {
+			conds = append(conds, fmt.Sprintf(`exists (
+				select 1 from url_tags ut join tags t on t.id = ut.tag_id
+				where ut.hash = urls.hash and t.name = %s
+			)`, p))
+		}
+		return strings.Join(conds, " and ")
+	},
+	deleted:    "is_deleted is true",
+	notDeleted: "is_deleted is not true",
+}
+
+// SQLiteDatabase хранит ссылки во встроенной базе SQLite в одном файле.
+type SQLiteDatabase struct {
+	db *sql.DB
+}
+
+func NewSQLiteDatabase(path string) (*SQLiteDatabase, error) {
+	if path == "" {
+		return nil, errors.New(`sqlite: database path is required`)
+	}
+	// Транзакции сразу берут блокировку на запись: иначе две транзакции,
+	// начавшие с чтения, не смогли бы потом обе перейти к записи.
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate"
+	db, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqliteMigrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteDatabase{db: db}, nil
+}
+
+// sqliteMigrate последовательно применяет ещё не применённые миграции.
+// Номер миграции — её индекс в sqliteMigrations плюс один.
+func sqliteMigrate(db *sql.DB) error {
+	if _, err := db.Exec(sqliteCreateMigrationsTable); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow(selectMigrationVersion).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(sqliteInsertMigrationVersion, i+1, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MigrationState сообщает, сколько миграций применено в базе.
+func (s *SQLiteDatabase) MigrationState() (MigrationState, error) {
+	state := MigrationState{Known: len(sqliteMigrations)}
+	err := s.db.QueryRow(selectMigrationVersion).Scan(&state.Applied)
+	return state, err
+}
+
+// sqlQuerier — общее у базы и транзакции.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rowScanner — общее у sql.Row и sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// utc приводит необязательное время к UTC: время хранится текстом
+// и сравнивается как строка, поэтому пояс у всех значений один.
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	v := t.UTC()
+	return &v
+}
+
+// scanSQLiteURL читает в u колонки sqliteURLColumns, а в dest — следующие за ними.
+func scanSQLiteURL(row rowScanner, u *URL, dest ...interface{}) error {
+	var tags sql.NullString
+	err := row.Scan(append([]interface{}{
+		&u.Hash, &u.Original, &u.UserID, &u.MaxClicks, &u.Clicks,
+		&u.ActiveFrom, &u.FallbackURL, &u.ExpiresAt, &u.PasswordHash, &u.Title, &u.DeletedAt, &u.CreatedAt,
+		&u.Folder, &tags, &u.WorkspaceID,
+	}, dest...)...)
+	if err != nil {
+		return err
+	}
+	u.Tags = nil
+	if tags.String != "" {
+		u.Tags = strings.Split(tags.String, tagSeparator)
+	}
+	return nil
+}
+
+// sqliteInsertURLRow добавляет ссылку как есть, вместе с тегами.
+// Ключ не уникален в схеме, поэтому занятость проверяется здесь:
+// транзакции SQLite идут по одной, и проверка не может устареть
+// до вставки.
+func sqliteInsertURLRow(q sqlQuerier, u URL) error {
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	var exists int
+	if err := q.QueryRow(sqliteSelectURLExists, u.Hash).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return ErrConflict
+	}
+	_, err := q.Exec(sqliteInsertURL, u.Hash, u.Original, u.UserID, u.MaxClicks, u.Clicks, utc(u.ActiveFrom),
+		u.FallbackURL, utc(u.ExpiresAt), u.PasswordHash, u.Title, utc(u.DeletedAt), u.CreatedAt.UTC(), u.Folder, u.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	return sqliteSetTags(q, u)
+}
+
+// sqliteSetTags заменяет теги ссылки на u.Tags, заводя недостающие теги владельца.
+func sqliteSetTags(q sqlQuerier, u URL) error {
+	if _, err := q.Exec(sqliteDeleteURLTags, u.Hash); err != nil {
+		return err
+	}
+	for _, tag := range u.Tags {
+		if _, err := q.Exec(sqliteInsertTag, u.UserID, tag); err != nil {
+			return err
+		}
+		if _, err := q.Exec(sqliteInsertURLTag, u.Hash, u.UserID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteMemberRole возвращает роль userID в пространстве workspaceID
+// или пустую строку, если пользователь в нём не состоит.
+func sqliteMemberRole(q sqlQuerier, workspaceID, userID string) (string, error) {
+	if workspaceID == "" {
+		return "", nil
+	}
+	var role string
+	err := q.QueryRow(sqliteSelectMemberRole, workspaceID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// sqliteAccess проверяет права userID на ссылку u не ниже need.
+func sqliteAccess(q sqlQuerier, u URL, userID, need string) error {
+	role, err := sqliteMemberRole(q, u.WorkspaceID, userID)
+	if err != nil {
+		return err
+	}
+	err = checkAccess(u, userID, role, need)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("key %s: %w", u.Hash, ErrNotFound)
+	}
+	return err
+}
+
+// sqliteSelect читает ссылку по ключу вместе с признаком удаления.
+func sqliteSelect(q sqlQuerier, key string) (URL, bool, error) {
+	var u URL
+	var isDeleted bool
+	err := scanSQLiteURL(q.QueryRow(sqliteSelectURL, key), &u, &isDeleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return URL{}, false, fmt.Errorf("key %s: %w", key, ErrNotFound)
+	}
+	return u, isDeleted, err
+}
+
+// sqliteSelectForUpdate читает ссылку в транзакции tx и проверяет,
+// что у userID есть на неё права не ниже need. Транзакция уже держит
+// блокировку базы на запись, так что отдельно блокировать строку не нужно.
+func sqliteSelectForUpdate(tx *sql.Tx, key, userID, need string) (URL, error) {
+	u, _, err := sqliteSelect(tx, key)
+	if err != nil {
+		return URL{}, err
+	}
+	if err := sqliteAccess(tx, u, userID, need); err != nil {
+		return URL{}, err
+	}
+	return u, nil
+}
+
+func (s *SQLiteDatabase) Close() {
+	s.db.Close()
+}
+
+func (s *SQLiteDatabase) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *SQLiteDatabase) Create(u URL) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	u.DeletedAt = nil
+	if err := sqliteInsertURLRow(tx, u); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateMany сохраняет пакет одной транзакцией.
+func (s *SQLiteDatabase) CreateMany(urls []URL) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, v := range urls {
+		v.DeletedAt = nil
+		if err := sqliteInsertURLRow(tx, v); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDatabase) Flush() error {
+	return nil
+}
+
+func (s *SQLiteDatabase) Select(key string) (URL, error) {
+	u, isDeleted, err := sqliteSelect(s.db, key)
+	if err != nil {
+		return URL{}, err
+	}
+	if isDeleted {
+		return URL{}, ErrGone
+	}
+	return u, nil
+}
+
+func (s *SQLiteDatabase) SelectMany(keys []string) ([]URL, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(keys))
+	params := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = key
+		params[i] = fmt.Sprintf("?%d", i+1)
+	}
+	rows, err := s.db.Query(fmt.Sprintf(sqliteSelectURLs, strings.Join(params, ", ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var data []URL
+	for rows.Next() {
+		var u URL
+		if err := scanSQLiteURL(rows, &u); err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	return data, rows.Err()
+}
+
+func (s *SQLiteDatabase) Totals() (t Totals, err error) {
+	err = s.db.QueryRow(sqliteCountURLs).Scan(&t.URLs, &t.Users)
+	return t, err
+}
+
+func (s *SQLiteDatabase) Visit(key string) (URL, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return URL{}, err
+	}
+	defer tx.Rollback()
+
+	// Условный update не даст двум одновременным запросам израсходовать
+	// последний переход: второй просто не найдёт подходящей строки.
+	now := time.Now()
+	res, err := tx.Exec(sqliteIncrementClicks, key, now.UTC())
+	if err != nil {
+		return URL{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return URL{}, err
+	} else if n > 0 {
+		u, _, err := sqliteSelect(tx, key)
+		if err != nil {
+			return URL{}, err
+		}
+		return u, tx.Commit()
+	}
+
+	u, isDeleted, err := sqliteSelect(tx, key)
+	if err != nil {
+		return URL{}, err
+	}
+	if isDeleted {
+		return URL{}, ErrGone
+	}
+	if err := checkVisit(u, now); errors.Is(err, ErrNotActive) {
+		return u, err
+	}
+	return URL{}, ErrGone
+}
+
+func (s *SQLiteDatabase) AddClicks(clicks map[string]int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for key, n := range clicks {
+		if _, err := tx.Exec(sqliteAddClicks, key, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDatabase) SelectAll(userID string) ([]URL, error) {
+	rows, err := s.db.Query(sqliteSelectAllUserRows, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var data []URL
+	for rows.Next() {
+		var u URL
+		if err := scanSQLiteURL(rows, &u); err != nil {
+			return nil, err
+		}
+		data = append(data, u)
+	}
+	return data, rows.Err()
+}
+
+func (s *SQLiteDatabase) List(q Query) (Page, error) {
+	var data []URL
+	err := s.query(q, func(u URL) error {
+		data = append(data, u)
+		return nil
+	})
+	if err != nil {
+		return Page{}, err
+	}
+
+	q, _ = q.Normalize()
+	return paginate(data, q), nil
+}
+
+func (s *SQLiteDatabase) Iterate(q Query, fn func(URL) error) error {
+	q.Limit, q.Cursor = 0, ""
+	return s.query(q, fn)
+}
+
+// query выполняет выборку q и передаёт fn строки по мере их чтения.
+func (s *SQLiteDatabase) query(q Query, fn func(URL) error) error {
+	if q.WorkspaceID != "" {
+		role, err := sqliteMemberRole(s.db, q.WorkspaceID, q.UserID)
+		if err != nil {
+			return err
+		}
+		if err := checkRole(role, RoleViewer); err != nil {
+			return err
+		}
+	}
+
+	query, args, err := buildListQuery(q, sqliteDialect)
+	if err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u URL
+		if err := scanSQLiteURL(rows, &u); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteDatabase) Update(key, userID string, edit func(*URL) error) (URL, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return URL{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := sqliteSelectForUpdate(tx, key, userID, RoleEditor)
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Deleted() {
+		return URL{}, ErrGone
+	}
+	now := time.Now().UTC()
+	prev := u.Revision(0, now)
+
+	if err := edit(&u); err != nil {
+		return URL{}, err
+	}
+
+	_, err = tx.Exec(sqliteInsertRevision, key, prev.Original, utc(prev.ExpiresAt), prev.PasswordHash, prev.Title, now)
+	if err != nil {
+		return URL{}, err
+	}
+	_, err = tx.Exec(sqliteUpdateURL, key, u.Original, utc(u.ExpiresAt), u.PasswordHash, u.Title, u.Folder)
+	if err != nil {
+		return URL{}, err
+	}
+	if err := sqliteSetTags(tx, u); err != nil {
+		return URL{}, err
+	}
+
+	return u, tx.Commit()
+}
+
+// sqliteRevisions читает историю ссылки key.
+func sqliteRevisions(q sqlQuerier, key string) ([]Revision, error) {
+	rows, err := q.Query(sqliteSelectRevisions, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var data []Revision
+	for rows.Next() {
+		var r Revision
+		err := rows.Scan(&r.Version, &r.Original, &r.ExpiresAt, &r.PasswordHash, &r.Title, &r.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, r)
+	}
+	return data, rows.Err()
+}
+
+func (s *SQLiteDatabase) Revisions(key, userID string) ([]Revision, error) {
+	u, err := s.Select(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqliteAccess(s.db, u, userID, RoleViewer); err != nil {
+		return nil, err
+	}
+	return sqliteRevisions(s.db, key)
+}
+
+func (s *SQLiteDatabase) Restore(key, userID string, since time.Time) (URL, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return URL{}, err
+	}
+	defer tx.Rollback()
+
+	u, err := sqliteSelectForUpdate(tx, key, userID, RoleEditor)
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Purgeable(since) {
+		return URL{}, ErrGone
+	}
+
+	if _, err := tx.Exec(sqliteRestoreURL, key); err != nil {
+		return URL{}, err
+	}
+	u.DeletedAt = nil
+	return u, tx.Commit()
+}
+
+func (s *SQLiteDatabase) Purge(userID string, before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	before = before.UTC()
+	if _, err := tx.Exec(sqlitePurgeRevisions, before, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(sqlitePurgeURLTags, before, userID); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(sqlitePurgeURLs, before, userID)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(purged), tx.Commit()
+}
+
+func (s *SQLiteDatabase) Delete(key, userID string) error {
+	args := []interface{}{key, userID, time.Now().UTC()}
+	var params []string
+	for _, role := range rolesAtLeast(RoleEditor) {
+		args = append(args, role)
+		params = append(params, fmt.Sprintf("?%d", len(args)))
+	}
+	_, err := s.db.Exec(fmt.Sprintf(sqliteDeleteURL, strings.Join(params, ", ")), args...)
+	return err
+}
+
+func (s *SQLiteDatabase) CreateWorkspace(w Workspace, ownerID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(sqliteInsertWorkspace, w.ID, w.Name, w.CreatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrConflict
+	}
+	if _, err := tx.Exec(sqliteUpsertMember, w.ID, ownerID, RoleOwner); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDatabase) Workspaces(userID string) ([]Workspace, error) {
+	rows, err := s.db.Query(sqliteSelectUserWorkspaces, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var data []Workspace
+	for rows.Next() {
+		var w Workspace
+		if err := rows.Scan(&w.ID, &w.Name, &w.CreatedAt, &w.Role); err != nil {
+			return nil, err
+		}
+		data = append(data, w)
+	}
+	return data, rows.Err()
+}
+
+// sqliteMembers читает роли участников пространства.
+func sqliteMembers(q sqlQuerier, workspaceID string) (map[string]string, error) {
+	rows, err := q.Query(sqliteSelectMembers, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make(map[string]string)
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			return nil, err
+		}
+		members[userID] = role
+	}
+	return members, rows.Err()
+}
+
+func (s *SQLiteDatabase) Members(workspaceID, userID string) ([]Member, error) {
+	members, err := sqliteMembers(s.db, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRole(members[userID], RoleViewer); err != nil {
+		return nil, err
+	}
+
+	var data []Member
+	for member, role := range members {
+		data = append(data, Member{WorkspaceID: workspaceID, UserID: member, Role: role})
+	}
+	sort.Slice(data, func(i, j int) bool { return data[i].UserID < data[j].UserID })
+	return data, nil
+}
+
+func (s *SQLiteDatabase) SetMember(actorID string, m Member) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	members, err := sqliteMembers(tx, m.WorkspaceID)
+	if err != nil {
+		return err
+	}
+	if err := checkMemberChange(members, actorID, m); err != nil {
+		return err
+	}
+
+	if m.Role == "" {
+		_, err = tx.Exec(sqliteDeleteMember, m.WorkspaceID, m.UserID)
+	} else {
+		_, err = tx.Exec(sqliteUpsertMember, m.WorkspaceID, m.UserID, m.Role)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (int, error) {
+	if fromID == "" {
+		fromID = userID
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	role, err := sqliteMemberRole(tx, workspaceID, userID)
+	if err != nil {
+		return 0, err
+	}
+	fromRole, err := sqliteMemberRole(tx, workspaceID, fromID)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkTransfer(userID, fromID, role, fromRole); err != nil {
+		return 0, err
+	}
+
+	if len(keys) == 0 {
+		res, err := tx.Exec(sqliteTransferUserURLs, workspaceID, fromID)
+		if err != nil {
+			return 0, err
+		}
+		transferred, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		return int(transferred), tx.Commit()
+	}
+
+	keys = uniqueKeys(keys)
+	for _, key := range keys {
+		u, err := sqliteSelectForUpdate(tx, key, fromID, RoleEditor)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkTransferURL(u, userID, fromID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(sqliteTransferURL, workspaceID, key); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), tx.Commit()
+}
+
+// Dump читает ссылки страницами, чтобы не держать запрос открытым,
+// пока fn пишет в другое хранилище или в ту же базу.
+func (s *SQLiteDatabase) Dump(after string, fn func(Record) error) error {
+	for {
+		page, err := s.dumpPage(after)
+		if err != nil {
+			return err
+		}
+		for _, rec := range page {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if len(page) < sqliteDumpPage {
+			return nil
+		}
+		after = page[len(page)-1].URL.Hash
+	}
+}
+
+func (s *SQLiteDatabase) dumpPage(after string) ([]Record, error) {
+	rows, err := s.db.Query(sqliteDumpURLs, after, sqliteDumpPage)
+	if err != nil {
+		return nil, err
+	}
+	var page []Record
+	for rows.Next() {
+		var rec Record
+		if err := scanSQLiteURL(rows, &rec.URL); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		page = append(page, rec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range page {
+		page[i].Revisions, err = sqliteRevisions(s.db, page[i].URL.Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// Load сохраняет пакет в одной транзакции.
+func (s *SQLiteDatabase) Load(recs []Record, overwrite bool) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var conflicts []string
+	for _, rec := range recs {
+		u := rec.URL
+		var exists int
+		if err := tx.QueryRow(sqliteSelectURLExists, u.Hash).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists > 0 {
+			conflicts = append(conflicts, u.Hash)
+			if !overwrite {
+				continue
+			}
+			for _, query := range []string{sqlitePurgeLoadedRevisions, sqlitePurgeLoadedURLTags, sqlitePurgeLoadedURL} {
+				if _, err := tx.Exec(query, u.Hash); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if err := sqliteInsertURLRow(tx, u); err != nil {
+			return nil, err
+		}
+		for _, r := range rec.Revisions {
+			_, err := tx.Exec(sqliteLoadRevision, u.Hash, r.Version, r.Original, utc(r.ExpiresAt), r.PasswordHash, r.Title, r.CreatedAt.UTC())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return conflicts, tx.Commit()
+}
+
+func (s *SQLiteDatabase) DumpWorkspaces(fn func(WorkspaceRecord) error) error {
+	rows, err := s.db.Query(sqliteDumpWorkspaces)
+	if err != nil {
+		return err
+	}
+	var data []WorkspaceRecord
+	for rows.Next() {
+		var rec WorkspaceRecord
+		if err := rows.Scan(&rec.Workspace.ID, &rec.Workspace.Name, &rec.Workspace.CreatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		data = append(data, rec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rec := range data {
+		members, err := sqliteMembers(s.db, rec.Workspace.ID)
+		if err != nil {
+			return err
+		}
+		for userID, role := range members {
+			rec.Members = append(rec.Members, Member{WorkspaceID: rec.Workspace.ID, UserID: userID, Role: role})
+		}
+		sort.Slice(rec.Members, func(i, j int) bool { return rec.Members[i].UserID < rec.Members[j].UserID })
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteDatabase) LoadWorkspace(rec WorkspaceRecord, overwrite bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	w := rec.Workspace
+	var exists int
+	if err := tx.QueryRow(sqliteSelectWorkspaceExists, w.ID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 && !overwrite {
+		return ErrConflict
+	}
+
+	if _, err := tx.Exec(sqliteUpsertWorkspace, w.ID, w.Name, w.CreatedAt.UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqliteDeleteMembers, w.ID); err != nil {
+		return err
+	}
+	for _, m := range rec.Members {
+		if _, err := tx.Exec(sqliteUpsertMember, w.ID, m.UserID, m.Role); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
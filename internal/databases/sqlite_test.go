@@ -0,0 +1,164 @@
+package databases
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLite(t *testing.T) (*SQLiteDatabase, string) {
+	path := filepath.Join(t.TempDir(), "urls.db")
+	db, err := NewSQLiteDatabase(path)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return db, path
+}
+
+func TestSQLiteDatabaseVisitMaxClicks(t *testing.T) {
+	db, path := newTestSQLite(t)
+	testVisitMaxClicks(t, db)
+
+	reopened, err := NewSQLiteDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	_, err = reopened.Visit("once")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+func TestSQLiteDatabaseList(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	testList(t, db)
+
+	require.NoError(t, db.Create(URL{Hash: "tagged", Original: "https://пример.рф/Путь", UserID: "user", Tags: []string{"b", "a"}}))
+	page, err := db.List(Query{UserID: "user", Tags: []string{"a", "b"}, Search: "ПУТЬ"})
+	require.NoError(t, err)
+	require.Len(t, page.URLs, 1)
+	assert.Equal(t, []string{"a", "b"}, page.URLs[0].Tags)
+}
+
+func TestSQLiteDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Database {
+		db, _ := newTestSQLite(t)
+		return db
+	})
+}
+
+func TestSQLiteDatabaseUpdateRestoreAndPurge(t *testing.T) {
+	db, path := newTestSQLite(t)
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, db.Create(URL{Hash: "abc", Original: "http://typo.example", UserID: "user", ExpiresAt: &expires}))
+	require.NoError(t, db.Create(URL{Hash: "old", Original: "http://old.example", UserID: "user"}))
+
+	_, err := db.Update("abc", "stranger", func(u *URL) error { return nil })
+	assert.ErrorIs(t, err, ErrNotFound)
+	u, err := db.Update("abc", "user", func(u *URL) error {
+		u.Original = "http://fixed.example"
+		u.Tags = []string{"fixed"}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "http://fixed.example", u.Original)
+
+	require.NoError(t, db.Delete("abc", "user"))
+	require.NoError(t, db.Delete("old", "user"))
+	_, err = db.Visit("abc")
+	assert.ErrorIs(t, err, ErrGone)
+
+	u, err = db.Restore("abc", "user", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, u.Deleted())
+
+	purged, err := db.Purge("", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	reopened, err := NewSQLiteDatabase(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	_, err = reopened.Select("old")
+	assert.ErrorIs(t, err, ErrNotFound)
+	u, err = reopened.Select("abc")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fixed"}, u.Tags)
+	require.NotNil(t, u.ExpiresAt)
+	assert.True(t, expires.Equal(*u.ExpiresAt))
+
+	revisions, err := reopened.Revisions("abc", "user")
+	require.NoError(t, err)
+	require.Len(t, revisions, 1)
+	assert.Equal(t, "http://typo.example", revisions[0].Original)
+}
+
+func TestSQLiteDatabaseWorkspaces(t *testing.T) {
+	db, _ := newTestSQLite(t)
+	require.NoError(t, db.Create(URL{Hash: "a", Original: "http://a.example", UserID: "alice"}))
+	require.NoError(t, db.CreateWorkspace(Workspace{ID: "team", Name: "Team", CreatedAt: time.Now()}, "alice"))
+	assert.ErrorIs(t, db.CreateWorkspace(Workspace{ID: "team"}, "bob"), ErrConflict)
+	require.NoError(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "bob", Role: RoleViewer}))
+	assert.ErrorIs(t, db.SetMember("alice", Member{WorkspaceID: "team", UserID: "alice", Role: RoleEditor}), ErrLastOwner)
+
+	_, err := db.Transfer("team", "bob", "", nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+	transferred, err := db.Transfer("team", "alice", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, transferred)
+
+	page, err := db.List(Query{UserID: "bob", WorkspaceID: "team"})
+	require.NoError(t, err)
+	require.Len(t, page.URLs, 1)
+	_, err = db.List(Query{UserID: "dave", WorkspaceID: "team"})
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, db.Delete("a", "bob"))
+	_, err = db.Select("a")
+	require.NoError(t, err)
+	require.NoError(t, db.Delete("a", "alice"))
+	_, err = db.Select("a")
+	assert.ErrorIs(t, err, ErrGone)
+}
+
+func TestSQLiteDatabaseDumpAndLoad(t *testing.T) {
+	src := NewMapDatabase()
+	dst, _ := newTestSQLite(t)
+	deleted := time.Now().Add(-time.Hour).UTC()
+	require.NoError(t, src.LoadWorkspace(WorkspaceRecord{
+		Workspace: Workspace{ID: "team", Name: "Team"},
+		Members:   []Member{{WorkspaceID: "team", UserID: "alice", Role: RoleOwner}},
+	}, false))
+	_, err := src.Load([]Record{
+		{URL: URL{Hash: "a", Original: "http://a.example", UserID: "alice", Clicks: 7, WorkspaceID: "team"}},
+		{URL: URL{Hash: "b", Original: "http://b.example", UserID: "alice", DeletedAt: &deleted},
+			Revisions: []Revision{{Version: 1, Original: "http://b.old", CreatedAt: deleted}}},
+	}, false)
+	require.NoError(t, err)
+
+	require.NoError(t, src.DumpWorkspaces(func(rec WorkspaceRecord) error { return dst.LoadWorkspace(rec, false) }))
+	var recs []Record
+	require.NoError(t, src.Dump("", func(rec Record) error { recs = append(recs, rec); return nil }))
+	conflicts, err := dst.Load(recs, false)
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+
+	conflicts, err = dst.Load(recs[:1], false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, conflicts)
+	conflicts, err = dst.Load(recs[:1], true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, conflicts)
+	assert.ErrorIs(t, dst.LoadWorkspace(WorkspaceRecord{Workspace: Workspace{ID: "team"}}, false), ErrConflict)
+
+	var dumped []Record
+	require.NoError(t, dst.Dump("", func(rec Record) error { dumped = append(dumped, rec); return nil }))
+	require.Len(t, dumped, 2)
+	assert.Equal(t, 7, dumped[0].URL.Clicks)
+	assert.Equal(t, "team", dumped[0].URL.WorkspaceID)
+	assert.True(t, dumped[1].URL.Deleted())
+	require.Len(t, dumped[1].Revisions, 1)
+	assert.Equal(t, "http://b.old", dumped[1].Revisions[0].Original)
+
+	var members []Member
+	require.NoError(t, dst.DumpWorkspaces(func(rec WorkspaceRecord) error { members = rec.Members; return nil }))
+	assert.Equal(t, []Member{{WorkspaceID: "team", UserID: "alice", Role: RoleOwner}}, members)
+}
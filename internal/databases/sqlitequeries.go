@@ -0,0 +1,245 @@
+package databases
+
+// Схема SQLite строится из тех же миграций, что и схема Postgres
+// (см. migrations.go). Время хранится текстом в UTC, поэтому
+// сравнивается как строки.
+var (
+	sqliteCreateMigrationsTable = `
+		create table if not exists schema_migrations (
+			version integer primary key not null,
+			applied_at timestamp
+		)
+	`
+
+	sqliteInsertMigrationVersion = `
+		insert into schema_migrations (version, applied_at) values (?1, ?2)
+	`
+
+	// sqliteTagsExpr собирает отсортированные теги ссылки в строку
+	// через разделитель tagSeparator.
+	sqliteTagsExpr = `(
+		select group_concat(name, char(31)) from (
+			select t.name from url_tags ut join tags t on t.id = ut.tag_id
+			where ut.hash = urls.hash order by t.name
+		)
+	)`
+
+	// sqliteURLColumns — колонки ссылки в порядке, который ожидает scanSQLiteURL.
+	sqliteURLColumns = `hash, original, user_id, max_clicks, clicks, active_from, fallback_url, expires_at, password_hash, title, deleted_at, created_at, folder, ` + sqliteTagsExpr + `, workspace_id`
+
+	sqliteInsertURL = `
+		insert into urls (hash, original, user_id, max_clicks, clicks, active_from, fallback_url,
+			expires_at, password_hash, title, is_deleted, deleted_at, created_at, folder, workspace_id)
+		values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11 is not null, ?11, ?12, ?13, ?14)
+	`
+
+	sqliteSelectURL = `
+		select ` + sqliteURLColumns + `, is_deleted
+		from urls
+		where hash = ?1
+	`
+
+	sqliteSelectURLs = `
+		select ` + sqliteURLColumns + `
+		from urls
+		where hash in (%s)
+	`
+
+	sqliteCountURLs = `
+		select count(*), count(distinct user_id)
+		from urls
+		where is_deleted is not true
+	`
+
+	sqliteSelectAllUserRows = `
+		select ` + sqliteURLColumns + `
+		from urls
+		where user_id = ?1 and workspace_id = ''
+	`
+
+	// sqliteListURLs и sqliteListWorkspaceURLs дополняются условиями,
+	// порядком и лимитом в buildListQuery.
+	sqliteListURLs = sqliteSelectAllUserRows
+
+	sqliteListWorkspaceURLs = `
+		select ` + sqliteURLColumns + `
+		from urls
+		where workspace_id = ?1
+	`
+
+	sqliteSelectMemberRole = `
+		select role from workspace_members
+		where workspace_id = ?1 and user_id = ?2
+	`
+
+	sqliteUpdateURL = `
+		update urls set
+			original = ?2,
+			expires_at = ?3,
+			password_hash = ?4,
+			title = ?5,
+			folder = ?6
+		where hash = ?1
+	`
+
+	sqliteInsertTag = `
+		insert into tags (user_id, name) values (?1, ?2)
+		on conflict (user_id, name) do nothing
+	`
+
+	sqliteInsertURLTag = `
+		insert into url_tags (hash, tag_id)
+		select ?1, id from tags where user_id = ?2 and name = ?3
+	`
+
+	sqliteDeleteURLTags = `
+		delete from url_tags where hash = ?1
+	`
+
+	sqliteInsertRevision = `
+		insert into url_revisions (hash, version, original, expires_at, password_hash, title, created_at)
+		select ?1, coalesce(max(version), 0) + 1, ?2, ?3, ?4, ?5, ?6
+		from url_revisions
+		where hash = ?1
+	`
+
+	sqliteSelectRevisions = `
+		select version, original, expires_at, password_hash, title, created_at
+		from url_revisions
+		where hash = ?1
+		order by version
+	`
+
+	sqliteAddClicks = `update urls set clicks = clicks + ?2 where hash = ?1`
+
+	sqliteIncrementClicks = `
+		update urls set
+			clicks = clicks + 1
+		where hash = ?1
+			and is_deleted is not true
+			and (max_clicks = 0 or clicks < max_clicks)
+			and (active_from is null or active_from <= ?2)
+			and (expires_at is null or expires_at > ?2)
+	`
+
+	// sqliteDeleteURL удаляет личную ссылку автора ?2 или ссылку
+	// пространства, в котором ?2 состоит с одной из ролей, перечисленных
+	// на месте %s.
+	sqliteDeleteURL = `
+		update urls set
+			is_deleted = true,
+			deleted_at = ?3
+		where hash = ?1 and is_deleted is not true
+			and (workspace_id = '' and user_id = ?2 or exists (
+				select 1 from workspace_members m
+				where m.workspace_id = urls.workspace_id and m.user_id = ?2 and m.role in (%s)
+			))
+	`
+
+	sqliteRestoreURL = `
+		update urls set
+			is_deleted = false,
+			deleted_at = null
+		where hash = ?1
+	`
+
+	sqlitePurgeCondition = `
+		is_deleted and deleted_at < ?1 and (?2 = '' or user_id = ?2 and workspace_id = '')
+	`
+
+	sqlitePurgeRevisions = `
+		delete from url_revisions
+		where hash in (select hash from urls where ` + sqlitePurgeCondition + `)
+	`
+
+	sqlitePurgeURLTags = `
+		delete from url_tags
+		where hash in (select hash from urls where ` + sqlitePurgeCondition + `)
+	`
+
+	sqlitePurgeURLs = `
+		delete from urls where ` + sqlitePurgeCondition + `
+	`
+
+	sqliteInsertWorkspace = `
+		insert into workspaces (id, name, created_at) values (?1, ?2, ?3)
+		on conflict (id) do nothing
+	`
+
+	sqliteSelectUserWorkspaces = `
+		select w.id, w.name, w.created_at, m.role
+		from workspaces w join workspace_members m on m.workspace_id = w.id
+		where m.user_id = ?1
+		order by w.created_at, w.id
+	`
+
+	sqliteSelectMembers = `
+		select user_id, role from workspace_members
+		where workspace_id = ?1
+		order by user_id
+	`
+
+	sqliteUpsertMember = `
+		insert into workspace_members (workspace_id, user_id, role) values (?1, ?2, ?3)
+		on conflict (workspace_id, user_id) do update set role = excluded.role
+	`
+
+	sqliteDeleteMember = `
+		delete from workspace_members where workspace_id = ?1 and user_id = ?2
+	`
+
+	sqliteTransferUserURLs = `
+		update urls set workspace_id = ?1
+		where user_id = ?2 and workspace_id = ''
+	`
+
+	sqliteTransferURL = `
+		update urls set workspace_id = ?1 where hash = ?2
+	`
+
+	sqliteDumpURLs = `
+		select ` + sqliteURLColumns + `
+		from urls
+		where hash > ?1
+		order by hash
+		limit ?2
+	`
+
+	sqliteSelectURLExists = `
+		select count(*) from urls where hash = ?1
+	`
+
+	sqlitePurgeLoadedRevisions = `
+		delete from url_revisions where hash = ?1
+	`
+
+	sqlitePurgeLoadedURLTags = `
+		delete from url_tags where hash = ?1
+	`
+
+	sqlitePurgeLoadedURL = `
+		delete from urls where hash = ?1
+	`
+
+	sqliteLoadRevision = `
+		insert into url_revisions (hash, version, original, expires_at, password_hash, title, created_at)
+		values (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+	`
+
+	sqliteDumpWorkspaces = `
+		select id, name, created_at from workspaces order by id
+	`
+
+	sqliteSelectWorkspaceExists = `
+		select count(*) from workspaces where id = ?1
+	`
+
+	sqliteUpsertWorkspace = `
+		insert into workspaces (id, name, created_at) values (?1, ?2, ?3)
+		on conflict (id) do update set name = excluded.name, created_at = excluded.created_at
+	`
+
+	sqliteDeleteMembers = `
+		delete from workspace_members where workspace_id = ?1
+	`
+)
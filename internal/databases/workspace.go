@@ -0,0 +1,144 @@
+package databases
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrForbidden = errors.New(`forbidden`)
+var ErrLastOwner = errors.New(`workspace must keep at least one owner`)
+
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// ValidRole сообщает, что role — одна из ролей участника пространства.
+func ValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// rolesAtLeast возвращает роли, дающие не меньше прав, чем need.
+func rolesAtLeast(need string) []string {
+	var roles []string
+	for role, rank := range roleRanks {
+		if rank >= roleRanks[need] {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// Workspace — рабочее пространство команды, которому могут
+// принадлежать ссылки.
+type Workspace struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role — роль пользователя, запросившего список пространств.
+	Role string `json:"role,omitempty"`
+}
+
+// Member — участие пользователя в рабочем пространстве.
+type Member struct {
+	WorkspaceID string `json:"workspace_id"`
+	UserID      string `json:"user_id"`
+	Role        string `json:"role"`
+}
+
+// checkRole проверяет, что у участника с ролью role достаточно прав.
+// Пустая роль означает, что пользователь в пространство не входит.
+func checkRole(role, need string) error {
+	if role == "" {
+		return ErrNotFound
+	}
+	if roleRanks[role] < roleRanks[need] {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkAccess проверяет права пользователя userID на ссылку u. Личной
+// ссылкой распоряжается только её автор, ссылкой пространства —
+// его участники с ролью не ниже need. memberRole — роль userID
+// в пространстве ссылки.
+func checkAccess(u URL, userID, memberRole, need string) error {
+	if u.WorkspaceID == "" {
+		if u.UserID != userID {
+			return ErrNotFound
+		}
+		return nil
+	}
+	return checkRole(memberRole, need)
+}
+
+// Personal сообщает, что ссылка принадлежит лично userID, а не
+// рабочему пространству.
+func (u URL) Personal(userID string) bool {
+	return u.WorkspaceID == "" && u.UserID == userID
+}
+
+// checkTransfer проверяет, что userID может передать пространству
+// ссылки fromID. Свои ссылки передаёт редактор пространства, ссылки
+// другого участника — только владелец: так команда забирает ссылки
+// ушедшего коллеги. role и fromRole — роли userID и fromID
+// в пространстве.
+func checkTransfer(userID, fromID, role, fromRole string) error {
+	if fromID == userID {
+		return checkRole(role, RoleEditor)
+	}
+	if err := checkRole(role, RoleOwner); err != nil {
+		return err
+	}
+	if fromRole == "" {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkTransferURL проверяет, что ссылку u, доступную fromID, можно
+// передать. Чужими руками передаются только личные ссылки fromID.
+func checkTransferURL(u URL, userID, fromID string) error {
+	if fromID != userID && !u.Personal(fromID) {
+		return fmt.Errorf("key %s: %w", u.Hash, ErrNotFound)
+	}
+	return nil
+}
+
+// uniqueKeys возвращает keys без повторов в прежнем порядке.
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	data := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			data = append(data, key)
+		}
+	}
+	return data
+}
+
+// checkMemberChange проверяет, что actorID может применить изменение m
+// к участникам members, и что в пространстве останется владелец.
+func checkMemberChange(members map[string]string, actorID string, m Member) error {
+	if err := checkRole(members[actorID], RoleOwner); err != nil {
+		return err
+	}
+	if members[m.UserID] != RoleOwner || m.Role == RoleOwner {
+		return nil
+	}
+	for userID, role := range members {
+		if role == RoleOwner && userID != m.UserID {
+			return nil
+		}
+	}
+	return ErrLastOwner
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Hasing interface {
@@ -27,3 +29,27 @@ func RandBytes(n int) (string, error) {
 	}
 	return base64.StdEncoding.EncodeToString(b), nil
 }
+
+// RandID возвращает случайный идентификатор из n байт в шестнадцатеричной записи.
+func RandID(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashPassword возвращает bcrypt-хеш пароля ссылки.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return ``, err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword сверяет пароль с хешем, полученным от HashPassword.
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,121 @@
+package grpcapi
+
+import (
+	"context"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/audit"
+	"github.com/salliko/reducer/internal/databases"
+	reducerv1 "github.com/salliko/reducer/internal/grpcapi/reducer/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+)
+
+func newClient(t *testing.T, cfg config.Config, db databases.Database, auditLog audit.Log) reducerv1.ShortenerClient {
+	lis := bufconn.Listen(1 << 20)
+	s := NewServer(cfg, db, auditLog)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return reducerv1.NewShortenerClient(conn)
+}
+
+func TestShortener(t *testing.T) {
+	auditLog := audit.NewMemoryLog()
+	client := newClient(t, config.Config{BaseURL: "http://localhost:8080"}, databases.NewMapDatabase(), auditLog)
+	ctx := context.Background()
+
+	// Без user_id сервер выдаёт нового пользователя, как cookie.
+	var header metadata.MD
+	resp, err := client.Shorten(ctx, &reducerv1.ShortenRequest{Url: "https://example.com/a"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.False(t, resp.GetConflict())
+	require.Len(t, header.Get(UserIDKey), 1)
+	require.Len(t, header.Get(RequestIDKey), 1)
+	userID := header.Get(UserIDKey)[0]
+	user := metadata.AppendToOutgoingContext(ctx, UserIDKey, userID)
+
+	again, err := client.Shorten(user, &reducerv1.ShortenRequest{Url: "https://example.com/a"})
+	require.NoError(t, err)
+	assert.True(t, again.GetConflict())
+	assert.Equal(t, resp.Result, again.Result)
+
+	_, err = client.Shorten(user, &reducerv1.ShortenRequest{Url: "not a url"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	batch, err := client.ShortenBatch(user, &reducerv1.ShortenBatchRequest{Urls: []*reducerv1.BatchURL{
+		{CorrelationId: "1", OriginalUrl: "https://example.com/b"},
+		{CorrelationId: "2", OriginalUrl: "https://example.com/c"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.GetUrls(), 2)
+	assert.Equal(t, "2", batch.GetUrls()[1].GetCorrelationId())
+
+	key := resp.Result[len("http://localhost:8080/"):]
+	resolved, err := client.Resolve(ctx, &reducerv1.ResolveRequest{Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/a", resolved.GetUrl())
+	_, err = client.Resolve(ctx, &reducerv1.ResolveRequest{Key: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	page, err := client.ListUserURLs(user, &reducerv1.ListUserURLsRequest{Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.GetUrls(), 2)
+	assert.NotEmpty(t, page.GetNextCursor())
+	_, err = client.ListUserURLs(user, &reducerv1.ListUserURLsRequest{Limit: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Чужой пользователь не может удалить ссылку.
+	_, err = client.DeleteURLs(metadata.AppendToOutgoingContext(ctx, UserIDKey, "stranger"), &reducerv1.DeleteURLsRequest{Keys: []string{key}})
+	require.NoError(t, err)
+	_, err = client.Resolve(ctx, &reducerv1.ResolveRequest{Key: key})
+	require.NoError(t, err)
+
+	_, err = client.DeleteURLs(user, &reducerv1.DeleteURLsRequest{Keys: []string{key}})
+	require.NoError(t, err)
+	_, err = client.Resolve(ctx, &reducerv1.ResolveRequest{Key: key})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.Ping(ctx, &reducerv1.PingRequest{})
+	assert.NoError(t, err)
+
+	entries, err := auditLog.Query(audit.Filter{Actor: userID})
+	require.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.NotEmpty(t, entries[0].RequestID)
+}
+
+func TestStatsRequiresAdmin(t *testing.T) {
+	db := databases.NewMapDatabase()
+	require.NoError(t, db.Create(databases.URL{Hash: "a", Original: "https://example.com/a", UserID: "u1"}))
+	require.NoError(t, db.Create(databases.URL{Hash: "b", Original: "https://example.com/b", UserID: "u1"}))
+	require.NoError(t, db.Create(databases.URL{Hash: "c", Original: "https://example.com/c", UserID: "u2"}))
+	require.NoError(t, db.Delete("c", "u2"))
+
+	client := newClient(t, config.Config{BaseURL: "http://localhost:8080", AdminToken: "secret"}, db, audit.NewMemoryLog())
+	ctx := context.Background()
+
+	_, err := client.Stats(ctx, &reducerv1.StatsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.Stats(metadata.AppendToOutgoingContext(ctx, AuthorizationKey, "Bearer wrong"), &reducerv1.StatsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stats, err := client.Stats(metadata.AppendToOutgoingContext(ctx, AuthorizationKey, "Bearer secret"), &reducerv1.StatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.GetUrls())
+	assert.Equal(t, int64(1), stats.GetUsers())
+}
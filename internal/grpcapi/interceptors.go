@@ -0,0 +1,124 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/salliko/reducer/internal/audit"
+	"github.com/salliko/reducer/internal/datahashes"
+	reducerv1 "github.com/salliko/reducer/internal/grpcapi/reducer/v1"
+	"github.com/salliko/reducer/internal/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+// Ключи метаданных. UserIDKey — аналог cookie user_id: если клиент его
+// не передал, сервер выдаёт новый в заголовке ответа.
+const (
+	UserIDKey        = "user_id"
+	RequestIDKey     = "x-request-id"
+	AuthorizationKey = "authorization"
+)
+
+type contextKey int
+
+const userIDKey contextKey = iota
+
+// adminMethods — методы, доступные только с токеном администратора.
+var adminMethods = map[string]bool{
+	"/" + reducerv1.Shortener_ServiceDesc.ServiceName + "/Stats": true,
+}
+
+// UserID возвращает пользователя вызова, которого определил
+// AuthInterceptor.
+func UserID(ctx context.Context) string {
+	id, _ := ctx.Value(userIDKey).(string)
+	return id
+}
+
+func firstValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// LoggingInterceptor — аналог logging.Middleware: принимает или выдаёт
+// идентификатор запроса, кладёт в контекст логгер с ним и адрес
+// клиента для журнала изменений и пишет по строке лога на вызов.
+// Вызовы, завершившиеся ошибкой сервера, пишутся с уровнем error.
+func LoggingInterceptor(base *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		id := logging.AcceptRequestID(firstValue(ctx, RequestIDKey))
+		grpc.SetHeader(ctx, metadata.Pairs(RequestIDKey, id))
+
+		logger := base.With(zap.String("request_id", id))
+		ctx = logging.WithLogger(logging.WithRequestID(ctx, id), logger)
+		remoteAddr := ""
+		if p, ok := peer.FromContext(ctx); ok {
+			remoteAddr = p.Addr.String()
+			ctx = audit.WithSourceIP(ctx, remoteAddr)
+		}
+
+		resp, err := handler(ctx, req)
+
+		code := status.Code(err)
+		level := zapcore.InfoLevel
+		switch code {
+		case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss, codes.Unimplemented:
+			level = zapcore.ErrorLevel
+		}
+		if ce := logger.Check(level, "rpc"); ce != nil {
+			fields := []zap.Field{
+				zap.String("method", info.FullMethod),
+				zap.String("code", code.String()),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("remote_addr", remoteAddr),
+			}
+			if err != nil {
+				fields = append(fields, zap.Error(err))
+			}
+			ce.Write(fields...)
+		}
+		return resp, err
+	}
+}
+
+// AuthInterceptor — аналог CookieMiddleware и AdminMiddleware: берёт
+// пользователя из метаданных user_id или выдаёт нового, а методы
+// администратора пропускает только с authorization: Bearer adminToken.
+// Без adminToken они недоступны.
+func AuthInterceptor(adminToken string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if adminMethods[info.FullMethod] {
+			got := strings.TrimPrefix(firstValue(ctx, AuthorizationKey), "Bearer ")
+			if adminToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(adminToken)) != 1 {
+				return nil, status.Error(codes.Unauthenticated, "admin token required")
+			}
+		}
+
+		userID := firstValue(ctx, UserIDKey)
+		if userID == "" {
+			value, err := datahashes.RandBytes(10)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			userID = value
+			if err := grpc.SetHeader(ctx, metadata.Pairs(UserIDKey, userID)); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		return handler(context.WithValue(ctx, userIDKey, userID), req)
+	}
+}
@@ -0,0 +1,203 @@
+// Package grpcapi — gRPC-версия API сокращателя поверх тех же
+// хранилища, хеширования и логики сохранения ссылок, что и у HTTP.
+// Сервис описан в reducer/v1/shortener.proto, код сообщений и сервиса
+// генерируется protoc-gen-go и protoc-gen-go-grpc.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative reducer/v1/shortener.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/audit"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/salliko/reducer/internal/datahashes"
+	reducerv1 "github.com/salliko/reducer/internal/grpcapi/reducer/v1"
+	"github.com/salliko/reducer/internal/handlers"
+	"github.com/salliko/reducer/internal/logging"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/url"
+	"time"
+)
+
+// Server реализует reducerv1.ShortenerServer поверх хранилища.
+type Server struct {
+	reducerv1.UnimplementedShortenerServer
+	db      databases.Database
+	hashURL datahashes.Hasing
+	cfg     config.Config
+}
+
+// NewServer возвращает gRPC-сервер с сервисом сокращателя. Изменения
+// ссылок, как и в NewRouter, пишутся в auditLog; opts дополняют
+// настройки сервера, например учётными данными TLS.
+func NewServer(cfg config.Config, db databases.Database, auditLog audit.Log, opts ...grpc.ServerOption) *grpc.Server {
+	db = logging.Database(audit.Database(db, auditLog))
+	opts = append(opts, grpc.ChainUnaryInterceptor(
+		LoggingInterceptor(zap.L()),
+		AuthInterceptor(cfg.AdminToken),
+	))
+	s := grpc.NewServer(opts...)
+	reducerv1.RegisterShortenerServer(s, &Server{db: db, hashURL: &datahashes.Md5HashData{}, cfg: cfg})
+	return s
+}
+
+// storageError переводит ошибку хранилища в статус gRPC, как
+// writeStorageError — в код HTTP.
+func storageError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, databases.ErrNotFound), errors.Is(err, databases.ErrGone):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, databases.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, databases.ErrConflict), errors.Is(err, databases.ErrLastOwner):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, databases.ErrInvalidCursor):
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		logging.FromContext(ctx).Error("storage error", zap.Error(err))
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (s *Server) Shorten(ctx context.Context, req *reducerv1.ShortenRequest) (*reducerv1.ShortenResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	if _, err := url.ParseRequestURI(req.GetUrl()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	result, err := handlers.InsertURL(databases.URL{Original: req.GetUrl(), UserID: UserID(ctx)}, s.hashURL, db, s.cfg)
+	if errors.Is(err, databases.ErrConflict) {
+		return &reducerv1.ShortenResponse{Result: result, Conflict: true}, nil
+	}
+	if err != nil {
+		return nil, storageError(ctx, err)
+	}
+	return &reducerv1.ShortenResponse{Result: result}, nil
+}
+
+func (s *Server) ShortenBatch(ctx context.Context, req *reducerv1.ShortenBatchRequest) (*reducerv1.ShortenBatchResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	for _, item := range req.GetUrls() {
+		if _, err := url.ParseRequestURI(item.GetOriginalUrl()); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %v", item.GetCorrelationId(), err)
+		}
+	}
+
+	resp := &reducerv1.ShortenBatchResponse{Urls: make([]*reducerv1.BatchResult, 0, len(req.GetUrls()))}
+	keys := make(map[string]string, len(req.GetUrls()))
+	var batch []databases.URL
+	for _, item := range req.GetUrls() {
+		key, ok := keys[item.GetOriginalUrl()]
+		if !ok {
+			var create bool
+			var err error
+			u := databases.URL{Original: item.GetOriginalUrl(), UserID: UserID(ctx)}
+			key, create, err = handlers.BatchKey(u, s.hashURL, db)
+			if err != nil {
+				return nil, storageError(ctx, err)
+			}
+			keys[item.GetOriginalUrl()] = key
+			if create {
+				u.Hash = key
+				batch = append(batch, u)
+			}
+		}
+		resp.Urls = append(resp.Urls, &reducerv1.BatchResult{
+			CorrelationId: item.GetCorrelationId(),
+			ShortUrl:      fmt.Sprintf("%s/%s", s.cfg.BaseURL, key),
+		})
+	}
+	if err := db.CreateMany(batch); err != nil {
+		return nil, storageError(ctx, err)
+	}
+	return resp, nil
+}
+
+func (s *Server) Resolve(ctx context.Context, req *reducerv1.ResolveRequest) (*reducerv1.ResolveResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	val, err := handlers.ResolveURL(db, req.GetKey(), req.GetPassword())
+	switch {
+	case err == nil:
+		return &reducerv1.ResolveResponse{Url: val.Original}, nil
+	case errors.Is(err, handlers.ErrPasswordRequired):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, databases.ErrNotActive):
+		if val.FallbackURL == "" {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return &reducerv1.ResolveResponse{Url: val.FallbackURL, Fallback: true}, nil
+	default:
+		return nil, storageError(ctx, err)
+	}
+}
+
+func (s *Server) ListUserURLs(ctx context.Context, req *reducerv1.ListUserURLsRequest) (*reducerv1.ListUserURLsResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = handlers.DefaultListLimit
+	}
+	if limit < 0 || limit > handlers.MaxListLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", handlers.MaxListLimit)
+	}
+
+	page, err := db.List(databases.Query{UserID: UserID(ctx), Limit: limit, Cursor: req.GetCursor()})
+	if err != nil {
+		return nil, storageError(ctx, err)
+	}
+	now := time.Now()
+	resp := &reducerv1.ListUserURLsResponse{Urls: make([]*reducerv1.UserURL, 0, len(page.URLs)), NextCursor: page.NextCursor}
+	for _, u := range page.URLs {
+		item := &reducerv1.UserURL{
+			ShortUrl:    fmt.Sprintf("%s/%s", s.cfg.BaseURL, u.Hash),
+			OriginalUrl: u.Original,
+			Status:      u.Status(now),
+			Title:       u.Title,
+			HasPassword: u.PasswordHash != "",
+			Tags:        u.Tags,
+			Folder:      u.Folder,
+			Clicks:      int64(u.Clicks),
+			CreatedAt:   timestamppb.New(u.CreatedAt),
+		}
+		if u.ExpiresAt != nil {
+			item.ExpiresAt = timestamppb.New(*u.ExpiresAt)
+		}
+		resp.Urls = append(resp.Urls, item)
+	}
+	return resp, nil
+}
+
+// DeleteURLs удаляет ссылки пользователя так же, как DELETE
+// /api/user/urls: чужие и несуществующие ключи пропускаются.
+func (s *Server) DeleteURLs(ctx context.Context, req *reducerv1.DeleteURLsRequest) (*reducerv1.DeleteURLsResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	handlers.DeleteURLs(ctx, db, UserID(ctx), req.GetKeys())
+	return &reducerv1.DeleteURLsResponse{}, nil
+}
+
+func (s *Server) Ping(ctx context.Context, req *reducerv1.PingRequest) (*reducerv1.PingResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	if err := db.Ping(); err != nil {
+		logging.FromContext(ctx).Error("ping storage", zap.Error(err))
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &reducerv1.PingResponse{}, nil
+}
+
+// Stats считает неудалённые ссылки и их владельцев запросом
+// к хранилищу.
+func (s *Server) Stats(ctx context.Context, req *reducerv1.StatsRequest) (*reducerv1.StatsResponse, error) {
+	db := databases.WithContext(ctx, s.db)
+	totals, err := db.Totals()
+	if err != nil {
+		return nil, storageError(ctx, err)
+	}
+	return &reducerv1.StatsResponse{Urls: int64(totals.URLs), Users: int64(totals.Users)}, nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/salliko/reducer/internal/audit"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditFilterFromRequest собирает выборку журнала из параметров запроса:
+// key, actor, action, workspace, since, until, limit и cursor — ID
+// последней записи предыдущей страницы.
+func auditFilterFromRequest(r *http.Request) (audit.Filter, error) {
+	params := r.URL.Query()
+	f := audit.Filter{
+		Key:       params.Get("key"),
+		Actor:     params.Get("actor"),
+		Action:    params.Get("action"),
+		Workspace: params.Get("workspace"),
+		Limit:     DefaultListLimit,
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return f, err
+		}
+		if limit <= 0 || limit > MaxListLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", MaxListLimit)
+		}
+		f.Limit = limit
+	}
+
+	if v := params.Get("cursor"); v != "" {
+		after, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, err
+		}
+		f.After = after
+	}
+
+	for name, dst := range map[string]**time.Time{
+		"since": &f.Since,
+		"until": &f.Until,
+	} {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, err
+			}
+			*dst = &t
+		}
+	}
+	return f, nil
+}
+
+// GetAuditLog отдаёт администратору записи журнала изменений по
+// возрастанию ID. Если страница заполнена целиком, ссылка на следующую
+// передаётся в заголовке Link.
+func GetAuditLog(log audit.Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := auditFilterFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, err := log.Query(f)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		if len(entries) == f.Limit {
+			w.Header().Set("Link", nextPageLink(r, strconv.FormatUint(entries[len(entries)-1].ID, 10)))
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
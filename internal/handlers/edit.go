@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/salliko/reducer/internal/datahashes"
+	"github.com/salliko/reducer/internal/logging"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// parseURLPatch разбирает тело PATCH-запроса. Отсутствующие поля
+// не меняются, null в expires_at и password снимает срок действия и пароль.
+func parseURLPatch(body map[string]json.RawMessage) (func(*databases.URL) error, error) {
+	var edits []func(*databases.URL)
+
+	for field, raw := range body {
+		switch field {
+		case "url":
+			var original string
+			if err := json.Unmarshal(raw, &original); err != nil {
+				return nil, err
+			}
+			if _, err := url.ParseRequestURI(original); err != nil {
+				return nil, err
+			}
+			edits = append(edits, func(u *databases.URL) { u.Original = original })
+		case "expires_at":
+			var expiresAt *time.Time
+			if err := json.Unmarshal(raw, &expiresAt); err != nil {
+				return nil, err
+			}
+			expiresAt = utcTime(expiresAt)
+			edits = append(edits, func(u *databases.URL) { u.ExpiresAt = expiresAt })
+		case "password":
+			var password *string
+			if err := json.Unmarshal(raw, &password); err != nil {
+				return nil, err
+			}
+			var hash string
+			if password != nil && *password != "" {
+				var err error
+				if hash, err = datahashes.HashPassword(*password); err != nil {
+					return nil, err
+				}
+			}
+			edits = append(edits, func(u *databases.URL) { u.PasswordHash = hash })
+		case "title":
+			var title string
+			if err := json.Unmarshal(raw, &title); err != nil {
+				return nil, err
+			}
+			edits = append(edits, func(u *databases.URL) { u.Title = title })
+		case "tags":
+			var tags []string
+			if err := json.Unmarshal(raw, &tags); err != nil {
+				return nil, err
+			}
+			tags, err := databases.NormalizeTags(tags)
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, func(u *databases.URL) { u.Tags = tags })
+		case "folder":
+			var folder string
+			if err := json.Unmarshal(raw, &folder); err != nil {
+				return nil, err
+			}
+			folder, err := databases.NormalizeFolder(folder)
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, func(u *databases.URL) { u.Folder = folder })
+		default:
+			return nil, fmt.Errorf("field %q can not be changed", field)
+		}
+	}
+
+	return func(u *databases.URL) error {
+		for _, edit := range edits {
+			edit(u)
+		}
+		return nil
+	}, nil
+}
+
+func writeUserURL(w http.ResponseWriter, u databases.URL, cfg config.Config) {
+	data, err := json.Marshal(newUserURL(u, cfg, time.Now()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// internalError пишет сбой в лог запроса и отвечает 500.
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Error("request failed", zap.Error(err))
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeStorageError отвечает на ошибку хранилища подходящим кодом.
+// Ошибки, не означающие неверный запрос, пишутся в лог.
+func writeStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, databases.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, databases.ErrGone):
+		http.Error(w, err.Error(), http.StatusGone)
+	case errors.Is(err, databases.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, databases.ErrConflict), errors.Is(err, databases.ErrLastOwner):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		logging.FromContext(r.Context()).Error("storage error", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// UpdateShortenURL меняет адрес назначения, срок действия, пароль,
+// заголовок, теги или папку ссылки владельца. Ключ ссылки при этом
+// не меняется.
+func UpdateShortenURL(db databases.Database, cfg config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		id := chi.URLParam(r, "ID")
+
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		edit, err := parseURLPatch(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u, err := db.Update(id, cookie.Value, edit)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeUserURL(w, u, cfg)
+	}
+}
+
+// GetURLRevisions возвращает историю прежних состояний ссылки.
+func GetURLRevisions(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		type revisionData struct {
+			Version     int        `json:"version"`
+			OriginalURL string     `json:"original_url"`
+			Title       string     `json:"title,omitempty"`
+			ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+			HasPassword bool       `json:"has_password,omitempty"`
+			CreatedAt   time.Time  `json:"created_at"`
+		}
+
+		id := chi.URLParam(r, "ID")
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		revisions, err := db.Revisions(id, cookie.Value)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		rows := make([]revisionData, 0, len(revisions))
+		for _, rev := range revisions {
+			rows = append(rows, revisionData{
+				Version:     rev.Version,
+				OriginalURL: rev.Original,
+				Title:       rev.Title,
+				ExpiresAt:   rev.ExpiresAt,
+				HasPassword: rev.PasswordHash != "",
+				CreatedAt:   rev.CreatedAt,
+			})
+		}
+
+		data, err := json.Marshal(rows)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}
+}
+
+// RollbackShortenURL возвращает ссылке состояние из указанной ревизии.
+// Текущее состояние при этом само попадает в историю.
+func RollbackShortenURL(db databases.Database, cfg config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		id := chi.URLParam(r, "ID")
+
+		var v struct {
+			Version int `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		revisions, err := db.Revisions(id, cookie.Value)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		var target *databases.Revision
+		for i := range revisions {
+			if revisions[i].Version == v.Version {
+				target = &revisions[i]
+			}
+		}
+		if target == nil {
+			http.Error(w, fmt.Sprintf("revision %d not found", v.Version), http.StatusNotFound)
+			return
+		}
+
+		u, err := db.Update(id, cookie.Value, func(u *databases.URL) error {
+			u.ApplyRevision(*target)
+			return nil
+		})
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeUserURL(w, u, cfg)
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/databases"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportURL — строка выгрузки ссылок.
+type exportURL struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Clicks      int        `json:"clicks"`
+}
+
+var exportColumns = []string{"short_url", "original_url", "created_at", "deleted_at", "clicks"}
+
+// exportWriter пишет строки выгрузки в одном из форматов.
+type exportWriter interface {
+	Write(exportURL) error
+	Close() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) (*csvExportWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportColumns); err != nil {
+		return nil, err
+	}
+	return &csvExportWriter{w: cw}, nil
+}
+
+func (c *csvExportWriter) Write(u exportURL) error {
+	var deletedAt string
+	if u.DeletedAt != nil {
+		deletedAt = u.DeletedAt.UTC().Format(time.RFC3339)
+	}
+	return c.w.Write([]string{
+		u.ShortURL,
+		u.OriginalURL,
+		u.CreatedAt.UTC().Format(time.RFC3339),
+		deletedAt,
+		strconv.Itoa(u.Clicks),
+	})
+}
+
+func (c *csvExportWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (n *ndjsonExportWriter) Write(u exportURL) error {
+	return n.enc.Encode(u)
+}
+
+func (n *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+// jsonExportWriter пишет строки JSON-массивом, не собирая его в памяти.
+type jsonExportWriter struct {
+	w     io.Writer
+	enc   *json.Encoder
+	count int
+}
+
+func newJSONExportWriter(w io.Writer) (*jsonExportWriter, error) {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return nil, err
+	}
+	return &jsonExportWriter{w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (j *jsonExportWriter) Write(u exportURL) error {
+	if j.count > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.count++
+	return j.enc.Encode(u)
+}
+
+func (j *jsonExportWriter) Close() error {
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+var exportContentTypes = map[string]string{
+	"csv":    "text/csv; charset=UTF-8",
+	"ndjson": "application/x-ndjson",
+	"json":   "application/json; charset=UTF-8",
+}
+
+// exportFormat выбирает формат по параметру format, а без него —
+// по заголовку Accept. По умолчанию выгрузка отдаётся в JSON.
+func exportFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		if _, ok := exportContentTypes[format]; !ok {
+			return "", fmt.Errorf("unknown export format %q", format)
+		}
+		return format, nil
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		switch mediaType {
+		case "text/csv":
+			return "csv", nil
+		case "application/x-ndjson", "application/ndjson":
+			return "ndjson", nil
+		case "application/json":
+			return "json", nil
+		}
+	}
+	return "json", nil
+}
+
+// ExportURLs выгружает ссылки пользователя в CSV, NDJSON или JSON.
+// Фильтры те же, что у GetAllShortenURLS, кроме limit и cursor:
+// выгружается вся выборка. Строки читаются из хранилища по одной
+// и сразу пишутся в ответ.
+func ExportURLs(db databases.Database, cfg config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		format, err := exportFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q, err := listQueryFromRequest(r, cookie.Value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Заголовки отправляются с первой строкой, чтобы ошибку доступа
+		// или хранилища до начала выгрузки ещё можно было вернуть кодом.
+		var out exportWriter
+		start := func() error {
+			w.Header().Set("Content-Type", exportContentTypes[format])
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="urls.%s"`, format))
+			w.WriteHeader(http.StatusOK)
+
+			switch format {
+			case "csv":
+				out, err = newCSVExportWriter(w)
+			case "ndjson":
+				out = &ndjsonExportWriter{enc: json.NewEncoder(w)}
+			default:
+				out, err = newJSONExportWriter(w)
+			}
+			return err
+		}
+
+		err = db.Iterate(q, func(u databases.URL) error {
+			if out == nil {
+				if err := start(); err != nil {
+					return err
+				}
+			}
+			return out.Write(exportURL{
+				ShortURL:    fmt.Sprintf("%s/%s", cfg.BaseURL, u.Hash),
+				OriginalURL: u.Original,
+				CreatedAt:   u.CreatedAt,
+				DeletedAt:   u.DeletedAt,
+				Clicks:      u.Clicks,
+			})
+		})
+		if err != nil && out == nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		// Ошибку посреди выгрузки клиент увидит по оборванному телу.
+		if err != nil {
+			return
+		}
+
+		if out == nil {
+			if err := start(); err != nil {
+				return
+			}
+		}
+		out.Close()
+	}
+}
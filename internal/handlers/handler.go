@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,33 +9,246 @@ import (
 	"github.com/salliko/reducer/config"
 	"github.com/salliko/reducer/internal/databases"
 	"github.com/salliko/reducer/internal/datahashes"
+	"github.com/salliko/reducer/internal/logging"
+	"go.uber.org/zap"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func InsertURL(URL []byte, hashURL datahashes.Hasing, db databases.Database, cfg config.Config, userID string) (string, error) {
-	key := hashURL.Hash(URL)
-	err := db.Create(key, string(URL), userID)
-	if err != nil {
-		if errors.Is(err, databases.ErrConflict) {
-			return fmt.Sprintf("%s/%s", cfg.BaseURL, key), databases.ErrConflict
-		} else {
+var errNegativeMaxClicks = errors.New("max_clicks must not be negative")
+
+// ErrPasswordRequired — к защищённой паролем ссылке не подошёл пароль.
+var ErrPasswordRequired = errors.New("password required")
+
+// linkOptions — необязательные параметры создаваемой ссылки.
+type linkOptions struct {
+	MaxClicks   int        `json:"max_clicks"`
+	ActiveFrom  *time.Time `json:"active_from"`
+	FallbackURL string     `json:"fallback_url"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	Password    string     `json:"password"`
+	Title       string     `json:"title"`
+	Tags        []string   `json:"tags"`
+	Folder      string     `json:"folder"`
+}
+
+// linkOptionsFromQuery читает параметры ссылки из query-строки запроса.
+func linkOptionsFromQuery(q url.Values) (linkOptions, error) {
+	var opts linkOptions
+	var err error
+
+	if v := q.Get("max_clicks"); v != "" {
+		opts.MaxClicks, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, err
+		}
+	}
+	if v := q.Get("active_from"); v != "" {
+		activeFrom, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.ActiveFrom = &activeFrom
+	}
+	if v := q.Get("expires_at"); v != "" {
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return opts, err
+		}
+		opts.ExpiresAt = &expiresAt
+	}
+	opts.FallbackURL = q.Get("fallback_url")
+	opts.Password = q.Get("password")
+	opts.Title = q.Get("title")
+	if v := q.Get("tags"); v != "" {
+		opts.Tags = strings.Split(v, ",")
+	}
+	opts.Folder = q.Get("folder")
+
+	return opts, nil
+}
+
+// validate проверяет параметры ссылки и приводит теги и папку
+// к каноническому виду.
+func (o *linkOptions) validate() error {
+	if o.MaxClicks < 0 {
+		return errNegativeMaxClicks
+	}
+	var err error
+	if o.Tags, err = databases.NormalizeTags(o.Tags); err != nil {
+		return err
+	}
+	if o.Folder, err = databases.NormalizeFolder(o.Folder); err != nil {
+		return err
+	}
+	if o.FallbackURL != "" {
+		if _, err := url.ParseRequestURI(o.FallbackURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o linkOptions) apply(u *databases.URL) error {
+	u.MaxClicks = o.MaxClicks
+	u.ActiveFrom = utcTime(o.ActiveFrom)
+	u.FallbackURL = o.FallbackURL
+	u.ExpiresAt = utcTime(o.ExpiresAt)
+	u.Title = o.Title
+	u.Tags = o.Tags
+	u.Folder = o.Folder
+	if o.Password != "" {
+		hash, err := datahashes.HashPassword(o.Password)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+	}
+	return nil
+}
+
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// userURL — ссылка в том виде, в котором её видит владелец.
+type userURL struct {
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	Status      string     `json:"status"`
+	Title       string     `json:"title,omitempty"`
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	HasPassword bool       `json:"has_password,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Folder      string     `json:"folder,omitempty"`
+	WorkspaceID string     `json:"workspace_id,omitempty"`
+	Clicks      int        `json:"clicks"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+func newUserURL(u databases.URL, cfg config.Config, now time.Time) userURL {
+	return userURL{
+		ShortURL:    fmt.Sprintf("%s/%s", cfg.BaseURL, u.Hash),
+		OriginalURL: u.Original,
+		Status:      u.Status(now),
+		Title:       u.Title,
+		ActiveFrom:  u.ActiveFrom,
+		ExpiresAt:   u.ExpiresAt,
+		HasPassword: u.PasswordHash != "",
+		Tags:        u.Tags,
+		Folder:      u.Folder,
+		WorkspaceID: u.WorkspaceID,
+		Clicks:      u.Clicks,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+// maxKeyAttempts ограничивает число попыток подобрать свободный ключ.
+const maxKeyAttempts = 5
+
+// reusable сообщает, что вместо новой ссылки u можно отдать уже
+// сохранённую existing: она ведёт на тот же адрес, ещё работает
+// и создана с теми же параметрами. Ссылки с паролем не переиспользуются:
+// по хешу нельзя проверить, тот же ли это пароль.
+func reusable(existing, u databases.URL, now time.Time) bool {
+	return existing.Original == u.Original &&
+		!existing.Deleted() && !existing.Expired(now) && !existing.Exhausted() &&
+		existing.MaxClicks == u.MaxClicks &&
+		equalTime(existing.ActiveFrom, u.ActiveFrom) &&
+		equalTime(existing.ExpiresAt, u.ExpiresAt) &&
+		existing.FallbackURL == u.FallbackURL &&
+		existing.PasswordHash == "" && u.PasswordHash == "" &&
+		existing.Title == u.Title &&
+		strings.Join(existing.Tags, ",") == strings.Join(u.Tags, ",") &&
+		existing.Folder == u.Folder
+}
+
+func equalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// InsertURL сохраняет ссылку u, вычисляя её ключ по оригинальному адресу.
+// Если по ключу уже сохранена такая же ссылка (см. reusable), возвращает
+// её вместе с ErrConflict. Если та ссылка удалена, истекла, исчерпала
+// лимит, создана с другими параметрами или владелец перенаправил её
+// на другой адрес, новая ссылка получает свежий ключ.
+func InsertURL(u databases.URL, hashURL datahashes.Hasing, db databases.Database, cfg config.Config) (string, error) {
+	key := hashURL.Hash([]byte(u.Original))
+	for attempt := 1; ; attempt++ {
+		u.Hash = key
+		err := db.Create(u)
+		if err == nil {
+			return fmt.Sprintf("%s/%s", cfg.BaseURL, key), nil
+		}
+		if !errors.Is(err, databases.ErrConflict) || attempt == maxKeyAttempts {
 			return "", err
 		}
+		if attempt == 1 {
+			existing, err := db.Select(key)
+			if err != nil && !errors.Is(err, databases.ErrGone) {
+				return "", err
+			}
+			if err == nil && reusable(existing, u, time.Now()) {
+				return fmt.Sprintf("%s/%s", cfg.BaseURL, key), databases.ErrConflict
+			}
+		}
+		salt, err := datahashes.RandID(8)
+		if err != nil {
+			return "", err
+		}
+		key = hashURL.Hash([]byte(u.Original + salt))
+	}
+}
+
+// BatchKey подбирает ключ для ссылки u из пакета. Если такая же ссылка
+// уже сохранена (см. reusable), возвращает её ключ и false: ссылку
+// не нужно добавлять заново. Ключ, который занят другой ссылкой,
+// заменяется свежим, как в InsertURL.
+func BatchKey(u databases.URL, hashURL datahashes.Hasing, db databases.Database) (string, bool, error) {
+	key := hashURL.Hash([]byte(u.Original))
+	for attempt := 1; ; attempt++ {
+		existing, err := db.Select(key)
+		switch {
+		case errors.Is(err, databases.ErrNotFound):
+			return key, true, nil
+		case err == nil && reusable(existing, u, time.Now()):
+			return key, false, nil
+		case err != nil && !errors.Is(err, databases.ErrGone):
+			return "", false, err
+		}
+		if attempt == maxKeyAttempts {
+			return "", false, databases.ErrConflict
+		}
+		salt, err := datahashes.RandID(8)
+		if err != nil {
+			return "", false, err
+		}
+		key = hashURL.Hash([]byte(u.Original + salt))
 	}
-	return fmt.Sprintf("%s/%s", cfg.BaseURL, key), nil
 }
 
 func GenerateShortURL(hashURL datahashes.Hasing, db databases.Database, cfg config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
 
 		inputURL, err := io.ReadAll(r.Body)
 
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			internalError(w, r, err)
 			return
 		}
 
@@ -43,13 +257,29 @@ func GenerateShortURL(hashURL datahashes.Hasing, db databases.Database, cfg conf
 			return
 		}
 
+		opts, err := linkOptionsFromQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := opts.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		cookie, err := r.Cookie("user_id")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		newURL, err := InsertURL(inputURL, hashURL, db, cfg, cookie.Value)
+		u := databases.URL{Original: string(inputURL), UserID: cookie.Value}
+		if err := opts.apply(&u); err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		newURL, err := InsertURL(u, hashURL, db, cfg)
 		if err != nil {
 			if errors.Is(err, databases.ErrConflict) {
 				w.WriteHeader(http.StatusConflict)
@@ -65,12 +295,43 @@ func GenerateShortURL(hashURL datahashes.Hasing, db databases.Database, cfg conf
 	}
 }
 
+// ResolveURL засчитывает переход по ссылке key и возвращает её. Пароль
+// проверяется до Visit, чтобы неудачная попытка не расходовала переходы
+// по ссылке. У ещё не активной ссылки вместе с ErrNotActive возвращается
+// она сама, с адресом заглушки.
+func ResolveURL(db databases.Database, key, password string) (databases.URL, error) {
+	val, err := db.Select(key)
+	if err != nil {
+		return val, err
+	}
+	if val.PasswordHash != "" && val.Status(time.Now()) == databases.StatusActive &&
+		!datahashes.CheckPassword(val.PasswordHash, password) {
+		return databases.URL{}, ErrPasswordRequired
+	}
+	return db.Visit(key)
+}
+
 func RedirectFromShortToFull(db databases.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
 		id := chi.URLParam(r, "ID")
 
-		val, err := db.Select(id)
+		_, password, _ := r.BasicAuth()
+		val, err := ResolveURL(db, id, password)
 		if err != nil {
+			if errors.Is(err, ErrPasswordRequired) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="link", charset="UTF-8"`)
+				http.Error(w, "Password required", http.StatusUnauthorized)
+				return
+			}
+			if errors.Is(err, databases.ErrNotActive) {
+				if val.FallbackURL != "" {
+					http.Redirect(w, r, val.FallbackURL, http.StatusTemporaryRedirect)
+					return
+				}
+				http.NotFound(w, r)
+				return
+			}
 			if errors.Is(err, databases.ErrGone) {
 				http.Error(w, err.Error(), http.StatusGone)
 				return
@@ -79,15 +340,17 @@ func RedirectFromShortToFull(db databases.Database) http.HandlerFunc {
 			w.Write([]byte("Not found"))
 			return
 		}
-		http.Redirect(w, r, val, http.StatusTemporaryRedirect)
+		http.Redirect(w, r, val.Original, http.StatusTemporaryRedirect)
 		w.Write([]byte("Found"))
 	}
 }
 
 func GenerateShortenJSONURL(hashURL datahashes.Hasing, db databases.Database, cfg config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
 		var v struct {
 			URL string `json:"url"`
+			linkOptions
 		}
 
 		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
@@ -100,16 +363,27 @@ func GenerateShortenJSONURL(hashURL datahashes.Hasing, db databases.Database, cf
 			return
 		}
 
+		if err := v.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		cookie, err := r.Cookie("user_id")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		newURL, err := InsertURL([]byte(v.URL), hashURL, db, cfg, cookie.Value)
+		u := databases.URL{Original: v.URL, UserID: cookie.Value}
+		if err := v.apply(&u); err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		newURL, err := InsertURL(u, hashURL, db, cfg)
 		if err != nil {
 			if errors.Is(err, databases.ErrConflict) {
-				log.Println(err.Error())
+				logging.FromContext(r.Context()).Debug("url already shortened", zap.String("url", v.URL))
 				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 				w.WriteHeader(http.StatusConflict)
 			} else {
@@ -129,25 +403,18 @@ func GenerateShortenJSONURL(hashURL datahashes.Hasing, db databases.Database, cf
 
 		data, err := json.Marshal(res)
 		if err != nil {
-			log.Println(err.Error())
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			internalError(w, r, err)
 			return
 		}
 
-		log.Println(w.Header())
-
 		w.Write(data)
 	}
 }
 
 func GetAllShortenURLS(db databases.Database, cfg config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		type rowData struct {
-			ShortURL    string `json:"short_url"`
-			OriginalURL string `json:"original_url"`
-		}
-
-		var rows []rowData
+		db := databases.WithContext(r.Context(), db)
+		var rows []userURL
 
 		cookie, err := r.Cookie("user_id")
 		if err != nil {
@@ -157,23 +424,30 @@ func GetAllShortenURLS(db databases.Database, cfg config.Config) http.HandlerFun
 			return
 		}
 
-		allRows, err := db.SelectAll(cookie.Value)
+		q, err := listQueryFromRequest(r, cookie.Value)
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(http.StatusBadRequest)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if len(allRows) == 0 {
+
+		page, err := db.List(q)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+		if len(page.URLs) == 0 {
 			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 			w.WriteHeader(http.StatusNoContent)
 			http.Error(w, "No Content", http.StatusNoContent)
 			return
 		}
 
-		for _, value := range allRows {
-			shortURL := fmt.Sprintf("%s/%s", cfg.BaseURL, value.Hash)
-			rows = append(rows, rowData{ShortURL: shortURL, OriginalURL: value.Original})
+		now := time.Now()
+		for _, value := range page.URLs {
+			rows = append(rows, newUserURL(value, cfg, now))
+		}
+		if page.NextCursor != "" {
+			w.Header().Set("Link", nextPageLink(r, page.NextCursor))
 		}
 
 		data, err := json.Marshal(rows)
@@ -191,9 +465,10 @@ func GetAllShortenURLS(db databases.Database, cfg config.Config) http.HandlerFun
 
 func Ping(db databases.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
 		err := db.Ping()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			internalError(w, r, err)
 			return
 		}
 
@@ -204,6 +479,7 @@ func Ping(db databases.Database) http.HandlerFunc {
 
 func GenerateManyShortenJSONURL(hashURL datahashes.Hasing, db databases.Database, cfg config.Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
 
 		var inputValues []databases.InputURL
 		var outputValues []databases.OutputURL
@@ -219,24 +495,58 @@ func GenerateManyShortenJSONURL(hashURL datahashes.Hasing, db databases.Database
 			return
 		}
 
+		batchOpts := make([]linkOptions, 0, len(inputValues))
 		for _, value := range inputValues {
-			key := hashURL.Hash([]byte(value.OriginalURL))
-			err := db.CreateMany(databases.URL{
-				Hash:     key,
-				Original: value.OriginalURL,
-				UserID:   cookie.Value,
-			})
-			if err != nil {
+			opts := linkOptions{
+				MaxClicks:   value.MaxClicks,
+				ActiveFrom:  value.ActiveFrom,
+				FallbackURL: value.FallbackURL,
+				ExpiresAt:   value.ExpiresAt,
+				Title:       value.Title,
+				Tags:        value.Tags,
+				Folder:      value.Folder,
+			}
+			if err := opts.validate(); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			batchOpts = append(batchOpts, opts)
+		}
+
+		// keys — ключи адресов, уже попавших в пакет, batch — новые
+		// ссылки пакета, которые сохраняются одним CreateMany.
+		keys := make(map[string]string, len(inputValues))
+		var batch []databases.URL
+		for i, value := range inputValues {
+			key, ok := keys[value.OriginalURL]
+			if !ok {
+				u := databases.URL{
+					Original: value.OriginalURL,
+					UserID:   cookie.Value,
+				}
+				if err := batchOpts[i].apply(&u); err != nil {
+					internalError(w, r, err)
+					return
+				}
+				var create bool
+				key, create, err = BatchKey(u, hashURL, db)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				keys[value.OriginalURL] = key
+				if create {
+					u.Hash = key
+					batch = append(batch, u)
+				}
+			}
 			outputValues = append(outputValues, databases.OutputURL{
-				ShortURL:      fmt.Sprintf("%s/%s", cfg.BaseURL, hashURL.Hash([]byte(value.OriginalURL))),
+				ShortURL:      fmt.Sprintf("%s/%s", cfg.BaseURL, key),
 				CorrelationID: value.CorrelationID,
 			})
 		}
 
-		err = db.Flush()
+		err = db.CreateMany(batch)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -260,8 +570,38 @@ type deleteItem struct {
 	UserID string
 }
 
+// pendingDeletes — ключи, принятые Delete и ещё не удалённые,
+// а deletes — ещё не закончившиеся вызовы Delete.
+var (
+	pendingDeletes int64
+	deletes        sync.WaitGroup
+)
+
+// PendingDeletes возвращает длину очереди на удаление.
+func PendingDeletes() int64 {
+	return atomic.LoadInt64(&pendingDeletes)
+}
+
+// WaitDeletes ждёт, пока закончатся все начатые удаления, но не
+// дольше, чем живёт ctx. Новые удаления к этому времени уже не должны
+// начинаться, поэтому вызывать её нужно после остановки сервера.
+func WaitDeletes(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		deletes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func Delete(db databases.Database) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
 		var keys []string
 
 		if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
@@ -275,29 +615,46 @@ func Delete(db databases.Database) http.HandlerFunc {
 			return
 		}
 
-		inputCh := make(chan deleteItem)
-		workersCount := 10
+		DeleteURLs(r.Context(), db, cookie.Value, keys)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
 
-		go func() {
-			for _, key := range keys {
-				inputCh <- deleteItem{Key: key, UserID: cookie.Value}
-			}
-			close(inputCh)
-		}()
+// DeleteURLs удаляет ссылки keys пользователя userID пулом воркеров
+// и ждёт, пока они закончат. Ссылки, которые пользователь удалить
+// не может, пропускаются, а ошибки хранилища пишутся в лог запроса.
+func DeleteURLs(ctx context.Context, db databases.Database, userID string, keys []string) {
+	deletes.Add(1)
+	defer deletes.Done()
+	atomic.AddInt64(&pendingDeletes, int64(len(keys)))
+	databases.DeleteBatch(db, userID, keys, func() {
+		deleteURLs(ctx, db, userID, keys)
+	})
+}
 
-		fanOutChs := fanOut(inputCh, workersCount)
-		workerChs := make([]chan error, 0, workersCount)
-		for _, fanOutCh := range fanOutChs {
-			w := newWorker(db, fanOutCh)
-			workerChs = append(workerChs, w)
-		}
+func deleteURLs(ctx context.Context, db databases.Database, userID string, keys []string) {
+	inputCh := make(chan deleteItem)
+	workersCount := 10
 
-		// здесь fanIn
-		for v := range fanIn(workerChs...) {
-			log.Println(v)
+	go func() {
+		for _, key := range keys {
+			inputCh <- deleteItem{Key: key, UserID: userID}
 		}
+		close(inputCh)
+	}()
 
-		w.WriteHeader(http.StatusAccepted)
+	fanOutChs := fanOut(inputCh, workersCount)
+	workerChs := make([]chan error, 0, workersCount)
+	for _, fanOutCh := range fanOutChs {
+		w := newWorker(db, fanOutCh)
+		workerChs = append(workerChs, w)
+	}
+
+	// здесь fanIn
+	for err := range fanIn(workerChs...) {
+		if err != nil {
+			logging.FromContext(ctx).Error("delete url", zap.Error(err))
+		}
 	}
 }
 
@@ -339,6 +696,7 @@ func newWorker(db databases.Database, inputCh <-chan deleteItem) chan error {
 	go func() {
 		for item := range inputCh {
 			err := db.Delete(item.Key, item.UserID)
+			atomic.AddInt64(&pendingDeletes, -1)
 			outCh <- err
 		}
 
@@ -0,0 +1,427 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/salliko/reducer/internal/datahashes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// importBatchSize — сколько строк импорта сохраняется одним
+	// CreateMany.
+	importBatchSize = 100
+	maxImportLine   = 1 << 20
+)
+
+const (
+	importCreated  = "created"
+	importConflict = "conflict"
+	importInvalid  = "invalid"
+	importFailed   = "failed"
+)
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,25}$`)
+
+// reservedAliases собирает первые сегменты статических маршрутов
+// routes: такие алиасы не откроются как короткие ссылки.
+func reservedAliases(routes chi.Routes) (map[string]bool, error) {
+	reserved := make(map[string]bool)
+	err := chi.Walk(routes, func(_, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		segment := strings.SplitN(strings.TrimPrefix(route, "/"), "/", 2)[0]
+		if segment != "" && !strings.Contains(segment, "{") {
+			reserved[strings.ToLower(segment)] = true
+		}
+		return nil
+	})
+	return reserved, err
+}
+
+// importRecord — строка импорта. Row — её номер среди строк данных,
+// начиная с единицы. Err заполняется, если строку не удалось разобрать.
+type importRecord struct {
+	Row       int
+	URL       string     `json:"url"`
+	Alias     string     `json:"alias"`
+	Tags      []string   `json:"tags"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Title     string     `json:"title"`
+	Folder    string     `json:"folder"`
+	Err       error      `json:"-"`
+}
+
+// importReader отдаёт строки импорта по одной. io.EOF означает конец
+// загрузки, прочие ошибки прерывают импорт.
+type importReader interface {
+	Next() (importRecord, error)
+}
+
+type csvImportReader struct {
+	r       *csv.Reader
+	columns map[string]int
+	row     int
+}
+
+// newCSVImportReader читает заголовок CSV. Обязательна колонка url,
+// остальные — alias, tags (через запятую), expires_at (RFC 3339),
+// title и folder — могут отсутствовать.
+func newCSVImportReader(body io.Reader) (*csvImportReader, error) {
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, errors.New("csv header must contain url column")
+	}
+	return &csvImportReader{r: r, columns: columns}, nil
+}
+
+func (c *csvImportReader) Next() (importRecord, error) {
+	fields, err := c.r.Read()
+	if err == io.EOF {
+		return importRecord{}, err
+	}
+	c.row++
+	rec := importRecord{Row: c.row}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rec.Err = err
+			return rec, nil
+		}
+		return rec, err
+	}
+
+	field := func(name string) string {
+		if i, ok := c.columns[name]; ok && i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	rec.URL = field("url")
+	rec.Alias = field("alias")
+	rec.Title = field("title")
+	rec.Folder = field("folder")
+	if v := field("tags"); v != "" {
+		rec.Tags = strings.Split(v, ",")
+	}
+	if v := field("expires_at"); v != "" {
+		expiresAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			rec.Err = err
+			return rec, nil
+		}
+		rec.ExpiresAt = &expiresAt
+	}
+	return rec, nil
+}
+
+type ndjsonImportReader struct {
+	s   *bufio.Scanner
+	row int
+}
+
+func newNDJSONImportReader(body io.Reader) *ndjsonImportReader {
+	s := bufio.NewScanner(body)
+	s.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	return &ndjsonImportReader{s: s}
+}
+
+func (n *ndjsonImportReader) Next() (importRecord, error) {
+	for n.s.Scan() {
+		data := strings.TrimSpace(n.s.Text())
+		if data == "" {
+			continue
+		}
+		n.row++
+		var rec importRecord
+		rec.Err = json.Unmarshal([]byte(data), &rec)
+		rec.Row = n.row
+		return rec, nil
+	}
+	if err := n.s.Err(); err != nil {
+		return importRecord{}, err
+	}
+	return importRecord{}, io.EOF
+}
+
+// newImportReader выбирает формат по параметру format, а без него —
+// по Content-Type запроса.
+func newImportReader(r *http.Request) (importReader, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = "csv"
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			format = "ndjson"
+		}
+	}
+
+	switch format {
+	case "csv":
+		return newCSVImportReader(r.Body)
+	case "ndjson":
+		return newNDJSONImportReader(r.Body), nil
+	default:
+		return nil, errUnsupportedImportFormat
+	}
+}
+
+var errUnsupportedImportFormat = errors.New("import format must be csv or ndjson")
+
+type importResult struct {
+	Row      int    `json:"row"`
+	Status   string `json:"status"`
+	ShortURL string `json:"short_url,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	url databases.URL
+}
+
+// importer проверяет строки импорта и сохраняет их пакетами через
+// CreateMany. Результаты строк отдаются report по мере
+// сохранения пакетов, поэтому в памяти держится не больше пакета.
+type importer struct {
+	db      databases.Database
+	hashURL datahashes.Hasing
+	cfg     config.Config
+	userID  string
+	report  func(importResult) error
+	// reserved — алиасы, занятые маршрутами сервиса.
+	reserved map[string]bool
+
+	// seen — ключи ожидающего пакета. Ключи прошлых пакетов уже
+	// сохранены, и их находит Select.
+	seen    map[string]bool
+	pending []importResult
+	counts  map[string]int
+}
+
+func (im *importer) add(rec importRecord) error {
+	res := im.check(rec)
+	im.pending = append(im.pending, res)
+	if len(im.pending) >= importBatchSize {
+		return im.flush()
+	}
+	return nil
+}
+
+func (im *importer) check(rec importRecord) importResult {
+	res := importResult{Row: rec.Row}
+	invalid := func(err error) importResult {
+		res.Status = importInvalid
+		res.Error = err.Error()
+		return res
+	}
+
+	if rec.Err != nil {
+		return invalid(rec.Err)
+	}
+	if _, err := url.ParseRequestURI(rec.URL); err != nil {
+		return invalid(err)
+	}
+	if rec.Alias != "" && (!aliasPattern.MatchString(rec.Alias) || im.reserved[strings.ToLower(rec.Alias)]) {
+		return invalid(fmt.Errorf("invalid alias %q", rec.Alias))
+	}
+	opts := linkOptions{ExpiresAt: rec.ExpiresAt, Title: rec.Title, Tags: rec.Tags, Folder: rec.Folder}
+	if err := opts.validate(); err != nil {
+		return invalid(err)
+	}
+
+	u := databases.URL{Hash: rec.Alias, Original: rec.URL, UserID: im.userID}
+	if u.Hash == "" {
+		u.Hash = im.hashURL.Hash([]byte(rec.URL))
+	}
+	if err := opts.apply(&u); err != nil {
+		return invalid(err)
+	}
+	res.ShortURL = fmt.Sprintf("%s/%s", im.cfg.BaseURL, u.Hash)
+
+	if im.seen[u.Hash] {
+		res.Status = importConflict
+		return res
+	}
+	im.seen[u.Hash] = true
+
+	_, err := im.db.Select(u.Hash)
+	switch {
+	case err == nil, errors.Is(err, databases.ErrGone):
+		res.Status = importConflict
+	case errors.Is(err, databases.ErrNotFound):
+		res.url = u
+	default:
+		res.Status = importFailed
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// flush сохраняет ожидающие строки одним пакетом. Если пакет целиком
+// не сохранился, например из-за ключа, занятого параллельным запросом,
+// строки сохраняются по одной, чтобы выяснить судьбу каждой.
+func (im *importer) flush() error {
+	err := im.createMany()
+	for i := range im.pending {
+		res := &im.pending[i]
+		if res.Status != "" {
+			continue
+		}
+		res.Status = importCreated
+		if err == nil {
+			continue
+		}
+		if err := im.db.Create(res.url); err != nil {
+			if errors.Is(err, databases.ErrConflict) {
+				res.Status = importConflict
+			} else {
+				res.Status = importFailed
+				res.Error = err.Error()
+			}
+		}
+	}
+
+	for _, res := range im.pending {
+		im.counts[res.Status]++
+		if err := im.report(res); err != nil {
+			return err
+		}
+	}
+	im.pending = im.pending[:0]
+	im.seen = make(map[string]bool)
+	return nil
+}
+
+func (im *importer) createMany() error {
+	var urls []databases.URL
+	for _, res := range im.pending {
+		if res.Status == "" {
+			urls = append(urls, res.url)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	return im.db.CreateMany(urls)
+}
+
+// ImportURLs массово создаёт ссылки пользователя из CSV или NDJSON.
+// Загрузка читается потоком, а отчёт по строкам пишется по мере
+// сохранения пакетов:
+//
+//	{"rows": [{"row": 1, "status": "created", "short_url": "..."}, ...],
+//	 "created": 1, "conflict": 0, "invalid": 0, "failed": 0}
+//
+// Если загрузка оборвалась, в отчёт добавляется поле error. Алиасы,
+// совпадающие со статическими маршрутами routes, отклоняются.
+func ImportURLs(hashURL datahashes.Hasing, db databases.Database, cfg config.Config, routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		reserved, err := reservedAliases(routes)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		reader, err := newImportReader(r)
+		if errors.Is(err, errUnsupportedImportFormat) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, `{"rows":[`)
+
+		enc := json.NewEncoder(w)
+		first := true
+		im := &importer{
+			db:       db,
+			hashURL:  hashURL,
+			cfg:      cfg,
+			userID:   cookie.Value,
+			reserved: reserved,
+			seen:     make(map[string]bool),
+			counts:   make(map[string]int),
+			report: func(res importResult) error {
+				if !first {
+					io.WriteString(w, ",")
+				}
+				first = false
+				return enc.Encode(res)
+			},
+		}
+
+		var readErr error
+		for {
+			rec, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				readErr = err
+				break
+			}
+			if err := im.add(rec); err != nil {
+				return
+			}
+		}
+		if err := im.flush(); err != nil {
+			return
+		}
+
+		summary := struct {
+			Created  int    `json:"created"`
+			Conflict int    `json:"conflict"`
+			Invalid  int    `json:"invalid"`
+			Failed   int    `json:"failed"`
+			Error    string `json:"error,omitempty"`
+		}{
+			Created:  im.counts[importCreated],
+			Conflict: im.counts[importConflict],
+			Invalid:  im.counts[importInvalid],
+			Failed:   im.counts[importFailed],
+		}
+		if readErr != nil {
+			summary.Error = readErr.Error()
+		}
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return
+		}
+		// Поля итогов дописываются к объекту после массива строк.
+		io.WriteString(w, "],")
+		w.Write(data[1:])
+	}
+}
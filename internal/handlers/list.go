@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/salliko/reducer/internal/databases"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultListLimit и MaxListLimit — размер страницы выборки по умолчанию
+// и наибольший допустимый.
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// listQueryFromRequest собирает выборку ссылок пользователя из параметров
+// запроса: limit, cursor, search, domain, created_from, created_to,
+// tag (можно несколько), folder, deleted, sort (created или clicks),
+// order (asc или desc) и workspace — ссылки рабочего пространства
+// вместо личных.
+func listQueryFromRequest(r *http.Request, userID string) (databases.Query, error) {
+	params := r.URL.Query()
+	q := databases.Query{
+		UserID:      userID,
+		WorkspaceID: params.Get("workspace"),
+		Search:      params.Get("search"),
+		Domain:      params.Get("domain"),
+		Folder:      params.Get("folder"),
+		Sort:        params.Get("sort"),
+		Cursor:      params.Get("cursor"),
+		Limit:       DefaultListLimit,
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return q, err
+		}
+		if limit <= 0 || limit > MaxListLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", MaxListLimit)
+		}
+		q.Limit = limit
+	}
+
+	for name, dst := range map[string]**time.Time{
+		"created_from": &q.CreatedFrom,
+		"created_to":   &q.CreatedTo,
+	} {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, err
+			}
+			*dst = &t
+		}
+	}
+
+	tags, err := databases.NormalizeTags(params["tag"])
+	if err != nil {
+		return q, err
+	}
+	q.Tags = tags
+
+	if v := params.Get("deleted"); v != "" {
+		deleted, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, err
+		}
+		q.Deleted = &deleted
+	}
+
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("unknown order %q", params.Get("order"))
+	}
+
+	return q.Normalize()
+}
+
+// nextPageLink возвращает значение заголовка Link со ссылкой на следующую
+// страницу выборки.
+func nextPageLink(r *http.Request, cursor string) string {
+	params := r.URL.Query()
+	params.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: params.Encode()}
+	return fmt.Sprintf(`<%s>; rel="next"`, next.String())
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/salliko/reducer/config"
+	"github.com/salliko/reducer/internal/databases"
+	"net/http"
+	"time"
+)
+
+// RestoreShortenURL отменяет удаление ссылки, пока не истёк срок
+// хранения удалённых ссылок cfg.DeletedRetention.
+func RestoreShortenURL(db databases.Database, cfg config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		id := chi.URLParam(r, "ID")
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u, err := db.Restore(id, cookie.Value, time.Now().Add(-cfg.DeletedRetention))
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeUserURL(w, u, cfg)
+	}
+}
+
+// EmptyTrash окончательно удаляет все удалённые ссылки пользователя,
+// не дожидаясь фоновой очистки.
+func EmptyTrash(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		purged, err := db.Purge(cookie.Value, time.Now())
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		data, err := json.Marshal(struct {
+			Purged int `json:"purged"`
+		}{Purged: purged})
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	}
+}
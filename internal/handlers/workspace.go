@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/salliko/reducer/internal/datahashes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxWorkspaceNameLength = 255
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// CreateWorkspace заводит рабочее пространство, владельцем которого
+// становится создавший его пользователь.
+func CreateWorkspace(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		var v struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.Name = strings.TrimSpace(v.Name)
+		if v.Name == "" || len(v.Name) > maxWorkspaceNameLength {
+			http.Error(w, fmt.Sprintf("name must be 1 to %d bytes", maxWorkspaceNameLength), http.StatusBadRequest)
+			return
+		}
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id, err := datahashes.RandID(8)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		ws := databases.Workspace{ID: id, Name: v.Name, CreatedAt: time.Now().UTC()}
+		if err := db.CreateWorkspace(ws, cookie.Value); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		ws.Role = databases.RoleOwner
+		writeJSON(w, http.StatusCreated, ws)
+	}
+}
+
+// GetWorkspaces возвращает пространства пользователя с его ролью в каждом.
+func GetWorkspaces(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		workspaces, err := db.Workspaces(cookie.Value)
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		if len(workspaces) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, workspaces)
+	}
+}
+
+// GetWorkspaceMembers возвращает участников пространства. Доступно
+// любому участнику.
+func GetWorkspaceMembers(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		members, err := db.Members(chi.URLParam(r, "WS"), cookie.Value)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, members)
+	}
+}
+
+// SetWorkspaceMember добавляет участника или меняет его роль.
+func SetWorkspaceMember(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		var m databases.Member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if m.UserID == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+		if !databases.ValidRole(m.Role) {
+			http.Error(w, fmt.Sprintf("unknown role %q", m.Role), http.StatusBadRequest)
+			return
+		}
+		m.WorkspaceID = chi.URLParam(r, "WS")
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := db.SetMember(cookie.Value, m); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, m)
+	}
+}
+
+// RemoveWorkspaceMember исключает участника из пространства.
+func RemoveWorkspaceMember(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		var v struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v.UserID == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m := databases.Member{WorkspaceID: chi.URLParam(r, "WS"), UserID: v.UserID}
+		if err := db.SetMember(cookie.Value, m); err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TransferToWorkspace передаёт пространству перечисленные ссылки
+// или, при пустом списке, все личные ссылки пользователя. Владелец
+// пространства может указать в user_id другого участника и передать
+// его ссылки, например ушедшего из команды.
+func TransferToWorkspace(db databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		var v struct {
+			URLs   []string `json:"urls"`
+			UserID string   `json:"user_id"`
+		}
+		// Пустое тело означает перенос всех ссылок.
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		cookie, err := r.Cookie("user_id")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		transferred, err := db.Transfer(chi.URLParam(r, "WS"), cookie.Value, v.UserID, v.URLs)
+		if err != nil {
+			writeStorageError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, struct {
+			Transferred int `json:"transferred"`
+		}{Transferred: transferred})
+	}
+}
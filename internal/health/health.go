@@ -0,0 +1,221 @@
+// Package health отвечает на пробы живости и готовности: /healthz
+// говорит, что процесс жив, /readyz — что он может обслуживать запросы,
+// с результатом каждой проверки готовности.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/salliko/reducer/internal/databases"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// probeKey — ключ, которого нет среди ссылок: чтение по нему проходит
+// до хранилища и обратно, ничего не меняя.
+const probeKey = "__readyz__"
+
+var ErrTimeout = errors.New("check timed out")
+
+// Check — проверка готовности. Она должна вернуться, как только ctx
+// отменён; проверки, которые этого не умеют, оборачиваются в bounded.
+type Check func(ctx context.Context) (detail interface{}, err error)
+
+// Result — итог одной проверки.
+type Result struct {
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+	Duration string      `json:"duration"`
+}
+
+// Report — ответ /readyz.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker выполняет проверки готовности, каждую не дольше timeout;
+// нулевой timeout их не ограничивает.
+type Checker struct {
+	timeout time.Duration
+	names   []string
+	checks  map[string]Check
+}
+
+func New(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, checks: make(map[string]Check)}
+}
+
+// Add добавляет проверку name.
+func (c *Checker) Add(name string, check Check) {
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Run выполняет все проверки одновременно.
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(c.names))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range c.names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := ctx, context.CancelFunc(func() {})
+			if c.timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, c.timeout)
+			}
+			defer cancel()
+
+			start := time.Now()
+			detail, err := bounded(check)(ctx)
+			res := Result{Status: StatusOK, Detail: detail, Duration: time.Since(start).String()}
+			if err != nil {
+				res.Status, res.Error = StatusFail, err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = res
+			if err != nil {
+				report.Status = StatusFail
+			}
+		}(name, c.checks[name])
+	}
+	wg.Wait()
+	return report
+}
+
+// bounded возвращает ErrTimeout по отмене ctx, даже если check ещё
+// не вернулась: вызовы хранилища контекст не принимают.
+func bounded(check Check) Check {
+	return func(ctx context.Context) (interface{}, error) {
+		type result struct {
+			detail interface{}
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			detail, err := check(ctx)
+			done <- result{detail, err}
+		}()
+		select {
+		case res := <-done:
+			return res.detail, res.err
+		case <-ctx.Done():
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Live отвечает 200, пока процесс способен обработать запрос.
+func Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+// Ready отвечает 200, если все проверки прошли, иначе 503, и в обоих
+// случаях отдаёт результат каждой проверки.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Storage проверяет, что основное хранилище отвечает: пингует его
+// и читает ссылку по несуществующему ключу. Кеши и зеркало
+// пропускаются, чтобы ответ не пришёл из кеша.
+func Storage(db databases.Database) Check {
+	layers := databases.Layers(db)
+	primary := layers[len(layers)-1]
+	return func(ctx context.Context) (interface{}, error) {
+		if err := primary.Ping(); err != nil {
+			return nil, err
+		}
+		_, err := primary.Select(probeKey)
+		if err != nil && !errors.Is(err, databases.ErrNotFound) && !errors.Is(err, databases.ErrGone) {
+			return nil, err
+		}
+		return nil, nil
+	}
+}
+
+// DeleteQueue проверяет, что очередь на удаление pending не длиннее max.
+func DeleteQueue(pending func() int64, max int64) Check {
+	return func(ctx context.Context) (interface{}, error) {
+		n := pending()
+		detail := map[string]int64{"pending": n, "max": max}
+		if n > max {
+			return detail, fmt.Errorf("%d deletes pending, more than %d", n, max)
+		}
+		return detail, nil
+	}
+}
+
+// Migrations проверяет, что к схеме хранилища применены все миграции,
+// которые знает сервис. У хранилищ без миграций проверка проходит.
+func Migrations(db databases.Database) Check {
+	return func(ctx context.Context) (interface{}, error) {
+		for _, layer := range databases.Layers(db) {
+			migrated, ok := layer.(interface {
+				MigrationState() (databases.MigrationState, error)
+			})
+			if !ok {
+				continue
+			}
+			state, err := migrated.MigrationState()
+			if err != nil {
+				return nil, err
+			}
+			if state.Applied < state.Known {
+				return state, fmt.Errorf("%d of %d migrations applied", state.Applied, state.Known)
+			}
+			return state, nil
+		}
+		return nil, nil
+	}
+}
+
+// Writable проверяет, что в каталоге файла path можно создать файл:
+// файловое хранилище сохраняется через временный файл рядом с основным.
+func Writable(path string) Check {
+	return func(ctx context.Context) (interface{}, error) {
+		file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".readyz.*")
+		if err != nil {
+			return nil, err
+		}
+		name := file.Name()
+		if err := file.Close(); err != nil {
+			os.Remove(name)
+			return nil, err
+		}
+		return nil, os.Remove(name)
+	}
+}
@@ -0,0 +1,73 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	db, err := databases.NewSQLiteDatabase(filepath.Join(t.TempDir(), "ready.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var pending int64
+	c := New(50 * time.Millisecond)
+	c.Add("storage", Storage(databases.NewCachedDatabase(db, 10, time.Minute, time.Minute)))
+	c.Add("migrations", Migrations(db))
+	c.Add("delete_queue", DeleteQueue(func() int64 { return pending }, 10))
+	c.Add("file_storage", Writable(filepath.Join(t.TempDir(), "urls.json")))
+
+	report := c.Run(context.Background())
+	assert.Equal(t, StatusOK, report.Status, report)
+	require.Len(t, report.Checks, 4)
+	assert.IsType(t, databases.MigrationState{}, report.Checks["migrations"].Detail)
+
+	pending = 11
+	c.Add("file_storage", Writable(filepath.Join(t.TempDir(), "missing", "urls.json")))
+	c.Add("slow", func(ctx context.Context) (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+	report = c.Run(context.Background())
+	assert.Equal(t, StatusFail, report.Status)
+	assert.Equal(t, StatusOK, report.Checks["storage"].Status)
+	assert.Equal(t, StatusFail, report.Checks["delete_queue"].Status)
+	assert.Equal(t, StatusFail, report.Checks["file_storage"].Status)
+	assert.Equal(t, ErrTimeout.Error(), report.Checks["slow"].Error)
+}
+
+func TestReady(t *testing.T) {
+	c := New(time.Second)
+	fail := false
+	c.Add("flag", func(ctx context.Context) (interface{}, error) {
+		if fail {
+			return nil, ErrTimeout
+		}
+		return nil, nil
+	})
+
+	w := httptest.NewRecorder()
+	c.Ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	fail = true
+	w = httptest.NewRecorder()
+	c.Ready(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var report Report
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, StatusFail, report.Checks["flag"].Status)
+
+	w = httptest.NewRecorder()
+	Live(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+}
@@ -0,0 +1,202 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"github.com/salliko/reducer/internal/databases"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"time"
+)
+
+// loggedDatabase пишет в лог каждый вызов хранилища логгером запроса,
+// к которому хранилище привязано WithContext. Ошибки, которыми
+// хранилище отвечает на неверный запрос (нет ссылки, нет прав и т. п.),
+// пишутся уровнем debug, остальные — error. Ссылки целиком в лог не
+// попадают: только их ключи.
+type loggedDatabase struct {
+	db     databases.Database
+	logger *zap.Logger
+}
+
+// Database оборачивает db так, что вызовы и ошибки хранилища попадают
+// в лог.
+func Database(db databases.Database) databases.Database {
+	return &loggedDatabase{db: db}
+}
+
+func (d *loggedDatabase) WithContext(ctx context.Context) databases.Database {
+	return &loggedDatabase{db: databases.WithContext(ctx, d.db), logger: FromContext(ctx)}
+}
+
+// Unwrap возвращает обёрнутое хранилище.
+func (d *loggedDatabase) Unwrap() databases.Database { return d.db }
+
+// expected сообщает, что err — штатный ответ хранилища, а не сбой.
+func expected(err error) bool {
+	for _, target := range []error{
+		databases.ErrNotFound, databases.ErrGone, databases.ErrConflict, databases.ErrNotActive,
+		databases.ErrForbidden, databases.ErrLastOwner, databases.ErrInvalidCursor,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// done пишет вызов method, начатый в start. err читается в момент
+// вызова done, поэтому его удобно откладывать через defer.
+func (d *loggedDatabase) done(method string, start time.Time, err *error, fields ...zap.Field) {
+	logger := d.logger
+	if logger == nil {
+		logger = zap.L()
+	}
+	level := zapcore.DebugLevel
+	if *err != nil && !expected(*err) {
+		level = zapcore.ErrorLevel
+	}
+	if ce := logger.Check(level, "storage call"); ce != nil {
+		fields = append(fields, zap.String("method", method), zap.Duration("duration", time.Since(start)))
+		if *err != nil {
+			fields = append(fields, zap.Error(*err))
+		}
+		ce.Write(fields...)
+	}
+}
+
+func key(key string) zap.Field { return zap.String("key", key) }
+
+func (d *loggedDatabase) Create(u databases.URL) (err error) {
+	defer d.done("Create", time.Now(), &err, key(u.Hash))
+	return d.db.Create(u)
+}
+
+func (d *loggedDatabase) Select(k string) (u databases.URL, err error) {
+	defer d.done("Select", time.Now(), &err, key(k))
+	return d.db.Select(k)
+}
+
+func (d *loggedDatabase) SelectMany(keys []string) (urls []databases.URL, err error) {
+	defer d.done("SelectMany", time.Now(), &err, zap.Int("keys", len(keys)))
+	return d.db.SelectMany(keys)
+}
+
+func (d *loggedDatabase) Totals() (t databases.Totals, err error) {
+	defer d.done("Totals", time.Now(), &err)
+	return d.db.Totals()
+}
+
+func (d *loggedDatabase) Visit(k string) (u databases.URL, err error) {
+	defer d.done("Visit", time.Now(), &err, key(k))
+	return d.db.Visit(k)
+}
+
+func (d *loggedDatabase) AddClicks(clicks map[string]int) (err error) {
+	defer d.done("AddClicks", time.Now(), &err, zap.Int("keys", len(clicks)))
+	return d.db.AddClicks(clicks)
+}
+
+func (d *loggedDatabase) SelectAll(userID string) (urls []databases.URL, err error) {
+	defer d.done("SelectAll", time.Now(), &err)
+	return d.db.SelectAll(userID)
+}
+
+func (d *loggedDatabase) List(q databases.Query) (page databases.Page, err error) {
+	defer d.done("List", time.Now(), &err)
+	return d.db.List(q)
+}
+
+func (d *loggedDatabase) Iterate(q databases.Query, fn func(databases.URL) error) (err error) {
+	defer d.done("Iterate", time.Now(), &err)
+	return d.db.Iterate(q, fn)
+}
+
+func (d *loggedDatabase) Update(k, userID string, edit func(*databases.URL) error) (u databases.URL, err error) {
+	defer d.done("Update", time.Now(), &err, key(k))
+	return d.db.Update(k, userID, edit)
+}
+
+func (d *loggedDatabase) Revisions(k, userID string) (revisions []databases.Revision, err error) {
+	defer d.done("Revisions", time.Now(), &err, key(k))
+	return d.db.Revisions(k, userID)
+}
+
+func (d *loggedDatabase) Restore(k, userID string, since time.Time) (u databases.URL, err error) {
+	defer d.done("Restore", time.Now(), &err, key(k))
+	return d.db.Restore(k, userID, since)
+}
+
+func (d *loggedDatabase) Purge(userID string, before time.Time) (purged int, err error) {
+	defer d.done("Purge", time.Now(), &err)
+	return d.db.Purge(userID, before)
+}
+
+func (d *loggedDatabase) CreateWorkspace(w databases.Workspace, ownerID string) (err error) {
+	defer d.done("CreateWorkspace", time.Now(), &err, zap.String("workspace", w.ID))
+	return d.db.CreateWorkspace(w, ownerID)
+}
+
+func (d *loggedDatabase) Workspaces(userID string) (workspaces []databases.Workspace, err error) {
+	defer d.done("Workspaces", time.Now(), &err)
+	return d.db.Workspaces(userID)
+}
+
+func (d *loggedDatabase) Members(workspaceID, userID string) (members []databases.Member, err error) {
+	defer d.done("Members", time.Now(), &err, zap.String("workspace", workspaceID))
+	return d.db.Members(workspaceID, userID)
+}
+
+func (d *loggedDatabase) SetMember(actorID string, member databases.Member) (err error) {
+	defer d.done("SetMember", time.Now(), &err, zap.String("workspace", member.WorkspaceID))
+	return d.db.SetMember(actorID, member)
+}
+
+func (d *loggedDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (transferred int, err error) {
+	defer d.done("Transfer", time.Now(), &err, zap.String("workspace", workspaceID), zap.Int("keys", len(keys)))
+	return d.db.Transfer(workspaceID, userID, fromID, keys)
+}
+
+func (d *loggedDatabase) Dump(after string, fn func(databases.Record) error) (err error) {
+	defer d.done("Dump", time.Now(), &err)
+	return d.db.Dump(after, fn)
+}
+
+func (d *loggedDatabase) Load(recs []databases.Record, overwrite bool) (conflicts []string, err error) {
+	defer d.done("Load", time.Now(), &err, zap.Int("keys", len(recs)))
+	return d.db.Load(recs, overwrite)
+}
+
+func (d *loggedDatabase) DumpWorkspaces(fn func(databases.WorkspaceRecord) error) (err error) {
+	defer d.done("DumpWorkspaces", time.Now(), &err)
+	return d.db.DumpWorkspaces(fn)
+}
+
+func (d *loggedDatabase) LoadWorkspace(rec databases.WorkspaceRecord, overwrite bool) (err error) {
+	defer d.done("LoadWorkspace", time.Now(), &err, zap.String("workspace", rec.Workspace.ID))
+	return d.db.LoadWorkspace(rec, overwrite)
+}
+
+func (d *loggedDatabase) Close() {
+	d.db.Close()
+}
+
+func (d *loggedDatabase) Ping() (err error) {
+	defer d.done("Ping", time.Now(), &err)
+	return d.db.Ping()
+}
+
+func (d *loggedDatabase) CreateMany(urls []databases.URL) (err error) {
+	defer d.done("CreateMany", time.Now(), &err, zap.Int("keys", len(urls)))
+	return d.db.CreateMany(urls)
+}
+
+func (d *loggedDatabase) Flush() (err error) {
+	defer d.done("Flush", time.Now(), &err)
+	return d.db.Flush()
+}
+
+func (d *loggedDatabase) Delete(k, userID string) (err error) {
+	defer d.done("Delete", time.Now(), &err, key(k))
+	return d.db.Delete(k, userID)
+}
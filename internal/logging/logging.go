@@ -0,0 +1,206 @@
+// Package logging пишет структурированные JSON-логи: у каждого запроса
+// свой идентификатор, который передаётся через контекст в обработчики
+// и вызовы хранилища, а куки, пароли и заголовки авторизации в логи
+// не попадают.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RequestIDHeader — заголовок, в котором клиент может передать свой
+// идентификатор запроса и в котором сервис возвращает его в ответе.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength ограничивает идентификатор, пришедший от клиента.
+const maxRequestIDLength = 128
+
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders и sensitiveParams не записываются в лог как есть.
+var (
+	sensitiveHeaders = map[string]bool{
+		"Authorization":       true,
+		"Cookie":              true,
+		"Proxy-Authorization": true,
+		"Set-Cookie":          true,
+	}
+	sensitiveParams = map[string]bool{
+		"password": true,
+		"token":    true,
+	}
+)
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// New создаёт JSON-логгер уровня level (debug, info, warn, error),
+// пишущий в w.
+func New(level string, w io.Writer) (*zap.Logger, error) {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "time"
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(w), lvl)
+	return zap.New(core, zap.AddCaller(), zap.ErrorOutput(zapcore.AddSync(w))), nil
+}
+
+// WithLogger кладёт logger в ctx.
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext возвращает логгер запроса, а вне запроса — общий логгер.
+func FromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*zap.Logger); ok {
+		return logger
+	}
+	return zap.L()
+}
+
+// RequestID возвращает идентификатор запроса из ctx.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithRequestID кладёт в ctx идентификатор запроса id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// AcceptRequestID возвращает идентификатор запроса, переданный
+// клиентом, если он допустим, иначе — новый.
+func AcceptRequestID(id string) string {
+	if !validRequestID(id) {
+		return newRequestID()
+	}
+	return id
+}
+
+// newRequestID возвращает случайный идентификатор запроса.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID проверяет идентификатор от клиента: он попадает в лог
+// и в заголовок ответа, поэтому допускаются только видимые символы ASCII.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RedactHeaders возвращает заголовки для лога, скрывая значения
+// куки и авторизации.
+func RedactHeaders(h http.Header) map[string]string {
+	fields := make(map[string]string, len(h))
+	for name, values := range h {
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			fields[name] = redacted
+			continue
+		}
+		if len(values) > 0 {
+			fields[name] = values[0]
+		}
+	}
+	return fields
+}
+
+// RedactURL возвращает путь и параметры запроса для лога, скрывая
+// пароли и токены.
+func RedactURL(u *url.URL) string {
+	q := u.Query()
+	if len(q) == 0 {
+		return u.Path
+	}
+	for name := range q {
+		if sensitiveParams[name] {
+			q.Set(name, redacted)
+		}
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// Middleware даёт запросу идентификатор — из заголовка X-Request-ID
+// или новый, — возвращает его в ответе, кладёт в контекст логгер с этим
+// идентификатором и по завершении пишет запрос в лог: ошибки сервера
+// уровнем error, остальное — info. Заголовки пишутся только на уровне
+// debug.
+func Middleware(base *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			id := AcceptRequestID(r.Header.Get(RequestIDHeader))
+			w.Header().Set(RequestIDHeader, id)
+
+			logger := base.With(zap.String("request_id", id))
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				logger = logger.With(zap.String("trace_id", sc.TraceID().String()))
+			}
+			ctx := WithLogger(WithRequestID(r.Context(), id), logger)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			route := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+			level := zapcore.InfoLevel
+			if status >= http.StatusInternalServerError {
+				level = zapcore.ErrorLevel
+			}
+			if ce := logger.Check(level, "request"); ce != nil {
+				fields := []zap.Field{
+					zap.String("method", r.Method),
+					zap.String("route", route),
+					zap.String("path", RedactURL(r.URL)),
+					zap.Int("status", status),
+					zap.Int("bytes", ww.BytesWritten()),
+					zap.Duration("duration", time.Since(start)),
+					zap.String("remote_addr", r.RemoteAddr),
+				}
+				if logger.Core().Enabled(zapcore.DebugLevel) {
+					fields = append(fields,
+						zap.Any("request_headers", RedactHeaders(r.Header)),
+						zap.Any("response_headers", RedactHeaders(ww.Header())),
+					)
+				}
+				ce.Write(fields...)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// entries разбирает записи JSON-лога из buf.
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var result []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), scanner.Text())
+		result = append(result, entry)
+	}
+	return result
+}
+
+func newTestRouter(t *testing.T, level string) (http.Handler, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger, err := New(level, &buf)
+	require.NoError(t, err)
+
+	db := Database(databases.NewMapDatabase())
+	r := chi.NewRouter()
+	r.Use(Middleware(logger))
+	r.Get("/{ID}", func(w http.ResponseWriter, r *http.Request) {
+		db := databases.WithContext(r.Context(), db)
+		if _, err := db.Select(chi.URLParam(r, "ID")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return r, &buf
+}
+
+func TestNewRejectsUnknownLevel(t *testing.T) {
+	_, err := New("loud", &bytes.Buffer{})
+	assert.Error(t, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	r, buf := newTestRouter(t, "debug")
+
+	req := httptest.NewRequest(http.MethodGet, "/missing?password=secret&q=1", nil)
+	req.Header.Set("Cookie", "user_id=secret")
+	req.Header.Set(RequestIDHeader, "client-id")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, "client-id", w.Header().Get(RequestIDHeader))
+
+	logged := buf.String()
+	assert.NotContains(t, logged, "secret")
+
+	var storage, request map[string]interface{}
+	for _, entry := range entries(t, buf) {
+		switch entry["msg"] {
+		case "storage call":
+			storage = entry
+		case "request":
+			request = entry
+		}
+	}
+	require.NotNil(t, storage)
+	require.NotNil(t, request)
+	// Вызов хранилища пишется логгером запроса, с его идентификатором.
+	assert.Equal(t, "client-id", storage["request_id"])
+	assert.Equal(t, "Select", storage["method"])
+	assert.Equal(t, "debug", storage["level"])
+	assert.Equal(t, "client-id", request["request_id"])
+	assert.Equal(t, "/{ID}", request["route"])
+	assert.EqualValues(t, http.StatusNotFound, request["status"])
+	assert.Equal(t, "[REDACTED]", request["request_headers"].(map[string]interface{})["Cookie"])
+}
+
+func TestMiddlewareGeneratesRequestID(t *testing.T) {
+	r, buf := newTestRouter(t, "info")
+
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	id := w.Header().Get(RequestIDHeader)
+	assert.Len(t, id, 32)
+
+	// На уровне info в лог попадает только сам запрос, без заголовков.
+	logged := entries(t, buf)
+	require.Len(t, logged, 1)
+	assert.Equal(t, "request", logged[0]["msg"])
+	assert.Equal(t, id, logged[0]["request_id"])
+	assert.NotContains(t, logged[0], "request_headers")
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/salliko/reducer/internal/databases"
+)
+
+// storageCollector при каждом сборе обходит хранилище и обёртки над
+// ним и отдаёт состояние пула соединений Postgres и счётчики кешей.
+type storageCollector struct {
+	db databases.Database
+
+	poolAcquired    *prometheus.Desc
+	poolIdle        *prometheus.Desc
+	poolConstructed *prometheus.Desc
+	poolTotal       *prometheus.Desc
+	poolMax         *prometheus.Desc
+	poolAcquires    *prometheus.Desc
+	poolEmpty       *prometheus.Desc
+	poolCanceled    *prometheus.Desc
+	poolWait        *prometheus.Desc
+
+	cacheHits   *prometheus.Desc
+	cacheMisses *prometheus.Desc
+	cacheRatio  *prometheus.Desc
+}
+
+func newStorageCollector(db databases.Database) *storageCollector {
+	pool := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "pgx_pool", name), help, nil, nil)
+	}
+	cache := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, []string{"cache"}, nil)
+	}
+	return &storageCollector{
+		db:              db,
+		poolAcquired:    pool("acquired_conns", "Connections currently in use."),
+		poolIdle:        pool("idle_conns", "Idle connections."),
+		poolConstructed: pool("constructing_conns", "Connections being established."),
+		poolTotal:       pool("total_conns", "All connections of the pool."),
+		poolMax:         pool("max_conns", "Maximum size of the pool."),
+		poolAcquires:    pool("acquires_total", "Successful connection acquisitions."),
+		poolEmpty:       pool("empty_acquires_total", "Acquisitions that had to wait for a connection."),
+		poolCanceled:    pool("canceled_acquires_total", "Acquisitions canceled by the caller."),
+		poolWait:        pool("acquire_duration_seconds_total", "Total time spent acquiring connections."),
+		cacheHits:       cache("hits_total", "Reads served by the cache."),
+		cacheMisses:     cache("misses_total", "Reads that went to the underlying storage."),
+		cacheRatio:      cache("hit_ratio", "Share of reads served by the cache."),
+	}
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.poolAcquired, c.poolIdle, c.poolConstructed, c.poolTotal, c.poolMax,
+		c.poolAcquires, c.poolEmpty, c.poolCanceled, c.poolWait,
+		c.cacheHits, c.cacheMisses, c.cacheRatio,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, layer := range databases.Layers(c.db) {
+		if pooled, ok := layer.(interface{ PoolStat() *pgxpool.Stat }); ok {
+			c.collectPool(ch, pooled.PoolStat())
+		}
+		cached, ok := layer.(interface{ CacheStats() databases.CacheStats })
+		if !ok {
+			continue
+		}
+		name := "memory"
+		if _, ok := layer.(*databases.RedisCacheDatabase); ok {
+			name = "redis"
+		}
+		stats := cached.CacheStats()
+		ch <- prometheus.MustNewConstMetric(c.cacheHits, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(c.cacheMisses, prometheus.CounterValue, float64(stats.Misses), name)
+		var ratio float64
+		if total := stats.Hits + stats.Misses; total > 0 {
+			ratio = float64(stats.Hits) / float64(total)
+		}
+		ch <- prometheus.MustNewConstMetric(c.cacheRatio, prometheus.GaugeValue, ratio, name)
+	}
+}
+
+func (c *storageCollector) collectPool(ch chan<- prometheus.Metric, stat *pgxpool.Stat) {
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+	counter := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value)
+	}
+	gauge(c.poolAcquired, float64(stat.AcquiredConns()))
+	gauge(c.poolIdle, float64(stat.IdleConns()))
+	gauge(c.poolConstructed, float64(stat.ConstructingConns()))
+	gauge(c.poolTotal, float64(stat.TotalConns()))
+	gauge(c.poolMax, float64(stat.MaxConns()))
+	counter(c.poolAcquires, float64(stat.AcquireCount()))
+	counter(c.poolEmpty, float64(stat.EmptyAcquireCount()))
+	counter(c.poolCanceled, float64(stat.CanceledAcquireCount()))
+	counter(c.poolWait, stat.AcquireDuration().Seconds())
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+	"github.com/salliko/reducer/internal/databases"
+	"time"
+)
+
+// instrumentedDatabase замеряет каждый вызов хранилища. Для Iterate и
+// Dump в длительность входит и время обработчика fn.
+type instrumentedDatabase struct {
+	db databases.Database
+	m  *Metrics
+}
+
+// Database оборачивает db так, что длительность и ошибки каждого
+// вызова попадают в метрики по имени метода.
+func (m *Metrics) Database(db databases.Database) databases.Database {
+	return &instrumentedDatabase{db: db, m: m}
+}
+
+// WithContext привязывает к ctx обёрнутое хранилище: самим метрикам
+// контекст не нужен.
+func (d *instrumentedDatabase) WithContext(ctx context.Context) databases.Database {
+	return &instrumentedDatabase{db: databases.WithContext(ctx, d.db), m: d.m}
+}
+
+// Unwrap возвращает обёрнутое хранилище.
+func (d *instrumentedDatabase) Unwrap() databases.Database { return d.db }
+
+// done учитывает вызов method, начатый в start. err читается в момент
+// вызова done, поэтому его удобно откладывать через defer.
+func (d *instrumentedDatabase) done(method string, start time.Time, err *error) {
+	d.m.observe(method, start, *err)
+}
+
+func (d *instrumentedDatabase) Create(u databases.URL) (err error) {
+	defer d.done("Create", time.Now(), &err)
+	return d.db.Create(u)
+}
+
+func (d *instrumentedDatabase) Select(key string) (u databases.URL, err error) {
+	defer d.done("Select", time.Now(), &err)
+	return d.db.Select(key)
+}
+
+func (d *instrumentedDatabase) SelectMany(keys []string) (urls []databases.URL, err error) {
+	defer d.done("SelectMany", time.Now(), &err)
+	return d.db.SelectMany(keys)
+}
+
+func (d *instrumentedDatabase) Totals() (t databases.Totals, err error) {
+	defer d.done("Totals", time.Now(), &err)
+	return d.db.Totals()
+}
+
+func (d *instrumentedDatabase) Visit(key string) (u databases.URL, err error) {
+	defer d.done("Visit", time.Now(), &err)
+	return d.db.Visit(key)
+}
+
+func (d *instrumentedDatabase) AddClicks(clicks map[string]int) (err error) {
+	defer d.done("AddClicks", time.Now(), &err)
+	return d.db.AddClicks(clicks)
+}
+
+func (d *instrumentedDatabase) SelectAll(userID string) (urls []databases.URL, err error) {
+	defer d.done("SelectAll", time.Now(), &err)
+	return d.db.SelectAll(userID)
+}
+
+func (d *instrumentedDatabase) List(q databases.Query) (page databases.Page, err error) {
+	defer d.done("List", time.Now(), &err)
+	return d.db.List(q)
+}
+
+func (d *instrumentedDatabase) Iterate(q databases.Query, fn func(databases.URL) error) (err error) {
+	defer d.done("Iterate", time.Now(), &err)
+	return d.db.Iterate(q, fn)
+}
+
+func (d *instrumentedDatabase) Update(key, userID string, edit func(*databases.URL) error) (u databases.URL, err error) {
+	defer d.done("Update", time.Now(), &err)
+	return d.db.Update(key, userID, edit)
+}
+
+func (d *instrumentedDatabase) Revisions(key, userID string) (revisions []databases.Revision, err error) {
+	defer d.done("Revisions", time.Now(), &err)
+	return d.db.Revisions(key, userID)
+}
+
+func (d *instrumentedDatabase) Restore(key, userID string, since time.Time) (u databases.URL, err error) {
+	defer d.done("Restore", time.Now(), &err)
+	return d.db.Restore(key, userID, since)
+}
+
+func (d *instrumentedDatabase) Purge(userID string, before time.Time) (purged int, err error) {
+	defer d.done("Purge", time.Now(), &err)
+	return d.db.Purge(userID, before)
+}
+
+func (d *instrumentedDatabase) CreateWorkspace(w databases.Workspace, ownerID string) (err error) {
+	defer d.done("CreateWorkspace", time.Now(), &err)
+	return d.db.CreateWorkspace(w, ownerID)
+}
+
+func (d *instrumentedDatabase) Workspaces(userID string) (workspaces []databases.Workspace, err error) {
+	defer d.done("Workspaces", time.Now(), &err)
+	return d.db.Workspaces(userID)
+}
+
+func (d *instrumentedDatabase) Members(workspaceID, userID string) (members []databases.Member, err error) {
+	defer d.done("Members", time.Now(), &err)
+	return d.db.Members(workspaceID, userID)
+}
+
+func (d *instrumentedDatabase) SetMember(actorID string, member databases.Member) (err error) {
+	defer d.done("SetMember", time.Now(), &err)
+	return d.db.SetMember(actorID, member)
+}
+
+func (d *instrumentedDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (transferred int, err error) {
+	defer d.done("Transfer", time.Now(), &err)
+	return d.db.Transfer(workspaceID, userID, fromID, keys)
+}
+
+func (d *instrumentedDatabase) Dump(after string, fn func(databases.Record) error) (err error) {
+	defer d.done("Dump", time.Now(), &err)
+	return d.db.Dump(after, fn)
+}
+
+func (d *instrumentedDatabase) Load(recs []databases.Record, overwrite bool) (conflicts []string, err error) {
+	defer d.done("Load", time.Now(), &err)
+	return d.db.Load(recs, overwrite)
+}
+
+func (d *instrumentedDatabase) DumpWorkspaces(fn func(databases.WorkspaceRecord) error) (err error) {
+	defer d.done("DumpWorkspaces", time.Now(), &err)
+	return d.db.DumpWorkspaces(fn)
+}
+
+func (d *instrumentedDatabase) LoadWorkspace(rec databases.WorkspaceRecord, overwrite bool) (err error) {
+	defer d.done("LoadWorkspace", time.Now(), &err)
+	return d.db.LoadWorkspace(rec, overwrite)
+}
+
+func (d *instrumentedDatabase) Close() {
+	d.db.Close()
+}
+
+func (d *instrumentedDatabase) Ping() (err error) {
+	defer d.done("Ping", time.Now(), &err)
+	return d.db.Ping()
+}
+
+func (d *instrumentedDatabase) CreateMany(urls []databases.URL) (err error) {
+	defer d.done("CreateMany", time.Now(), &err)
+	return d.db.CreateMany(urls)
+}
+
+func (d *instrumentedDatabase) Flush() (err error) {
+	defer d.done("Flush", time.Now(), &err)
+	return d.db.Flush()
+}
+
+func (d *instrumentedDatabase) Delete(key, userID string) (err error) {
+	defer d.done("Delete", time.Now(), &err)
+	return d.db.Delete(key, userID)
+}
@@ -0,0 +1,135 @@
+// Package metrics собирает метрики сервиса в формате Prometheus:
+// HTTP-запросы по шаблонам маршрутов chi, вызовы хранилища, очередь
+// удаления, пул соединений Postgres и попадания в кеши.
+package metrics
+
+import (
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/salliko/reducer/internal/databases"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "reducer"
+
+// unmatchedRoute — метка запросов, не попавших ни в один маршрут,
+// чтобы произвольные пути не плодили серии.
+const unmatchedRoute = "unmatched"
+
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+}
+
+// New заводит метрики в собственном реестре. Метрики пула соединений
+// и кешей читаются из db и хранилищ под ним в момент сбора, длина
+// очереди удаления — из queueDepth.
+func New(db databases.Database, queueDepth func() int64) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route pattern and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_operation_duration_seconds",
+			Help:      "Storage call latency by Database method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "storage_errors_total",
+			Help:      "Storage call errors by Database method and error kind.",
+		}, []string{"method", "error"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.storageDuration,
+		m.storageErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "delete_queue_depth",
+			Help:      "Keys accepted for deletion and not deleted yet.",
+		}, func() float64 { return float64(queueDepth()) }),
+		newStorageCollector(db),
+	)
+	return m
+}
+
+// Handler отдаёт метрики в формате Prometheus. Сжатие оставлено
+// GzipResponseMiddleware.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{DisableCompression: true})
+}
+
+// Middleware считает запросы и их длительность. Маршрут берётся из
+// шаблона chi, например /api/user/urls/{ID}, а не из пути запроса.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		m.requests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// errorKind сводит ошибку хранилища к короткой метке.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, databases.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, databases.ErrGone):
+		return "gone"
+	case errors.Is(err, databases.ErrConflict):
+		return "conflict"
+	case errors.Is(err, databases.ErrNotActive):
+		return "not_active"
+	case errors.Is(err, databases.ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, databases.ErrLastOwner):
+		return "last_owner"
+	case errors.Is(err, databases.ErrInvalidCursor):
+		return "invalid_cursor"
+	default:
+		return "other"
+	}
+}
+
+// observe учитывает вызов method хранилища, начатый в start.
+func (m *Metrics) observe(method string, start time.Time, err error) {
+	m.storageDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(method, errorKind(err)).Inc()
+	}
+}
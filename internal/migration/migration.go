@@ -0,0 +1,263 @@
+// Package migration копирует данные между любыми двумя хранилищами
+// databases.Database пакетами, с возобновлением после обрыва
+// и сверкой результата.
+package migration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/salliko/reducer/internal/databases"
+	"os"
+	"path/filepath"
+)
+
+const DefaultBatchSize = 500
+
+var errStop = errors.New(`stop`)
+
+// Options — параметры копирования.
+type Options struct {
+	// From и To — описания хранилищ. Они записываются в контрольную
+	// точку, чтобы не продолжить по ней копирование в другое место.
+	From, To  string
+	BatchSize int
+	// Checkpoint — файл контрольной точки. Пустой путь отключает
+	// возобновление.
+	Checkpoint string
+	// Progress, если задан, вызывается после каждого пакета.
+	Progress func(copied int)
+	// Mirrored сообщает, что сервер уже повторяет записи в dst
+	// (databases.MirrorDatabase). Тогда записи, которые в dst уже
+	// есть, не перезаписываются: их написало зеркало, и они не старше
+	// прочитанных из src.
+	Mirrored bool
+}
+
+// checkpoint — сохранённое состояние копирования.
+type checkpoint struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	WorkspacesDone bool   `json:"workspaces_done"`
+	// After — ключ последней скопированной ссылки. Ссылки копируются
+	// по возрастанию ключа, поэтому продолжать надо со следующего.
+	After  string `json:"after"`
+	Copied int    `json:"copied"`
+}
+
+func loadCheckpoint(opts Options) (checkpoint, error) {
+	cp := checkpoint{From: opts.From, To: opts.To}
+	if opts.Checkpoint == "" {
+		return cp, nil
+	}
+
+	data, err := os.ReadFile(opts.Checkpoint)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	var saved checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return cp, fmt.Errorf("checkpoint %s: %w", opts.Checkpoint, err)
+	}
+	if saved.From != opts.From || saved.To != opts.To {
+		return cp, fmt.Errorf("checkpoint %s belongs to migration from %s to %s", opts.Checkpoint, saved.From, saved.To)
+	}
+	return saved, nil
+}
+
+// save атомарно перезаписывает файл контрольной точки.
+func (cp checkpoint) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Copy копирует рабочие пространства и ссылки из src в dst. Записи,
+// которые уже есть в dst, заменяются: источник считается главным, —
+// кроме копирования при работающем зеркале (opts.Mirrored). В нём
+// ссылки пакета перед записью перечитываются из src, чтобы правка,
+// которую зеркало не смогло повторить в dst, не потерялась.
+// После каждого пакета состояние сохраняется в opts.Checkpoint,
+// и повторный запуск продолжает с места обрыва. Возвращает число
+// скопированных за все запуски ссылок.
+func Copy(src, dst databases.Database, opts Options) (int, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	cp, err := loadCheckpoint(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	if !cp.WorkspacesDone {
+		err := src.DumpWorkspaces(func(rec databases.WorkspaceRecord) error {
+			err := dst.LoadWorkspace(rec, !opts.Mirrored)
+			if opts.Mirrored && errors.Is(err, databases.ErrConflict) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return cp.Copied, fmt.Errorf("copy workspaces: %w", err)
+		}
+		cp.WorkspacesDone = true
+		if err := cp.save(opts.Checkpoint); err != nil {
+			return cp.Copied, err
+		}
+	}
+
+	batch := make([]databases.Record, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		last := batch[len(batch)-1].URL.Hash
+		recs := batch
+		if opts.Mirrored {
+			var err error
+			if recs, err = refresh(src, batch); err != nil {
+				return fmt.Errorf("copy links after %q: %w", cp.After, err)
+			}
+		}
+		if _, err := dst.Load(recs, !opts.Mirrored); err != nil {
+			return fmt.Errorf("copy links after %q: %w", cp.After, err)
+		}
+		cp.After = last
+		cp.Copied += len(batch)
+		batch = batch[:0]
+		if err := cp.save(opts.Checkpoint); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(cp.Copied)
+		}
+		return nil
+	}
+
+	err = src.Dump(cp.After, func(rec databases.Record) error {
+		batch = append(batch, rec)
+		if len(batch) == opts.BatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return cp.Copied, err
+	}
+	return cp.Copied, flush()
+}
+
+// refresh заменяет ссылки recs их текущими версиями из src. Ссылки,
+// которых в src уже нет, из пакета выпадают.
+func refresh(src databases.Database, recs []databases.Record) ([]databases.Record, error) {
+	keys := make([]string, len(recs))
+	for i, rec := range recs {
+		keys[i] = rec.URL.Hash
+	}
+	current, err := src.SelectMany(keys)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]databases.URL, len(current))
+	for _, u := range current {
+		byKey[u.Hash] = u
+	}
+
+	data := make([]databases.Record, 0, len(recs))
+	for _, rec := range recs {
+		if u, ok := byKey[rec.URL.Hash]; ok {
+			rec.URL = u
+			data = append(data, rec)
+		}
+	}
+	return data, nil
+}
+
+// Report — итог сверки хранилищ.
+type Report struct {
+	Source int
+	Target int
+	// Missing — ссылки источника, которых нет в dst.
+	Missing int
+	// Extra — ссылки dst, которых нет в источнике.
+	Extra int
+}
+
+// keys возвращает до limit ключей db, следующих за after.
+func keys(db databases.Database, after string, limit int) ([]string, error) {
+	var data []string
+	err := db.Dump(after, func(rec databases.Record) error {
+		data = append(data, rec.URL.Hash)
+		if len(data) == limit {
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Verify сверяет ключи ссылок src и dst, проходя оба хранилища
+// страницами по возрастанию ключа.
+func Verify(src, dst databases.Database, batchSize int) (Report, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	var report Report
+	after := ""
+	for {
+		srcKeys, err := keys(src, after, batchSize)
+		if err != nil {
+			return report, err
+		}
+		if len(srcKeys) == 0 {
+			break
+		}
+		last := srcKeys[len(srcKeys)-1]
+
+		present := make(map[string]bool, len(srcKeys))
+		err = dst.Dump(after, func(rec databases.Record) error {
+			if rec.URL.Hash > last {
+				return errStop
+			}
+			present[rec.URL.Hash] = true
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStop) {
+			return report, err
+		}
+
+		for _, key := range srcKeys {
+			if !present[key] {
+				report.Missing++
+			}
+		}
+		report.Source += len(srcKeys)
+		after = last
+	}
+
+	err := dst.Dump("", func(databases.Record) error {
+		report.Target++
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Extra = report.Target - (report.Source - report.Missing)
+	return report, nil
+}
@@ -0,0 +1,156 @@
+package migration
+
+import (
+	"errors"
+	"fmt"
+	"github.com/salliko/reducer/internal/databases"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+// flakyDatabase отказывает в Load после failAfter успешных пакетов.
+type flakyDatabase struct {
+	databases.Database
+	failAfter int
+}
+
+func (f *flakyDatabase) Load(recs []databases.Record, overwrite bool) ([]string, error) {
+	if f.failAfter == 0 {
+		return nil, errors.New("connection lost")
+	}
+	f.failAfter--
+	return f.Database.Load(recs, overwrite)
+}
+
+func TestCopyResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	src, err := databases.NewFileDatabase(filepath.Join(dir, "urls.json"))
+	require.NoError(t, err)
+	require.NoError(t, src.CreateWorkspace(databases.Workspace{ID: "team", Name: "Team"}, "alice"))
+	var urls []databases.URL
+	for i := 0; i < 25; i++ {
+		urls = append(urls, databases.URL{Hash: fmt.Sprintf("k%02d", i), Original: "http://example.com", UserID: "alice"})
+	}
+	require.NoError(t, src.CreateMany(urls))
+
+	dst := databases.NewMapDatabase()
+	opts := Options{From: "file:a", To: "memory:", BatchSize: 10, Checkpoint: filepath.Join(dir, "checkpoint")}
+
+	copied, err := Copy(src, &flakyDatabase{Database: dst, failAfter: 1}, opts)
+	require.Error(t, err)
+	assert.Equal(t, 10, copied)
+
+	report, err := Verify(src, dst, 7)
+	require.NoError(t, err)
+	assert.Equal(t, Report{Source: 25, Target: 10, Missing: 15}, report)
+
+	_, err = Copy(src, dst, Options{From: "file:b", To: "memory:", Checkpoint: opts.Checkpoint})
+	assert.Error(t, err)
+
+	copied, err = Copy(src, dst, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 25, copied)
+
+	report, err = Verify(src, dst, 7)
+	require.NoError(t, err)
+	assert.Equal(t, Report{Source: 25, Target: 25}, report)
+
+	workspaces, err := dst.Workspaces("alice")
+	require.NoError(t, err)
+	assert.Len(t, workspaces, 1)
+}
+
+// lazyDatabase читает ссылки для Dump по одной, как постраничная
+// выгрузка SQL-хранилищ: ссылки, созданные во время копирования,
+// в неё попадают.
+type lazyDatabase struct {
+	databases.Database
+}
+
+func (l *lazyDatabase) Dump(after string, fn func(databases.Record) error) error {
+	for {
+		var rec *databases.Record
+		err := l.Database.Dump(after, func(r databases.Record) error {
+			rec = &r
+			return errStop
+		})
+		if err != nil && !errors.Is(err, errStop) {
+			return err
+		}
+		if rec == nil {
+			return nil
+		}
+		if err := fn(*rec); err != nil {
+			return err
+		}
+		after = rec.URL.Hash
+	}
+}
+
+// hookedDatabase вызывает beforeLoad перед каждым Load.
+type hookedDatabase struct {
+	databases.Database
+	beforeLoad func(recs []databases.Record)
+}
+
+func (h *hookedDatabase) Load(recs []databases.Record, overwrite bool) ([]string, error) {
+	h.beforeLoad(recs)
+	return h.Database.Load(recs, overwrite)
+}
+
+func TestCopyMirrored(t *testing.T) {
+	primary := databases.NewMapDatabase()
+	for i := 0; i < 9; i++ {
+		require.NoError(t, primary.Create(databases.URL{Hash: fmt.Sprintf("k%02d", i), Original: "http://example.com", UserID: "alice"}))
+	}
+	dst := databases.NewMapDatabase()
+	// Сервер, повторяющий записи в целевое хранилище.
+	mirror := databases.NewMirrorDatabase(primary, dst)
+	title := func(key, value string) {
+		_, err := mirror.Update(key, "alice", func(u *databases.URL) error {
+			u.Title = value
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	target := &hookedDatabase{Database: dst, beforeLoad: func(recs []databases.Record) {
+		for _, rec := range recs {
+			if rec.URL.Hash == "k04a" {
+				// Правка между чтением пакета и его записью.
+				title("k04a", "edited late")
+			}
+		}
+	}}
+	copied, err := Copy(&lazyDatabase{Database: primary}, target, Options{
+		BatchSize: 3,
+		Mirrored:  true,
+		Progress: func(copied int) {
+			if copied != 3 {
+				return
+			}
+			// Правки через зеркало посреди копирования: уже
+			// скопированной ссылки, ещё не скопированных и новой.
+			title("k01", "edited")
+			title("k07", "edited")
+			require.NoError(t, mirror.Delete("k05", "alice"))
+			require.NoError(t, mirror.Create(databases.URL{Hash: "k04a", Original: "http://new.example", UserID: "alice"}))
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 10, copied)
+
+	for key, want := range map[string]string{"k01": "edited", "k07": "edited", "k04a": "edited late"} {
+		u, err := dst.Select(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, want, u.Title, key)
+	}
+	_, err = dst.Select("k05")
+	assert.ErrorIs(t, err, databases.ErrGone)
+
+	report, err := Verify(primary, dst, 4)
+	require.NoError(t, err)
+	assert.Equal(t, Report{Source: 10, Target: 10}, report)
+}
@@ -0,0 +1,248 @@
+// Package openapi отдаёт описание HTTP API в OpenAPI 3 и проверяет
+// по нему запросы: параметры пути и query-строки и тело запроса.
+// Описание хранится в openapi.json рядом с пакетом и встраивается
+// в бинарный файл.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var specJSON []byte
+
+var defaultSpec = mustParse(specJSON)
+
+// Schema — подмножество схемы OpenAPI 3.0, которое понимает проверка
+// запросов.
+type Schema struct {
+	Ref           string             `json:"$ref"`
+	Type          string             `json:"type"`
+	Format        string             `json:"format"`
+	Enum          []interface{}      `json:"enum"`
+	Nullable      bool               `json:"nullable"`
+	Minimum       *float64           `json:"minimum"`
+	Maximum       *float64           `json:"maximum"`
+	MinLength     *int               `json:"minLength"`
+	MaxLength     *int               `json:"maxLength"`
+	MinProperties *int               `json:"minProperties"`
+	Items         *Schema            `json:"items"`
+	Properties    map[string]*Schema `json:"properties"`
+	Required      []string           `json:"required"`
+	AllOf         []*Schema          `json:"allOf"`
+	// AdditionalProperties — false или схема лишних полей объекта.
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+}
+
+type Parameter struct {
+	Ref      string  `json:"$ref"`
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Operation struct {
+	OperationID string       `json:"operationId"`
+	Parameters  []*Parameter `json:"parameters"`
+	RequestBody *RequestBody `json:"requestBody"`
+	// HandlerErrors — обработчик сам отвечает на ошибки во входных
+	// данных, а проверка не читает тело и только пишет расхождения
+	// параметров со схемой в лог.
+	HandlerErrors bool `json:"x-handler-errors"`
+}
+
+// Route — метод и шаблон пути документированной операции.
+type Route struct {
+	Method string
+	Path   string
+}
+
+// path — шаблон пути, разбитый на сегменты; параметры записаны
+// в фигурных скобках, как в OpenAPI и chi.
+type path struct {
+	template string
+	segments []string
+	ops      map[string]*Operation
+}
+
+// Spec — разобранное описание API.
+type Spec struct {
+	raw        map[string]interface{}
+	paths      []path
+	schemas    map[string]*Schema
+	parameters map[string]*Parameter
+}
+
+// Default возвращает описание API сервиса.
+func Default() *Spec {
+	return defaultSpec
+}
+
+func mustParse(data []byte) *Spec {
+	spec, err := Parse(data)
+	if err != nil {
+		panic(fmt.Sprintf("openapi: %v", err))
+	}
+	return spec
+}
+
+// Parse разбирает описание API в JSON. Ссылки $ref на параметры
+// подставляются сразу, на схемы — при проверке.
+func Parse(data []byte) (*Spec, error) {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas    map[string]*Schema    `json:"schemas"`
+			Parameters map[string]*Parameter `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	s := &Spec{schemas: doc.Components.Schemas, parameters: doc.Components.Parameters}
+	if err := json.Unmarshal(data, &s.raw); err != nil {
+		return nil, err
+	}
+
+	for template, item := range doc.Paths {
+		p := path{template: template, segments: splitPath(template), ops: make(map[string]*Operation)}
+		for method, raw := range item {
+			method = strings.ToUpper(method)
+			if !knownMethods[method] {
+				continue
+			}
+			var op Operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", method, template, err)
+			}
+			for i, param := range op.Parameters {
+				if param.Ref == "" {
+					continue
+				}
+				resolved, ok := s.parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]
+				if !ok {
+					return nil, fmt.Errorf("%s %s: unknown parameter %s", method, template, param.Ref)
+				}
+				op.Parameters[i] = resolved
+			}
+			p.ops[method] = &op
+		}
+		s.paths = append(s.paths, p)
+	}
+	sort.Slice(s.paths, func(i, j int) bool { return s.paths[i].template < s.paths[j].template })
+	return s, nil
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+func splitPath(p string) []string {
+	return strings.Split(strings.Trim(p, "/"), "/")
+}
+
+// Routes возвращает все документированные операции.
+func (s *Spec) Routes() []Route {
+	var routes []Route
+	for _, p := range s.paths {
+		for method := range p.ops {
+			routes = append(routes, Route{Method: method, Path: p.template})
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+	return routes
+}
+
+// Operation находит операцию для запроса method к пути urlPath
+// и значения параметров пути. Как и в chi, сегмент-константа
+// важнее параметра: /ping не считается ключом ссылки.
+func (s *Spec) Operation(method, urlPath string) (*Operation, map[string]string) {
+	segments := splitPath(urlPath)
+	var best *Operation
+	var bestParams map[string]string
+	bestScore := -1
+	for _, p := range s.paths {
+		op, ok := p.ops[method]
+		if !ok || len(p.segments) != len(segments) {
+			continue
+		}
+		score, params, ok := p.match(segments)
+		if ok && score > bestScore {
+			best, bestParams, bestScore = op, params, score
+		}
+	}
+	return best, bestParams
+}
+
+// match сопоставляет сегменты пути с шаблоном и возвращает число
+// совпавших констант.
+func (p path) match(segments []string) (int, map[string]string, bool) {
+	score := 0
+	params := make(map[string]string)
+	for i, segment := range p.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return 0, nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return 0, nil, false
+		}
+		score++
+	}
+	return score, params, true
+}
+
+// schema разворачивает ссылку на схему из components.
+func (s *Spec) schema(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// Handler отдаёт описание API с адресом сервера baseURL.
+func (s *Spec) Handler(baseURL string) http.Handler {
+	doc := make(map[string]interface{}, len(s.raw)+1)
+	for k, v := range s.raw {
+		doc[k] = v
+	}
+	doc["servers"] = []map[string]string{{"url": baseURL}}
+	data, err := json.Marshal(doc)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	})
+}
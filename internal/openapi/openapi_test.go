@@ -0,0 +1,199 @@
+package openapi
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOperation(t *testing.T) {
+	spec := Default()
+
+	op, params := spec.Operation(http.MethodGet, "/ping")
+	require.NotNil(t, op)
+	assert.Equal(t, "ping", op.OperationID)
+	assert.Empty(t, params)
+
+	op, params = spec.Operation(http.MethodGet, "/6qxTVvsy")
+	require.NotNil(t, op)
+	assert.Equal(t, "resolve", op.OperationID)
+	assert.Equal(t, map[string]string{"ID": "6qxTVvsy"}, params)
+
+	op, _ = spec.Operation(http.MethodGet, "/api/user/urls/export")
+	require.NotNil(t, op)
+	assert.Equal(t, "exportUserURLs", op.OperationID)
+
+	op, _ = spec.Operation(http.MethodPost, "/ping")
+	assert.Nil(t, op)
+}
+
+func TestValidate(t *testing.T) {
+	var got string
+	handler := Default().Validate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+		details     []FieldError
+	}{
+		{
+			name:   "valid json",
+			method: http.MethodPost,
+			target: "/api/shorten",
+			body:   `{"url": "https://example.com", "tags": ["a"], "expires_at": null}`,
+			status: http.StatusTeapot,
+		},
+		{
+			name:   "missing field and wrong type",
+			method: http.MethodPost,
+			target: "/api/shorten",
+			body:   `{"max_clicks": "ten"}`,
+			status: http.StatusBadRequest,
+			details: []FieldError{
+				{In: InBody, Field: "url", Message: "is required"},
+				{In: InBody, Field: "max_clicks", Message: "must be an integer"},
+			},
+		},
+		{
+			name:    "malformed json",
+			method:  http.MethodPost,
+			target:  "/api/shorten",
+			body:    `{"url":`,
+			status:  http.StatusBadRequest,
+			details: []FieldError{{In: InBody, Message: "unexpected EOF"}},
+		},
+		{
+			name:    "unknown patch field",
+			method:  http.MethodPatch,
+			target:  "/api/user/urls/abc",
+			body:    `{"hash": "other"}`,
+			status:  http.StatusBadRequest,
+			details: []FieldError{{In: InBody, Field: "hash", Message: "is not allowed"}},
+		},
+		{
+			name:    "enum in body",
+			method:  http.MethodPut,
+			target:  "/api/workspaces/ws/members",
+			body:    `{"user_id": "u", "role": "admin"}`,
+			status:  http.StatusBadRequest,
+			details: []FieldError{{In: InBody, Field: "role", Message: "must be one of viewer, editor, owner"}},
+		},
+		{
+			name:   "query parameters",
+			method: http.MethodGet,
+			target: "/api/user/urls?limit=0&deleted=maybe&sort=clicks&tag=a&tag=b",
+			status: http.StatusBadRequest,
+			details: []FieldError{
+				{In: InQuery, Field: "limit", Message: "must be at least 1"},
+				{In: InQuery, Field: "deleted", Message: "must be a boolean"},
+			},
+		},
+		{
+			name:   "empty optional body",
+			method: http.MethodPost,
+			target: "/api/workspaces/ws/transfer",
+			status: http.StatusTeapot,
+		},
+		{
+			name:        "text body",
+			method:      http.MethodPost,
+			target:      "/?max_clicks=3",
+			contentType: "text/plain; charset=utf-8",
+			body:        "https://example.com",
+			status:      http.StatusTeapot,
+		},
+		{
+			name:        "any content type",
+			method:      http.MethodPost,
+			target:      "/",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "https://example.com",
+			status:      http.StatusTeapot,
+		},
+		{
+			name:        "unsupported content type",
+			method:      http.MethodPost,
+			target:      "/api/shorten",
+			contentType: "application/xml",
+			body:        "<url/>",
+			status:      http.StatusUnsupportedMediaType,
+			details:     []FieldError{{In: InBody, Message: "content type must be one of application/json"}},
+		},
+		{
+			name:        "streamed body is not read",
+			method:      http.MethodPost,
+			target:      "/api/user/import",
+			contentType: "text/csv",
+			body:        "url\nnot a url\n",
+			status:      http.StatusTeapot,
+		},
+		{
+			name:   "undocumented route",
+			method: http.MethodPost,
+			target: "/ping",
+			status: http.StatusTeapot,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusTeapot {
+				// Обработчик получает тело нетронутым.
+				assert.Equal(t, tt.body, got)
+				return
+			}
+			var body Error
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.NotEmpty(t, body.Error)
+			assert.Equal(t, tt.details, body.Details)
+		})
+	}
+}
+
+func TestValidateHandlerErrors(t *testing.T) {
+	var got string
+	handler := Default().Validate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	// Операции, ответы которых закреплены автотестами, сами отвечают
+	// на ошибки: запрос доходит до обработчика с нетронутым телом.
+	for _, tt := range []struct{ target, body string }{
+		{"/?max_clicks=ten", "not a url"},
+		{"/", strings.Repeat("x", maxBodyBytes+1)},
+	} {
+		r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusTeapot, w.Code)
+		assert.Equal(t, tt.body, got)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(strings.Repeat("x", maxBodyBytes+1)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
@@ -0,0 +1,458 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/salliko/reducer/internal/logging"
+	"go.uber.org/zap"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxBodyBytes ограничивает тело, которое проверка читает в память.
+// Потоковые тела, например импорт, и тела операций с HandlerErrors
+// не читаются.
+const maxBodyBytes = 10 << 20
+
+// Где найдена ошибка запроса.
+const (
+	InPath  = "path"
+	InQuery = "query"
+	InBody  = "body"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// FieldError — ошибка в одном параметре или поле тела. Field — имя
+// параметра или путь к полю тела вида urls[0].original_url; пустой
+// у тела целиком.
+type FieldError struct {
+	In      string `json:"in"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error — тело ответа на запрос, не прошедший проверку.
+type Error struct {
+	Error   string       `json:"error"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string, details []FieldError) {
+	data, err := json.Marshal(Error{Error: message, Details: details})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// Validate проверяет запросы к документированным операциям и отвечает
+// 400, 413 или 415 с телом Error, не доходя до обработчика. Операции
+// с HandlerErrors, ответы которых закреплены автотестами, отвечают на
+// ошибки сами: их тело не читается, а расхождения параметров со схемой
+// только пишутся в лог запроса. Запросы к недокументированным маршрутам
+// пропускаются как есть: на них ответит маршрутизатор.
+func (s *Spec) Validate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, pathParams := s.Operation(r.Method, r.URL.Path)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if op.HandlerErrors {
+			if details := s.checkParameters(op, pathParams, r.URL.Query()); len(details) > 0 {
+				logging.FromContext(r.Context()).Debug("request does not match the api description",
+					zap.String("operation", op.OperationID), zap.Any("details", details))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if status, e := s.checkRequest(r, op, pathParams); status != 0 {
+			writeError(w, status, e.Error, e.Details)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkRequest проверяет запрос к операции op и возвращает код
+// и тело ответа на него или 0, если запрос подходит под схему.
+func (s *Spec) checkRequest(r *http.Request, op *Operation, pathParams map[string]string) (int, Error) {
+	details := s.checkParameters(op, pathParams, r.URL.Query())
+
+	if op.RequestBody != nil {
+		mediaType, ok := requestMediaType(op.RequestBody, r.Header.Get("Content-Type"))
+		if !ok {
+			return http.StatusUnsupportedMediaType, Error{Error: "unsupported content type", Details: []FieldError{{
+				In:      InBody,
+				Message: fmt.Sprintf("content type must be one of %s", strings.Join(contentTypes(op.RequestBody), ", ")),
+			}}}
+		}
+		bodyDetails, err := s.checkBody(r, op.RequestBody, mediaType)
+		if errors.Is(err, errBodyTooLarge) {
+			return http.StatusRequestEntityTooLarge, Error{Error: err.Error()}
+		}
+		if err != nil {
+			return http.StatusBadRequest, Error{Error: "invalid request body", Details: []FieldError{{In: InBody, Message: err.Error()}}}
+		}
+		details = append(details, bodyDetails...)
+	}
+
+	if len(details) > 0 {
+		return http.StatusBadRequest, Error{Error: "invalid request", Details: details}
+	}
+	return 0, Error{}
+}
+
+func contentTypes(body *RequestBody) []string {
+	types := make([]string, 0, len(body.Content))
+	for mediaType := range body.Content {
+		types = append(types, mediaType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// requestMediaType выбирает описание тела по Content-Type запроса;
+// описания вида */* и text/* подходят под любой тип и подтип.
+// Без заголовка подходит единственный описанный тип, а если их
+// несколько, тело не проверяется: формат выберет обработчик.
+func requestMediaType(body *RequestBody, header string) (string, bool) {
+	if header == "" {
+		if len(body.Content) == 1 {
+			for mediaType := range body.Content {
+				return mediaType, true
+			}
+		}
+		return "", true
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		if _, ok := body.Content["*/*"]; ok {
+			return "*/*", true
+		}
+		return "", false
+	}
+	for _, candidate := range []string{mediaType, strings.SplitN(mediaType, "/", 2)[0] + "/*", "*/*"} {
+		if _, ok := body.Content[candidate]; ok {
+			return candidate, true
+		}
+	}
+	return mediaType, false
+}
+
+// checkParameters проверяет параметры пути и query-строки. Пустое
+// значение необязательного параметра обработчики считают его
+// отсутствием, поэтому оно не проверяется.
+func (s *Spec) checkParameters(op *Operation, pathParams map[string]string, query url.Values) []FieldError {
+	var details []FieldError
+	for _, param := range op.Parameters {
+		var values []string
+		switch param.In {
+		case InPath:
+			if v := pathParams[param.Name]; v != "" {
+				values = []string{v}
+			}
+		case InQuery:
+			for _, v := range query[param.Name] {
+				if v != "" {
+					values = append(values, v)
+				}
+			}
+		default:
+			continue
+		}
+		if len(values) == 0 {
+			if param.Required {
+				details = append(details, FieldError{In: param.In, Field: param.Name, Message: "is required"})
+			}
+			continue
+		}
+
+		schema := s.schema(param.Schema)
+		value, err := s.parameterValue(schema, values)
+		if err != nil {
+			details = append(details, FieldError{In: param.In, Field: param.Name, Message: err.Error()})
+			continue
+		}
+		for _, e := range s.check(schema, value, "") {
+			details = append(details, FieldError{In: param.In, Field: param.Name, Message: e.Message})
+		}
+	}
+	return details
+}
+
+// parameterValue приводит строковые значения параметра к типу его
+// схемы. Массив собирается из повторов параметра: tag=a&tag=b.
+func (s *Spec) parameterValue(schema *Schema, values []string) (interface{}, error) {
+	if schema == nil {
+		return values[0], nil
+	}
+	if schema.Type == "array" {
+		items := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			item, err := scalarValue(s.schema(schema.Items), v)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return scalarValue(schema, values[0])
+}
+
+func scalarValue(schema *Schema, v string) (interface{}, error) {
+	if schema == nil {
+		return v, nil
+	}
+	switch schema.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		return json.Number(v), nil
+	case "number":
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return json.Number(v), nil
+	case "boolean":
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		return b, nil
+	default:
+		return v, nil
+	}
+}
+
+// checkBody проверяет тело в JSON или текстом и возвращает его
+// в запрос нетронутым. Тела других типов не читаются.
+func (s *Spec) checkBody(r *http.Request, body *RequestBody, mediaType string) ([]FieldError, error) {
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	if !isJSON && mediaType != "text/plain" {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		if body.Required {
+			return []FieldError{{In: InBody, Message: "is required"}}, nil
+		}
+		return nil, nil
+	}
+
+	schema := s.schema(body.Content[mediaType].Schema)
+	if !isJSON {
+		return s.check(schema, string(data), ""), nil
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return s.check(schema, value, ""), nil
+}
+
+// readCloser читает из Reader, а закрывает исходное тело запроса.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func field(p, name string) string {
+	if p == "" {
+		return name
+	}
+	return p + "." + name
+}
+
+// check проверяет значение value, разобранное из JSON с UseNumber,
+// по схеме. p — путь к значению для сообщений об ошибках.
+func (s *Spec) check(schema *Schema, value interface{}, p string) []FieldError {
+	schema = s.schema(schema)
+	if schema == nil {
+		return nil
+	}
+	fail := func(format string, args ...interface{}) []FieldError {
+		return []FieldError{{In: InBody, Field: p, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	var details []FieldError
+	for _, sub := range schema.AllOf {
+		details = append(details, s.check(sub, value, p)...)
+	}
+
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return details
+		}
+		return append(details, fail("must not be null")...)
+	}
+
+	switch schema.Type {
+	case "string":
+		v, ok := value.(string)
+		if !ok {
+			return append(details, fail("must be a string")...)
+		}
+		details = append(details, s.checkString(schema, v, p)...)
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok && schema.Type == "integer" {
+			return append(details, fail("must be an integer")...)
+		}
+		if !ok {
+			return append(details, fail("must be a number")...)
+		}
+		if schema.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return append(details, fail("must be an integer")...)
+			}
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return append(details, fail("must be a number")...)
+		}
+		if schema.Minimum != nil && f < *schema.Minimum {
+			details = append(details, fail("must be at least %v", *schema.Minimum)...)
+		}
+		if schema.Maximum != nil && f > *schema.Maximum {
+			details = append(details, fail("must be at most %v", *schema.Maximum)...)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(details, fail("must be a boolean")...)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return append(details, fail("must be an array")...)
+		}
+		for i, item := range items {
+			details = append(details, s.check(schema.Items, item, fmt.Sprintf("%s[%d]", p, i))...)
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(details, fail("must be an object")...)
+		}
+		details = append(details, s.checkObject(schema, obj, p)...)
+	}
+
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		details = append(details, fail("must be one of %s", enumList(schema.Enum))...)
+	}
+	return details
+}
+
+func (s *Spec) checkString(schema *Schema, v, p string) []FieldError {
+	var messages []string
+	length := utf8.RuneCountInString(v)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		messages = append(messages, fmt.Sprintf("must be at least %d characters", *schema.MinLength))
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		messages = append(messages, fmt.Sprintf("must be at most %d characters", *schema.MaxLength))
+	}
+	switch schema.Format {
+	case "uri":
+		if _, err := url.ParseRequestURI(v); err != nil {
+			messages = append(messages, "must be an absolute url")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			messages = append(messages, "must be an RFC 3339 date-time")
+		}
+	}
+
+	details := make([]FieldError, 0, len(messages))
+	for _, m := range messages {
+		details = append(details, FieldError{In: InBody, Field: p, Message: m})
+	}
+	return details
+}
+
+func (s *Spec) checkObject(schema *Schema, obj map[string]interface{}, p string) []FieldError {
+	var details []FieldError
+	for _, name := range schema.Required {
+		if _, ok := obj[name]; !ok {
+			details = append(details, FieldError{In: InBody, Field: field(p, name), Message: "is required"})
+		}
+	}
+	if schema.MinProperties != nil && len(obj) < *schema.MinProperties {
+		details = append(details, FieldError{In: InBody, Field: p, Message: fmt.Sprintf("must have at least %d fields", *schema.MinProperties)})
+	}
+
+	var additional *Schema
+	closed := false
+	if len(schema.AdditionalProperties) > 0 {
+		if string(schema.AdditionalProperties) == "false" {
+			closed = true
+		} else if err := json.Unmarshal(schema.AdditionalProperties, &additional); err != nil {
+			additional = nil
+		}
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if prop, ok := schema.Properties[name]; ok {
+			details = append(details, s.check(prop, obj[name], field(p, name))...)
+			continue
+		}
+		switch {
+		case closed:
+			details = append(details, FieldError{In: InBody, Field: field(p, name), Message: "is not allowed"})
+		case additional != nil:
+			details = append(details, s.check(additional, obj[name], field(p, name))...)
+		}
+	}
+	return details
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(enum []interface{}) string {
+	values := make([]string, 0, len(enum))
+	for _, e := range enum {
+		values = append(values, fmt.Sprint(e))
+	}
+	return strings.Join(values, ", ")
+}
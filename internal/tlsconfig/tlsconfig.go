@@ -0,0 +1,208 @@
+// Package tlsconfig готовит настройки TLS сервера: безопасные версии
+// и шифры по умолчанию, сертификат из файлов с перечитыванием без
+// перезапуска и самоподписанный сертификат для разработки.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"go.uber.org/zap"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// selfSignedValidity — срок действия самоподписанного сертификата.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// New возвращает настройки TLS не ниже 1.2 с шифрами ECDHE и AEAD,
+// которые берут сертификат у getCertificate при каждом подключении.
+func New(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// Для TLS 1.3 набор шифров не настраивается и безопасен сам по себе.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: getCertificate,
+	}
+}
+
+// Static отдаёт всегда один и тот же сертификат.
+func Static(cert tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	}
+}
+
+// SelfSigned выпускает самоподписанный сертификат ECDSA P-256 для
+// hosts — имён и IP-адресов. Годится только для разработки: клиенты
+// ему не доверяют.
+func SelfSigned(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"reducer development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// fileStamp — время изменения и размер файла: по ним Watch замечает,
+// что сертификат заменили.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func (s fileStamp) equal(other fileStamp) bool {
+	return s.modTime.Equal(other.modTime) && s.size == other.size
+}
+
+func stat(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Reloader держит сертификат из пары файлов и перечитывает их по
+// Reload. Если новые файлы не читаются, остаётся прежний сертификат.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	stamps [2]fileStamp
+}
+
+// NewReloader загружает сертификат из certFile и keyFile в PEM.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload перечитывает файлы сертификата и ключа.
+func (r *Reloader) Reload() error {
+	certStamp, err := stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyStamp, err := stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.stamps = [2]fileStamp{certStamp, keyStamp}
+	return nil
+}
+
+// GetCertificate отдаёт текущий сертификат; подходит для
+// tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// changed сообщает, изменились ли файлы с последней удачной загрузки.
+func (r *Reloader) changed() bool {
+	certStamp, certErr := stat(r.certFile)
+	keyStamp, keyErr := stat(r.keyFile)
+	if certErr != nil || keyErr != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.stamps[0].equal(certStamp) || !r.stamps[1].equal(keyStamp)
+}
+
+// Watch раз в interval проверяет, не заменены ли файлы, и перечитывает
+// их. Ошибка чтения пишется в лог, а попытка повторяется на следующей
+// проверке: сертификат и ключ могут заменяться не одновременно.
+// Работает до отмены ctx.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				zap.L().Warn("reload tls certificate", zap.Error(err))
+				continue
+			}
+			zap.L().Info("tls certificate reloaded", zap.Time("not_after", r.notAfter()))
+		}
+	}
+}
+
+func (r *Reloader) notAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert.Leaf.NotAfter
+}
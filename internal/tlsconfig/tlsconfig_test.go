@@ -0,0 +1,87 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair записывает сертификат и ключ в PEM.
+func writePair(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+}
+
+func serial(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	return cert.Leaf.SerialNumber.String()
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	writePair(t, first, certFile, keyFile)
+
+	r, err := NewReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, first.Leaf.SerialNumber.String(), serial(t, r))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	second, err := SelfSigned("localhost")
+	require.NoError(t, err)
+	// Время изменения может совпасть с прежним, размер — нет.
+	writePair(t, second, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	assert.Eventually(t, func() bool {
+		return serial(t, r) == second.Leaf.SerialNumber.String()
+	}, time.Second, 10*time.Millisecond)
+
+	// Испорченный файл не заменяет рабочий сертификат.
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.Error(t, r.Reload())
+	assert.Equal(t, second.Leaf.SerialNumber.String(), serial(t, r))
+}
+
+func TestNewRejectsOldTLS(t *testing.T) {
+	cert, err := SelfSigned("localhost")
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// httptest подставляет свой сертификат, если клиент не передал имя
+	// сервера, поэтому клиент передаёт его в ServerName.
+	ts.TLS = New(Static(cert))
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := func(max uint16) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "localhost", MaxVersion: max}}}
+	}
+
+	resp, err := client(tls.VersionTLS13).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = client(tls.VersionTLS11).Get(ts.URL)
+	assert.Error(t, err)
+}
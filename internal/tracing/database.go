@@ -0,0 +1,185 @@
+package tracing
+
+import (
+	"context"
+	"github.com/salliko/reducer/internal/databases"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// keyAttribute — ключ ссылки, с которой работает вызов хранилища.
+const keyAttribute = attribute.Key("reducer.key")
+
+// tracedDatabase открывает спан на каждый вызов хранилища. Родителем
+// спана становится ctx, к которому хранилище привязано WithContext,
+// обычно — спан HTTP-запроса.
+type tracedDatabase struct {
+	db  databases.Database
+	ctx context.Context
+}
+
+// Database оборачивает db так, что каждый вызов пишется в трассировку.
+// Чтобы вызовы попадали в трассировку запроса, обработчики привязывают
+// хранилище к контексту запроса через databases.WithContext.
+func Database(db databases.Database) databases.Database {
+	return &tracedDatabase{db: db, ctx: context.Background()}
+}
+
+func (d *tracedDatabase) WithContext(ctx context.Context) databases.Database {
+	return &tracedDatabase{db: databases.WithContext(ctx, d.db), ctx: ctx}
+}
+
+// Unwrap возвращает обёрнутое хранилище.
+func (d *tracedDatabase) Unwrap() databases.Database { return d.db }
+
+// start открывает спан вызова method и возвращает функцию, которая
+// записывает в него ошибку *err и закрывает его.
+func (d *tracedDatabase) start(method string, attrs ...attribute.KeyValue) func(err *error) {
+	_, span := tracer().Start(d.ctx, "databases."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(append(attrs, attribute.String("db.operation", method))...),
+	)
+	return func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+	}
+}
+
+func (d *tracedDatabase) Create(u databases.URL) (err error) {
+	defer d.start("Create", keyAttribute.String(u.Hash))(&err)
+	return d.db.Create(u)
+}
+
+func (d *tracedDatabase) Select(key string) (u databases.URL, err error) {
+	defer d.start("Select", keyAttribute.String(key))(&err)
+	return d.db.Select(key)
+}
+
+func (d *tracedDatabase) SelectMany(keys []string) (urls []databases.URL, err error) {
+	defer d.start("SelectMany", attribute.Int("reducer.keys", len(keys)))(&err)
+	return d.db.SelectMany(keys)
+}
+
+func (d *tracedDatabase) Totals() (t databases.Totals, err error) {
+	defer d.start("Totals")(&err)
+	return d.db.Totals()
+}
+
+func (d *tracedDatabase) Visit(key string) (u databases.URL, err error) {
+	defer d.start("Visit", keyAttribute.String(key))(&err)
+	return d.db.Visit(key)
+}
+
+func (d *tracedDatabase) AddClicks(clicks map[string]int) (err error) {
+	defer d.start("AddClicks", attribute.Int("reducer.keys", len(clicks)))(&err)
+	return d.db.AddClicks(clicks)
+}
+
+func (d *tracedDatabase) SelectAll(userID string) (urls []databases.URL, err error) {
+	defer d.start("SelectAll")(&err)
+	return d.db.SelectAll(userID)
+}
+
+func (d *tracedDatabase) List(q databases.Query) (page databases.Page, err error) {
+	defer d.start("List")(&err)
+	return d.db.List(q)
+}
+
+func (d *tracedDatabase) Iterate(q databases.Query, fn func(databases.URL) error) (err error) {
+	defer d.start("Iterate")(&err)
+	return d.db.Iterate(q, fn)
+}
+
+func (d *tracedDatabase) Update(key, userID string, edit func(*databases.URL) error) (u databases.URL, err error) {
+	defer d.start("Update", keyAttribute.String(key))(&err)
+	return d.db.Update(key, userID, edit)
+}
+
+func (d *tracedDatabase) Revisions(key, userID string) (revisions []databases.Revision, err error) {
+	defer d.start("Revisions", keyAttribute.String(key))(&err)
+	return d.db.Revisions(key, userID)
+}
+
+func (d *tracedDatabase) Restore(key, userID string, since time.Time) (u databases.URL, err error) {
+	defer d.start("Restore", keyAttribute.String(key))(&err)
+	return d.db.Restore(key, userID, since)
+}
+
+func (d *tracedDatabase) Purge(userID string, before time.Time) (purged int, err error) {
+	defer d.start("Purge")(&err)
+	return d.db.Purge(userID, before)
+}
+
+func (d *tracedDatabase) CreateWorkspace(w databases.Workspace, ownerID string) (err error) {
+	defer d.start("CreateWorkspace")(&err)
+	return d.db.CreateWorkspace(w, ownerID)
+}
+
+func (d *tracedDatabase) Workspaces(userID string) (workspaces []databases.Workspace, err error) {
+	defer d.start("Workspaces")(&err)
+	return d.db.Workspaces(userID)
+}
+
+func (d *tracedDatabase) Members(workspaceID, userID string) (members []databases.Member, err error) {
+	defer d.start("Members")(&err)
+	return d.db.Members(workspaceID, userID)
+}
+
+func (d *tracedDatabase) SetMember(actorID string, member databases.Member) (err error) {
+	defer d.start("SetMember")(&err)
+	return d.db.SetMember(actorID, member)
+}
+
+func (d *tracedDatabase) Transfer(workspaceID, userID, fromID string, keys []string) (transferred int, err error) {
+	defer d.start("Transfer", attribute.Int("reducer.keys", len(keys)))(&err)
+	return d.db.Transfer(workspaceID, userID, fromID, keys)
+}
+
+func (d *tracedDatabase) Dump(after string, fn func(databases.Record) error) (err error) {
+	defer d.start("Dump")(&err)
+	return d.db.Dump(after, fn)
+}
+
+func (d *tracedDatabase) Load(recs []databases.Record, overwrite bool) (conflicts []string, err error) {
+	defer d.start("Load", attribute.Int("reducer.keys", len(recs)))(&err)
+	return d.db.Load(recs, overwrite)
+}
+
+func (d *tracedDatabase) DumpWorkspaces(fn func(databases.WorkspaceRecord) error) (err error) {
+	defer d.start("DumpWorkspaces")(&err)
+	return d.db.DumpWorkspaces(fn)
+}
+
+func (d *tracedDatabase) LoadWorkspace(rec databases.WorkspaceRecord, overwrite bool) (err error) {
+	defer d.start("LoadWorkspace")(&err)
+	return d.db.LoadWorkspace(rec, overwrite)
+}
+
+func (d *tracedDatabase) Close() {
+	d.db.Close()
+}
+
+func (d *tracedDatabase) Ping() (err error) {
+	defer d.start("Ping")(&err)
+	return d.db.Ping()
+}
+
+func (d *tracedDatabase) CreateMany(urls []databases.URL) (err error) {
+	defer d.start("CreateMany", attribute.Int("reducer.keys", len(urls)))(&err)
+	return d.db.CreateMany(urls)
+}
+
+func (d *tracedDatabase) Flush() (err error) {
+	defer d.start("Flush")(&err)
+	return d.db.Flush()
+}
+
+func (d *tracedDatabase) Delete(key, userID string) (err error) {
+	defer d.start("Delete", keyAttribute.String(key))(&err)
+	return d.db.Delete(key, userID)
+}
@@ -0,0 +1,142 @@
+// Package tracing пишет трассировку OpenTelemetry: спан на каждый
+// HTTP-запрос с контекстом W3C из заголовков, спаны этапов обработки
+// и спан на каждый вызов хранилища.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/salliko/reducer/internal/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	serviceName         = "reducer"
+	instrumentationName = "github.com/salliko/reducer"
+	fileExporterPrefix  = "file:"
+)
+
+var ErrUnknownExporter = errors.New("unknown trace exporter")
+
+// propagator читает и пишет контекст трассировки в заголовках
+// traceparent и tracestate (W3C Trace Context) и baggage.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer берётся заново при каждом вызове, чтобы подхватывать
+// провайдер, установленный после старта.
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup включает экспорт спанов по spec: "stdout" печатает их в
+// стандартный вывод, "file:path" дописывает в файл, "otlp" отправляет
+// по OTLP/HTTP на адрес из OTEL_EXPORTER_OTLP_ENDPOINT (по умолчанию
+// localhost:4318). Возвращённая функция досылает накопленные спаны
+// и останавливает экспорт.
+func Setup(ctx context.Context, spec string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch {
+	case spec == "stdout":
+		exporter, err = stdouttrace.New()
+	case strings.HasPrefix(spec, fileExporterPrefix):
+		file, err = os.OpenFile(strings.TrimPrefix(spec, fileExporterPrefix), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case spec == "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownExporter, spec)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// serverAttributes возвращает атрибуты серверного спана запроса r.
+// В http.target секретные параметры запроса скрыты, как в логах.
+func serverAttributes(r *http.Request) []attribute.KeyValue {
+	attrs := semconv.HTTPServerAttributesFromHTTPRequest(serviceName, "", r)
+	for i, attr := range attrs {
+		if attr.Key == semconv.HTTPTargetKey {
+			attrs[i] = semconv.HTTPTargetKey.String(logging.RedactURL(r.URL))
+		}
+	}
+	return attrs
+}
+
+// Middleware открывает серверный спан на запрос, продолжая трассировку
+// из заголовков запроса, и возвращает её клиенту в traceparent ответа.
+// Имя спана — метод и шаблон маршрута chi, а не путь запроса.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(serverAttributes(r)...),
+		)
+		defer span.End()
+		propagator.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRouteKey.String(rctx.RoutePattern()))
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	})
+}
+
+// Stage открывает спан name на оставшуюся часть цепочки обработчиков,
+// чтобы отделить её время от уже пройденных middleware.
+func Stage(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := tracer().Start(r.Context(), name)
+			defer span.End()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package tracing
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	_, err := Setup(context.Background(), "jaeger")
+	assert.ErrorIs(t, err, ErrUnknownExporter)
+
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(context.Background(), "file:"+path)
+	require.NoError(t, err)
+
+	_, span := tracer().Start(context.Background(), "exported")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"exported"`)
+	assert.Contains(t, string(data), `"reducer"`)
+}
+
+func TestMiddlewareRedactsTarget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(context.Background(), "file:"+path)
+	require.NoError(t, err)
+
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/?password=secret&ttl=1h", nil))
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"http.target"`)
+	assert.Contains(t, string(data), "ttl=1h")
+	assert.NotContains(t, string(data), "secret")
+}